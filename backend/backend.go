@@ -1,15 +1,23 @@
 package backend
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
-	"regexp"
-	"strings"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/metrics"
 	"github.com/NiR-/prom-autoexporter/models"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -25,63 +33,394 @@ const (
 	LABEL_EXPORTED_ID   = "autoexporter.exported.id"
 	LABEL_EXPORTED_NAME = "autoexporter.exported.name"
 	LABEL_EXPORTER_NAME = "autoexporter.exporter"
+	// Go template overriding the name of exporter containers
+	LABEL_NAME_TEMPLATE = "autoexporter.name"
+	// Hash of the exporter spec, used to detect changed exporters
+	LABEL_EXPORTER_SPEC_HASH = "autoexporter.exporter.spec-hash"
+	// Type of the exporter, as several exporters can run for a container
+	LABEL_EXPORTER_TYPE = "autoexporter.exporter.type"
+	// Container through which the exporter is scraped
+	LABEL_SCRAPE_TARGET = "autoexporter.scrape-target"
+	// Hash of the exported task properties the exporter config is rendered from
+	LABEL_EXPORTER_SOURCE_HASH = "autoexporter.exporter.source-hash"
+	// Port on which the exporter exposes its metrics
+	LABEL_EXPORTER_PORT = "autoexporter.exporter.port"
+	// Version of the exporter rules (e.g. git SHA) the exporter was created with
+	LABEL_RULES_VERSION = "autoexporter.rules-version"
+	// Comma-separated networks the scrape target has been connected to
+	LABEL_PROM_NETWORK = "autoexporter.prom-network"
+	// Comma-separated networks the scrape target wasn't part of, and that
+	// prom-autoexporter connected it to. Only those are disconnected.
+	LABEL_ATTACHED_NETWORKS = "autoexporter.attached-networks"
+	// Set to network on exporters running in their own network namespace
+	LABEL_NETWORK_MODE = "autoexporter.network-mode"
+	// Label set on exported containers to wait for them to be healthy before
+	// starting their exporters
+	LABEL_WAIT_HEALTHY = "autoexporter.wait-healthy"
+	// Random ID correlating the logs of an exporter lifecycle
+	LABEL_LIFECYCLE_ID = "autoexporter.lifecycle-id"
+	// Creation time of the exporter, formatted as RFC3339
+	LABEL_EXPORTER_CREATED_AT = "autoexporter.exporter.created-at"
+
+	// Label set on exporter containers, following prometheus.io annotations
+	// convention, when a scrape timeout or interval is defined
+	LABEL_SCRAPE_TIMEOUT  = "prometheus.io/scrape-timeout"
+	LABEL_SCRAPE_INTERVAL = "prometheus.io/scrape-interval"
+	// Port scraped by Prometheus, following the same convention. Exporters
+	// share the network namespace of their exported container, so the port
+	// can't be exposed nor published and is only advertised through this label.
+	LABEL_SCRAPE_PORT = "prometheus.io/port"
+	// Path scraped by Prometheus and query params added to scrapes, when the
+	// exporter overrides them
+	LABEL_METRICS_PATH        = "autoexporter.metrics-path"
+	LABEL_SCRAPE_PARAM_PREFIX = "autoexporter.scrape-param."
+	// Labels honored by Prometheus to override the scrape timeout and
+	// interval of a target
+	promLabelScrapeTimeout  = "__scrape_timeout__"
+	promLabelScrapeInterval = "__scrape_interval__"
+	// Labels honored by Prometheus to override the scraped path and params
+	promLabelMetricsPath       = "__metrics_path__"
+	promLabelScrapeParamPrefix = "__param_"
+	// Target label holding the health status of the exported container, set
+	// when the unhealthy action is annotate
+	promLabelHealth = "health"
+
+	defaultExporterUser = "1000"
 
 	stepPullImage = "pullImage"
 	stepCreate    = "create"
 	stepConnect   = "connect"
+	stepWait      = "waitHealthy"
 	stepStart     = "start"
 	stepFinished  = "finished"
 )
 
-type Backend struct {
-	cli *client.Client
+var (
+	exportersDesired = metrics.NewGauge(
+		"autoexporter_exporters_desired",
+		"Number of exporters that should be running, computed on each reconcile.",
+	)
+	exportersRunning = metrics.NewGauge(
+		"autoexporter_exporters_running",
+		"Number of exporters actually running, computed on each reconcile.",
+	)
+	exportersOutdated = metrics.NewGauge(
+		"autoexporter_exporters_outdated",
+		"Number of running exporters created with other rules version, computed on each reconcile.",
+	)
+	exporterLifetime = metrics.NewHistogram(
+		"autoexporter_exporter_lifetime_seconds",
+		"Time elapsed between the creation of exporters and their cleanup.",
+		nil,
+	)
+	imagePullFailures = metrics.NewCounter(
+		"autoexporter_image_pull_failures_total",
+		"Number of exporter images that failed to be pulled.",
+	)
+)
+
+var _ Backend = DockerBackend{}
+
+// IsPodman detects whether the Docker API is served by Podman
+func IsPodman(ctx context.Context, cli client.APIClient) (bool, error) {
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	for _, component := range version.Components {
+		if strings.Contains(strings.ToLower(component.Name), "podman") {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
-func NewBackend(cli *client.Client) Backend {
-	return Backend{cli}
+// Thread-safe holder of the ExporterFinder used by a DockerBackend
+type finderHolder struct {
+	mutex  sync.RWMutex
+	finder models.ExporterFinder
 }
 
-type process {
+func (h *finderHolder) get() models.ExporterFinder {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.finder
+}
+
+func (h *finderHolder) set(finder models.ExporterFinder) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.finder = finder
+}
+
+// inspectCache memoizes container inspections, including not found errors
+// but not transient ones, such that they can be retried
+type inspectCache struct {
+	cli     client.APIClient
+	results map[string]inspectResult
+}
+
+type inspectResult struct {
+	container types.ContainerJSON
+	err       error
+}
+
+func newInspectCache(cli client.APIClient) *inspectCache {
+	return &inspectCache{
+		cli:     cli,
+		results: make(map[string]inspectResult, 0),
+	}
+}
+
+func (c *inspectCache) inspect(ctx context.Context, cid string) (types.ContainerJSON, error) {
+	if res, ok := c.results[cid]; ok {
+		return res.container, res.err
+	}
+
+	container, err := c.cli.ContainerInspect(ctx, cid)
+	if err == nil || client.IsErrNotFound(err) {
+		c.results[cid] = inspectResult{container, err}
+	}
+
+	return container, err
+}
+
+// Thread-safe set of the exporters currently being started
+type inflightSet struct {
+	mutex sync.Mutex
+	names map[string]struct{}
+}
+
+func newInflightSet() *inflightSet {
+	return &inflightSet{names: make(map[string]struct{}, 0)}
+}
+
+// acquire adds name to the set and returns false if it was already there
+func (s *inflightSet) acquire(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.names[name]; ok {
+		return false
+	}
+
+	s.names[name] = struct{}{}
+	return true
+}
+
+func (s *inflightSet) release(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.names, name)
+}
+
+type DockerBackend struct {
+	cli client.APIClient
+
+	retryAttempts    uint
+	retryInterval    time.Duration
+	retryMaxInterval time.Duration
+
+	// In dry-run mode, calls mutating Docker state are logged but not executed
+	dryRun bool
+	// finder resolves which exporters should run for a given container. It's
+	// shared between copies of the DockerBackend such that it can be reloaded.
+	finder *finderHolder
+	// Whether oom events should be watched to cleanup associated exporters
+	handleOOM bool
+	// What to do with exporters when their exported container gets unhealthy
+	unhealthyAction string
+	// Whether Docker API is actually served by Podman
+	podmanCompat bool
+	// Whether all exporters run with an init process, regardless of their own setting
+	init bool
+	// Exporters being started, such that concurrent startups of the same
+	// exporter are deduplicated
+	inflight *inflightSet
+	// When exporters are stopped relative to the other containers of their stack
+	stopOrder string
+	// Credentials used to pull exporter images, indexed by registry address
+	registryAuths map[string]types.AuthConfig
+	// What to do when a container not managed by prom-autoexporter already
+	// has the name of an exporter
+	collisionPolicy string
+	// Port scraped when exporters don't define one
+	defaultScrapePort string
+	// Checks that exporters still serve their metrics
+	livenessChecker LivenessChecker
+	// Restricts which containers are considered for export
+	filter ContainerFilter
+	// Version of the exporter rules, stamped on created exporters
+	rulesVersion string
+	// Whether cleanup is aborted when the scrape target can't be disconnected
+	disconnectFailure string
+	// Patterns of the exported container labels copied onto exporters
+	labelsToPropagate []string
+	// Gates mutations of Docker state when several instances are running
+	elector LeaderElector
+	// Maximum time spent waiting for exported containers to be healthy
+	waitHealthyTimeout time.Duration
+	// Notified when exporters are started or stopped
+	observer        LifecycleObserver
+	observerTimeout time.Duration
+	// Targets file regenerated on each reconcile and exporter start or stop,
+	// disabled when nil
+	fileSD *fileSD
+	// Stops recreating crash-looping exporters, disabled when nil
+	quarantine *quarantine
+	// Container actions subscribed to, DefaultEvents when empty
+	events []string
+	// Maximum duration of Docker API calls and image pulls, unbounded when 0
+	apiTimeout  time.Duration
+	pullTimeout time.Duration
+	// Status of the exporters started by this instance
+	statuses *statusRegistry
+	// Maximum deviation of each periodic reconciliation from its interval
+	reconcileJitter time.Duration
+	// Host paths under which bind labels can mount sources
+	allowedBindSources []string
+	// Host paths under which env-file labels can mount files
+	allowedEnvFileSources []string
+	// Rules applied to exporter images, e.g. to pull them from a mirror
+	imageRewrites []ImageRewrite
+}
+
+func NewDockerBackend(cli client.APIClient, opts ...Option) DockerBackend {
+	b := DockerBackend{
+		cli:                cli,
+		retryAttempts:      defaultRetryAttempts,
+		retryInterval:      defaultRetryInterval,
+		retryMaxInterval:   defaultRetryMaxInterval,
+		finder:             &finderHolder{finder: models.NewPredefinedExporterFinder()},
+		inflight:           newInflightSet(),
+		statuses:           newStatusRegistry(),
+		collisionPolicy:    CollisionPolicySkip,
+		disconnectFailure:  DisconnectFailureBestEffort,
+		elector:            singleInstance{},
+		waitHealthyTimeout: defaultWaitHealthyTimeout,
+		livenessChecker:    NewHTTPLivenessChecker(defaultLivenessTimeout),
+		observerTimeout:    defaultObserverTimeout,
+		apiTimeout:         defaultAPITimeout,
+		pullTimeout:        defaultPullTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(&b)
+	}
+
+	if b.apiTimeout > 0 || b.pullTimeout > 0 {
+		b.cli = newTimeoutClient(b.cli, b.apiTimeout, b.pullTimeout)
+	}
+
+	return b
+}
+
+type process struct {
 	exporter    models.Exporter
 	step        string
 	exporterCID string
+	// Whether the exporter container has been created by this process, as
+	// opposed to adopted, such that it's removed when a later step fails
+	created bool
+	// Correlates the logs of the whole exporter lifecycle, from its startup
+	// to its cleanup
+	lifecycleID string
+}
+
+func (b DockerBackend) RunExporter(ctx context.Context, exporter models.Exporter) {
+	// Errors are already logged along with the failing step
+	b.startExporter(ctx, exporter)
 }
 
-func (b Backend) RunExporter(ctx context.Context, exporter models.Exporter) {
+// startExporter executes the startup process of the exporter and returns the
+// error that interrupted it, if any
+func (b DockerBackend) startExporter(ctx context.Context, exporter models.Exporter) error {
 	var err error
 
+	p := process{exporter: exporter, step: stepPullImage, lifecycleID: newLifecycleID()}
+
 	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
 		"exported.name":  exporter.Exported.Name,
 		"exporter.type":  exporter.PredefinedType,
 		"exporter.name":  exporter.Name,
 		"exporter.image": exporter.Image,
+		"lifecycle.id":   p.lifecycleID,
 	})
 
 	ctx = log.WithLogger(ctx, logger)
 
-	p := process{exporter, stepPullImage}
+	if err := exporter.Validate(); err != nil {
+		logger.Errorf("%+v", err)
+		return err
+	}
+
+	if !b.inflight.acquire(exporter.Name) {
+		logger.Debug("Exporter is already being started.")
+		return nil
+	}
+	defer b.inflight.release(exporter.Name)
+
+	if quarantined, err := b.isQuarantined(ctx, exporter); err != nil {
+		logger.Errorf("%+v", err)
+		return err
+	} else if quarantined {
+		return errors.Errorf("exporter %q is quarantined", exporter.Name)
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			// The exporter is left untouched once started
+			if p.step == stepFinished {
+				b.statuses.set(exporter.Name, ExporterStateRunning, "", nil)
+			} else {
+				b.statuses.set(exporter.Name, ExporterStateFailed, p.step, ctx.Err())
+				b.rollback(ctx, p)
+			}
+			return ctx.Err()
 		default:
-			logFields := logrus.Fields{"step": p.step}
-			if p.exporterCID != nil {
+			// The step is advanced before its error is checked
+			step := p.step
+			logFields := logrus.Fields{"step": step}
+			if p.exporterCID != "" {
 				logFields["exporter.cid"] = p.exporterCID
 			}
 
 			logger = logger.WithFields(logFields)
 			ctx = log.WithLogger(ctx, logger)
 
+			if step != stepFinished {
+				b.statuses.set(exporter.Name, ExporterStatePending, step, nil)
+			}
+
 			// The startup process is decomposed into several steps executed serially,
 			// in order to cancel the startup as soon as possible
 			switch p.step {
 			case stepPullImage:
-				err = b.pullImage(ctx, exporter.Image)
+				err = b.pullImage(ctx, exporter)
+				if IsErrImagePull(err) {
+					imagePullFailures.Inc()
+				}
 				p.step = stepCreate
 			case stepCreate:
-				cid, err := b.createContainer(ctx, p.exporter)
+				if err = b.removeStaleExporter(ctx, p.exporter); err != nil {
+					break
+				}
+
+				var cid string
+				cid, err = b.createContainer(ctx, p.exporter, p.lifecycleID)
+				p.created = err == nil
+
+				// The exporter already exists, e.g. it survived a restart of
+				// prom-autoexporter
+				if isErrConflict(err) {
+					cid, p.created, err = b.adoptOrRecreate(ctx, p.exporter, p.lifecycleID)
+				}
 
 				if err == nil {
 					p.exporterCID = cid
@@ -90,138 +429,894 @@ func (b Backend) RunExporter(ctx context.Context, exporter models.Exporter) {
 				p.step = stepConnect
 			case stepConnect:
 				err = b.connectToNetwork(ctx, p.exporter, p.exporterCID)
+				p.step = stepWait
+			case stepWait:
+				err = b.waitHealthy(ctx, p.exporter)
 				p.step = stepStart
 			case stepStart:
 				err = b.startContainer(ctx, p.exporter, p.exporterCID)
+				// The namespaces joined by the exporter vanish when the
+				// exported container dies before the exporter starts
+				if err != nil && !b.namespaceTargetRunning(ctx, p.exporter) {
+					b.removeContainer(ctx, p.exporterCID)
+					err = newErrExportedNotRunning(p.exporter.Name, p.exporter.NamespaceTargetID())
+				}
 				p.step = stepFinished
+				if err == nil && !b.dryRun {
+					b.notifyObserver(ctx, LifecycleEventStarted, p.exporter)
+					b.writeFileSD(ctx)
+				}
 			case stepFinished:
-				return
+				b.statuses.set(exporter.Name, ExporterStateRunning, "", nil)
+				return nil
 			default:
 				err = errors.New(fmt.Sprintf("undefined step %s", p.step))
 			}
 
-			if err != nil {
+			if IsErrExportedNotRunning(err) {
+				logger.Info("Exported container died before its exporter started.")
+				b.statuses.remove(exporter.Name)
+				return err
+			} else if err != nil {
 				logger.Errorf("%+v", err)
-				return
+				b.statuses.set(exporter.Name, ExporterStateFailed, step, err)
+				b.rollback(ctx, p)
+				return err
 			}
 		}
 	}
 }
 
-func (b Backend) pullImage(ctx context.Context, image string) error {
+// waitHealthy waits until the exported container is healthy, when it
+// defines a healthcheck and opted in with LABEL_WAIT_HEALTHY. The exporter is
+// started anyway after waitHealthyTimeout.
+func (b DockerBackend) waitHealthy(ctx context.Context, exporter models.Exporter) error {
+	if exporter.Exported.Labels[LABEL_WAIT_HEALTHY] != "true" {
+		return nil
+	}
+
+	logger := log.GetLogger(ctx)
+	timeout := time.After(b.waitHealthyTimeout)
+	t := time.NewTicker(waitHealthyInterval)
+	defer t.Stop()
+
+	for {
+		exported, err := b.cli.ContainerInspect(ctx, exporter.Exported.ID)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if exported.State == nil || exported.State.Health == nil {
+			logger.Debug("Exported container has no healthcheck, skip waiting.")
+			return nil
+		} else if exported.State.Health.Status == types.Healthy {
+			return nil
+		}
+
+		logger.Debugf("Waiting for exported container to be healthy (currently %s)...", exported.State.Health.Status)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			logger.Warnf("Exported container not healthy after %s, starting exporter anyway.", b.waitHealthyTimeout)
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+func (b DockerBackend) pullImage(ctx context.Context, exporter models.Exporter) error {
+	logger := log.GetLogger(ctx)
+	image := exporter.Image
+
+	// Digest-pinned images are immutable, there's no need to pull them again
+	digest, err := pinnedDigest(image)
+	if err != nil {
+		return err
+	}
+
+	if exporter.ImagePullPolicy != models.PullPolicyAlways || digest != "" {
+		_, _, err := b.cli.ImageInspectWithRaw(ctx, image)
+		if err == nil {
+			logger.Debugf("Image %q already present, skip pulling.", image)
+			return b.verifyDigest(ctx, image)
+		} else if !client.IsErrNotFound(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	logger.Debugf("Pulling image %q", image)
+
+	if b.dryRun {
+		logger.Info("[dry-run] Would pull exporter image.")
+		return nil
+	}
+
+	auth, err := b.registryAuth(image)
+	if err != nil {
+		return err
+	}
+
+	rc, err := b.cli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return errors.WithStack(newErrImagePull(image, err))
+	}
+
+	defer rc.Close()
+
+	// Wait until image pulling ends (= when rc is closed)
+	if err := readPullProgress(ctx, rc); err != nil {
+		return errors.WithStack(newErrImagePull(image, err))
+	}
+
+	return b.verifyDigest(ctx, image)
+}
+
+// pullMessage is a message of the JSON stream returned by Docker when
+// pulling an image
+type pullMessage struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Progress    string `json:"progress"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// readPullProgress consumes the pull progress stream until its end. Errors
+// reported in the stream, after the pull started, are returned.
+func readPullProgress(ctx context.Context, r io.Reader) error {
+	logger := log.GetLogger(ctx)
+	dec := json.NewDecoder(r)
+
+	for {
+		var msg pullMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return errors.Errorf("image pull failed: %s", msg.ErrorDetail.Message)
+		} else if msg.Error != "" {
+			return errors.Errorf("image pull failed: %s", msg.Error)
+		}
+
+		logger.WithField("layer", msg.ID).Debugf("%s %s", msg.Status, msg.Progress)
+	}
+}
+
+// removeStaleExporter removes the exporters of the same type and exported
+// name as the given exporter when they point to another exported container,
+// or when the container having its name has a different config source. The
+// former happens when the exported container is recreated with a new ID: the
+// old exporter shares a dead network namespace.
+func (b DockerBackend) removeStaleExporter(ctx context.Context, exporter models.Exporter) error {
+	if err := b.removeExporterOf(ctx, exporter, exporter.Name); err != nil {
+		return err
+	}
+
+	candidates, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_EXPORTED_NAME+"="+exporter.Exported.Name),
+			filters.Arg("label", LABEL_EXPORTER_TYPE+"="+exporter.PredefinedType),
+		),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, candidate := range candidates {
+		if candidate.Labels[LABEL_EXPORTED_ID] == exporter.Exported.ID {
+			continue
+		}
+		if err := b.removeExporterOf(ctx, exporter, candidate.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeExporterOf removes the given container when it's an exporter of
+// another exported container or of another config source than exporter.
+func (b DockerBackend) removeExporterOf(ctx context.Context, exporter models.Exporter, container string) error {
+	stale, err := b.cli.ContainerInspect(ctx, container)
+	if client.IsErrNotFound(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, ok := stale.Config.Labels[LABEL_EXPORTED_ID]; !ok {
+		return errors.Errorf("container %q is not managed by prom-autoexporter, it won't be removed", container)
+	}
+
+	if stale.Config.Labels[LABEL_EXPORTED_ID] == exporter.Exported.ID && !sourceChanged(stale.Config.Labels, exporter) {
+		return nil
+	}
+
+	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+		"exporter.cid":      stale.ID,
+		"stale.exported.id": stale.Config.Labels[LABEL_EXPORTED_ID],
+	})
+	logger.Info("Removing stale exporter pointing to a previous exported container or config source...")
+
+	return b.StopExporter(log.WithLogger(ctx, logger), stale)
+}
+
+// adoptOrRecreate returns the ID of the existing exporter container when it
+// runs the expected spec for the expected exported container. Otherwise, the
+// existing container is removed and a new one is created, in which case true
+// is returned.
+func (b DockerBackend) adoptOrRecreate(ctx context.Context, exporter models.Exporter, lifecycleID string) (string, bool, error) {
+	existing, err := b.cli.ContainerInspect(ctx, exporter.Name)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+
+	if _, ok := existing.Config.Labels[LABEL_EXPORTED_ID]; !ok {
+		return "", false, errors.Errorf("container %q is not managed by prom-autoexporter, it won't be removed", exporter.Name)
+	}
+
+	logger := log.GetLogger(ctx).WithField("exporter.cid", existing.ID)
+
+	if isAdoptable(existing, exporter) {
+		logger.Info("Adopting existing exporter container.")
+		return existing.ID, false, nil
+	}
+
+	logger.Info("Existing exporter container is stale, recreating it...")
+	if err := b.StopExporter(log.WithLogger(ctx, logger), existing); err != nil {
+		return "", false, err
+	}
+
+	cid, err := b.createContainer(ctx, exporter, lifecycleID)
+	return cid, err == nil, err
+}
+
+// isAdoptable checks if the existing container is a healthy instance of
+// the given exporter
+func isAdoptable(existing types.ContainerJSON, exporter models.Exporter) bool {
+	if existing.Config == nil || existing.State == nil {
+		return false
+	}
+
+	labels := existing.Config.Labels
+	if labels[LABEL_EXPORTED_ID] != exporter.Exported.ID ||
+		labels[LABEL_EXPORTER_SPEC_HASH] != exporter.SpecHash() ||
+		sourceChanged(labels, exporter) {
+		return false
+	}
+
+	return !existing.State.Dead && !existing.State.Restarting && !existing.State.OOMKilled
+}
+
+// propagatedLabels returns the labels of the exported container to copy onto
+// its exporter. Patterns ending with "*" match label prefixes, others match
+// exact names. Labels reserved to prom-autoexporter are never copied.
+func (b DockerBackend) propagatedLabels(labels map[string]string) map[string]string {
+	propagated := make(map[string]string, 0)
+
+	for label, value := range labels {
+		if strings.HasPrefix(label, "autoexporter.") {
+			continue
+		}
+
+		if matchesLabel(label, b.labelsToPropagate) {
+			propagated[label] = value
+		}
+	}
+
+	return propagated
+}
+
+// matchesLabel checks if the given label matches any of the patterns.
+// Patterns ending with "*" match label prefixes, others match exact names.
+func matchesLabel(label string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if label == pattern || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(label, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newLifecycleID returns a short random ID
+func newLifecycleID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// sourceChanged checks if the config source of the exporter having the given
+// labels differs from the one of exporter. Exporters created without source
+// hash are considered up to date.
+func sourceChanged(labels map[string]string, exporter models.Exporter) bool {
+	hash, ok := labels[LABEL_EXPORTER_SOURCE_HASH]
+	return ok && hash != exporter.SourceHash()
+}
+
+func (b DockerBackend) createContainer(ctx context.Context, exporter models.Exporter, lifecycleID string) (string, error) {
+	user := exporter.User
+	if user == "" {
+		user = defaultExporterUser
+	}
+
+	authCmd, authEnv, err := exporter.ScrapeAuthArgs()
+	if err != nil {
+		return "", err
+	}
+
+	fileBinds, fileEnv, err := envFileBinds(exporter, b.allowedEnvFileSources)
+	if err != nil {
+		return "", err
+	}
+
+	labelBinds, err := bindsFromLabels(exporter.Exported.Labels, b.allowedBindSources)
+	if err != nil {
+		return "", err
+	}
+
+	config := container.Config{
+		User:  user,
+		Cmd:   append(append([]string{}, exporter.Cmd...), authCmd...),
+		Image: exporter.Image,
+		Env:   append(append(append([]string{}, exporter.EnvVars...), authEnv...), fileEnv...),
+		Labels: map[string]string{
+			LABEL_EXPORTED_ID:   exporter.Exported.ID,
+			LABEL_EXPORTED_NAME: exporter.Exported.Name,
+			LABEL_EXPORTER_TYPE: exporter.PredefinedType,
+			LABEL_SCRAPE_TARGET: exporter.ScrapeTargetName(),
+		},
+	}
+	if len(exporter.Entrypoint) > 0 {
+		config.Entrypoint = exporter.Entrypoint
+	}
+	hostConfig := container.HostConfig{
+		NetworkMode: container.NetworkMode(fmt.Sprintf("container:%s", exporter.NamespaceTargetID())),
+		RestartPolicy: container.RestartPolicy{
+			Name:              "on-failure",
+			MaximumRetryCount: 10,
+		},
+		Binds: append(append(append([]string{}, exporter.Binds...), labelBinds...), fileBinds...),
+	}
+	if exporter.HasOwnNetns() {
+		// The exporter reaches the exported container by name, so they need
+		// a network with DNS resolution in common
+		if len(exporter.PromNetworks) == 0 {
+			return exporter.Name, errors.Errorf("exporter %q runs in its own network namespace but no prometheus network is configured", exporter.Name)
+		}
+		hostConfig.NetworkMode = container.NetworkMode(exporter.PromNetworks[0])
+		config.Labels[LABEL_NETWORK_MODE] = models.NetworkModeNetwork
+	} else if exporter.ShareUTS {
+		hostConfig.UTSMode = container.UTSMode(fmt.Sprintf("container:%s", exporter.NamespaceTargetID()))
+	}
+	if b.init || exporter.Init {
+		init := true
+		hostConfig.Init = &init
+	}
+	if exporter.ScrapeTimeout != "" {
+		config.Labels[LABEL_SCRAPE_TIMEOUT] = exporter.ScrapeTimeout
+	}
+	if exporter.ScrapeInterval != "" {
+		config.Labels[LABEL_SCRAPE_INTERVAL] = exporter.ScrapeInterval
+	}
+	if stack := stackOf(exporter.Exported.Labels); stack != "" {
+		config.Labels[LABEL_EXPORTED_STACK] = stack
+	}
+	if exporter.Port != "" {
+		config.Labels[LABEL_EXPORTER_PORT] = exporter.Port
+		config.Labels[LABEL_SCRAPE_PORT] = exporter.Port
+	}
+	if b.rulesVersion != "" {
+		config.Labels[LABEL_RULES_VERSION] = b.rulesVersion
+	}
+	if exporter.MetricsPath != "" {
+		config.Labels[LABEL_METRICS_PATH] = exporter.MetricsPath
+	}
+	for param, value := range exporter.ScrapeParams {
+		config.Labels[LABEL_SCRAPE_PARAM_PREFIX+param] = value
+	}
+	if len(exporter.PromNetworks) > 0 {
+		config.Labels[LABEL_PROM_NETWORK] = strings.Join(exporter.PromNetworks, ",")
+
+		attached, err := b.networksToAttach(ctx, exporter)
+		if err != nil {
+			return "", err
+		}
+		if len(attached) > 0 {
+			config.Labels[LABEL_ATTACHED_NETWORKS] = strings.Join(attached, ",")
+		}
+	}
+	for label, value := range b.propagatedLabels(exporter.Exported.Labels) {
+		if _, ok := config.Labels[label]; !ok {
+			config.Labels[label] = value
+		}
+	}
+	config.Labels[LABEL_LIFECYCLE_ID] = lifecycleID
+	config.Labels[LABEL_EXPORTER_SPEC_HASH] = exporter.SpecHash()
+	config.Labels[LABEL_EXPORTER_SOURCE_HASH] = exporter.SourceHash()
+	config.Labels[LABEL_EXPORTER_CREATED_AT] = time.Now().UTC().Format(time.RFC3339)
+
+	networkingConfig := network.NetworkingConfig{}
+	logger := log.GetLogger(ctx)
+
+	if b.dryRun {
+		logger.WithFields(logrus.Fields{
+			"config":            fmt.Sprintf("%+v", config),
+			"host_config":       fmt.Sprintf("%+v", hostConfig),
+			"networking_config": fmt.Sprintf("%+v", networkingConfig),
+		}).Infof("[dry-run] Would create exporter container %q.", exporter.Name)
+		return exporter.Name, nil
+	}
+
+	container, err := b.cli.ContainerCreate(ctx, &config, &hostConfig, &networkingConfig, exporter.Name)
+	if err != nil {
+		return exporter.Name, errors.WithStack(err)
+	}
+
+	logger.Debug("Exporter container created.")
+
+	if len(container.Warnings) > 0 {
+		logger.WithFields(logrus.Fields{
+			"warnings": container.Warnings,
+		}).Warning("Docker emitted warnings during container create.")
+	}
+
+	// The container isn't reported as created when the copy fails, so it's
+	// removed right away instead of being rolled back
+	if err := b.copyFiles(ctx, container.ID, exporter.Files); err != nil {
+		b.removeContainer(log.WithLogger(context.Background(), logger), container.ID)
+		return exporter.Name, err
+	}
+
+	return exporter.Name, nil
+}
+
+// copyFiles writes the given files, indexed by absolute path, into the
+// created exporter container before it starts
+func (b DockerBackend) copyFiles(ctx context.Context, cid string, files map[string]string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for path, content := range files {
+		header := &tar.Header{
+			Name:    strings.TrimPrefix(path, "/"),
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	err := b.cli.CopyToContainer(ctx, cid, "/", &buf, types.CopyToContainerOptions{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.GetLogger(ctx).Debugf("%d files copied into exporter container.", len(files))
+
+	return nil
+}
+
+func (b DockerBackend) connectToNetwork(ctx context.Context, exporter models.Exporter, cid string) error {
+	logger := log.GetLogger(ctx)
+
+	// Exporters might be scraped through networks the exported container is
+	// already part of
+	if len(exporter.PromNetworks) == 0 {
+		logger.Debug("No prometheus network configured, skip connecting.")
+		return nil
+	}
+
+	if exporter.HasOwnNetns() {
+		if err := b.connectAll(ctx, exporter.PromNetworks, exporter.Exported.Name); err != nil {
+			return err
+		}
+		// The exporter joined the first network when it was created
+		return b.connectAll(ctx, exporter.PromNetworks[1:], exporter.ScrapeTargetName())
+	}
+
+	return b.connectAll(ctx, exporter.PromNetworks, exporter.ScrapeTargetName())
+}
+
+// networksToAttach returns the Prometheus networks the container connected on
+// behalf of the exporter is not part of yet
+func (b DockerBackend) networksToAttach(ctx context.Context, exporter models.Exporter) ([]string, error) {
+	target := exporter.ScrapeTargetName()
+	if exporter.HasOwnNetns() {
+		target = exporter.Exported.Name
+	}
+
+	networks := []string{}
+	for _, promNetwork := range exporter.PromNetworks {
+		attached, err := b.isAttached(ctx, promNetwork, target)
+		if err != nil {
+			return nil, err
+		} else if !attached {
+			networks = append(networks, promNetwork)
+		}
+	}
+
+	return networks, nil
+}
+
+// connectAll connects the target container to all the given networks, or
+// none of them
+func (b DockerBackend) connectAll(ctx context.Context, networks []string, target string) error {
+	logger := log.GetLogger(ctx)
+	connected := make([]string, 0, len(networks))
+
+	for _, promNetwork := range networks {
+		if b.dryRun {
+			logger.Infof("[dry-run] Would connect %q to network %q.", target, promNetwork)
+			continue
+		}
+
+		attached, err := b.isAttached(ctx, promNetwork, target)
+		if err == nil && attached {
+			logger.Debugf("%q already connected to network %q.", target, promNetwork)
+			continue
+		} else if err == nil {
+			endpointSettings := network.EndpointSettings{}
+			err = errors.WithStack(b.cli.NetworkConnect(ctx, promNetwork, target, &endpointSettings))
+		}
+
+		if err != nil {
+			// Networks connected so far are left, such that the target is
+			// connected either to all networks or none of them
+			b.disconnectFrom(ctx, connected, target)
+			return err
+		}
+
+		connected = append(connected, promNetwork)
+		logger.Debugf("%q connected to network %q.", target, promNetwork)
+	}
+
+	return nil
+}
+
+// disconnectFrom disconnects the container from the given networks, logging
+// failures
+func (b DockerBackend) disconnectFrom(ctx context.Context, networks []string, container string) {
+	for _, promNetwork := range networks {
+		err := b.cli.NetworkDisconnect(ctx, promNetwork, container, false)
+		if err != nil && !isErrNotConnected(err) {
+			log.GetLogger(ctx).Errorf("%+v", errors.WithStack(err))
+		}
+	}
+}
+
+// isAttached checks if the given container, designated by its ID or name, is
+// connected to the given network
+func (b DockerBackend) isAttached(ctx context.Context, networkID, container string) (bool, error) {
+	resource, err := b.cli.NetworkInspect(ctx, networkID, types.NetworkInspectOptions{})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	for cid, endpoint := range resource.Containers {
+		if cid == container || endpoint.Name == strings.TrimLeft(container, "/") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// rollback removes the exporter container created by the process, if any,
+// such that it doesn't leak when a later step fails. It's also done when ctx
+// has been cancelled.
+func (b DockerBackend) rollback(ctx context.Context, p process) {
+	if !p.created || p.exporterCID == "" {
+		return
+	}
+
+	logger := log.GetLogger(ctx)
+	logger.Info("Removing partially created exporter container...")
+	b.removeContainer(log.WithLogger(context.Background(), logger), p.exporterCID)
+}
+
+// namespaceTargetRunning checks if the container whose namespaces are joined
+// by the exporter is still running. It's assumed to be when it can't be
+// inspected, such that the original error is reported.
+func (b DockerBackend) namespaceTargetRunning(ctx context.Context, exporter models.Exporter) bool {
+	target, err := b.cli.ContainerInspect(ctx, exporter.NamespaceTargetID())
+	if client.IsErrNotFound(err) {
+		return false
+	} else if err != nil {
+		return true
+	}
+
+	return target.State != nil && target.State.Running
+}
+
+// removeContainer forcefully removes a partially created exporter container.
+// Failures are only logged, as the exporter is cleaned up anyway when its
+// exported container stops.
+func (b DockerBackend) removeContainer(ctx context.Context, cid string) {
+	logger := log.GetLogger(ctx)
+	if b.dryRun {
+		logger.Infof("[dry-run] Would remove exporter container %q.", cid)
+		return
+	}
+
+	err := b.cli.ContainerRemove(ctx, cid, types.ContainerRemoveOptions{Force: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		logger.Errorf("%+v", errors.WithStack(err))
+		return
+	}
+
+	logger.Debug("Partially created exporter container removed.")
+}
+
+func (b DockerBackend) startContainer(ctx context.Context, exporter models.Exporter, cid string) error {
+	logger := log.GetLogger(ctx)
+	logger.Debug("Starting exporter container.")
+
+	if b.dryRun {
+		logger.Infof("[dry-run] Would start exporter container %q.", cid)
+		return nil
+	}
+
+	err := b.cli.ContainerStart(ctx, cid, types.ContainerStartOptions{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (b DockerBackend) StopExporter(ctx context.Context, exporter types.ContainerJSON) error {
 	logger := log.GetLogger(ctx)
-	logger.Debugf("Pulling image %q", image)
+	removeOpts := types.ContainerRemoveOptions{
+		Force: true,
+	}
 
-	rc, err := b.cli.ImagePull(ctx, image, types.ImagePullOptions{})
-	if err != nil {
+	if b.dryRun {
+		logger.WithFields(logrus.Fields{
+			"remove_options": fmt.Sprintf("%+v", removeOpts),
+		}).Infof("[dry-run] Would stop and remove exporter container %q.", exporter.ID)
+		return nil
+	}
+
+	// Exporters might have stopped already (e.g. crashed) or even been
+	// removed, removal is attempted anyway
+	err := b.cli.ContainerStop(ctx, exporter.ID, nil)
+	if err != nil && !client.IsErrNotFound(err) && !isErrNotRunning(err) {
 		return errors.WithStack(err)
+	} else if err != nil {
+		logger.WithError(err).Debug("Exporter container not running, removing it anyway.")
 	}
 
-	// Wait until image pulling ends (= when rc is closed)
-	if _, err := ioutil.ReadAll(rc); err != nil {
+	err = b.cli.ContainerRemove(ctx, exporter.ID, removeOpts)
+	if err != nil && !client.IsErrNotFound(err) {
 		return errors.WithStack(err)
 	}
 
+	logger.Info("Exporter container stopped.")
+	observeLifetime(ctx, exporter)
+	b.statuses.remove(exporter.Name)
+
+	if exporter.Config != nil {
+		b.notifyObserver(ctx, LifecycleEventStopped, exporterFromContainer(exporter.Name, exporter.Config.Image, exporter.Config.Labels, "removed"))
+	}
+	b.writeFileSD(ctx)
+
 	return nil
 }
 
-func (b Backend) createContainer(ctx context.Context, exporter models.Exporter) (string, error) {
-	config := container.Config{
-		User:   "1000",
-		Cmd:    exporter.Cmd,
-		Image:  exporter.Image,
-		Env:    exporter.EnvVars,
-		Labels: map[string]string{
-			LABEL_EXPORTED_ID:   exporter.Exported.ID,
-			LABEL_EXPORTED_NAME: exporter.Exported.Name,
-		},
+// observeLifetime records how long the given exporter lived, based on its
+// creation time label. Exporters created by older versions don't have it
+// and are ignored.
+func observeLifetime(ctx context.Context, exporter types.ContainerJSON) {
+	if exporter.Config == nil {
+		return
 	}
-	hostConfig := container.HostConfig{
-		NetworkMode: container.NetworkMode(fmt.Sprintf("container:%s", exporter.Exported.ID)),
-		RestartPolicy: container.RestartPolicy{
-			Name:              "on-failure",
-			MaximumRetryCount: 10,
-		},
+
+	createdAt, ok := exporter.Config.Labels[LABEL_EXPORTER_CREATED_AT]
+	if !ok {
+		return
 	}
-	networkingConfig := network.NetworkingConfig{}
 
-	container, err := b.cli.ContainerCreate(ctx, &config, &hostConfig, &networkingConfig, exporter.Name)
+	created, err := time.Parse(time.RFC3339, createdAt)
 	if err != nil {
-		return exporter.Name, errors.WithStack(err)
+		log.GetLogger(ctx).WithError(err).Warnf("Invalid creation time label on exporter %q.", exporter.ID)
+		return
 	}
 
-	logger := log.GetLogger(ctx)
-	logger.Debug("Exporter container created.")
+	lifetime := time.Since(created)
+	exporterLifetime.Observe(lifetime.Seconds())
+	log.GetLogger(ctx).WithField("lifetime", lifetime.String()).Debug("Exporter lifetime recorded.")
+}
 
-	if len(container.Warnings) > 0 {
-		logger.WithFields(logrus.Fields{
-			"warnings": container.Warnings,
-		}).Warning("Docker emitted warnings during container create.")
+// ReconcileOnStartup starts missing exporters once, and then every interval
+// in background, as a safety net against missed events. Periodic
+// reconciliation is disabled when interval is zero.
+func (b DockerBackend) ReconcileOnStartup(ctx context.Context, promNetworks []string, interval time.Duration) error {
+	err := b.StartMissingExporters(ctx, promNetworks)
+
+	if interval > 0 {
+		go b.reconcilePeriodically(ctx, promNetworks, interval)
 	}
 
-	return exporter.Name, nil
+	return err
 }
 
-func (b Backend) connectToNetwork(ctx context.Context, exporter models.Exporter, cid string) error {
-	endpointSettings := network.EndpointSettings{}
-	err := b.cli.NetworkConnect(ctx, exporter.PromNetwork, exporter.Exported.Name, &endpointSettings)
+func (b DockerBackend) reconcilePeriodically(ctx context.Context, promNetworks []string, interval time.Duration) {
+	logger := log.GetLogger(ctx)
+	rnd := newJitterSource()
+	t := time.NewTimer(jitteredInterval(interval, b.reconcileJitter, rnd))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			logger.Debug("Reconciling exporters...")
+
+			if err := b.StartMissingExporters(ctx, promNetworks); err != nil {
+				logger.Errorf("%+v", err)
+			}
+
+			t.Reset(jitteredInterval(interval, b.reconcileJitter, rnd))
+		}
+	}
+}
 
-	if err != nil && strings.Contains(err.Error(), "endpoint with name") {
+// StartMissingExporters runs an exporter for each running container that
+// should have one but does not, and updates the reconcile gauges
+func (b DockerBackend) StartMissingExporters(ctx context.Context, promNetworks []string) error {
+	if !b.elector.IsLeader(ctx) {
+		log.GetLogger(ctx).Debug("Not the leader, skipping reconciliation.")
 		return nil
-	} else if err != nil {
+	}
+
+	running, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_EXPORTED_ID),
+		),
+	})
+	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	logger := log.GetLogger(ctx)
-	logger.Debug("Exporter connected to prometheus network.")
+	missing, err := b.FindMissingExporters(ctx, promNetworks)
+	if err != nil {
+		return err
+	}
+
+	exportersRunning.Set(float64(len(running)))
+	exportersDesired.Set(float64(len(running) + len(missing)))
+	exportersOutdated.Set(float64(len(b.filterOutdated(running))))
+
+	for _, exporter := range missing {
+		logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+			"exported.id":   exporter.Exported.ID,
+			"exported.name": exporter.Exported.Name,
+		})
+		ctx := log.WithLogger(ctx, logger)
+
+		logger.WithFields(logrus.Fields{
+			"exporter.image": exporter.Image,
+		}).Info("Starting exporter...")
+
+		b.RunExporter(ctx, exporter)
+	}
+
+	b.writeFileSD(ctx)
 
 	return nil
 }
 
-func (b Backend) startContainer(ctx context.Context, exporter models.Exporter, cid string) error {
+// ReconcileOnce cleans up the exporters of containers not running anymore and
+// starts missing exporters, without listening for events. It returns an
+// error when any of these operations failed.
+func (b DockerBackend) ReconcileOnce(ctx context.Context, promNetworks []string) error {
 	logger := log.GetLogger(ctx)
-	logger.Debug("Starting exporter container.")
+	if !b.elector.IsLeader(ctx) {
+		logger.Debug("Not the leader, skipping reconciliation.")
+		return nil
+	}
 
-	err := b.cli.ContainerStart(ctx, cid, types.ContainerStartOptions{})
+	failures := 0
+	if err := b.CleanupExporters(ctx, false); err != nil && !IsErrExportedStillRunning(err) {
+		logger.Errorf("%+v", err)
+		failures++
+	}
+
+	missing, err := b.FindMissingExporters(ctx, promNetworks)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
+	}
+
+	for _, exporter := range missing {
+		if err := b.startExporter(ctx, exporter); err != nil && !IsErrExportedNotRunning(err) {
+			failures++
+		}
+	}
+
+	b.writeFileSD(ctx)
+
+	if failures > 0 {
+		return errors.Errorf("%d reconciliation operations failed", failures)
 	}
 
 	return nil
 }
 
-func (b Backend) StopExporter(ctx context.Context, exporter types.ContainerJSON) error {
-	err := b.cli.ContainerStop(ctx, exporter.ID, nil)
+// FindOutdatedExporters returns the exporters created with another rules
+// version than the current one, including the ones created without version
+func (b DockerBackend) FindOutdatedExporters(ctx context.Context) ([]types.Container, error) {
+	exporters, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_EXPORTED_ID),
+		),
+	})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	err = b.cli.ContainerRemove(ctx, exporter.ID, types.ContainerRemoveOptions{
-		Force: true,
-	})
-	if err != nil {
-		return errors.WithStack(err)
+	return b.filterOutdated(exporters), nil
+}
+
+func (b DockerBackend) filterOutdated(exporters []types.Container) []types.Container {
+	outdated := make([]types.Container, 0)
+	if b.rulesVersion == "" {
+		return outdated
 	}
 
-	logger := log.GetLogger(ctx)
-	logger.Info("Exporter container stopped.")
+	for _, exporter := range exporters {
+		if exporter.Labels[LABEL_RULES_VERSION] != b.rulesVersion {
+			outdated = append(outdated, exporter)
+		}
+	}
 
-	return nil
+	return outdated
 }
 
-func (b Backend) StartMissingExporters(ctx context.Context, promNetwork string) error {
+// FindMissingExporters returns the exporters that should be running,
+// based on currently running containers, but are not. They're sorted by name.
+func (b DockerBackend) FindMissingExporters(ctx context.Context, promNetworks []string) ([]models.Exporter, error) {
 	containers, err := b.cli.ContainerList(ctx, types.ContainerListOptions{})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	containerNames := make(map[string]string, 0)
+	// Exporter labels indexed by exporter names
+	exporterNames := make(map[string]map[string]string, 0)
 	for _, container := range containers {
+		if _, ok := container.Labels[LABEL_EXPORTED_ID]; !ok {
+			continue
+		}
+
 		for _, name := range container.Names {
-			containerNames[name] = name
+			exporterNames[name] = container.Labels
 		}
 	}
 
+	missing := make([]models.Exporter, 0)
+
 	// Iterate over containers to find which one should have an associated
 	// exporter running but does not
 	for _, container := range containers {
@@ -230,63 +1325,116 @@ func (b Backend) StartMissingExporters(ctx context.Context, promNetwork string)
 			continue
 		}
 
-		exporterName := getExporterName(container.Names[0])
-		if _, ok := containerNames[exporterName]; ok {
+		if !b.filter.Allows(container.Names, container.Image, container.Labels) {
 			continue
 		}
 
 		logger := log.GetLogger(ctx).WithFields(logrus.Fields{
 			"exported.id":   container.ID,
-			"exported.name": container.Names[0],
+			"exported.name": firstName(container.Names),
 		})
 		ctx := log.WithLogger(ctx, logger)
 
-		err := b.handleContainerStart(ctx, container.ID, promNetwork)
+		exported, err := b.cli.ContainerInspect(ctx, container.ID)
+		if client.IsErrNotFound(err) {
+			continue
+		} else if err != nil {
+			logger.Errorf("%+v", errors.WithStack(err))
+			continue
+		}
+
+		exporters, err := b.resolveExporters(ctx, newTaskToExport(exported))
 		if err != nil {
 			logger.Errorf("%+v", err)
+			continue
 		}
-	}
 
-	return nil
-}
+		// Each exporter of a container is checked independently. An exporter
+		// pointing to another container (e.g. a recreated one) or rendered
+		// from another config source is stale.
+		for _, exporter := range exporters {
+			if hasExporter(exporterNames, exporter, container) {
+				continue
+			}
 
-func (b Backend) CleanupStaleExporters(ctx context.Context) error {
-	exporters, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
-		All: true,
-		Filters: filters.NewArgs(
-			filters.Arg("label", LABEL_EXPORTED_ID),
-		),
+			exporter.PromNetworks = promNetworks
+			missing = append(missing, exporter)
+		}
+	}
+
+	// Missing exporters are sorted by name, such that output is stable
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].Name < missing[j].Name
 	})
 
-	if err != nil {
-		return errors.WithStack(err)
+	return missing, nil
+}
+
+// hasExporter checks if exporter is already running for the exported
+// container, under any of the names it could have been given. Exporter
+// labels are indexed by exporter names.
+func hasExporter(exporterNames map[string]map[string]string, exporter models.Exporter, exported types.Container) bool {
+	candidates := []string{exporter.Name}
+	for _, name := range exported.Names {
+		// Links are named after the linking container (e.g. "/web/db")
+		if strings.Contains(strings.TrimLeft(name, "/"), "/") {
+			continue
+		}
+		candidates = append(candidates,
+			getExporterName(exporter.PredefinedType, name, exported.ID),
+			getLegacyExporterName(exporter.PredefinedType, name))
 	}
 
-	logger := log.GetLogger(ctx)
-	logger.Debugf("Found %d running exporters.", len(exporters))
+	for _, candidate := range candidates {
+		labels, ok := exporterNames[candidate]
+		if ok && labels[LABEL_EXPORTED_ID] == exported.ID && !sourceChanged(labels, exporter) {
+			return true
+		}
+	}
 
-	for _, container := range exporters {
-		logger = logger.WithFields(logrus.Fields{
-			"exporter.cid":  container.ID,
-			"exporter.name": container.Names[0],
-		})
-		ctx := log.WithLogger(ctx, logger)
+	return false
+}
 
-		err := b.CleanupExporter(ctx, container.ID, false)
-		if err != nil && !IsErrExportedStillRunning(err) {
-			logger.Errorf("%+v", err)
-		}
+// firstName returns the first name of a container, or an empty string when
+// it has none
+func firstName(names []string) string {
+	if len(names) == 0 {
+		return ""
 	}
 
-	return nil
+	return names[0]
 }
 
-func (b Backend) CleanupAllExporters(ctx context.Context) error {
+// CleanupExporters cleans up exporters whose exported container is not
+// running anymore, or all the exporters when force is true
+func (b DockerBackend) CleanupExporters(ctx context.Context, force bool) error {
+	return b.CleanupExportersBySelector(ctx, map[string]string{}, force)
+}
+
+// CleanupExportersBySelector cleans up exporters having all the given labels.
+// An empty label value matches any value. When force is false, exporters whose
+// exported container is still running are left untouched. All exporters are
+// attempted and failures are returned together.
+func (b DockerBackend) CleanupExportersBySelector(ctx context.Context, labelFilters map[string]string, force bool) error {
+	if !b.elector.IsLeader(ctx) {
+		log.GetLogger(ctx).Debug("Not the leader, skipping cleanup.")
+		return nil
+	}
+
+	args := filters.NewArgs(
+		filters.Arg("label", LABEL_EXPORTED_ID),
+	)
+	for label, value := range labelFilters {
+		if value == "" {
+			args.Add("label", label)
+		} else {
+			args.Add("label", label+"="+value)
+		}
+	}
+
 	exporters, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
-		All: true,
-		Filters: filters.NewArgs(
-			filters.Arg("label", LABEL_EXPORTED_ID),
-		),
+		All:     true,
+		Filters: args,
 	})
 
 	if err != nil {
@@ -296,30 +1444,78 @@ func (b Backend) CleanupAllExporters(ctx context.Context) error {
 	logger := log.GetLogger(ctx)
 	logger.Debugf("Found %d exporters to clean up...", len(exporters))
 
-	for _, container := range exporters {
-		logger := logger.WithFields(logrus.Fields{
-			"exporter.cid":  container.ID,
-			"exporter.name": container.Names[0],
-		})
-		ctx := log.WithLogger(ctx, logger)
-
-		err := b.CleanupExporter(ctx, container.ID, true)
-		if err != nil {
-			logger.Errorf("%+v", err)
+	// Exported containers are inspected once per pass, even when shared by
+	// several exporters
+	cache := newInspectCache(b.cli)
+
+	var failures []error
+
+	// Exporters are cleaned up stack by stack
+	stacks, groups := groupByStack(exporters)
+	for _, stack := range stacks {
+		for _, container := range groups[stack] {
+			logger := logger.WithFields(logrus.Fields{
+				"exporter.cid":  container.ID,
+				"exporter.name": firstName(container.Names),
+				"stack":         stack,
+			})
+			ctx := log.WithLogger(ctx, logger)
+
+			err := b.cleanupExporter(ctx, container.ID, force, cache)
+			if err != nil && !IsErrExporterNotFound(err) {
+				failures = append(failures, errors.Wrapf(err, "cleaning up exporter %q", firstName(container.Names)))
+			}
 		}
 	}
 
+	if len(failures) > 0 {
+		return errCleanupFailed{failures}
+	}
+
 	return nil
 }
 
-func (b Backend) CleanupExporter(ctx context.Context, cid string, force bool) error {
-	exporter, err := b.cli.ContainerInspect(ctx, cid)
-	if err != nil {
+// inspectWithRetry inspects the given container with inspect, and retries on
+// transient errors. Not found errors are returned right away.
+func (b DockerBackend) inspectWithRetry(ctx context.Context, cid string, inspect func(context.Context, string) (types.ContainerJSON, error)) (types.ContainerJSON, error) {
+	var container types.ContainerJSON
+	var notFound error
+
+	err := retry(b.retryAttempts, b.retryInterval, b.retryMaxInterval, func() error {
+		var err error
+		container, err = inspect(ctx, cid)
+		if client.IsErrNotFound(err) {
+			notFound = err
+			return nil
+		}
+
+		return err
+	})
+	if notFound != nil {
+		return container, notFound
+	}
+
+	return container, err
+}
+
+func (b DockerBackend) CleanupExporter(ctx context.Context, cid string, force bool) error {
+	return b.cleanupExporter(ctx, cid, force, newInspectCache(b.cli))
+}
+
+func (b DockerBackend) cleanupExporter(ctx context.Context, cid string, force bool, cache *inspectCache) error {
+	exporter, err := b.inspectWithRetry(ctx, cid, b.cli.ContainerInspect)
+	if client.IsErrNotFound(err) {
+		return newErrExporterNotFound(cid)
+	} else if err != nil {
 		return errors.WithStack(err)
 	}
 
-	exportedTaskId := exporter.Config.Labels[LABEL_EXPORTED_ID]
-	exported, err := b.cli.ContainerInspect(ctx, exportedTaskId)
+	// Containers not managed by prom-autoexporter are never cleaned up
+	exportedTaskId, ok := exporter.Config.Labels[LABEL_EXPORTED_ID]
+	if !ok {
+		return newErrExporterNotFound(cid)
+	}
+	exported, err := b.inspectWithRetry(ctx, exportedTaskId, cache.inspect)
 
 	if err != nil && !client.IsErrNotFound(err) {
 		return errors.WithStack(err)
@@ -330,34 +1526,130 @@ func (b Backend) CleanupExporter(ctx context.Context, cid string, force bool) er
 	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
 		"exported.id":   exportedTaskId,
 		"exported.name": exporter.Config.Labels[LABEL_EXPORTED_NAME],
+		"lifecycle.id":  exporter.Config.Labels[LABEL_LIFECYCLE_ID],
 	})
 	ctx = log.WithLogger(ctx, logger)
 
+	if err := b.disconnectScrapeTarget(ctx, exporter); err != nil {
+		if b.disconnectFailure == DisconnectFailureAbort {
+			return err
+		}
+		logger.Warnf("Failed to disconnect scrape target, removing exporter anyway: %+v", err)
+	}
+
 	return b.StopExporter(ctx, exporter)
 }
 
-func (b Backend) FindAssociatedExporter(ctx context.Context, exportedId string) (types.Container, bool, error) {
+// CleanupExporterByExportedID cleans up all the exporters of the given
+// exported container. A typed error, detected with IsErrExporterNotFound, is
+// returned when it has none. All exporters are attempted and failures are
+// returned together.
+func (b DockerBackend) CleanupExporterByExportedID(ctx context.Context, exportedID string, force bool) error {
+	exporters, err := b.FindAssociatedExporters(ctx, exportedID)
+	if err != nil {
+		return err
+	}
+
+	if len(exporters) == 0 {
+		return newErrExporterNotFound(exportedID)
+	}
+
+	var failures []error
+	for _, exporter := range exporters {
+		// Exporters might be removed concurrently, e.g. by a stack cleanup
+		if err := b.CleanupExporter(ctx, exporter.ID, force); err != nil && !IsErrExporterNotFound(err) {
+			failures = append(failures, errors.Wrapf(err, "cleaning up exporter %q", firstName(exporter.Names)))
+		}
+	}
+
+	if len(failures) > 0 {
+		return errCleanupFailed{failures}
+	}
+
+	return nil
+}
+
+// DescribeExporter returns the exporters that would be run for the given
+// container, fully resolved, without creating anything
+func (b DockerBackend) DescribeExporter(ctx context.Context, containerID string) ([]models.Exporter, error) {
+	exported, err := b.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return b.resolveExporters(ctx, newTaskToExport(exported))
+}
+
+// ListExporterContainers returns the containers of all the exporters, including
+// the ones not running
+func (b DockerBackend) ListExporterContainers(ctx context.Context) ([]types.Container, error) {
 	containers, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
 		Filters: filters.NewArgs(
-			filters.Arg("label", LABEL_EXPORTED_ID+"="+exportedId),
+			filters.Arg("label", LABEL_EXPORTED_ID),
 		),
 	})
 
 	if err != nil {
-		return types.Container{}, false, errors.WithStack(err)
+		return nil, errors.WithStack(err)
+	}
+
+	return containers, nil
+}
+
+// ListExporters returns all the exporters managed by prom-autoexporter,
+// reconstructed from the labels of their containers. Labels missing on a
+// container leave the matching fields empty.
+func (b DockerBackend) ListExporters(ctx context.Context) ([]models.Exporter, error) {
+	containers, err := b.ListExporterContainers(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(containers) == 0 {
-		return types.Container{}, false, nil
+	exporters := make([]models.Exporter, 0, len(containers))
+	for _, container := range containers {
+		exporter := exporterFromContainer(firstName(container.Names), container.Image, container.Labels, container.State)
+		if status, ok := b.statuses.get(exporter.Name); ok {
+			exporter.LastError = status.LastError
+		}
+
+		exporters = append(exporters, exporter)
 	}
 
-	return containers[0], true, nil
+	return exporters, nil
 }
 
-func (b Backend) GetPromStaticConfig(ctx context.Context, promNetwork string) (*models.StaticConfig, error) {
-	endpoints, err := b.listNetworkEndpoints(ctx, promNetwork)
+// FindAssociatedExporters returns the exporters of the given exported
+// container, including the ones not running (e.g. restarting in loop because
+// the exported network namespace is dead)
+func (b DockerBackend) FindAssociatedExporters(ctx context.Context, exportedId string) ([]types.Container, error) {
+	containers, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_EXPORTED_ID+"="+exportedId),
+		),
+	})
+
 	if err != nil {
-		return nil, err
+		return nil, errors.WithStack(err)
+	}
+
+	return containers, nil
+}
+
+func (b DockerBackend) GetPromStaticConfig(ctx context.Context, promNetworks []string) (*models.StaticConfig, error) {
+	// Endpoints of all the networks, the first network wins when a container
+	// is connected to several of them
+	endpoints := map[string]string{}
+	for i := len(promNetworks) - 1; i >= 0; i-- {
+		networkEndpoints, err := b.listNetworkEndpoints(ctx, promNetworks[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for name, endpoint := range networkEndpoints {
+			endpoints[name] = endpoint
+		}
 	}
 
 	tasks, err := b.cli.TaskList(ctx, types.TaskListOptions{
@@ -391,57 +1683,65 @@ func (b Backend) GetPromStaticConfig(ctx context.Context, promNetwork string) (*
 		}
 
 		taskName := fmt.Sprintf("%s.%d.%s", services[task.ServiceID], task.Slot, task.ID)
-		if _, ok := endpoints[taskName]; !ok {
+		exported := models.NewTaskToExport(
+			task.ID,
+			services[task.ServiceID],
+			task.Spec.ContainerSpec.Image,
+			task.Spec.ContainerSpec.Labels,
+		)
+		exported.State = string(task.Status.State)
+
+		exporters, err := b.findExporters(ctx, exported)
+		if err != nil {
+			logger.Errorf("%+v", err)
 			continue
 		}
 
-		// We first check if an exporter name has been explicitly provided
-		// Then we try to find a predefined exporter matching service name
-		exporterType := task.Spec.ContainerSpec.Labels[LABEL_EXPORTER_NAME]
-		if exporterType == "" {
-			exporterType = models.FindMatchingExporter(services[task.ServiceID])
-		}
+		for exporterType, exporter := range exporters {
+			// Exporters are scraped through the exported task, unless they
+			// define another scrape target
+			endpointName := taskName
+			if exporter.ScrapeTarget != "" {
+				endpointName = exporter.ScrapeTarget
+			}
 
-		// Finally, this task is ignored if no exporter has been infered
-		if exporterType == "" {
-			continue
-		}
+			// Central exporters are scraped at their own address
+			target := exporter.CentralAddress
+			if !exporter.IsCentral() {
+				if _, ok := endpoints[endpointName]; !ok {
+					continue
+				}
 
-		// Ignore this task, if the associated exporter does not exist
-		if !models.PredefinedExporterExist(exporterType) {
-			continue
-		}
+				ip, _, err := net.ParseCIDR(endpoints[endpointName])
+				if err != nil {
+					logger.Error(err)
+					continue
+				}
 
-		ip, _, err := net.ParseCIDR(endpoints[taskName])
-		if err != nil {
-			logger.Error(err)
-			continue
-		}
+				target = fmt.Sprintf("%s:%s", ip.String(), exporter.Port)
+			}
 
-		port, err := models.GetExporterPort(exporterType)
-		if err != nil {
-			logger.Error(err)
-			continue
-		}
+			labels := map[string]string{
+				"job":                fmt.Sprintf("autoexporter-%s", exporterType),
+				"swarm_service_name": services[task.ServiceID],
+				"swarm_task_slot":    strconv.Itoa(task.Slot),
+				"swarm_task_id":      task.ID,
+			}
+			for label, value := range scrapeOverrideLabels(exporter) {
+				labels[label] = value
+			}
 
-		target := fmt.Sprintf("%s:%s", ip.String(), port)
-		labels := map[string]string{
-			"job": fmt.Sprintf("autoexporter-%s", exporterType),
-			"swarm_service_name": services[task.ServiceID],
-			"swarm_task_slot": strconv.Itoa(task.Slot),
-			"swarm_task_id": task.ID,
+			staticConfig.AddTarget(target, labels)
+			logger.WithFields(logrus.Fields{
+				"labels": labels,
+			}).Debugf("Add exporter %s for target %s", exporterType, target)
 		}
-
-		staticConfig.AddTarget(target, labels)
-		logger.WithFields(logrus.Fields{
-			"labels": labels,
-		}).Debugf("Add exporter %s for target %s", exporterType, target)
 	}
 
 	return staticConfig, nil
 }
 
-func (b Backend) listNetworkEndpoints(ctx context.Context, networkName string) (map[string]string, error) {
+func (b DockerBackend) listNetworkEndpoints(ctx context.Context, networkName string) (map[string]string, error) {
 	network, err := b.cli.NetworkInspect(ctx, networkName, types.NetworkInspectOptions{})
 
 	if err != nil {
@@ -455,7 +1755,3 @@ func (b Backend) listNetworkEndpoints(ctx context.Context, networkName string) (
 
 	return endpoints, nil
 }
-
-func getExporterName(containerName string) string {
-	return fmt.Sprintf("/exporter.%s", strings.TrimLeft(containerName, "/"))
-}
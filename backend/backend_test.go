@@ -0,0 +1,2809 @@
+package backend
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/metrics"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestStartMissingExportersUpdatesGauges(t *testing.T) {
+	redis := types.Container{ID: "redis-id", Names: []string{"/redis"}}
+	nginx := types.Container{ID: "nginx-id", Names: []string{"/nginx"}}
+	nginxExporter := types.Container{
+		ID:    "exporter-id",
+		Names: []string{"/exporter.nginx.nginx"},
+		Labels: map[string]string{
+			LABEL_EXPORTED_ID:   "nginx-id",
+			LABEL_EXPORTED_NAME: "/nginx",
+		},
+	}
+
+	var pulled []string
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			if options.Filters.Contains("label") {
+				return []types.Container{nginxExporter}, nil
+			}
+			return []types.Container{redis, nginx, nginxExporter}, nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			names := map[string]string{"redis-id": "/redis", "nginx-id": "/nginx"}
+			if name, ok := names[id]; ok {
+				return exportedContainer(id, name, nil), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			pulled = append(pulled, ref)
+			return nil, errors.New("registry unavailable")
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if err := b.StartMissingExporters(context.Background(), []string{"prometheus"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if got := exportersRunning.Value(); got != 1 {
+		t.Errorf("expected 1 running exporter, got %v", got)
+	}
+	if got := exportersDesired.Value(); got != 2 {
+		t.Errorf("expected 2 desired exporters, got %v", got)
+	}
+	if len(pulled) != 1 {
+		t.Errorf("expected the missing exporter to be started once, got %d image pulls", len(pulled))
+	}
+}
+
+func TestCreateContainerLabelsScrapeTimeout(t *testing.T) {
+	exporter := redisExporter()
+	exporter.ScrapeTimeout = "30s"
+	exporter.ScrapeInterval = "1m"
+
+	config, _ := createExporterContainer(t, exporter)
+	if got := config.Labels[LABEL_SCRAPE_TIMEOUT]; got != "30s" {
+		t.Errorf("expected label %s to be %q, got %q", LABEL_SCRAPE_TIMEOUT, "30s", got)
+	}
+	if got := config.Labels[LABEL_SCRAPE_INTERVAL]; got != "1m" {
+		t.Errorf("expected label %s to be %q, got %q", LABEL_SCRAPE_INTERVAL, "1m", got)
+	}
+}
+
+func TestCreateContainerInit(t *testing.T) {
+	testcases := map[string]struct {
+		global   bool
+		exporter bool
+		expected bool
+	}{
+		"disabled by default":      {},
+		"enabled globally":         {global: true, expected: true},
+		"enabled for the exporter": {exporter: true, expected: true},
+	}
+
+	for tcname, tc := range testcases {
+		t.Run(tcname, func(t *testing.T) {
+			exporter := redisExporter()
+			exporter.Init = tc.exporter
+
+			_, hostConfig := createExporterContainer(t, exporter, WithInit(tc.global))
+			init := hostConfig.Init != nil && *hostConfig.Init
+			if init != tc.expected {
+				t.Errorf("expected Init to be %t, got %t", tc.expected, init)
+			}
+		})
+	}
+}
+
+func TestCreateContainerShareUTS(t *testing.T) {
+	exporter := redisExporter()
+
+	_, hostConfig := createExporterContainer(t, exporter)
+	if hostConfig.UTSMode != "" {
+		t.Errorf("expected UTS namespace not to be shared by default, got %q", hostConfig.UTSMode)
+	}
+
+	exporter.ShareUTS = true
+
+	_, hostConfig = createExporterContainer(t, exporter)
+	if expected := container.UTSMode("container:redis-id"); hostConfig.UTSMode != expected {
+		t.Errorf("expected UTSMode %q, got %q", expected, hostConfig.UTSMode)
+	}
+}
+
+func TestGetPromStaticConfigWithoutScrapeTimeout(t *testing.T) {
+	cli := &fakeClient{
+		networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+			return types.NetworkResource{
+				Containers: map[string]types.EndpointResource{
+					"task-id": {Name: "redis.1.task-id", IPv4Address: "10.0.0.3/24"},
+				},
+			}, nil
+		},
+		taskListFn: func(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+			return []swarm.Task{{
+				ID:        "task-id",
+				ServiceID: "service-id",
+				Slot:      1,
+				Spec:      swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}},
+			}}, nil
+		},
+		serviceInspectWithRawFn: func(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+			return swarm.Service{Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "redis"}}}, nil, nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	staticConfig, err := b.GetPromStaticConfig(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	labels, ok := staticConfig.Targets["10.0.0.3:9121"]
+	if !ok {
+		t.Fatalf("expected a target for the redis task, got %v", staticConfig.Targets)
+	}
+	if timeout, ok := labels[promLabelScrapeTimeout]; ok {
+		t.Errorf("expected no scrape timeout when none is defined, got %q", timeout)
+	}
+}
+
+func TestGetPromStaticConfigUsesConfiguredFinder(t *testing.T) {
+	finder, err := models.LoadConfigFinder("testdata/exporters.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	cli := &fakeClient{
+		networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+			return types.NetworkResource{
+				Containers: map[string]types.EndpointResource{
+					"task-id": {Name: "myapp.1.task-id", IPv4Address: "10.0.0.4/24"},
+				},
+			}, nil
+		},
+		taskListFn: func(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+			return []swarm.Task{{
+				ID:        "task-id",
+				ServiceID: "service-id",
+				Slot:      1,
+				Spec: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{
+					Image:  "mycompany/myapp:3.1",
+					Labels: map[string]string{"autoexporter.scrape-interval": "45s"},
+				}},
+			}}, nil
+		},
+		serviceInspectWithRawFn: func(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+			return swarm.Service{Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "myapp"}}}, nil, nil
+		},
+	}
+
+	b := NewDockerBackend(cli, WithFinder(finder))
+	staticConfig, err := b.GetPromStaticConfig(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	labels, ok := staticConfig.Targets["10.0.0.4:9100"]
+	if !ok {
+		t.Fatalf("expected a target for the myapp task, got %v", staticConfig.Targets)
+	}
+	if labels["job"] != "autoexporter-myapp" {
+		t.Errorf("unexpected job label %q", labels["job"])
+	}
+	if labels[promLabelScrapeTimeout] != "20s" {
+		t.Errorf("expected scrape timeout %q to be surfaced, got %q", "20s", labels[promLabelScrapeTimeout])
+	}
+	if labels[promLabelScrapeInterval] != "45s" {
+		t.Errorf("expected scrape interval %q to be surfaced, got %q", "45s", labels[promLabelScrapeInterval])
+	}
+}
+
+func TestReconcileOnStartupStartsOnlyMissingExporters(t *testing.T) {
+	redis := types.Container{ID: "redis-id", Names: []string{"/redis"}}
+	redisExporter := types.Container{
+		ID:     "redis-exporter-id",
+		Names:  []string{"/exporter.redis.redis"},
+		Labels: map[string]string{LABEL_EXPORTED_ID: "redis-id", LABEL_EXPORTED_NAME: "/redis"},
+	}
+	php := types.Container{ID: "php-id", Names: []string{"/php"}}
+	es := types.Container{ID: "es-id", Names: []string{"/elasticsearch"}}
+	names := map[string]string{"php-id": "/php", "es-id": "/elasticsearch"}
+
+	var mutex sync.Mutex
+	var pulled []string
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			if options.Filters.Contains("label") {
+				return []types.Container{redisExporter}, nil
+			}
+			return []types.Container{redis, redisExporter, php, es}, nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if name, ok := names[id]; ok {
+				return exportedContainer(id, name, nil), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			pulled = append(pulled, ref)
+			return nil, errors.New("registry unavailable")
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewDockerBackend(cli)
+	if err := b.ReconcileOnStartup(ctx, []string{"prometheus"}, 0); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	sort.Strings(pulled)
+	expected := []string{"bakins/php-fpm-exporter:v0.5.0", "justwatch/elasticsearch_exporter:1.0.4rc1"}
+	if len(pulled) != len(expected) || pulled[0] != expected[0] || pulled[1] != expected[1] {
+		t.Fatalf("expected exporters %v to be started, got %v", expected, pulled)
+	}
+
+	// Periodic reconciliation starts missing exporters again
+	if err := b.ReconcileOnStartup(ctx, []string{"prometheus"}, 5*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	deadline := time.After(time.Second)
+	for {
+		mutex.Lock()
+		n := len(pulled)
+		mutex.Unlock()
+
+		if n >= 3*len(expected) {
+			break
+		}
+
+		select {
+		case <-deadline:
+			t.Fatalf("expected periodic reconciliation to start missing exporters, got %d image pulls", n)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestReconcileOnce(t *testing.T) {
+	testcases := map[string]struct {
+		pullErr     error
+		expectedErr bool
+	}{
+		"everything succeeds": {},
+		"an exporter fails to start": {
+			pullErr:     errors.New("registry unavailable"),
+			expectedErr: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			orphan := types.Container{
+				ID:     "orphan-exporter-id",
+				Names:  []string{"/exporter.redis.gone"},
+				State:  "running",
+				Labels: map[string]string{LABEL_EXPORTED_ID: "gone-id", LABEL_EXPORTED_NAME: "/gone"},
+			}
+			redis := types.Container{ID: "redis-id", Names: []string{"/redis"}, State: "running"}
+
+			var removed, created []string
+			cli := &fakeClient{
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					if options.Filters.Contains("label") {
+						return filterContainers([]types.Container{orphan}, options.Filters), nil
+					}
+					return []types.Container{redis, orphan}, nil
+				},
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					switch id {
+					case "redis-id":
+						return exportedContainer(id, "/redis", nil), nil
+					case orphan.ID:
+						return exportedContainer(id, orphan.Names[0], orphan.Labels), nil
+					}
+					return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+				},
+				containerStopFn: func(ctx context.Context, id string) error {
+					return nil
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed = append(removed, id)
+					return nil
+				},
+				imageInspectFn: imageNotFound,
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					if tc.pullErr != nil {
+						return nil, tc.pullErr
+					}
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+				containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+					created = append(created, name)
+					return container.ContainerCreateCreatedBody{ID: "redis-exporter-id"}, nil
+				},
+				networkInspectFn: emptyNetwork,
+				networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+					return nil
+				},
+				containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli, WithRetry(1, time.Millisecond, time.Millisecond), WithFinder(stubFinder{
+				"/redis": {stubExporter("redis", "redis_exporter")},
+			}))
+			err := b.ReconcileOnce(context.Background(), []string{"prometheus"})
+			if tc.expectedErr && err == nil {
+				t.Fatal("expected an error")
+			} else if !tc.expectedErr && err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if !reflect.DeepEqual(removed, []string{orphan.ID}) {
+				t.Errorf("expected the orphaned exporter to be removed, got %v", removed)
+			}
+			if !tc.expectedErr && !reflect.DeepEqual(created, []string{getExporterName("redis", "/redis", "redis-id")}) {
+				t.Errorf("expected the missing exporter to be created, got %v", created)
+			}
+		})
+	}
+}
+
+func TestExportedContainerDyingBeforeExporterStarts(t *testing.T) {
+	testcases := map[string]struct {
+		exportedRunning bool
+		notRunningErr   bool
+	}{
+		"exported container died": {
+			exportedRunning: false,
+			notRunningErr:   true,
+		},
+		"exported container still running": {
+			exportedRunning: true,
+			notRunningErr:   false,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			var removed []string
+			cli := &fakeClient{
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if id != "redis-id" {
+						return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+					}
+					redis := exportedContainer(id, "/redis", nil)
+					redis.State.Running = tc.exportedRunning
+					return redis, nil
+				},
+				containerListFn: noContainers,
+				imageInspectFn:  imageNotFound,
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+				containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+					return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+				},
+				networkInspectFn: emptyNetwork,
+				networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+					return nil
+				},
+				containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+					return errors.New("cannot join network of a non running container: redis-id")
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed = append(removed, id)
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli)
+			exporter := redisExporter()
+			exporter.PromNetworks = []string{"prometheus"}
+
+			err := b.startExporter(context.Background(), exporter)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if IsErrExportedNotRunning(err) != tc.notRunningErr {
+				t.Errorf("unexpected error: %+v", err)
+			}
+
+			// The partially created exporter is removed once, whatever the
+			// reason of the failure
+			if !reflect.DeepEqual(removed, []string{exporter.Name}) {
+				t.Errorf("expected the exporter container to be removed, got %v", removed)
+			}
+		})
+	}
+}
+
+func TestRunExporterRollsBackCreatedContainer(t *testing.T) {
+	testcases := map[string]struct {
+		connectErr error
+		startErr   error
+		adopted    bool
+		rolledBack bool
+	}{
+		"connect fails after create": {
+			connectErr: errors.New("network prometheus not found"),
+			rolledBack: true,
+		},
+		"start fails after create": {
+			startErr:   errors.New("oci runtime error"),
+			rolledBack: true,
+		},
+		"adopted containers are kept": {
+			startErr:   errors.New("oci runtime error"),
+			adopted:    true,
+			rolledBack: false,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exporter := redisExporter()
+			exporter.PromNetworks = []string{"prometheus"}
+
+			var removed []string
+			cli := &fakeClient{
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					switch id {
+					case "redis-id":
+						return exportedContainer(id, "/redis", nil), nil
+					case exporter.Name:
+						if tc.adopted {
+							existing := exportedContainer("existing-exporter-id", exporter.Name, map[string]string{
+								LABEL_EXPORTED_ID:          "redis-id",
+								LABEL_EXPORTER_SPEC_HASH:   exporter.SpecHash(),
+								LABEL_EXPORTER_SOURCE_HASH: exporter.SourceHash(),
+							})
+							existing.State.Status = "created"
+							return existing, nil
+						}
+					}
+					return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+				},
+				containerListFn: noContainers,
+				imageInspectFn:  imageNotFound,
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+				containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+					if tc.adopted {
+						return container.ContainerCreateCreatedBody{}, errdefs.Conflict(errors.New("name already in use"))
+					}
+					return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+				},
+				networkInspectFn: emptyNetwork,
+				networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+					return tc.connectErr
+				},
+				containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+					return tc.startErr
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					if !options.Force {
+						t.Errorf("expected the removal to be forced")
+					}
+					removed = append(removed, id)
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli)
+			if err := b.startExporter(context.Background(), exporter); err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if tc.rolledBack && !reflect.DeepEqual(removed, []string{exporter.Name}) {
+				t.Errorf("expected the created container to be removed, got %v", removed)
+			} else if !tc.rolledBack && len(removed) != 0 {
+				t.Errorf("expected the adopted container to be kept, got %v removed", removed)
+			}
+		})
+	}
+}
+
+func TestCleanupExporterRetriesTransientInspectErrors(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+
+	testcases := map[string]struct {
+		// Errors returned by the successive inspections of the exported
+		// container, before it's found
+		inspectErrs     []error
+		expectedInspect int
+		expectedErr     bool
+	}{
+		"exported container not found": {
+			inspectErrs:     []error{errdefs.NotFound(errors.New("no such container"))},
+			expectedInspect: 1,
+		},
+		"transient error then success": {
+			inspectErrs:     []error{transient},
+			expectedInspect: 2,
+		},
+		"persistent error": {
+			inspectErrs:     []error{transient, transient, transient},
+			expectedInspect: 3,
+			expectedErr:     true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			inspected := 0
+			var removed []string
+			cli := &fakeClient{
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if id == "exporter-id" {
+						return exportedContainer(id, "/exporter.redis.redis", map[string]string{LABEL_EXPORTED_ID: "redis-id"}), nil
+					}
+
+					inspected++
+					if inspected <= len(tc.inspectErrs) {
+						return types.ContainerJSON{}, tc.inspectErrs[inspected-1]
+					}
+					return exportedContainer(id, "/redis", nil), nil
+				},
+				containerStopFn: func(ctx context.Context, id string) error {
+					return nil
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed = append(removed, id)
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli, WithRetry(3, time.Millisecond, time.Millisecond))
+			err := b.CleanupExporter(context.Background(), "exporter-id", true)
+			if tc.expectedErr && err == nil {
+				t.Fatal("expected an error")
+			} else if !tc.expectedErr && err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if inspected != tc.expectedInspect {
+				t.Errorf("expected %d inspections of the exported container, got %d", tc.expectedInspect, inspected)
+			}
+			if tc.expectedErr && len(removed) != 0 {
+				t.Errorf("expected the exporter to be kept, got %v removed", removed)
+			} else if !tc.expectedErr && !reflect.DeepEqual(removed, []string{"exporter-id"}) {
+				t.Errorf("expected the exporter to be removed, got %v", removed)
+			}
+		})
+	}
+}
+
+func TestCleanupExporterIgnoresUnmanagedContainers(t *testing.T) {
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return exportedContainer(id, "/redis", nil), nil
+		},
+	}
+
+	// Stopping the container would panic on the fake client
+	b := NewDockerBackend(cli)
+	if err := b.CleanupExporter(context.Background(), "redis", true); !IsErrExporterNotFound(err) {
+		t.Errorf("expected an exporter not found error, got %+v", err)
+	}
+}
+
+func redisExporter() models.Exporter {
+	exporter := models.NewExporter(getExporterName("redis", "/redis", "redis-id"), "redis", "redis_exporter", nil, nil, models.NewTaskToExport("redis-id", "/redis", "redis:5", nil))
+	exporter.Port = "9121"
+	return exporter
+}
+
+// createExporterContainer creates the container of the given exporter with a
+// Backend configured with opts, and returns the configs sent to Docker
+func createExporterContainer(t *testing.T, exporter models.Exporter, opts ...Option) (*container.Config, *container.HostConfig) {
+	t.Helper()
+
+	var config *container.Config
+	var hostConfig *container.HostConfig
+	cli := &fakeClient{
+		containerCreateFn: func(c *container.Config, hc *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			config, hostConfig = c, hc
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		networkInspectFn: emptyNetwork,
+	}
+
+	b := NewDockerBackend(cli, opts...)
+	if _, err := b.createContainer(context.Background(), exporter, newLifecycleID()); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	return config, hostConfig
+}
+
+func exportedContainer(id, name string, labels map[string]string) types.ContainerJSON {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    id,
+			Name:  name,
+			State: &types.ContainerState{Running: true},
+		},
+		Config: &container.Config{Labels: labels},
+	}
+}
+
+func TestCleanupExportersBySelector(t *testing.T) {
+	exporters := []types.Container{
+		{
+			ID:    "web-exporter-id",
+			Names: []string{"/exporter.nginx.web_nginx"},
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:            "web-nginx-id",
+				"com.docker.stack.namespace": "web",
+			},
+		},
+		{
+			ID:    "db-exporter-id",
+			Names: []string{"/exporter.redis.db_redis"},
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:            "db-redis-id",
+				"com.docker.stack.namespace": "db",
+			},
+		},
+		{
+			ID:     "plain-container-id",
+			Names:  []string{"/web_php"},
+			Labels: map[string]string{"com.docker.stack.namespace": "web"},
+		},
+	}
+
+	var removed []string
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(exporters, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, c := range exporters {
+				if c.ID == id {
+					return exportedContainer(c.ID, c.Names[0], c.Labels), nil
+				}
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			removed = append(removed, id)
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	err := b.CleanupExportersBySelector(context.Background(), map[string]string{"com.docker.stack.namespace": "web"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if len(removed) != 1 || removed[0] != "web-exporter-id" {
+		t.Errorf("expected only the exporter of the web stack to be removed, got %v", removed)
+	}
+}
+
+func TestDryRunDoesNotMutateDocker(t *testing.T) {
+	mutated := func(call string) {
+		t.Errorf("unexpected call to %s in dry-run mode", call)
+	}
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			// A stale exporter exists but must not be removed either
+			return exportedContainer("stale-exporter-id", id, map[string]string{LABEL_EXPORTED_ID: "old-redis-id"}), nil
+		},
+		containerListFn: noContainers,
+		imageInspectFn:  imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			mutated("ImagePull")
+			return nil, errors.New("unexpected call")
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			mutated("ContainerCreate")
+			return container.ContainerCreateCreatedBody{}, errors.New("unexpected call")
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			mutated("NetworkConnect")
+			return errors.New("unexpected call")
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			mutated("ContainerStart")
+			return errors.New("unexpected call")
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			mutated("ContainerStop")
+			return errors.New("unexpected call")
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			mutated("ContainerRemove")
+			return errors.New("unexpected call")
+		},
+	}
+
+	b := NewDockerBackend(cli, WithDryRun(true))
+	exporter := models.NewExporter("/exporter.redis.redis", "redis", "redis_exporter", nil, nil, models.NewTaskToExport("redis-id", "/redis", "redis:5", nil))
+	exporter.PromNetworks = []string{"prometheus"}
+
+	b.RunExporter(context.Background(), exporter)
+
+	if err := b.StopExporter(context.Background(), exportedContainer("exporter-id", "/exporter.redis.redis", nil)); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestDockerBackendConformance(t *testing.T) {
+	testBackendConformance(t, func(t *testing.T, w *conformanceWorld) Backend {
+		return NewDockerBackend(newConformanceClient(w))
+	})
+}
+
+// newConformanceClient returns a fake Docker client exposing the targets and
+// exporters of the given world as containers
+func newConformanceClient(w *conformanceWorld) *fakeClient {
+	list := func() []types.Container {
+		containers := []types.Container{}
+		for id, target := range w.targets {
+			state := "exited"
+			if target.running {
+				state = "running"
+			}
+			containers = append(containers, types.Container{ID: id, Names: []string{target.name}, State: state, Labels: map[string]string{}})
+		}
+		for id, exporter := range w.exporters {
+			containers = append(containers, types.Container{
+				ID:    id,
+				Names: []string{exporter.name},
+				State: "running",
+				Labels: map[string]string{
+					LABEL_EXPORTED_ID:   exporter.exportedID,
+					LABEL_EXPORTED_NAME: w.targets[exporter.exportedID].name,
+				},
+			})
+		}
+		return containers
+	}
+
+	return &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+
+			containers := []types.Container{}
+			for _, c := range filterContainers(list(), options.Filters) {
+				if options.All || c.State == "running" {
+					containers = append(containers, c)
+				}
+			}
+			return containers, nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+
+			for _, c := range list() {
+				if c.ID == id {
+					inspected := exportedContainer(c.ID, c.Names[0], c.Labels)
+					inspected.State.Running = c.State == "running"
+					return inspected, nil
+				}
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+
+			w.started = append(w.started, name)
+			return container.ContainerCreateCreatedBody{ID: name}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+
+			delete(w.exporters, id)
+			w.removed = append(w.removed, id)
+			return nil
+		},
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			return make(chan events.Message), make(chan error)
+		},
+	}
+}
+
+func TestMultipleExportersForAContainer(t *testing.T) {
+	cache := types.Container{ID: "cache-id", Names: []string{"/cache"}}
+	redisExporter := types.Container{
+		ID:     "redis-exporter-id",
+		Names:  []string{"/exporter.redis.cache"},
+		Labels: map[string]string{LABEL_EXPORTED_ID: "cache-id", LABEL_EXPORTED_NAME: "/cache"},
+	}
+	containers := []types.Container{cache, redisExporter}
+
+	var removed []string
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(containers, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, c := range containers {
+				if c.ID == id {
+					return exportedContainer(c.ID, c.Names[0], c.Labels), nil
+				}
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			removed = append(removed, id)
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli, WithFinder(stubFinder{
+		"/cache": {
+			stubExporter("redis", "redis_exporter"),
+			stubExporter("node", "node_exporter"),
+		},
+	}))
+
+	exporters, err := b.resolveExporters(context.Background(), models.NewTaskToExport("cache-id", "/cache", "redis:5", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	nodeName, redisName := getExporterName("node", "/cache", "cache-id"), getExporterName("redis", "/cache", "cache-id")
+	if len(exporters) != 2 || exporters[0].Name != nodeName || exporters[1].Name != redisName {
+		t.Fatalf("expected each exporter to get a unique name, got %+v", exporters)
+	}
+
+	// Each exporter is detected independently, the redis one having been
+	// created before exporter names were hashed
+	missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(missing) != 1 || missing[0].Name != nodeName {
+		t.Errorf("expected only the node exporter to be missing, got %+v", missing)
+	}
+
+	// Each exporter is tracked for cleanup
+	containers = append(containers, types.Container{
+		ID:     "node-exporter-id",
+		Names:  []string{nodeName},
+		Labels: map[string]string{LABEL_EXPORTED_ID: "cache-id", LABEL_EXPORTED_NAME: "/cache"},
+	})
+	if err := b.handleContainerStop(context.Background(), "cache-id", ""); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	sort.Strings(removed)
+	if expected := []string{"node-exporter-id", "redis-exporter-id"}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected exporters %v to be removed, got %v", expected, removed)
+	}
+}
+
+func TestNamespaceAndScrapeTargetsAreAppliedIndependently(t *testing.T) {
+	exporter := redisExporter()
+	exporter.NamespaceTarget = "redis-proxy-id"
+	exporter.ScrapeTarget = "redis-gateway"
+	exporter.ShareUTS = true
+	exporter.Port = "9121"
+	exporter.PromNetworks = []string{"prometheus"}
+
+	config, hostConfig := createExporterContainer(t, exporter)
+	if expected := container.NetworkMode("container:redis-proxy-id"); hostConfig.NetworkMode != expected {
+		t.Errorf("expected NetworkMode %q, got %q", expected, hostConfig.NetworkMode)
+	}
+	if expected := container.UTSMode("container:redis-proxy-id"); hostConfig.UTSMode != expected {
+		t.Errorf("expected UTSMode %q, got %q", expected, hostConfig.UTSMode)
+	}
+	if got := config.Labels[LABEL_SCRAPE_TARGET]; got != "redis-gateway" {
+		t.Errorf("expected scrape target label %q, got %q", "redis-gateway", got)
+	}
+
+	var connected string
+	cli := &fakeClient{
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			connected = containerID
+			return nil
+		},
+		networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+			containers := map[string]types.EndpointResource{
+				"task-id": {Name: "redis.1.task-id", IPv4Address: "10.0.0.3/24"},
+			}
+			if connected != "" {
+				containers["gateway-id"] = types.EndpointResource{Name: "redis-gateway", IPv4Address: "10.0.0.4/24"}
+			}
+			return types.NetworkResource{Containers: containers}, nil
+		},
+		taskListFn: func(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+			return []swarm.Task{{
+				ID:        "task-id",
+				ServiceID: "service-id",
+				Slot:      1,
+				Spec:      swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}},
+			}}, nil
+		},
+		serviceInspectWithRawFn: func(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+			return swarm.Service{Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "redis"}}}, nil, nil
+		},
+	}
+	b := NewDockerBackend(cli, WithFinder(stubFinder{"redis": {exporter}}))
+
+	if err := b.connectToNetwork(context.Background(), exporter, "exporter-id"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if connected != "redis-gateway" {
+		t.Errorf("expected scrape target to be connected to the prometheus network, got %q", connected)
+	}
+
+	staticConfig, err := b.GetPromStaticConfig(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if _, ok := staticConfig.Targets["10.0.0.4:9121"]; !ok || len(staticConfig.Targets) != 1 {
+		t.Errorf("expected the exporter to be scraped through its scrape target, got %v", staticConfig.Targets)
+	}
+}
+
+func TestExporterLifetimeIsObservedOnCleanup(t *testing.T) {
+	config, _ := createExporterContainer(t, redisExporter())
+
+	created, err := time.Parse(time.RFC3339, config.Labels[LABEL_EXPORTER_CREATED_AT])
+	if err != nil {
+		t.Fatalf("expected creation time label to be set, got %q", config.Labels[LABEL_EXPORTER_CREATED_AT])
+	}
+	if time.Since(created) > time.Minute {
+		t.Errorf("expected creation time to be now, got %v", created)
+	}
+
+	cli := &fakeClient{
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+	b := NewDockerBackend(cli)
+
+	// The exporter has been created 2 hours ago
+	config.Labels[LABEL_EXPORTER_CREATED_AT] = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	observations := exporterLifetime.Count()
+	before := lifetimeSum(t)
+
+	if err := b.StopExporter(context.Background(), exportedContainer("exporter-id", "/exporter.redis.redis", config.Labels)); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if got := exporterLifetime.Count() - observations; got != 1 {
+		t.Fatalf("expected 1 lifetime observation, got %d", got)
+	}
+	if lifetime := lifetimeSum(t) - before; lifetime < 7200 || lifetime > 7260 {
+		t.Errorf("expected a lifetime of about 2 hours, got %vs", lifetime)
+	}
+
+	// Exporters without creation time are not observed
+	if err := b.StopExporter(context.Background(), exportedContainer("exporter-id", "/exporter.redis.redis", nil)); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if got := exporterLifetime.Count() - observations; got != 1 {
+		t.Errorf("expected exporters without creation time to be ignored, got %d observations", got)
+	}
+}
+
+// lifetimeSum reads the sum of exporter lifetimes from the metrics endpoint
+func lifetimeSum(t *testing.T) float64 {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, "autoexporter_exporter_lifetime_seconds_sum ") {
+			sum, err := strconv.ParseFloat(strings.Fields(line)[1], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sum
+		}
+	}
+
+	t.Fatalf("lifetime histogram not exposed:\n%s", rec.Body.String())
+	return 0
+}
+
+func TestConcurrentStartsCreateASingleExporter(t *testing.T) {
+	var mutex sync.Mutex
+	created := 0
+	pulls := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	cli := &fakeClient{
+		containerListFn: noContainers,
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			pulls <- struct{}{}
+			<-release
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			created++
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli)
+	exporter := redisExporter()
+	exporter.PromNetworks = []string{"prometheus"}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.RunExporter(context.Background(), exporter)
+		}()
+	}
+
+	// Wait for the first startup to be in progress, the second one should
+	// give up without pulling the image
+	<-pulls
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if len(pulls) != 0 {
+		t.Errorf("expected the duplicated startup to be skipped")
+	}
+	if created != 1 {
+		t.Errorf("expected 1 exporter container to be created, got %d", created)
+	}
+}
+
+func TestIsErrConflict(t *testing.T) {
+	testcases := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"nil error":            {err: nil, expected: false},
+		"conflict from docker": {err: errdefs.Conflict(errors.New("conflict")), expected: true},
+		"wrapped conflict":     {err: pkgerrors.WithStack(errors.New("Error response from daemon: Conflict. The container name is already in use")), expected: true},
+		"other error":          {err: errors.New("boom"), expected: false},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			if got := isErrConflict(tc.err); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestChangedConfigSourceRecreatesExporter(t *testing.T) {
+	previous := redisExporter()
+	previous.Exported.Labels = map[string]string{"autoexporter.dsn": "redis://old:6379"}
+
+	testcases := map[string]struct {
+		labels   map[string]string
+		recreate bool
+	}{
+		"unchanged source": {
+			labels:   map[string]string{"autoexporter.dsn": "redis://old:6379"},
+			recreate: false,
+		},
+		"changed source label": {
+			labels:   map[string]string{"autoexporter.dsn": "redis://new:6379"},
+			recreate: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			config, _ := createExporterContainer(t, previous)
+			running := types.Container{
+				ID:     "exporter-id",
+				Names:  []string{previous.Name},
+				Labels: config.Labels,
+			}
+			exported := types.Container{ID: "redis-id", Names: []string{"/redis"}, Image: "redis:5", Labels: tc.labels}
+
+			var removed, created []string
+			cli := &fakeClient{
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					return filterContainers([]types.Container{exported, running}, options.Filters), nil
+				},
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if id == running.ID || id == previous.Name {
+						return exportedContainer(running.ID, previous.Name, running.Labels), nil
+					}
+					redis := exportedContainer(id, "/redis", tc.labels)
+					redis.Config.Image = "redis:5"
+					return redis, nil
+				},
+				containerStopFn: func(ctx context.Context, id string) error {
+					return nil
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed = append(removed, id)
+					return nil
+				},
+				imageInspectFn: imageNotFound,
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+				containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+					created = append(created, name)
+					return container.ContainerCreateCreatedBody{ID: "new-exporter-id"}, nil
+				},
+				networkInspectFn: emptyNetwork,
+				networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+					return nil
+				},
+				containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli, WithFinder(stubFinder{
+				"/redis": {stubExporter("redis", "redis_exporter")},
+			}))
+			if err := b.StartMissingExporters(context.Background(), []string{"prometheus"}); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if !tc.recreate {
+				if len(removed) > 0 || len(created) > 0 {
+					t.Errorf("expected exporter to be left untouched, got removed %v and created %v", removed, created)
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(removed, []string{"exporter-id"}) {
+				t.Errorf("expected outdated exporter to be removed, got %v", removed)
+			}
+			if !reflect.DeepEqual(created, []string{previous.Name}) {
+				t.Errorf("expected exporter to be recreated, got %v", created)
+			}
+		})
+	}
+}
+
+func TestRunExporterReusesExistingExporterOnConflict(t *testing.T) {
+	exporter := redisExporter()
+	exporter.PromNetworks = []string{"prometheus"}
+	config, _ := createExporterContainer(t, exporter)
+
+	outdated := map[string]string{}
+	for k, v := range config.Labels {
+		outdated[k] = v
+	}
+	outdated[LABEL_EXPORTER_SPEC_HASH] = "outdated"
+
+	testcases := map[string]struct {
+		labels  map[string]string
+		state   types.ContainerState
+		removed []string
+		created int
+		started string
+	}{
+		"healthy exporter is adopted": {
+			labels:  config.Labels,
+			state:   types.ContainerState{Status: "exited"},
+			removed: nil,
+			created: 1,
+			started: "existing-id",
+		},
+		"outdated exporter is recreated": {
+			labels:  outdated,
+			state:   types.ContainerState{Status: "exited"},
+			removed: []string{"existing-id"},
+			created: 2,
+			started: exporter.Name,
+		},
+		"dead exporter is recreated": {
+			labels:  config.Labels,
+			state:   types.ContainerState{Dead: true},
+			removed: []string{"existing-id"},
+			created: 2,
+			started: exporter.Name,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exists := true
+			created := 0
+			var removed []string
+			var started string
+
+			cli := &fakeClient{
+				containerListFn: noContainers,
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if !exists {
+						return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+					}
+
+					existing := exportedContainer("existing-id", exporter.Name, tc.labels)
+					existing.State = &tc.state
+					return existing, nil
+				},
+				imageInspectFn: imageNotFound,
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+				containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+					created++
+					if exists {
+						return container.ContainerCreateCreatedBody{}, errdefs.Conflict(errors.New("Conflict. The container name is already in use"))
+					}
+					return container.ContainerCreateCreatedBody{ID: "new-id"}, nil
+				},
+				containerStopFn: func(ctx context.Context, id string) error {
+					return nil
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed = append(removed, id)
+					exists = false
+					return nil
+				},
+				networkInspectFn: emptyNetwork,
+				networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+					return nil
+				},
+				containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+					started = id
+					return nil
+				},
+			}
+
+			var b Backend = NewDockerBackend(cli)
+			b.RunExporter(context.Background(), exporter)
+
+			if !reflect.DeepEqual(removed, tc.removed) {
+				t.Errorf("expected %v to be removed, got %v", tc.removed, removed)
+			}
+			if created != tc.created {
+				t.Errorf("expected %d create attempts, got %d", tc.created, created)
+			}
+			if started != tc.started {
+				t.Errorf("expected %q to be started, got %q", tc.started, started)
+			}
+		})
+	}
+}
+
+func TestDescribeExporter(t *testing.T) {
+	finder, err := models.LoadConfigFinder("testdata/exporters.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id != "legacy-app-id" {
+				return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+			}
+
+			// The image doesn't match the myapp rules, the label overrides them
+			app := exportedContainer(id, "/legacy-app", map[string]string{
+				LABEL_EXPORTER_NAME: "myapp",
+				"env":               "staging",
+			})
+			app.Config.Image = "mycompany/legacy:1.0"
+			return app, nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			t.Errorf("unexpected call to ContainerCreate")
+			return container.ContainerCreateCreatedBody{}, errors.New("unexpected call")
+		},
+	}
+
+	b := NewDockerBackend(cli, WithFinder(finder))
+	exporters, err := b.DescribeExporter(context.Background(), "legacy-app-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if len(exporters) != 1 {
+		t.Fatalf("expected 1 exporter, got %+v", exporters)
+	}
+
+	exporter := exporters[0]
+	if exporter.Name != getExporterName("myapp", "/legacy-app", "legacy-app-id") || exporter.PredefinedType != "myapp" {
+		t.Errorf("expected the exporter selected by label, got %q of type %q", exporter.Name, exporter.PredefinedType)
+	}
+	if expected := []string{"--target=localhost:8080", "--name=/legacy-app"}; !reflect.DeepEqual(exporter.Cmd, expected) {
+		t.Errorf("expected templated cmd %v, got %v", expected, exporter.Cmd)
+	}
+	if expected := []string{"APP_ENV=staging"}; !reflect.DeepEqual(exporter.EnvVars, expected) {
+		t.Errorf("expected templated env %v, got %v", expected, exporter.EnvVars)
+	}
+	if exporter.Exported.ID != "legacy-app-id" || exporter.Port != "9100" || exporter.ScrapeTimeout != "20s" {
+		t.Errorf("unexpected exported ID %q, port %q or scrape timeout %q", exporter.Exported.ID, exporter.Port, exporter.ScrapeTimeout)
+	}
+}
+
+func TestPullImageSkipsImagesPresentLocally(t *testing.T) {
+	testcases := map[string]struct {
+		image      string
+		policy     string
+		present    bool
+		expectPull bool
+	}{
+		"present image is not pulled": {
+			image:      "oliver006/redis_exporter:v1.0.0",
+			policy:     models.PullPolicyIfNotPresent,
+			present:    true,
+			expectPull: false,
+		},
+		"missing image is pulled": {
+			image:      "oliver006/redis_exporter:v1.0.0",
+			policy:     models.PullPolicyIfNotPresent,
+			present:    false,
+			expectPull: true,
+		},
+		"always pull policy pulls present images": {
+			image:      "oliver006/redis_exporter:latest",
+			policy:     models.PullPolicyAlways,
+			present:    true,
+			expectPull: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			pulled := false
+			cli := &fakeClient{
+				imageInspectFn: func(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+					if image != tc.image {
+						t.Errorf("expected %q to be inspected, got %q", tc.image, image)
+					}
+					if !tc.present {
+						return imageNotFound(ctx, image)
+					}
+					return types.ImageInspect{ID: "sha256:abcdef"}, nil, nil
+				},
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					pulled = true
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+			}
+
+			exporter := models.NewExporter("", "redis", tc.image, nil, nil, models.TaskToExport{})
+			exporter.ImagePullPolicy = tc.policy
+
+			b := NewDockerBackend(cli)
+			if err := b.pullImage(context.Background(), exporter); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if pulled != tc.expectPull {
+				t.Errorf("expected pull to be %v, got %v", tc.expectPull, pulled)
+			}
+		})
+	}
+}
+
+func TestExporterNameCollisions(t *testing.T) {
+	name := getExporterName("redis", "/redis", "0123456789abcdef")
+	testcases := map[string]struct {
+		policy       string
+		managed      bool
+		expectedName string
+	}{
+		"unmanaged container is skipped by default": {
+			policy:       CollisionPolicySkip,
+			managed:      false,
+			expectedName: "",
+		},
+		"unmanaged container is disambiguated with a suffix": {
+			policy:       CollisionPolicySuffix,
+			managed:      false,
+			expectedName: name + ".0123456789ab",
+		},
+		"managed exporter is not a collision": {
+			policy:       CollisionPolicySuffix,
+			managed:      true,
+			expectedName: name,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			cli := &fakeClient{
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if id != name {
+						return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+					}
+
+					// The user named one of its own containers like an exporter
+					labels := map[string]string{}
+					if tc.managed {
+						labels[LABEL_EXPORTED_ID] = "0123456789abcdef"
+					}
+					return exportedContainer("user-container-id", id, labels), nil
+				},
+			}
+
+			b := NewDockerBackend(cli, WithCollisionPolicy(tc.policy), WithFinder(stubFinder{
+				"/redis": {stubExporter("redis", "redis_exporter")},
+			}))
+			exporters, err := b.resolveExporters(context.Background(), models.NewTaskToExport("0123456789abcdef", "/redis", "redis:5", nil))
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if tc.expectedName == "" {
+				if len(exporters) != 0 {
+					t.Errorf("expected colliding exporter to be skipped, got %+v", exporters)
+				}
+				return
+			}
+
+			if len(exporters) != 1 || exporters[0].Name != tc.expectedName {
+				t.Errorf("expected exporter named %q, got %+v", tc.expectedName, exporters)
+			}
+		})
+	}
+}
+
+func TestUnmanagedContainersAreNeverRemoved(t *testing.T) {
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return exportedContainer("user-container-id", id, map[string]string{}), nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			t.Errorf("unexpected removal of %q", id)
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if err := b.removeStaleExporter(context.Background(), redisExporter()); err == nil {
+		t.Errorf("expected an error when the exporter name is taken by an unmanaged container")
+	}
+	if _, _, err := b.adoptOrRecreate(context.Background(), redisExporter(), newLifecycleID()); err == nil {
+		t.Errorf("expected an error when the exporter name is taken by an unmanaged container")
+	}
+}
+
+func TestCleanupExportersInspectsSharedTargetOnce(t *testing.T) {
+	exporters := []types.Container{}
+	for _, exporterType := range []string{"redis", "node", "cadvisor"} {
+		exporters = append(exporters, types.Container{
+			ID:     exporterType + "-exporter-id",
+			Names:  []string{getExporterName(exporterType, "/cache", "cache-id")},
+			Labels: map[string]string{LABEL_EXPORTED_ID: "cache-id", LABEL_EXPORTED_NAME: "/cache"},
+		})
+	}
+
+	inspections := map[string]int{}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(exporters, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			inspections[id]++
+			for _, e := range exporters {
+				if e.ID == id {
+					return exportedContainer(e.ID, e.Names[0], e.Labels), nil
+				}
+			}
+
+			// The exported container is gone
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli)
+	if err := b.CleanupExporters(context.Background(), false); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if inspections["cache-id"] != 1 {
+		t.Errorf("expected the shared exported container to be inspected once, got %d", inspections["cache-id"])
+	}
+	for _, e := range exporters {
+		if inspections[e.ID] != 1 {
+			t.Errorf("expected exporter %q to be inspected once, got %d", e.ID, inspections[e.ID])
+		}
+	}
+}
+
+func TestPullImageSurfacesStreamErrors(t *testing.T) {
+	testcases := map[string]struct {
+		stream      string
+		expectedErr string
+	}{
+		"successful pull": {
+			stream: `{"status":"Pulling from oliver006/redis_exporter","id":"latest"}
+{"status":"Downloading","progress":"[==>   ] 1MB/2MB","id":"abc"}
+{"status":"Status: Downloaded newer image for oliver006/redis_exporter:latest"}
+`,
+		},
+		"error in the middle of the stream": {
+			stream: `{"status":"Pulling from mycompany/exporter","id":"1.0"}
+{"errorDetail":{"message":"unauthorized: authentication required"},"error":"unauthorized: authentication required"}
+`,
+			expectedErr: "image pull failed: unauthorized: authentication required",
+		},
+		"error without details": {
+			stream:      `{"error":"manifest unknown"}`,
+			expectedErr: "image pull failed: manifest unknown",
+		},
+		"truncated stream": {
+			stream:      `{"status":"Downloading"`,
+			expectedErr: "unexpected EOF",
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			cli := &fakeClient{
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader(tc.stream)), nil
+				},
+			}
+
+			b := NewDockerBackend(cli)
+			err := b.pullImage(context.Background(), redisExporter())
+
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %+v", err)
+				}
+				return
+			}
+			if err == nil || pkgerrors.Cause(err).Error() != tc.expectedErr {
+				t.Errorf("expected error %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestDefaultScrapePort(t *testing.T) {
+	withPort := models.NewExporter("", "redis", "redis_exporter", nil, nil, models.TaskToExport{})
+	withPort.Port = "9121"
+	withoutPort := models.NewExporter("", "myapp", "myapp", nil, nil, models.TaskToExport{})
+
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+	b := NewDockerBackend(cli, WithDefaultScrapePort("8080"), WithFinder(stubFinder{
+		"/app": {withPort, withoutPort},
+	}))
+
+	exporters, err := b.resolveExporters(context.Background(), models.NewTaskToExport("app-id", "/app", "app:1", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	ports := map[string]string{}
+	for _, exporter := range exporters {
+		ports[exporter.PredefinedType] = exporter.Port
+	}
+	if expected := map[string]string{"myapp": "8080", "redis": "9121"}; !reflect.DeepEqual(ports, expected) {
+		t.Errorf("expected ports %v, got %v", expected, ports)
+	}
+}
+
+func TestValidatePort(t *testing.T) {
+	testcases := map[string]struct {
+		port  string
+		valid bool
+	}{
+		"valid port":     {port: "9100", valid: true},
+		"zero":           {port: "0", valid: false},
+		"too high":       {port: "65536", valid: false},
+		"not a number":   {port: "http", valid: false},
+		"with host part": {port: ":9100", valid: false},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			if err := ValidatePort(tc.port); (err == nil) != tc.valid {
+				t.Errorf("expected port %q validity to be %v, got error %v", tc.port, tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestCreateContainerStampsRulesVersion(t *testing.T) {
+	config, _ := createExporterContainer(t, redisExporter())
+	if _, ok := config.Labels[LABEL_RULES_VERSION]; ok {
+		t.Errorf("expected no label %s without rules version", LABEL_RULES_VERSION)
+	}
+
+	config, _ = createExporterContainer(t, redisExporter(), WithRulesVersion("abc123"))
+	if got := config.Labels[LABEL_RULES_VERSION]; got != "abc123" {
+		t.Errorf("expected label %s to be %q, got %q", LABEL_RULES_VERSION, "abc123", got)
+	}
+}
+
+func TestFindOutdatedExporters(t *testing.T) {
+	exporters := []types.Container{
+		{ID: "current", Labels: map[string]string{LABEL_EXPORTED_ID: "a", LABEL_RULES_VERSION: "v2"}},
+		{ID: "older", Labels: map[string]string{LABEL_EXPORTED_ID: "b", LABEL_RULES_VERSION: "v1"}},
+		{ID: "unversioned", Labels: map[string]string{LABEL_EXPORTED_ID: "c"}},
+	}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(exporters, options.Filters), nil
+		},
+	}
+
+	testcases := map[string]struct {
+		version  string
+		expected []string
+	}{
+		"no rules version": {
+			version:  "",
+			expected: []string{},
+		},
+		"current rules version": {
+			version:  "v2",
+			expected: []string{"older", "unversioned"},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			b := NewDockerBackend(cli, WithRulesVersion(tc.version))
+			outdated, err := b.FindOutdatedExporters(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			ids := make([]string, 0, len(outdated))
+			for _, exporter := range outdated {
+				ids = append(ids, exporter.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.expected) {
+				t.Errorf("expected outdated exporters %v, got %v", tc.expected, ids)
+			}
+		})
+	}
+}
+
+func TestFindMissingExportersWithZeroOrMultipleNames(t *testing.T) {
+	containers := []types.Container{
+		{ID: "nameless-id"},
+		{ID: "db-id", Names: []string{"/web/db", "/db", "/db-alias"}},
+		{
+			ID:     "exporter-id",
+			Names:  []string{"/exporter.redis.db-alias"},
+			Labels: map[string]string{LABEL_EXPORTED_ID: "db-id", LABEL_EXPORTED_NAME: "/db"},
+		},
+		{ID: "cache-id", Names: []string{"/cache"}},
+	}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return containers, nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			switch id {
+			case "nameless-id":
+				return exportedContainer(id, "", nil), nil
+			case "db-id":
+				return exportedContainer(id, "/db", nil), nil
+			case "cache-id":
+				return exportedContainer(id, "/cache", nil), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+
+	redis := stubExporter("redis", "redis_exporter")
+	b := NewDockerBackend(cli, WithFinder(stubFinder{"/db": {redis}, "/cache": {redis}}))
+
+	missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(missing) != 1 || missing[0].Exported.ID != "cache-id" {
+		t.Errorf("expected only the exporter of cache to be missing, got %+v", missing)
+	}
+}
+
+func TestFindMissingExportersIsSortedByName(t *testing.T) {
+	containers := []types.Container{
+		{ID: "web-id", Names: []string{"/web"}},
+		{ID: "cache-id", Names: []string{"/cache"}},
+		{ID: "app-id", Names: []string{"/app"}},
+	}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(containers, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, c := range containers {
+				if c.ID == id {
+					return exportedContainer(c.ID, c.Names[0], c.Labels), nil
+				}
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+
+	node := stubExporter("node", "node_exporter")
+	b := NewDockerBackend(cli, WithFinder(stubFinder{
+		"/web":   {stubExporter("nginx", "nginx_exporter"), node},
+		"/cache": {stubExporter("redis", "redis_exporter"), node},
+		"/app":   {stubExporter("php", "php_exporter")},
+	}))
+
+	expected := []string{
+		getExporterName("nginx", "/web", "web-id"),
+		getExporterName("node", "/cache", "cache-id"),
+		getExporterName("node", "/web", "web-id"),
+		getExporterName("php", "/app", "app-id"),
+		getExporterName("redis", "/cache", "cache-id"),
+	}
+
+	// Map iteration order changes between calls, the output must not
+	for i := 0; i < 5; i++ {
+		missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		names := make([]string, 0, len(missing))
+		for _, exporter := range missing {
+			names = append(names, exporter.Name)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("expected missing exporters %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestCreateContainerPropagatesLabels(t *testing.T) {
+	exporter := models.NewExporter("/exporter.redis.redis", "redis", "redis_exporter", nil, nil, models.NewTaskToExport("redis-id", "/redis", "redis:5", map[string]string{
+		"app":                  "cache",
+		"application":          "cache",
+		"prometheus.job":       "redis",
+		"prometheus.team":      "storage",
+		"com.example.owner":    "storage",
+		"autoexporter.exclude": "nope",
+	}))
+
+	config, _ := createExporterContainer(t, exporter, WithPropagatedLabels([]string{"app", "prometheus.*", "autoexporter.*"}))
+
+	for _, label := range []string{"app", "prometheus.job", "prometheus.team"} {
+		if got := config.Labels[label]; got != exporter.Exported.Labels[label] {
+			t.Errorf("expected label %s to be %q, got %q", label, exporter.Exported.Labels[label], got)
+		}
+	}
+	for _, label := range []string{"application", "com.example.owner", "autoexporter.exclude"} {
+		if _, ok := config.Labels[label]; ok {
+			t.Errorf("expected label %s not to be propagated", label)
+		}
+	}
+	if got := config.Labels[LABEL_EXPORTED_ID]; got != "redis-id" {
+		t.Errorf("expected label %s to be preserved, got %q", LABEL_EXPORTED_ID, got)
+	}
+}
+
+func TestCreateContainerLabelsScrapePort(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Port = "9121"
+
+	config, hostConfig := createExporterContainer(t, exporter)
+	if got := config.Labels[LABEL_SCRAPE_PORT]; got != "9121" {
+		t.Errorf("expected label %s to be %q, got %q", LABEL_SCRAPE_PORT, "9121", got)
+	}
+	// The exporter joins the netns of its exported container, so Docker would
+	// reject any exposed or published port
+	if len(config.ExposedPorts) != 0 || len(hostConfig.PortBindings) != 0 {
+		t.Errorf("expected no exposed nor published port, got %v and %v", config.ExposedPorts, hostConfig.PortBindings)
+	}
+}
+
+// recordingHook records the entries logged through a logger
+type recordingHook struct {
+	mutex   sync.Mutex
+	entries []*logrus.Entry
+}
+
+func (h *recordingHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recordingHook) Fire(entry *logrus.Entry) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+func TestLifecycleIDCorrelatesStartAndStopLogs(t *testing.T) {
+	var labels map[string]string
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if labels != nil && id == "exporter-id" {
+				return exportedContainer(id, "/exporter.redis.redis", labels), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			labels = config.Labels
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return []types.Container{{ID: "exporter-id", Labels: labels}}, nil
+		},
+		networkDisconnectFn: func(ctx context.Context, networkID, containerID string, force bool) error {
+			return nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+
+	hook := &recordingHook{}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Level = logrus.DebugLevel
+	logger.AddHook(hook)
+	ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+
+	b := NewDockerBackend(cli)
+	exporter := redisExporter()
+	exporter.PromNetworks = []string{"prometheus"}
+
+	b.RunExporter(ctx, exporter)
+	started := len(hook.entries)
+	if started == 0 {
+		t.Fatal("expected the startup to be logged")
+	}
+
+	if err := b.CleanupExporter(ctx, "exporter-id", true); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(hook.entries) == started {
+		t.Fatal("expected the cleanup to be logged")
+	}
+
+	id := labels[LABEL_LIFECYCLE_ID]
+	if id == "" {
+		t.Fatalf("expected label %s to be set", LABEL_LIFECYCLE_ID)
+	}
+	for i, entry := range hook.entries {
+		if got := entry.Data["lifecycle.id"]; got != id {
+			t.Errorf("expected entry %d (%q) to have lifecycle ID %q, got %v", i, entry.Message, id, got)
+		}
+	}
+}
+
+func TestConnectToNetwork(t *testing.T) {
+	testcases := map[string]struct {
+		attached     map[string]types.EndpointResource
+		inspectErr   error
+		connectErr   error
+		expectErr    bool
+		expectCalled bool
+	}{
+		"already attached": {
+			attached: map[string]types.EndpointResource{"0123456789ab": {Name: "redis"}},
+		},
+		"not attached": {
+			attached:     map[string]types.EndpointResource{"nginx-id": {Name: "nginx"}},
+			expectCalled: true,
+		},
+		"network inspection fails": {
+			inspectErr: errdefs.NotFound(errors.New("network prometheus not found")),
+			expectErr:  true,
+		},
+		"connection fails with an unrelated endpoint error": {
+			attached:     map[string]types.EndpointResource{},
+			connectErr:   errors.New("failed to create endpoint with name redis: address already in use"),
+			expectErr:    true,
+			expectCalled: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			called := false
+			cli := &fakeClient{
+				networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+					return types.NetworkResource{ID: networkID, Containers: tc.attached}, tc.inspectErr
+				},
+				networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+					called = true
+					return tc.connectErr
+				},
+			}
+
+			exporter := models.NewExporter("/exporter.redis.redis", "redis", "redis_exporter", nil, nil, models.NewTaskToExport("redis-id", "/redis", "redis:5", nil))
+			exporter.PromNetworks = []string{"prometheus"}
+
+			b := NewDockerBackend(cli)
+			err := b.connectToNetwork(context.Background(), exporter, "exporter-id")
+			if tc.expectErr && err == nil {
+				t.Error("expected an error")
+			} else if !tc.expectErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+			if called != tc.expectCalled {
+				t.Errorf("expected NetworkConnect to be called: %t, got %t", tc.expectCalled, called)
+			}
+		})
+	}
+}
+
+func TestExportersWithoutPromNetwork(t *testing.T) {
+	var labels map[string]string
+	started := false
+	cli := &fakeClient{
+		containerListFn: noContainers,
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if labels != nil && id == "exporter-id" {
+				return exportedContainer(id, "/exporter.redis.redis", labels), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			labels = config.Labels
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+			t.Errorf("unexpected inspection of network %q", networkID)
+			return types.NetworkResource{}, nil
+		},
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			t.Errorf("unexpected connection of %q to %q", containerID, networkID)
+			return nil
+		},
+		networkDisconnectFn: func(ctx context.Context, networkID, containerID string, force bool) error {
+			t.Errorf("unexpected disconnection of %q from %q", containerID, networkID)
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			started = true
+			return nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	b.RunExporter(context.Background(), redisExporter())
+
+	if !started {
+		t.Fatal("expected the exporter to be started")
+	}
+	if _, ok := labels[LABEL_PROM_NETWORK]; ok {
+		t.Errorf("expected no label %s", LABEL_PROM_NETWORK)
+	}
+
+	if err := b.CleanupExporter(context.Background(), "exporter-id", true); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestConnectToMultipleNetworks(t *testing.T) {
+	testcases := map[string]struct {
+		failOn               string
+		expectErr            bool
+		expectedConnected    []string
+		expectedDisconnected []string
+	}{
+		"connected to all networks": {
+			expectedConnected: []string{"prom-a", "prom-b"},
+		},
+		"partial failure tears down previous connections": {
+			failOn:               "prom-b",
+			expectErr:            true,
+			expectedConnected:    []string{"prom-a"},
+			expectedDisconnected: []string{"prom-a"},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			var connected, disconnected []string
+			cli := &fakeClient{
+				networkInspectFn: emptyNetwork,
+				networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+					if networkID == tc.failOn {
+						return errors.New("network not found")
+					}
+					connected = append(connected, networkID)
+					return nil
+				},
+				networkDisconnectFn: func(ctx context.Context, networkID, containerID string, force bool) error {
+					disconnected = append(disconnected, networkID)
+					return nil
+				},
+			}
+
+			exporter := redisExporter()
+			exporter.PromNetworks = []string{"prom-a", "prom-b"}
+
+			b := NewDockerBackend(cli)
+			err := b.connectToNetwork(context.Background(), exporter, "exporter-id")
+			if tc.expectErr && err == nil {
+				t.Error("expected an error")
+			} else if !tc.expectErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(connected, tc.expectedConnected) {
+				t.Errorf("expected connections to %v, got %v", tc.expectedConnected, connected)
+			}
+			if !reflect.DeepEqual(disconnected, tc.expectedDisconnected) {
+				t.Errorf("expected disconnections from %v, got %v", tc.expectedDisconnected, disconnected)
+			}
+		})
+	}
+}
+
+func TestCleanupDisconnectsFromEveryNetwork(t *testing.T) {
+	labels := map[string]string{
+		LABEL_EXPORTED_ID:       "redis-id",
+		LABEL_SCRAPE_TARGET:     "/redis",
+		LABEL_PROM_NETWORK:      "prom-a,prom-b",
+		LABEL_ATTACHED_NETWORKS: "prom-a,prom-b",
+	}
+	disconnected := []string{}
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id == "exporter-id" {
+				return exportedContainer(id, "/exporter.redis.redis", labels), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return []types.Container{{ID: "exporter-id", Labels: labels}}, nil
+		},
+		networkInspectFn: attachedNetwork("/redis"),
+		networkDisconnectFn: func(ctx context.Context, networkID, containerID string, force bool) error {
+			disconnected = append(disconnected, networkID)
+			return nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if err := b.CleanupExporter(context.Background(), "exporter-id", false); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if expected := []string{"prom-a", "prom-b"}; !reflect.DeepEqual(disconnected, expected) {
+		t.Errorf("expected disconnections from %v, got %v", expected, disconnected)
+	}
+}
+
+func TestRunExporterWaitsForExportedContainerToBeHealthy(t *testing.T) {
+	testcases := map[string]struct {
+		labels          map[string]string
+		health          []string
+		timeout         time.Duration
+		expectedInspect int
+	}{
+		"not opted in": {
+			labels:          map[string]string{},
+			health:          []string{types.Unhealthy},
+			timeout:         time.Minute,
+			expectedInspect: 0,
+		},
+		"unhealthy then healthy": {
+			labels:          map[string]string{LABEL_WAIT_HEALTHY: "true"},
+			health:          []string{types.Unhealthy, types.Healthy},
+			timeout:         time.Minute,
+			expectedInspect: 2,
+		},
+		"without healthcheck": {
+			labels:          map[string]string{LABEL_WAIT_HEALTHY: "true"},
+			health:          []string{""},
+			timeout:         time.Minute,
+			expectedInspect: 1,
+		},
+		"never healthy": {
+			labels:          map[string]string{LABEL_WAIT_HEALTHY: "true"},
+			health:          []string{types.Starting},
+			timeout:         10 * time.Millisecond,
+			expectedInspect: 1,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			inspected := 0
+			started := false
+			cli := &fakeClient{
+				containerListFn: noContainers,
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if id != "redis-id" {
+						return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+					}
+					if started {
+						t.Error("unexpected inspection after the exporter started")
+					}
+
+					// The last status is kept once all transitions happened
+					status := tc.health[len(tc.health)-1]
+					if inspected < len(tc.health) {
+						status = tc.health[inspected]
+					}
+					inspected++
+
+					redis := exportedContainer(id, "/redis", tc.labels)
+					if status != "" {
+						redis.State.Health = &types.Health{Status: status}
+					}
+					return redis, nil
+				},
+				imageInspectFn: imageNotFound,
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+				containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+					return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+				},
+				containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+					started = true
+					return nil
+				},
+			}
+
+			exporter := models.NewExporter("/exporter.redis.redis", "redis", "redis_exporter", nil, nil, models.NewTaskToExport("redis-id", "/redis", "redis:5", tc.labels))
+			exporter.Port = "9121"
+			b := NewDockerBackend(cli, WithWaitHealthyTimeout(tc.timeout))
+			b.RunExporter(context.Background(), exporter)
+
+			if !started {
+				t.Error("expected the exporter to be started")
+			}
+			if inspected != tc.expectedInspect {
+				t.Errorf("expected the exported container health to be checked %d times, got %d", tc.expectedInspect, inspected)
+			}
+		})
+	}
+}
+
+func TestCleanupExporterByExportedID(t *testing.T) {
+	exporters := []types.Container{
+		{ID: "redis-exporter-id", Labels: map[string]string{LABEL_EXPORTED_ID: "redis-id"}},
+		{ID: "app-exporter-id", Labels: map[string]string{LABEL_EXPORTED_ID: "app-id"}},
+		{ID: "app-envoy-exporter-id", Labels: map[string]string{LABEL_EXPORTED_ID: "app-id"}},
+	}
+
+	testcases := map[string]struct {
+		exportedID string
+		expected   []string
+		notFound   bool
+	}{
+		"found":            {exportedID: "redis-id", expected: []string{"redis-exporter-id"}},
+		"not found":        {exportedID: "nginx-id", expected: []string{}, notFound: true},
+		"multiple matches": {exportedID: "app-id", expected: []string{"app-exporter-id", "app-envoy-exporter-id"}},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			removed := []string{}
+			cli := &fakeClient{
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					return filterContainers(exporters, options.Filters), nil
+				},
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					for _, exporter := range exporters {
+						if exporter.ID == id {
+							return exportedContainer(id, "/"+id, exporter.Labels), nil
+						}
+					}
+					// The exported container is still running, cleanup has
+					// to be forced
+					return exportedContainer(id, "/exported", nil), nil
+				},
+				containerStopFn: func(ctx context.Context, id string) error {
+					return nil
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed = append(removed, id)
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli)
+			err := b.CleanupExporterByExportedID(context.Background(), tc.exportedID, true)
+			if tc.notFound && !IsErrExporterNotFound(err) {
+				t.Errorf("expected an exporter not found error, got %v", err)
+			} else if !tc.notFound && err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(removed, tc.expected) {
+				t.Errorf("expected exporters %v to be removed, got %v", tc.expected, removed)
+			}
+		})
+	}
+}
+
+func TestCleanupExporterByExportedIDReturnsEveryFailure(t *testing.T) {
+	exporters := []types.Container{
+		{ID: "app-exporter-id", Names: []string{"/exporter.myapp.app"}, Labels: map[string]string{LABEL_EXPORTED_ID: "app-id"}},
+		{ID: "app-envoy-exporter-id", Names: []string{"/exporter.envoy.app"}, Labels: map[string]string{LABEL_EXPORTED_ID: "app-id"}},
+	}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(exporters, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, exporter := range exporters {
+				if exporter.ID == id {
+					return exportedContainer(id, exporter.Names[0], exporter.Labels), nil
+				}
+			}
+			return exportedContainer(id, "/app", nil), nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return errors.New("device or resource busy")
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	err := b.CleanupExporterByExportedID(context.Background(), "app-id", true)
+
+	cleanupErr, ok := pkgerrors.Cause(err).(errCleanupFailed)
+	if !ok {
+		t.Fatalf("expected a cleanup failed error, got %v", err)
+	}
+	if len(cleanupErr.failures) != len(exporters) {
+		t.Errorf("expected %d failures, got %d: %v", len(exporters), len(cleanupErr.failures), err)
+	}
+}
+
+func TestStopExporterNotRunning(t *testing.T) {
+	testcases := map[string]struct {
+		stopErr       error
+		removeErr     error
+		expectErr     bool
+		expectRemoved bool
+	}{
+		"already stopped": {
+			stopErr:       errors.New("Error response from daemon: Container exporter-id is not running"),
+			expectRemoved: true,
+		},
+		"already removed": {
+			stopErr:   errdefs.NotFound(errors.New("no such container")),
+			removeErr: errdefs.NotFound(errors.New("no such container")),
+		},
+		"stop failure": {
+			stopErr:   errors.New("daemon unavailable"),
+			expectErr: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			removed := false
+			cli := &fakeClient{
+				containerStopFn: func(ctx context.Context, id string) error {
+					return tc.stopErr
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed = tc.removeErr == nil
+					return tc.removeErr
+				},
+			}
+
+			b := NewDockerBackend(cli)
+			err := b.StopExporter(context.Background(), exportedContainer("exporter-id", "/exporter.redis.redis", nil))
+			if tc.expectErr && err == nil {
+				t.Error("expected an error")
+			} else if !tc.expectErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+			if removed != tc.expectRemoved {
+				t.Errorf("expected exporter removal to be %t, got %t", tc.expectRemoved, removed)
+			}
+		})
+	}
+}
+
+func TestCleanupExporterNotFound(t *testing.T) {
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	err := b.CleanupExporter(context.Background(), "exporter-id", true)
+	if !IsErrExporterNotFound(err) {
+		t.Fatalf("expected an exporter not found error, got %v", err)
+	}
+	if IsErrExporterNotFound(errors.New(`Exporter "exporter-id" not found.`)) {
+		t.Error("expected untyped errors not to be detected")
+	}
+	if !IsErrExporterNotFound(pkgerrors.WithStack(err)) {
+		t.Error("expected wrapped errors to be detected")
+	}
+}
+
+func TestCleanupExportersReportsAllFailures(t *testing.T) {
+	exporters := []types.Container{
+		{ID: "stale-exporter-id", Names: []string{"/exporter.redis.stale"}, Labels: map[string]string{LABEL_EXPORTED_ID: "stale-id"}},
+		{ID: "running-exporter-id", Names: []string{"/exporter.redis.running"}, Labels: map[string]string{LABEL_EXPORTED_ID: "running-id"}},
+		{ID: "broken-exporter-id", Names: []string{"/exporter.redis.broken"}, Labels: map[string]string{LABEL_EXPORTED_ID: "broken-id"}},
+		{ID: "other-stale-exporter-id", Names: []string{"/exporter.redis.other"}, Labels: map[string]string{LABEL_EXPORTED_ID: "other-id"}},
+	}
+
+	attempted := []string{}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(exporters, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, c := range exporters {
+				if c.ID == id {
+					return exportedContainer(c.ID, c.Names[0], c.Labels), nil
+				}
+			}
+			if id == "running-id" {
+				return exportedContainer(id, "/running", nil), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			attempted = append(attempted, id)
+			if id == "broken-exporter-id" {
+				return errors.New("cannot kill container: permission denied")
+			}
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	err := b.CleanupExporters(context.Background(), false)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := []string{"stale-exporter-id", "broken-exporter-id", "other-stale-exporter-id"}
+	if !reflect.DeepEqual(attempted, expected) {
+		t.Errorf("expected exporters %v to be stopped, got %v", expected, attempted)
+	}
+
+	for _, name := range []string{"/exporter.redis.running", "/exporter.redis.broken", "permission denied", "still running"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected error to mention %q, got %q", name, err.Error())
+		}
+	}
+	if strings.Contains(err.Error(), "/exporter.redis.stale") {
+		t.Errorf("expected successful cleanups not to be reported, got %q", err.Error())
+	}
+	if IsErrExportedStillRunning(err) {
+		t.Error("expected hard failures not to be reported as still running exporters only")
+	}
+}
+
+func TestListExporters(t *testing.T) {
+	containers := []types.Container{
+		{
+			Names: []string{"/exporter.redis.redis"},
+			Image: "oliver006/redis_exporter",
+			State: "running",
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:   "redis-id",
+				LABEL_EXPORTED_NAME: "/redis",
+				LABEL_EXPORTER_TYPE: "redis",
+				LABEL_EXPORTER_PORT: "9121",
+				LABEL_SCRAPE_TARGET: "/redis-proxy",
+				LABEL_PROM_NETWORK:  "prom-a,prom-b",
+			},
+		},
+		{
+			// Created by an older version, without most of the labels
+			Names:  []string{"/exporter.nginx.nginx"},
+			Image:  "nginx/nginx-prometheus-exporter",
+			State:  "restarting",
+			Labels: map[string]string{LABEL_EXPORTED_ID: "nginx-id"},
+		},
+		{
+			Names:  []string{"/web"},
+			Labels: map[string]string{},
+		},
+	}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			if !options.All {
+				t.Error("expected exporters not running to be listed too")
+			}
+			return filterContainers(containers, options.Filters), nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	exporters, err := b.ListExporters(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(exporters) != 2 {
+		t.Fatalf("expected 2 exporters, got %+v", exporters)
+	}
+
+	redis := exporters[0]
+	if redis.Name != "exporter.redis.redis" || redis.PredefinedType != "redis" || redis.Image != "oliver006/redis_exporter" || redis.Status != "running" {
+		t.Errorf("unexpected redis exporter %+v", redis)
+	}
+	if redis.Exported.ID != "redis-id" || redis.Exported.Name != "/redis" {
+		t.Errorf("unexpected exported task %+v", redis.Exported)
+	}
+	if redis.Port != "9121" || redis.ScrapeTarget != "/redis-proxy" || !reflect.DeepEqual(redis.PromNetworks, []string{"prom-a", "prom-b"}) {
+		t.Errorf("unexpected scrape settings %+v", redis)
+	}
+
+	nginx := exporters[1]
+	if nginx.Name != "exporter.nginx.nginx" || nginx.Exported.ID != "nginx-id" || nginx.Status != "restarting" {
+		t.Errorf("unexpected nginx exporter %+v", nginx)
+	}
+	if nginx.PredefinedType != "" || nginx.Exported.Name != "" || nginx.Port != "" || nginx.PromNetworks != nil {
+		t.Errorf("expected missing labels to leave fields empty, got %+v", nginx)
+	}
+}
+
+func TestCreateContainerAddsScrapeAuthArgs(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Cmd = []string{"-redis.addr=redis://localhost:6379"}
+	exporter.ScrapeAuth = models.ScrapeAuth{Type: models.ScrapeAuthBasic, Password: "s3cr3t"}
+
+	config, _ := createExporterContainer(t, exporter)
+
+	expected := []string{"-redis.addr=redis://localhost:6379", "-redis.password=s3cr3t"}
+	if !reflect.DeepEqual([]string(config.Cmd), expected) {
+		t.Errorf("expected cmd %v, got %v", expected, config.Cmd)
+	}
+	if len(exporter.Cmd) != 1 {
+		t.Errorf("expected the exporter cmd not to be modified, got %v", exporter.Cmd)
+	}
+}
+
+func TestCreateContainerCopiesFiles(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Files = map[string]string{"/etc/blackbox_exporter/autoexporter.yml": "modules: {}\n"}
+	exporter.MetricsPath = "/probe"
+	exporter.ScrapeParams = map[string]string{"module": "tcp_connect"}
+
+	var config *container.Config
+	copied := map[string]string{}
+	cli := &fakeClient{
+		containerCreateFn: func(c *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			config = c
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		copyToContainerFn: func(ctx context.Context, cid, path string, content io.Reader, options types.CopyToContainerOptions) error {
+			if cid != "exporter-id" || path != "/" {
+				t.Errorf("unexpected copy to %s:%s", cid, path)
+			}
+
+			tr := tar.NewReader(content)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("unexpected error: %+v", err)
+				}
+
+				file, _ := ioutil.ReadAll(tr)
+				copied[header.Name] = string(file)
+			}
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if _, err := b.createContainer(context.Background(), exporter, newLifecycleID()); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if expected := map[string]string{"etc/blackbox_exporter/autoexporter.yml": "modules: {}\n"}; !reflect.DeepEqual(copied, expected) {
+		t.Errorf("expected files %v to be copied, got %v", expected, copied)
+	}
+	if config.Labels[LABEL_METRICS_PATH] != "/probe" || config.Labels[LABEL_SCRAPE_PARAM_PREFIX+"module"] != "tcp_connect" {
+		t.Errorf("expected the metrics path and scrape params to be labeled, got %v", config.Labels)
+	}
+}
+
+func TestCreateContainerRemovesContainerWhenCopyFails(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Files = map[string]string{"/etc/redis_exporter/config.yml": "{}\n"}
+
+	removed := []string{}
+	cli := &fakeClient{
+		containerCreateFn: func(c *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		copyToContainerFn: func(ctx context.Context, cid, path string, content io.Reader, options types.CopyToContainerOptions) error {
+			return errors.New("no space left on device")
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			removed = append(removed, id)
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if _, err := b.createContainer(context.Background(), exporter, newLifecycleID()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if expected := []string{"exporter-id"}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected %v to be removed, got %v", expected, removed)
+	}
+}
+
+func TestCreateContainerNetworkModes(t *testing.T) {
+	testcases := map[string]struct {
+		networkMode         string
+		promNetworks        []string
+		expectedNetworkMode container.NetworkMode
+		expectedLabel       string
+		expectedErr         bool
+	}{
+		"shared netns": {
+			networkMode:         models.NetworkModeSharedNetns,
+			promNetworks:        []string{"prometheus"},
+			expectedNetworkMode: "container:redis-id",
+		},
+		"own netns": {
+			networkMode:         models.NetworkModeNetwork,
+			promNetworks:        []string{"prometheus", "monitoring"},
+			expectedNetworkMode: "prometheus",
+			expectedLabel:       models.NetworkModeNetwork,
+		},
+		"own netns without prometheus network": {
+			networkMode: models.NetworkModeNetwork,
+			expectedErr: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exporter := redisExporter()
+			exporter.NetworkMode = tc.networkMode
+			exporter.PromNetworks = tc.promNetworks
+
+			var config *container.Config
+			var hostConfig *container.HostConfig
+			cli := &fakeClient{
+				containerCreateFn: func(c *container.Config, hc *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+					config, hostConfig = c, hc
+					return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+				},
+				networkInspectFn: emptyNetwork,
+			}
+
+			b := NewDockerBackend(cli)
+			_, err := b.createContainer(context.Background(), exporter, newLifecycleID())
+			if tc.expectedErr {
+				if err == nil || config != nil {
+					t.Fatalf("expected an error before creating the container, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if hostConfig.NetworkMode != tc.expectedNetworkMode {
+				t.Errorf("expected network mode %q, got %q", tc.expectedNetworkMode, hostConfig.NetworkMode)
+			}
+			if config.Labels[LABEL_NETWORK_MODE] != tc.expectedLabel {
+				t.Errorf("expected network mode label %q, got %q", tc.expectedLabel, config.Labels[LABEL_NETWORK_MODE])
+			}
+		})
+	}
+}
+
+func TestCreateContainerRecordsAttachedNetworks(t *testing.T) {
+	exporter := redisExporter()
+	exporter.PromNetworks = []string{"prom-a", "prom-b"}
+
+	var config *container.Config
+	cli := &fakeClient{
+		containerCreateFn: func(c *container.Config, hc *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			config = c
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+			if networkID == "prom-a" {
+				return attachedNetwork(exporter.ScrapeTargetName())(ctx, networkID, options)
+			}
+			return emptyNetwork(ctx, networkID, options)
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if _, err := b.createContainer(context.Background(), exporter, newLifecycleID()); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if config.Labels[LABEL_PROM_NETWORK] != "prom-a,prom-b" {
+		t.Errorf("expected label %s to be %q, got %q", LABEL_PROM_NETWORK, "prom-a,prom-b", config.Labels[LABEL_PROM_NETWORK])
+	}
+	if config.Labels[LABEL_ATTACHED_NETWORKS] != "prom-b" {
+		t.Errorf("expected label %s to be %q, got %q", LABEL_ATTACHED_NETWORKS, "prom-b", config.Labels[LABEL_ATTACHED_NETWORKS])
+	}
+}
+
+func TestConnectExporterRunningInItsOwnNetns(t *testing.T) {
+	exporter := redisExporter()
+	exporter.NetworkMode = models.NetworkModeNetwork
+	exporter.PromNetworks = []string{"prometheus", "monitoring"}
+
+	connected := []string{}
+	cli := &fakeClient{
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			connected = append(connected, containerID+"@"+networkID)
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if err := b.connectToNetwork(context.Background(), exporter, "exporter-id"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	// The exported container must be reachable by name from the exporter,
+	// which joined the first network on creation
+	expected := []string{"/redis@prometheus", "/redis@monitoring", exporter.Name + "@monitoring"}
+	if !reflect.DeepEqual(connected, expected) {
+		t.Errorf("expected connections %v, got %v", expected, connected)
+	}
+}
+
+func TestRunExporterValidatesExporters(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Port = ""
+
+	// Any Docker call would panic on the fake client
+	b := NewDockerBackend(&fakeClient{})
+	if err := b.startExporter(context.Background(), exporter); !models.IsErrInvalidExporter(err) {
+		t.Errorf("expected an invalid exporter error, got %v", err)
+	}
+}
+
+func TestCreateContainerEntrypoint(t *testing.T) {
+	exporter := redisExporter()
+
+	config, _ := createExporterContainer(t, exporter)
+	if config.Entrypoint != nil {
+		t.Errorf("expected the image entrypoint to be kept, got %v", config.Entrypoint)
+	}
+
+	exporter.Entrypoint = []string{"/wrapper.sh", "--"}
+	config, _ = createExporterContainer(t, exporter)
+	if !reflect.DeepEqual([]string(config.Entrypoint), exporter.Entrypoint) {
+		t.Errorf("expected entrypoint %v, got %v", exporter.Entrypoint, config.Entrypoint)
+	}
+}
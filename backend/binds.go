@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Prefix of the labels bind mounting a host path into the exporters of the
+// exported container, e.g. autoexporter.bind.config=/etc/snmp:/etc/snmp:ro.
+// Only sources under the allowed paths can be mounted this way.
+const LABEL_BIND_PREFIX = "autoexporter.bind."
+
+// bindsFromLabels returns the binds requested by the bind labels of the
+// exported container, sorted by label name. An error is returned when a
+// bind is malformed or its source is not allowed.
+func bindsFromLabels(labels map[string]string, allowed []string) ([]string, error) {
+	binds := []string{}
+
+	for _, name := range labelsWithPrefix(labels, LABEL_BIND_PREFIX) {
+		bind := labels[LABEL_BIND_PREFIX+name]
+
+		parts := strings.Split(bind, ":")
+		if len(parts) < 2 || len(parts) > 3 || !filepath.IsAbs(parts[0]) || !filepath.IsAbs(parts[1]) {
+			return nil, errors.Errorf("invalid bind %q in label %s, should be /source:/target[:ro|rw]", bind, LABEL_BIND_PREFIX+name)
+		}
+		if len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw" {
+			return nil, errors.Errorf("invalid bind mode %q in label %s, should be ro or rw", parts[2], LABEL_BIND_PREFIX+name)
+		}
+		if !isBindAllowed(parts[0], allowed) {
+			return nil, errors.Errorf("bind source %q in label %s is not allowed", parts[0], LABEL_BIND_PREFIX+name)
+		}
+
+		binds = append(binds, bind)
+	}
+
+	return binds, nil
+}
+
+// isBindAllowed checks if the given source path is one of the allowed paths,
+// or is nested under one of them
+func isBindAllowed(source string, allowed []string) bool {
+	source = filepath.Clean(source)
+
+	for _, path := range allowed {
+		path = filepath.Clean(path)
+		if source == path || strings.HasPrefix(source, strings.TrimSuffix(path, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
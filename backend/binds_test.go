@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/pkg/errors"
+)
+
+func TestBindsFromLabels(t *testing.T) {
+	allowed := []string{"/etc/snmp", "/var/run/app/"}
+
+	testcases := map[string]struct {
+		labels        map[string]string
+		expectedBinds []string
+		expectedErr   bool
+	}{
+		"no bind label": {
+			labels:        map[string]string{"app": "snmp"},
+			expectedBinds: []string{},
+		},
+		"allowed sources": {
+			labels: map[string]string{
+				LABEL_BIND_PREFIX + "socket": "/var/run/app/app.sock:/app.sock",
+				LABEL_BIND_PREFIX + "config": "/etc/snmp:/etc/snmp:ro",
+			},
+			expectedBinds: []string{"/etc/snmp:/etc/snmp:ro", "/var/run/app/app.sock:/app.sock"},
+		},
+		"source out of the allowed paths": {
+			labels:      map[string]string{LABEL_BIND_PREFIX + "config": "/etc:/etc:ro"},
+			expectedErr: true,
+		},
+		"source sharing a prefix with an allowed path": {
+			labels:      map[string]string{LABEL_BIND_PREFIX + "config": "/etc/snmp-secrets:/etc/snmp:ro"},
+			expectedErr: true,
+		},
+		"source escaping the allowed path": {
+			labels:      map[string]string{LABEL_BIND_PREFIX + "config": "/etc/snmp/../shadow:/shadow:ro"},
+			expectedErr: true,
+		},
+		"relative source": {
+			labels:      map[string]string{LABEL_BIND_PREFIX + "config": "etc/snmp:/etc/snmp"},
+			expectedErr: true,
+		},
+		"missing target": {
+			labels:      map[string]string{LABEL_BIND_PREFIX + "config": "/etc/snmp"},
+			expectedErr: true,
+		},
+		"invalid mode": {
+			labels:      map[string]string{LABEL_BIND_PREFIX + "config": "/etc/snmp:/etc/snmp:z"},
+			expectedErr: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			binds, err := bindsFromLabels(tc.labels, allowed)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error, got binds %v", binds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(binds, tc.expectedBinds) {
+				t.Errorf("expected binds %v, got %v", tc.expectedBinds, binds)
+			}
+		})
+	}
+
+	if _, err := bindsFromLabels(map[string]string{LABEL_BIND_PREFIX + "config": "/etc/snmp:/etc/snmp"}, nil); err == nil {
+		t.Error("expected bind labels to be rejected without allowed paths")
+	}
+}
+
+func TestCreateContainerBinds(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Binds = []string{"/etc/redis:/etc/redis:ro"}
+	exporter.Exported.Labels = map[string]string{LABEL_BIND_PREFIX + "socket": "/var/run/redis/redis.sock:/redis.sock"}
+
+	_, hostConfig := createExporterContainer(t, exporter, WithAllowedBindSources([]string{"/var/run/redis"}))
+
+	expected := []string{"/etc/redis:/etc/redis:ro", "/var/run/redis/redis.sock:/redis.sock"}
+	if !reflect.DeepEqual(hostConfig.Binds, expected) {
+		t.Errorf("expected binds %v, got %v", expected, hostConfig.Binds)
+	}
+}
+
+func TestCreateContainerRejectsDisallowedBinds(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Exported.Labels = map[string]string{LABEL_BIND_PREFIX + "root": "/:/host"}
+
+	cli := &fakeClient{
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			t.Error("unexpected container creation")
+			return container.ContainerCreateCreatedBody{}, errors.New("unexpected call")
+		},
+	}
+
+	b := NewDockerBackend(cli, WithAllowedBindSources([]string{"/var/run/redis"}))
+	if _, err := b.createContainer(context.Background(), exporter, newLifecycleID()); err == nil {
+		t.Error("expected the disallowed bind to be rejected")
+	}
+}
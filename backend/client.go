@@ -0,0 +1,19 @@
+package backend
+
+import (
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// NewClient returns a Docker client configured from the environment
+// (DOCKER_HOST, DOCKER_API_VERSION, etc.). Unless DOCKER_API_VERSION pins a
+// version, the API version is negotiated with the daemon on the first
+// request, such that older daemons are supported.
+func NewClient() (*client.Client, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return cli, nil
+}
@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewClientNegotiatesAPIVersion(t *testing.T) {
+	testcases := map[string]struct {
+		pinnedVersion   string
+		expectedVersion string
+	}{
+		"negotiated with the daemon": {
+			expectedVersion: "1.30",
+		},
+		"pinned through the environment": {
+			pinnedVersion:   "1.25",
+			expectedVersion: "1.25",
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			paths := []string{}
+			daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				// An old daemon, only supporting API versions up to 1.30
+				w.Header().Set("API-Version", "1.30")
+				if strings.HasSuffix(r.URL.Path, "/_ping") {
+					w.Write([]byte("OK"))
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"Id": "redis-id", "Name": "/redis"}`))
+			}))
+			defer daemon.Close()
+
+			defer setenv("DOCKER_HOST", "tcp://"+strings.TrimPrefix(daemon.URL, "http://"))()
+			defer setenv("DOCKER_API_VERSION", tc.pinnedVersion)()
+
+			cli, err := NewClient()
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			defer cli.Close()
+
+			if _, err := cli.ContainerInspect(context.Background(), "redis-id"); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if got := cli.ClientVersion(); got != tc.expectedVersion {
+				t.Errorf("expected API version %q, got %q", tc.expectedVersion, got)
+			}
+			if last := paths[len(paths)-1]; last != "/v"+tc.expectedVersion+"/containers/redis-id/json" {
+				t.Errorf("expected the inspect call to use API version %s, got %s", tc.expectedVersion, last)
+			}
+		})
+	}
+}
+
+// setenv sets (or unsets when empty) an environment variable and returns a
+// func restoring its previous value
+func setenv(key, value string) func() {
+	prev, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+
+	return func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
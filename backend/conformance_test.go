@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// conformanceWorld describes the targets and exporters seen by a Backend
+// under test, and records the exporters it starts and removes. Backend
+// implementations expose it through their own runtime API.
+type conformanceWorld struct {
+	mutex sync.Mutex
+	// Targets indexed by ID
+	targets map[string]conformanceTarget
+	// Exporters indexed by ID
+	exporters map[string]conformanceExporter
+	// Names of the exporters started
+	started []string
+	// IDs of the exporters removed
+	removed []string
+}
+
+type conformanceTarget struct {
+	name    string
+	running bool
+}
+
+type conformanceExporter struct {
+	name       string
+	exportedID string
+}
+
+func newConformanceWorld() *conformanceWorld {
+	return &conformanceWorld{
+		targets:   map[string]conformanceTarget{},
+		exporters: map[string]conformanceExporter{},
+	}
+}
+
+func (w *conformanceWorld) addTarget(id, name string, running bool) {
+	w.targets[id] = conformanceTarget{name, running}
+}
+
+func (w *conformanceWorld) addExporter(id, exporterType, exportedID string) {
+	w.exporters[id] = conformanceExporter{getExporterName(exporterType, w.targets[exportedID].name, exportedID), exportedID}
+}
+
+func (w *conformanceWorld) startedExporters() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	started := append([]string{}, w.started...)
+	sort.Strings(started)
+	return started
+}
+
+func (w *conformanceWorld) removedExporters() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	removed := append([]string{}, w.removed...)
+	sort.Strings(removed)
+	return removed
+}
+
+// testBackendConformance runs the behaviors expected from any Backend
+// implementation. newBackend has to return a Backend exposing the given world.
+// The default exporter finder is expected: redis and php targets get an
+// exporter.
+func testBackendConformance(t *testing.T, newBackend func(t *testing.T, w *conformanceWorld) Backend) {
+	t.Run("FindMissingExporters", func(t *testing.T) {
+		w := newConformanceWorld()
+		w.addTarget("redis-id", "/redis", true)
+		w.addTarget("php-id", "/php", true)
+		w.addTarget("app-id", "/app", true)
+		w.addExporter("redis-exporter-id", "redis", "redis-id")
+
+		missing, err := newBackend(t, w).FindMissingExporters(context.Background(), []string{"prometheus"})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if len(missing) != 1 || missing[0].Exported.ID != "php-id" || missing[0].PredefinedType != "php" {
+			t.Errorf("expected only the php exporter to be missing, got %+v", missing)
+		}
+	})
+
+	t.Run("RunExporter", func(t *testing.T) {
+		w := newConformanceWorld()
+		w.addTarget("redis-id", "/redis", true)
+		b := newBackend(t, w)
+
+		missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+		if err != nil || len(missing) != 1 {
+			t.Fatalf("expected one missing exporter, got %+v (%+v)", missing, err)
+		}
+
+		b.RunExporter(context.Background(), missing[0])
+
+		if started := w.startedExporters(); len(started) != 1 || started[0] != getExporterName("redis", "/redis", "redis-id") {
+			t.Errorf("expected the redis exporter to be started, got %v", started)
+		}
+	})
+
+	t.Run("CleanupExporter", func(t *testing.T) {
+		w := newConformanceWorld()
+		w.addTarget("redis-id", "/redis", true)
+		w.addExporter("redis-exporter-id", "redis", "redis-id")
+		b := newBackend(t, w)
+
+		err := b.CleanupExporter(context.Background(), "redis-exporter-id", false)
+		if !IsErrExportedStillRunning(err) {
+			t.Errorf("expected exporter of a running target to be kept, got %+v", err)
+		}
+
+		if err := b.CleanupExporter(context.Background(), "redis-exporter-id", true); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if removed := w.removedExporters(); len(removed) != 1 || removed[0] != "redis-exporter-id" {
+			t.Errorf("expected forced cleanup to remove the exporter, got %v", removed)
+		}
+	})
+
+	t.Run("CleanupExporters", func(t *testing.T) {
+		w := newConformanceWorld()
+		w.addTarget("redis-id", "/redis", true)
+		w.addTarget("php-id", "/php", false)
+		w.addExporter("redis-exporter-id", "redis", "redis-id")
+		w.addExporter("php-exporter-id", "php", "php-id")
+		b := newBackend(t, w)
+
+		// Exporters of running targets are reported as kept
+		if err := b.CleanupExporters(context.Background(), false); err != nil && !IsErrExportedStillRunning(err) {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if removed := w.removedExporters(); len(removed) != 1 || removed[0] != "php-exporter-id" {
+			t.Errorf("expected only stale exporters to be removed, got %v", removed)
+		}
+
+		if err := b.CleanupExporters(context.Background(), true); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if removed := w.removedExporters(); len(removed) != 2 {
+			t.Errorf("expected all exporters to be removed when forced, got %v", removed)
+		}
+	})
+
+	t.Run("ListenForTasksToExport", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		b := newBackend(t, newConformanceWorld())
+
+		done := make(chan struct{})
+		go func() {
+			b.ListenForTasksToExport(ctx, []string{"prometheus"})
+			close(done)
+		}()
+
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("ListenForTasksToExport did not return after ctx cancellation")
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// DiagnosticCheck is the outcome of one of the checks run by Diagnose
+type DiagnosticCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Diagnosis reports whether prom-autoexporter can run exporters, along with
+// the names of the exporters currently managed and of the missing ones
+type Diagnosis struct {
+	Checks  []DiagnosticCheck `json:"checks"`
+	Managed []string          `json:"managed"`
+	Missing []string          `json:"missing"`
+}
+
+// Healthy checks if all the checks succeeded
+func (d Diagnosis) Healthy() bool {
+	for _, check := range d.Checks {
+		if !check.OK {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (d *Diagnosis) add(name string, err error, detail string) {
+	check := DiagnosticCheck{Name: name, OK: err == nil, Detail: detail}
+	if err != nil {
+		check.Detail = err.Error()
+	}
+
+	d.Checks = append(d.Checks, check)
+}
+
+// Diagnose checks the connectivity to Docker, that the Prometheus networks
+// exist and that the images of managed and missing exporters are available,
+// either locally or from their registry. The remaining checks are skipped
+// when Docker can't be reached.
+func (b DockerBackend) Diagnose(ctx context.Context, promNetworks []string) Diagnosis {
+	diagnosis := Diagnosis{Managed: []string{}, Missing: []string{}}
+
+	ping, err := b.cli.Ping(ctx)
+	diagnosis.add("docker connectivity", err, fmt.Sprintf("API version %s", ping.APIVersion))
+	if err != nil {
+		return diagnosis
+	}
+
+	for _, promNetwork := range promNetworks {
+		_, err := b.cli.NetworkInspect(ctx, promNetwork, types.NetworkInspectOptions{})
+		if client.IsErrNotFound(err) {
+			err = errors.Errorf("network %q does not exist", promNetwork)
+		}
+		diagnosis.add(fmt.Sprintf("network %s", promNetwork), err, "exists")
+	}
+
+	images := map[string]struct{}{}
+
+	managed, err := b.ListExporters(ctx)
+	diagnosis.add("list managed exporters", err, fmt.Sprintf("%d exporters", len(managed)))
+	for _, exporter := range managed {
+		diagnosis.Managed = append(diagnosis.Managed, exporter.Name)
+		images[exporter.Image] = struct{}{}
+	}
+
+	missing, err := b.FindMissingExporters(ctx, promNetworks)
+	diagnosis.add("find missing exporters", err, fmt.Sprintf("%d exporters", len(missing)))
+	for _, exporter := range missing {
+		diagnosis.Missing = append(diagnosis.Missing, exporter.Name)
+		images[exporter.Image] = struct{}{}
+	}
+
+	sorted := make([]string, 0, len(images))
+	for image := range images {
+		sorted = append(sorted, image)
+	}
+	sort.Strings(sorted)
+
+	for _, image := range sorted {
+		detail, err := b.checkImageAvailable(ctx, image)
+		diagnosis.add(fmt.Sprintf("image %s", image), err, detail)
+	}
+
+	return diagnosis
+}
+
+// checkImageAvailable checks if the given image is present locally, or can
+// be pulled from its registry, without pulling it
+func (b DockerBackend) checkImageAvailable(ctx context.Context, image string) (string, error) {
+	_, _, err := b.cli.ImageInspectWithRaw(ctx, image)
+	if err == nil {
+		return "present locally", nil
+	} else if !client.IsErrNotFound(err) {
+		return "", err
+	}
+
+	auth, err := b.registryAuth(image)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := b.cli.DistributionInspect(ctx, image, auth); err != nil {
+		return "", err
+	}
+
+	return "pullable", nil
+}
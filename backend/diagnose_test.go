@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestDiagnoseDockerUnreachable(t *testing.T) {
+	cli := &fakeClient{
+		pingFn: func(ctx context.Context) (types.Ping, error) {
+			return types.Ping{}, errors.New("cannot connect to the Docker daemon")
+		},
+	}
+
+	// Any other call would panic on the fake client
+	diagnosis := NewDockerBackend(cli).Diagnose(context.Background(), []string{"prometheus"})
+
+	if diagnosis.Healthy() {
+		t.Fatal("expected the diagnosis to be unhealthy")
+	}
+	if len(diagnosis.Checks) != 1 || diagnosis.Checks[0].Detail != "cannot connect to the Docker daemon" {
+		t.Errorf("expected only the connectivity check to be run, got %+v", diagnosis.Checks)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	testcases := map[string]struct {
+		networks        []string
+		expectedHealthy bool
+		expectedFailed  []string
+	}{
+		"all checks pass": {
+			networks:        []string{"prometheus"},
+			expectedHealthy: true,
+			expectedFailed:  []string{},
+		},
+		"network missing": {
+			networks:        []string{"prometheus", "missing"},
+			expectedHealthy: false,
+			expectedFailed:  []string{"network missing"},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			containers := []types.Container{
+				{
+					ID:     "exporter-id",
+					Names:  []string{"/exporter.redis.redis"},
+					Image:  "oliver006/redis_exporter",
+					Labels: map[string]string{LABEL_EXPORTER_NAME: "/exporter.redis.redis", LABEL_EXPORTED_ID: "redis-id"},
+					State:  "running",
+				},
+				{ID: "redis-id", Names: []string{"/redis"}},
+				{ID: "php-id", Names: []string{"/php"}},
+			}
+
+			cli := &fakeClient{
+				pingFn: func(ctx context.Context) (types.Ping, error) {
+					return types.Ping{APIVersion: "1.30"}, nil
+				},
+				networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+					if networkID == "missing" {
+						return types.NetworkResource{}, errdefs.NotFound(errors.New("no such network"))
+					}
+					return emptyNetwork(ctx, networkID, options)
+				},
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					return filterContainers(containers, options.Filters), nil
+				},
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					for _, container := range containers {
+						if container.ID == id {
+							return exportedContainer(id, container.Names[0], nil), nil
+						}
+					}
+					return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+				},
+				imageInspectFn: func(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+					if image == "oliver006/redis_exporter" {
+						return types.ImageInspect{ID: "sha256:redis-exporter"}, nil, nil
+					}
+					return imageNotFound(ctx, image)
+				},
+				distributionInspectFn: func(ctx context.Context, image, encodedRegistryAuth string) (registry.DistributionInspect, error) {
+					return registry.DistributionInspect{}, nil
+				},
+			}
+
+			finder := stubFinder{"/php": {stubExporter("php-fpm", "hipages/php-fpm_exporter")}}
+			diagnosis := NewDockerBackend(cli, WithFinder(finder)).Diagnose(context.Background(), tc.networks)
+
+			if diagnosis.Healthy() != tc.expectedHealthy {
+				t.Errorf("expected healthy to be %t, got checks %+v", tc.expectedHealthy, diagnosis.Checks)
+			}
+
+			failed := []string{}
+			for _, check := range diagnosis.Checks {
+				if !check.OK {
+					failed = append(failed, check.Name)
+				}
+			}
+			if !reflect.DeepEqual(failed, tc.expectedFailed) {
+				t.Errorf("expected failed checks %v, got %v", tc.expectedFailed, failed)
+			}
+
+			if expected := []string{"exporter.redis.redis"}; !reflect.DeepEqual(diagnosis.Managed, expected) {
+				t.Errorf("expected managed exporters %v, got %v", expected, diagnosis.Managed)
+			}
+			if len(diagnosis.Missing) != 1 {
+				t.Errorf("expected one missing exporter, got %v", diagnosis.Missing)
+			}
+		})
+	}
+}
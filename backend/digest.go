@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// pinnedDigest returns the digest the given image reference is pinned to
+// (e.g. image@sha256:...), or an empty string when it's not pinned
+func pinnedDigest(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if canonical, ok := named.(reference.Canonical); ok {
+		return canonical.Digest().String(), nil
+	}
+
+	return "", nil
+}
+
+// verifyDigest checks that the local image matches the digest its reference
+// is pinned to, if any
+func (b DockerBackend) verifyDigest(ctx context.Context, image string) error {
+	digest, err := pinnedDigest(image)
+	if err != nil || digest == "" {
+		return err
+	}
+
+	inspect, _, err := b.cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, repoDigest := range inspect.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			return nil
+		}
+	}
+
+	return errors.Errorf("image %q doesn't match its pinned digest %s, resolved digests: %s", image, digest, strings.Join(inspect.RepoDigests, ", "))
+}
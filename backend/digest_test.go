@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+const pinnedImage = "oliver006/redis_exporter@sha256:0d8a5bd46e4d9fa4d4ec1bf84bc3d5d1a1b2c3d4e5f60718293a4b5c6d7e8f90"
+
+func TestPinnedDigest(t *testing.T) {
+	testcases := map[string]struct {
+		image          string
+		expectedDigest string
+	}{
+		"tagged image": {
+			image: "oliver006/redis_exporter:v0.34.1",
+		},
+		"pinned image": {
+			image:          pinnedImage,
+			expectedDigest: "sha256:0d8a5bd46e4d9fa4d4ec1bf84bc3d5d1a1b2c3d4e5f60718293a4b5c6d7e8f90",
+		},
+		"tagged and pinned image": {
+			image:          "oliver006/redis_exporter:v0.34.1@sha256:0d8a5bd46e4d9fa4d4ec1bf84bc3d5d1a1b2c3d4e5f60718293a4b5c6d7e8f90",
+			expectedDigest: "sha256:0d8a5bd46e4d9fa4d4ec1bf84bc3d5d1a1b2c3d4e5f60718293a4b5c6d7e8f90",
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			digest, err := pinnedDigest(tc.image)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if digest != tc.expectedDigest {
+				t.Errorf("expected digest %q, got %q", tc.expectedDigest, digest)
+			}
+		})
+	}
+}
+
+func TestPullDigestPinnedImage(t *testing.T) {
+	matching := "docker.io/oliver006/redis_exporter@sha256:0d8a5bd46e4d9fa4d4ec1bf84bc3d5d1a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	other := "docker.io/oliver006/redis_exporter@sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+
+	testcases := map[string]struct {
+		present        bool
+		repoDigests    []string
+		expectedPulled bool
+		expectedErr    bool
+	}{
+		"already present with the pinned digest": {
+			present:     true,
+			repoDigests: []string{matching},
+		},
+		"pulled with the pinned digest": {
+			repoDigests:    []string{matching},
+			expectedPulled: true,
+		},
+		"pulled with another digest": {
+			repoDigests:    []string{other},
+			expectedPulled: true,
+			expectedErr:    true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			pulled := false
+			cli := &fakeClient{
+				imageInspectFn: func(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+					if image != pinnedImage {
+						t.Errorf("expected %q to be inspected, got %q", pinnedImage, image)
+					}
+					if !tc.present && !pulled {
+						return imageNotFound(ctx, image)
+					}
+					return types.ImageInspect{RepoDigests: tc.repoDigests}, nil, nil
+				},
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					if ref != pinnedImage {
+						t.Errorf("expected %q to be pulled, got %q", pinnedImage, ref)
+					}
+					pulled = true
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+			}
+
+			exporter := redisExporter()
+			exporter.Image = pinnedImage
+
+			b := NewDockerBackend(cli)
+			err := b.pullImage(context.Background(), exporter)
+			if tc.expectedErr && err == nil {
+				t.Error("expected a digest mismatch error")
+			} else if !tc.expectedErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+			if pulled != tc.expectedPulled {
+				t.Errorf("expected pulled to be %t, got %t", tc.expectedPulled, pulled)
+			}
+		})
+	}
+}
+
+func TestCreateContainerWithDigestPinnedImage(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Image = pinnedImage
+
+	var image string
+	cli := &fakeClient{
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			image = config.Image
+			return container.ContainerCreateCreatedBody{}, errors.New("stop here")
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	b.createContainer(context.Background(), exporter, newLifecycleID())
+
+	if image != pinnedImage {
+		t.Errorf("expected the container to use %q, got %q", pinnedImage, image)
+	}
+}
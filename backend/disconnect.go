@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"context"
+	"strings"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Cleanup stops when the scrape target can't be disconnected
+	DisconnectFailureAbort = "abort"
+	// Cleanup proceeds to stop and remove the exporter anyway
+	DisconnectFailureBestEffort = "best-effort"
+)
+
+// disconnectScrapeTarget disconnects the scrape target of the given exporter
+// from the Prometheus networks prom-autoexporter attached it to, unless other
+// exporters still use it. Networks the scrape target was already part of are
+// left untouched. Scrape targets already gone or disconnected are ignored.
+func (b DockerBackend) disconnectScrapeTarget(ctx context.Context, exporter types.ContainerJSON) error {
+	labels := exporter.Config.Labels
+	joinedNetworks, target := labels[LABEL_PROM_NETWORK], connectedTarget(labels)
+	attachedNetworks := labels[LABEL_ATTACHED_NETWORKS]
+	if joinedNetworks == "" || attachedNetworks == "" || target == "" {
+		return nil
+	}
+
+	others, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_PROM_NETWORK+"="+joinedNetworks),
+		),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, other := range others {
+		if other.ID != exporter.ID && connectedTarget(other.Labels) == target {
+			return nil
+		}
+	}
+
+	logger := log.GetLogger(ctx)
+	var lastErr error
+
+	for _, promNetwork := range strings.Split(attachedNetworks, ",") {
+		if b.dryRun {
+			logger.Infof("[dry-run] Would disconnect %q from network %q.", target, promNetwork)
+			continue
+		}
+
+		// The scrape target might never have joined the network, e.g. when
+		// the exporter failed to start, or might have left it already
+		attached, err := b.isAttached(ctx, promNetwork, target)
+		if (err == nil && !attached) || (err != nil && isErrNotConnected(err)) {
+			logger.Debugf("Scrape target not connected to network %q, skip disconnecting.", promNetwork)
+			continue
+		}
+
+		err = b.cli.NetworkDisconnect(ctx, promNetwork, target, false)
+		if err != nil && !isErrNotConnected(err) {
+			lastErr = errors.WithStack(err)
+			continue
+		}
+
+		logger.Debugf("Scrape target disconnected from network %q.", promNetwork)
+	}
+
+	return lastErr
+}
+
+// connectedTarget returns the container connected to the Prometheus networks
+// on behalf of the exporter having the given labels: its scrape target, or
+// the exported container when the exporter runs in its own network namespace
+// (the exporter itself is disconnected on removal)
+func connectedTarget(labels map[string]string) string {
+	if labels[LABEL_NETWORK_MODE] == models.NetworkModeNetwork {
+		return labels[LABEL_EXPORTED_NAME]
+	}
+
+	return labels[LABEL_SCRAPE_TARGET]
+}
+
+// isErrNotConnected checks if a disconnection failed because the container
+// or the network doesn't exist, or because they're not connected
+func isErrNotConnected(err error) bool {
+	return client.IsErrNotFound(err) || strings.Contains(strings.ToLower(err.Error()), "not connected")
+}
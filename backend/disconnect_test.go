@@ -0,0 +1,221 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestCleanupExporterDisconnectsScrapeTarget(t *testing.T) {
+	exporter := exportedContainer("exporter-id", "/exporter.redis.redis", map[string]string{
+		LABEL_EXPORTED_ID:       "redis-id",
+		LABEL_EXPORTED_NAME:     "/redis",
+		LABEL_SCRAPE_TARGET:     "redis-id",
+		LABEL_PROM_NETWORK:      "prometheus",
+		LABEL_ATTACHED_NETWORKS: "prometheus",
+	})
+
+	testcases := map[string]struct {
+		notAttached   bool
+		disconnectErr error
+		behavior      string
+		expectErr     bool
+		expectRemoved bool
+	}{
+		"disconnected": {
+			behavior:      DisconnectFailureAbort,
+			expectRemoved: true,
+		},
+		"never connected is skipped": {
+			notAttached:   true,
+			behavior:      DisconnectFailureAbort,
+			expectRemoved: true,
+		},
+		"not connected anymore is ignored": {
+			disconnectErr: errors.New("Error response from daemon: container redis-id is not connected to network prometheus"),
+			behavior:      DisconnectFailureAbort,
+			expectRemoved: true,
+		},
+		"scrape target gone is ignored": {
+			disconnectErr: errdefs.NotFound(errors.New("no such container")),
+			behavior:      DisconnectFailureAbort,
+			expectRemoved: true,
+		},
+		"hard failure aborts cleanup": {
+			disconnectErr: errors.New("daemon unavailable"),
+			behavior:      DisconnectFailureAbort,
+			expectErr:     true,
+			expectRemoved: false,
+		},
+		"hard failure is ignored when best-effort": {
+			disconnectErr: errors.New("daemon unavailable"),
+			behavior:      DisconnectFailureBestEffort,
+			expectRemoved: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			networkInspectFn := attachedNetwork("redis-id")
+			if tc.notAttached {
+				networkInspectFn = emptyNetwork
+			}
+
+			var disconnected, removed bool
+			cli := &fakeClient{
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if id == exporter.ID {
+						return exporter, nil
+					}
+					return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+				},
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					return []types.Container{{ID: exporter.ID, Labels: exporter.Config.Labels}}, nil
+				},
+				networkInspectFn: networkInspectFn,
+				networkDisconnectFn: func(ctx context.Context, networkID, containerID string, force bool) error {
+					if networkID != "prometheus" || containerID != "redis-id" {
+						t.Errorf("unexpected disconnection of %q from %q", containerID, networkID)
+					}
+					disconnected = true
+					return tc.disconnectErr
+				},
+				containerStopFn: func(ctx context.Context, id string) error {
+					return nil
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed = true
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli, WithDisconnectFailure(tc.behavior))
+			err := b.CleanupExporter(context.Background(), exporter.ID, false)
+			if tc.expectErr && err == nil {
+				t.Error("expected an error")
+			} else if !tc.expectErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+			if disconnected == tc.notAttached {
+				t.Errorf("expected disconnection to be %t, got %t", !tc.notAttached, disconnected)
+			}
+			if removed != tc.expectRemoved {
+				t.Errorf("expected exporter removal to be %t, got %t", tc.expectRemoved, removed)
+			}
+		})
+	}
+}
+
+func TestDisconnectSkipsMissingNetworks(t *testing.T) {
+	exporter := exportedContainer("exporter-id", "/exporter.redis.redis", map[string]string{
+		LABEL_SCRAPE_TARGET:     "/redis",
+		LABEL_PROM_NETWORK:      "prom-a,prom-b",
+		LABEL_ATTACHED_NETWORKS: "prom-a,prom-b",
+	})
+
+	disconnected := []string{}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return []types.Container{{ID: exporter.ID, Labels: exporter.Config.Labels}}, nil
+		},
+		networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+			if networkID == "prom-a" {
+				return types.NetworkResource{}, errdefs.NotFound(errors.New("network prom-a not found"))
+			}
+			return attachedNetwork("/redis")(ctx, networkID, options)
+		},
+		networkDisconnectFn: func(ctx context.Context, networkID, containerID string, force bool) error {
+			disconnected = append(disconnected, networkID)
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if err := b.disconnectScrapeTarget(context.Background(), exporter); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(disconnected) != 1 || disconnected[0] != "prom-b" {
+		t.Errorf("expected only prom-b to be disconnected, got %v", disconnected)
+	}
+}
+
+func TestSharedScrapeTargetIsNotDisconnected(t *testing.T) {
+	labels := map[string]string{
+		LABEL_EXPORTED_ID:   "app-id",
+		LABEL_SCRAPE_TARGET: "app-id",
+		LABEL_PROM_NETWORK:  "prometheus",
+	}
+	exporter := exportedContainer("exporter-id", "/exporter.redis.app", labels)
+
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return []types.Container{
+				{ID: "exporter-id", Labels: labels},
+				{ID: "other-exporter-id", Labels: labels},
+			}, nil
+		},
+		networkDisconnectFn: func(ctx context.Context, networkID, containerID string, force bool) error {
+			t.Errorf("unexpected disconnection of %q from %q", containerID, networkID)
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	if err := b.disconnectScrapeTarget(context.Background(), exporter); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestDisconnectLeavesNetworksTheScrapeTargetWasPartOf(t *testing.T) {
+	testcases := map[string]struct {
+		attachedNetworks     string
+		expectedDisconnected []string
+	}{
+		"partially attached": {
+			attachedNetworks:     "prom-b",
+			expectedDisconnected: []string{"prom-b"},
+		},
+		"already part of every network": {
+			expectedDisconnected: []string{},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			labels := map[string]string{
+				LABEL_SCRAPE_TARGET: "/redis",
+				LABEL_PROM_NETWORK:  "prom-a,prom-b",
+			}
+			if tc.attachedNetworks != "" {
+				labels[LABEL_ATTACHED_NETWORKS] = tc.attachedNetworks
+			}
+			exporter := exportedContainer("exporter-id", "/exporter.redis.redis", labels)
+
+			disconnected := []string{}
+			cli := &fakeClient{
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					return []types.Container{{ID: exporter.ID, Labels: labels}}, nil
+				},
+				networkInspectFn: attachedNetwork("/redis"),
+				networkDisconnectFn: func(ctx context.Context, networkID, containerID string, force bool) error {
+					disconnected = append(disconnected, networkID)
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli)
+			if err := b.disconnectScrapeTarget(context.Background(), exporter); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(disconnected, tc.expectedDisconnected) {
+				t.Errorf("expected disconnections from %v, got %v", tc.expectedDisconnected, disconnected)
+			}
+		})
+	}
+}
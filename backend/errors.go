@@ -1,6 +1,12 @@
 package backend
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
 
 type errExportedStilRunning struct {
 	exporterID string
@@ -15,7 +21,161 @@ func (e errExportedStilRunning) Error() string {
 	return fmt.Sprintf("Exporter %q can't be stopped, exported container %q still running.", e.exporterID, e.exportedID)
 }
 
+// IsErrExportedStillRunning checks if the error has been returned because
+// exported containers are still running. It's true for a cleanup error made
+// only of such failures.
 func IsErrExportedStillRunning(e error) bool {
-	_, ok := e.(errExportedStilRunning)
+	switch err := errors.Cause(e).(type) {
+	case errExportedStilRunning:
+		return true
+	case errCleanupFailed:
+		for _, failure := range err.failures {
+			if !IsErrExportedStillRunning(failure) {
+				return false
+			}
+		}
+		return len(err.failures) > 0
+	}
+
+	return false
+}
+
+// errCleanupFailed aggregates the failures that happened while cleaning up
+// several exporters
+type errCleanupFailed struct {
+	failures []error
+}
+
+func (e errCleanupFailed) Error() string {
+	msgs := make([]string, 0, len(e.failures))
+	for _, failure := range e.failures {
+		msgs = append(msgs, failure.Error())
+	}
+
+	return fmt.Sprintf("%d exporters failed to be cleaned up:\n%s", len(e.failures), strings.Join(msgs, "\n"))
+}
+
+// isErrConflict checks if the given error has been returned by Docker because
+// the container name is already in use
+func isErrConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errdefs.IsConflict(err) {
+		return true
+	}
+
+	return strings.Contains(errors.Cause(err).Error(), "Conflict.")
+}
+
+// isErrNotRunning checks if the given error has been returned by Docker
+// because the container is already stopped
+func isErrNotRunning(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return strings.Contains(errors.Cause(err).Error(), "is not running")
+}
+
+// errImagePull is returned when the image of an exporter can't be pulled,
+// wrapping the underlying error
+type errImagePull struct {
+	image string
+	err   error
+}
+
+func newErrImagePull(image string, err error) errImagePull {
+	return errImagePull{image, err}
+}
+
+func (e errImagePull) Error() string {
+	return fmt.Sprintf("failed to pull image %q: %s", e.image, e.err)
+}
+
+// Image returns the image that failed to be pulled
+func (e errImagePull) Image() string {
+	return e.image
+}
+
+// Cause returns the error the pull failed with
+func (e errImagePull) Cause() error {
+	return e.err
+}
+
+// findErrImagePull returns the image pull error among the given error and
+// the errors it wraps, if any
+func findErrImagePull(err error) (errImagePull, bool) {
+	for err != nil {
+		if pullErr, ok := err.(errImagePull); ok {
+			return pullErr, true
+		}
+
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+
+	return errImagePull{}, false
+}
+
+// IsErrImagePull checks if the given error, or any error it wraps, has been
+// returned because the image of an exporter can't be pulled
+func IsErrImagePull(err error) bool {
+	_, ok := findErrImagePull(err)
+	return ok
+}
+
+// ImagePullFailure returns the image that failed to be pulled and the error
+// the pull failed with, when the given error or any error it wraps is an
+// image pull error. Both are empty otherwise.
+func ImagePullFailure(err error) (image string, cause error) {
+	pullErr, ok := findErrImagePull(err)
+	if !ok {
+		return "", nil
+	}
+
+	return pullErr.Image(), pullErr.Cause()
+}
+
+type errExporterNotFound struct {
+	id string
+}
+
+func newErrExporterNotFound(id string) errExporterNotFound {
+	return errExporterNotFound{id}
+}
+
+func (e errExporterNotFound) Error() string {
+	return fmt.Sprintf("Exporter %q not found.", e.id)
+}
+
+// IsErrExporterNotFound checks if the error has been returned because the
+// exporter to clean up doesn't exist (anymore)
+func IsErrExporterNotFound(e error) bool {
+	_, ok := errors.Cause(e).(errExporterNotFound)
+	return ok
+}
+
+type errExportedNotRunning struct {
+	exporterName string
+	exportedID   string
+}
+
+func newErrExportedNotRunning(exporterName, exportedID string) errExportedNotRunning {
+	return errExportedNotRunning{exporterName, exportedID}
+}
+
+func (e errExportedNotRunning) Error() string {
+	return fmt.Sprintf("Exporter %q can't start, container %q whose namespaces it joins is not running anymore.", e.exporterName, e.exportedID)
+}
+
+// IsErrExportedNotRunning checks if the error has been returned because the
+// exported container died while its exporter was being started
+func IsErrExportedNotRunning(e error) bool {
+	_, ok := errors.Cause(e).(errExportedNotRunning)
 	return ok
 }
@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+func TestPullImageFailuresAreTyped(t *testing.T) {
+	testcases := map[string]struct {
+		imagePullFn func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error)
+		expectedErr string
+	}{
+		"pull request fails": {
+			imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+				return nil, errors.New("registry unreachable")
+			},
+			expectedErr: "registry unreachable",
+		},
+		"pull progress reports an error": {
+			imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(`{"errorDetail":{"message":"manifest unknown"}}`)), nil
+			},
+			expectedErr: "manifest unknown",
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			cli := &fakeClient{
+				imageInspectFn: imageNotFound,
+				imagePullFn:    tc.imagePullFn,
+			}
+
+			exporter := redisExporter()
+			err := NewDockerBackend(cli).pullImage(context.Background(), exporter)
+			if !IsErrImagePull(err) {
+				t.Fatalf("expected an image pull error, got %+v", err)
+			}
+
+			image, cause := ImagePullFailure(err)
+			if image != exporter.Image {
+				t.Errorf("expected the error to carry image %q, got %q", exporter.Image, image)
+			}
+			if cause == nil || !strings.Contains(cause.Error(), tc.expectedErr) {
+				t.Errorf("expected the cause to be %q, got %v", tc.expectedErr, cause)
+			}
+			if !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Errorf("expected the error to wrap %q, got %q", tc.expectedErr, err.Error())
+			}
+		})
+	}
+}
+
+func TestIsErrImagePull(t *testing.T) {
+	if IsErrImagePull(nil) {
+		t.Error("expected nil not to be an image pull error")
+	}
+	if IsErrImagePull(errors.New("conflict: the container name is already in use")) {
+		t.Error("expected a create error not to be an image pull error")
+	}
+	if !IsErrImagePull(errors.Wrap(newErrImagePull("redis", errors.New("timeout")), "starting exporter")) {
+		t.Error("expected a wrapped image pull error to be detected")
+	}
+	if image, cause := ImagePullFailure(errors.New("conflict: the container name is already in use")); image != "" || cause != nil {
+		t.Error("expected no image pull failure to be found in a create error")
+	}
+}
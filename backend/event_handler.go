@@ -1,15 +1,16 @@
 package backend
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"fmt"
-	"html/template"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/metrics"
 	"github.com/NiR-/prom-autoexporter/models"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
@@ -19,20 +20,31 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	exportedOOMKills = metrics.NewCounter(
+		"autoexporter_exported_oom_kills_total",
+		"Number of OOM kills of exported containers.",
+	)
+	exportedFailedExits = metrics.NewCounter(
+		"autoexporter_exported_failed_exits_total",
+		"Number of exported containers exiting with a non-zero code.",
+	)
+)
+
 // Thread-safe collection of context.CancelFunc
 type cancellableCollection struct {
 	mutex sync.RWMutex
 	funcs map[string]context.CancelFunc
 }
 
-func newCancellableCollection() cancellableCollection {
-	return cancellableCollection{
+func newCancellableCollection() *cancellableCollection {
+	return &cancellableCollection{
 		mutex: sync.RWMutex{},
 		funcs: make(map[string]context.CancelFunc, 0),
 	}
 }
 
-func (c cancellableCollection) cancel(k string) bool {
+func (c *cancellableCollection) cancel(k string) bool {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -47,7 +59,7 @@ func (c cancellableCollection) cancel(k string) bool {
 	return ok
 }
 
-func (c cancellableCollection) add(k string, ctx context.Context) context.Context {
+func (c *cancellableCollection) add(k string, ctx context.Context) context.Context {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -55,7 +67,18 @@ func (c cancellableCollection) add(k string, ctx context.Context) context.Contex
 	return ctx
 }
 
-func (c cancellableCollection) remove(k string) {
+// cancelAll cancels all the pending processes
+func (c *cancellableCollection) cancelAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k, f := range c.funcs {
+		f()
+		delete(c.funcs, k)
+	}
+}
+
+func (c *cancellableCollection) remove(k string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -64,29 +87,111 @@ func (c cancellableCollection) remove(k string) {
 	}
 }
 
-func (b Backend) ListenEventsForExported(ctx context.Context, promNetwork string) {
-	evtCh, errCh := b.cli.Events(ctx, types.EventsOptions{
-		Since: time.Now().Format(time.RFC3339),
-		Filters: filters.NewArgs(
-			filters.Arg("type", events.ContainerEventType),
-			filters.Arg("action", "start,die"),
-		),
+// ListenForTasksToExport listens for Docker events and starts or stops
+// exporters accordingly. It subscribes again to the event stream whenever it
+// gets interrupted, until ctx is cancelled. Once cancelled, pending handlers
+// are cancelled too and waited for before returning.
+func (b DockerBackend) ListenForTasksToExport(ctx context.Context, promNetworks []string) {
+	logger := log.GetLogger(ctx)
+	cancellables := newCancellableCollection()
+	inflight := &sync.WaitGroup{}
+	seen := newSeenEvents(seenEventsTTL)
+	since := time.Now()
+	reconnects := uint(0)
+
+	defer func() {
+		cancellables.cancelAll()
+		inflight.Wait()
+	}()
+
+	for {
+		lastEvt, err := b.consumeEvents(ctx, since, seen, cancellables, inflight, promNetworks)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Resume from the last event received, such that no event is missed
+		// across reconnects
+		if !lastEvt.IsZero() {
+			since = lastEvt
+			reconnects = 0
+		}
+
+		reconnects++
+		delay := backoffDelay(reconnects, b.retryInterval, b.retryMaxInterval)
+		logger.Errorf("Docker events stream interrupted, subscribing again in %s: %+v", delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// consumeEvents subscribes to Docker events emitted since the given time and
+// handles them until the stream fails. Events already seen, replayed since
+// the stream resumes from the last event received, are skipped. It returns
+// the time of the last event received (or zero if none) and the error that
+// interrupted the stream.
+func (b DockerBackend) consumeEvents(ctx context.Context, since time.Time, seen *seenEvents, cancellables *cancellableCollection, inflight *sync.WaitGroup, promNetworks []string) (time.Time, error) {
+	// The stream is closed when returning, but handlers still running in
+	// background should not be cancelled
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	actions := b.watchedActions()
+	if b.quarantine != nil {
+		// Exporter deaths and removals are tracked to quarantine the ones
+		// crash-looping
+		actions = appendMissing(appendMissing(actions, "die"), "destroy")
+	}
+
+	args := filters.NewArgs(filters.Arg("type", events.ContainerEventType))
+	for _, action := range actions {
+		args.Add("event", action)
+	}
+
+	evtCh, errCh := b.cli.Events(streamCtx, types.EventsOptions{
+		Since:   fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+		Filters: args,
 	})
 
-	cancellables := newCancellableCollection()
+	var lastEvt time.Time
 
 	for {
 		select {
-		case err := <-errCh:
-			panic(err)
-		case evt := <-evtCh:
-			// Ignore exporters
+		case <-ctx.Done():
+			return lastEvt, ctx.Err()
+		case err, ok := <-errCh:
+			if !ok {
+				return lastEvt, errors.New("errors channel closed")
+			}
+			return lastEvt, errors.WithStack(err)
+		case evt, ok := <-evtCh:
+			// Reading from a closed channel would spin on zero-value messages
+			if !ok {
+				return lastEvt, errors.New("events channel closed")
+			}
+
+			lastEvt = time.Unix(0, evt.TimeNano)
+			if b.podmanCompat {
+				evt = normalizePodmanEvent(evt)
+			}
+
+			// Exporters events are only used to track their restarts
 			if _, ok := evt.Actor.Attributes[LABEL_EXPORTED_NAME]; ok {
+				b.observeExporterEvent(ctx, evt)
 				continue
 			}
 
 			// Ignore actions not filtered by docker daemon
-			if evt.Action != "start" && evt.Action != "die" {
+			if !b.isWatchedAction(evt.Action) {
+				continue
+			}
+
+			if !seen.markSeen(evt, time.Now()) {
+				log.GetLogger(ctx).Debugf("Event %q of %q already handled, skipped.", evt.Action, evt.Actor.ID)
 				continue
 			}
 
@@ -95,25 +200,50 @@ func (b Backend) ListenEventsForExported(ctx context.Context, promNetwork string
 				"event.action": evt.Action,
 				"exported.cid": evt.Actor.ID,
 			})
-			ctx = log.WithLogger(ctx, logger)
+			ctx := log.WithLogger(ctx, logger)
 
 			logger.Debug("New container event received.")
 
-			if evt.Action == "start" {
-				cancellables.add(evt.Actor.ID, ctx)
-			} else if evt.Action == "die" {
+			if !b.elector.IsLeader(ctx) {
+				logger.Debug("Not the leader, ignoring event.")
+				continue
+			}
+
+			if evt.Action == "start" || (evt.Action == "health_status: healthy" && b.startsOnHealthy()) {
+				ctx = cancellables.add(evt.Actor.ID, ctx)
+			} else if evt.Action == "die" || evt.Action == "oom" {
+				if evt.Action == "die" {
+					ctx = withExitCode(ctx, evt.Actor.Attributes)
+				}
+				if evt.Action == "oom" {
+					logger.Warn("Exported container has been OOM killed.")
+					exportedOOMKills.Inc()
+				}
+
 				if cancelled := cancellables.cancel(evt.Actor.ID); cancelled {
 					logger.Debug("Set up process was running and has been cancelled.")
 				}
 			}
 
+			inflight.Add(1)
 			go func(ctx context.Context, evt events.Message) {
+				defer inflight.Done()
+
 				handler := func() error {
-					switch evt.Action {
+					switch baseAction(evt.Action) {
 					case "start":
-						return b.handleContainerStart(ctx, evt.Actor.ID, promNetwork)
+						return b.handleContainerStart(ctx, evt.Actor.ID, promNetworks)
 					case "die":
-						return b.handleContainerStop(ctx, evt.Actor.ID)
+						return b.handleContainerStop(ctx, evt.Actor.ID, stackOf(evt.Actor.Attributes))
+					case "oom":
+						// The namespace shared with the exporter is usually
+						// broken after an OOM kill, so the exporter is
+						// forcefully cleaned up
+						return b.handleContainerStop(ctx, evt.Actor.ID, stackOf(evt.Actor.Attributes))
+					case "rename":
+						return b.handleContainerRename(ctx, evt.Actor.ID, promNetworks)
+					case "health_status":
+						return b.handleHealthStatus(ctx, evt.Actor.ID, strings.TrimSpace(strings.TrimPrefix(evt.Action, "health_status:")), promNetworks)
 					default:
 						return fmt.Errorf("Action %q for %s %q is not supported.", evt.Action, evt.Type, evt.Actor.ID)
 					}
@@ -121,7 +251,7 @@ func (b Backend) ListenEventsForExported(ctx context.Context, promNetwork string
 
 				logger := log.GetLogger(ctx)
 
-				if err := retry(3, 5, handler); err != nil {
+				if err := retry(b.retryAttempts, b.retryInterval, b.retryMaxInterval, handler); err != nil {
 					logger.Errorf("%+v", err)
 				}
 
@@ -131,23 +261,141 @@ func (b Backend) ListenEventsForExported(ctx context.Context, promNetwork string
 	}
 }
 
-// @TODO: implement true back-off retry
-func retry(times uint, interval time.Duration, f func() error) error {
-	err := f()
+// withExitCode adds the exit code given by the attributes of a die event to
+// the logger of ctx, and counts non-zero exits
+func withExitCode(ctx context.Context, attributes map[string]string) context.Context {
+	logger := log.GetLogger(ctx)
 
+	exitCode, err := strconv.Atoi(attributes["exitCode"])
 	if err != nil {
-		times = times - 1
+		logger.Debugf("No valid exit code in die event: %q.", attributes["exitCode"])
+		return ctx
+	}
+
+	logger = logger.WithField("exported.exit_code", exitCode)
+	if exitCode != 0 {
+		logger.Warnf("Exported container exited with code %d.", exitCode)
+		exportedFailedExits.Inc()
+	} else {
+		logger.Debug("Exported container exited.")
+	}
+
+	return log.WithLogger(ctx, logger)
+}
+
+// watchedActions returns the container actions subscribed to: the
+// configured ones, or start and die by default, and the ones required by
+// enabled features
+func (b DockerBackend) watchedActions() []string {
+	actions := append([]string{}, DefaultEvents...)
+	if len(b.events) > 0 {
+		actions = append([]string{}, b.events...)
+	}
+
+	if b.podmanCompat {
+		actions = appendMissing(actions, "died")
 	}
-	if times != 0 && err != nil {
-		time.Sleep(interval)
+	if b.handleOOM {
+		actions = appendMissing(actions, "oom")
+	}
+	if b.unhealthyAction != UnhealthyActionNone {
+		actions = appendMissing(actions, "health_status")
+	}
+
+	return actions
+}
+
+// startsOnHealthy checks if exporters are started when their exported
+// container becomes healthy
+func (b DockerBackend) startsOnHealthy() bool {
+	for _, action := range b.events {
+		if action == "health_status" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendMissing(actions []string, action string) []string {
+	for _, a := range actions {
+		if a == action {
+			return actions
+		}
+	}
+
+	return append(actions, action)
+}
+
+func (b DockerBackend) isWatchedAction(action string) bool {
+	for _, a := range b.watchedActions() {
+		if a == baseAction(action) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizePodmanEvent translates events emitted by Podman Docker-compatible
+// API into their Docker counterpart
+func normalizePodmanEvent(evt events.Message) events.Message {
+	// Some Podman versions only fill the deprecated status field
+	if evt.Action == "" {
+		evt.Action = evt.Status
+	}
+	// Podman names container death "died" instead of "die"
+	if evt.Action == "died" {
+		evt.Action = "die"
+	}
+
+	return evt
+}
+
+// baseAction strips the status from actions like "health_status: healthy"
+func baseAction(action string) string {
+	return strings.SplitN(action, ":", 2)[0]
+}
+
+// retry calls f until it succeeds or has been called the given number of times.
+// The delay between two attempts doubles each time, up to maxInterval.
+func retry(times uint, interval, maxInterval time.Duration, f func() error) error {
+	var err error
 
-		err = retry(times, interval, f)
+	// f is always called at least once
+	if times == 0 {
+		times = 1
+	}
+
+	for attempt := uint(0); attempt < times; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoffDelay(attempt, interval, maxInterval))
+		}
+
+		if err = f(); err == nil {
+			return nil
+		}
 	}
 
 	return err
 }
 
-func (b Backend) handleContainerStart(ctx context.Context, containerId, promNetwork string) error {
+// backoffDelay computes the delay to wait before the given attempt (starting
+// at 1 for the first retry)
+func backoffDelay(attempt uint, interval, maxInterval time.Duration) time.Duration {
+	delay := interval
+	for i := uint(1); i < attempt && delay < maxInterval; i++ {
+		delay *= 2
+	}
+
+	if delay > maxInterval {
+		return maxInterval
+	}
+
+	return delay
+}
+
+func (b DockerBackend) handleContainerStart(ctx context.Context, containerId string, promNetworks []string) error {
 	logger := log.GetLogger(ctx)
 	container, err := b.cli.ContainerInspect(ctx, containerId)
 
@@ -158,79 +406,312 @@ func (b Backend) handleContainerStart(ctx context.Context, containerId, promNetw
 		return errors.WithStack(err)
 	}
 
-	// We first check if an exporter name has been explicitly provided
-	exporterType, err := readLabel(container, LABEL_EXPORTER_NAME)
+	logger = logger.WithFields(logrus.Fields{
+		"exported.name": container.Name,
+	})
+	ctx = log.WithLogger(ctx, logger)
+
+	if !b.filter.Allows([]string{container.Name}, container.Config.Image, container.Config.Labels) {
+		logger.Debug("Container excluded by filters.")
+		return nil
+	}
+
+	exporters, err := b.resolveExporters(ctx, newTaskToExport(container))
 	if err != nil {
 		return err
 	}
 
-	// Then we try to find a predefined exporter matching container metadata
-	if exporterType == "" {
-		exporterType = models.FindMatchingExporter(container.Name)
+	for _, exporter := range exporters {
+		logger.WithFields(logrus.Fields{
+			"exporter.name":  exporter.Name,
+			"exporter.image": exporter.Image,
+		}).Info("Starting exporter...")
+
+		exporter.PromNetworks = promNetworks
+		b.RunExporter(ctx, exporter)
 	}
 
-	logger = logger.WithFields(logrus.Fields{
-		"exported.name": container.Name,
-	})
-	ctx = log.WithLogger(ctx, logger)
+	return nil
+}
 
-	// At this point, if no exporter has been found, we abort start up process
-	if exporterType == "" {
+// findExporters returns the exporters that should run for the given
+// container, indexed by exporter type
+func (b DockerBackend) findExporters(ctx context.Context, task models.TaskToExport) (map[string]models.Exporter, error) {
+	exporters, err := lookupExporters(ctx, b.finder.get(), task)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.rewriteImages(b.applyDefaultPort(exporters)), nil
+}
+
+// lookupExporters returns the exporters found by finder for the given task,
+// indexed by exporter type
+func lookupExporters(ctx context.Context, finder models.ExporterFinder, task models.TaskToExport) (map[string]models.Exporter, error) {
+	logger := log.GetLogger(ctx)
+
+	// We first check if an exporter name has been explicitly provided
+	exporterType, err := readLabel(task, LABEL_EXPORTER_NAME)
+	if err != nil {
+		return nil, err
+	}
+
+	if exporterType != "" {
+		exporter, err := finder.GetExporter(exporterType, task)
+		if models.IsErrPredefinedExporterNotFound(err) {
+			logger.Warnf("No exporter named %q found.", exporterType)
+			return map[string]models.Exporter{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return map[string]models.Exporter{exporterType: exporter}, nil
+	}
+
+	// Then we try to find exporters matching container metadata
+	exporters, errs := finder.FindMatchingExporters(task)
+	for _, err := range errs {
+		logger.Errorf("%+v", err)
+	}
+
+	return exporters, nil
+}
+
+// applyDefaultPort sets the default scrape port on exporters having none
+func (b DockerBackend) applyDefaultPort(exporters map[string]models.Exporter) map[string]models.Exporter {
+	for exporterType, exporter := range exporters {
+		if exporter.Port == "" {
+			exporter.Port = b.defaultScrapePort
+			exporters[exporterType] = exporter
+		}
+	}
+
+	return exporters
+}
+
+// resolveExporters finds which exporters should be run for the given
+// container, sorted by name
+func (b DockerBackend) resolveExporters(ctx context.Context, task models.TaskToExport) ([]models.Exporter, error) {
+	logger := log.GetLogger(ctx)
+
+	found, err := b.findExporters(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 {
 		logger.Debug("No exporter name provided and no matching exporter found.")
+		return []models.Exporter{}, nil
+	}
 
-		return nil
+	exporters := make([]models.Exporter, 0, len(found))
+	for exporterType, exporter := range found {
+		// Central exporters are only registered in service discovery
+		if exporter.IsCentral() {
+			logger.Debugf("Exporter %q runs centrally at %q, skipped.", exporterType, exporter.CentralAddress)
+			continue
+		}
+
+		exporter.Name = exporterName(ctx, exporterType, task)
+
+		exporter, ok, err := b.avoidNameCollision(ctx, exporter)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		exporters = append(exporters, exporter)
 	}
 
-	exporterName := getExporterName(container.Name)
-	exporter, err := models.FromPredefinedExporter(exporterName, exporterType, container)
-	if models.IsErrPredefinedExporterNotFound(err) {
-		logger.Warnf("No predefined exporter named %q found.", exporterType)
-		return nil
+	sort.Slice(exporters, func(i, j int) bool {
+		return exporters[i].Name < exporters[j].Name
+	})
+
+	return exporters, nil
+}
+
+// avoidNameCollision checks if a container not managed by prom-autoexporter
+// already has the name of the given exporter, and applies the configured
+// collision policy. It returns false when the exporter should be skipped.
+func (b DockerBackend) avoidNameCollision(ctx context.Context, exporter models.Exporter) (models.Exporter, bool, error) {
+	existing, err := b.cli.ContainerInspect(ctx, exporter.Name)
+	if client.IsErrNotFound(err) {
+		return exporter, true, nil
 	} else if err != nil {
-		return err
+		return exporter, false, errors.WithStack(err)
 	}
 
-	logger.WithFields(logrus.Fields{
-		"exporter.image": exporter.Image,
-	}).Info("Starting exporter...")
+	if _, ok := existing.Config.Labels[LABEL_EXPORTED_ID]; ok {
+		return exporter, true, nil
+	}
 
-	exporter.PromNetwork = promNetwork
-	b.RunExporter(ctx, exporter)
+	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+		"exporter.name": exporter.Name,
+		"colliding.cid": existing.ID,
+	})
 
-	return nil
+	if b.collisionPolicy != CollisionPolicySuffix {
+		logger.Warn("A container not managed by prom-autoexporter has the name of the exporter, skipping it.")
+		return exporter, false, nil
+	}
+
+	exporter.Name = getSuffixedExporterName(exporter.Name, exporter.Exported.ID)
+	logger.WithField("exporter.suffixed_name", exporter.Name).Warn("A container not managed by prom-autoexporter has the name of the exporter, suffixing it.")
+
+	return exporter, true, nil
 }
 
-func readLabel(container types.ContainerJSON, label string) (string, error) {
-	return renderTpl(container.Config.Labels[label], container)
+func readLabel(task models.TaskToExport, label string) (string, error) {
+	return models.RenderTpl(task.Labels[label], task)
 }
 
-func renderTpl(tplStr string, values interface{}) (string, error) {
-	tpl, err := template.New("").Parse(tplStr)
-	if err != nil {
-		return "", errors.WithStack(err)
+func newTaskToExport(container types.ContainerJSON) models.TaskToExport {
+	task := models.NewTaskToExport(container.ID, container.Name, container.Config.Image, container.Config.Labels)
+	if container.State != nil {
+		task.State = container.State.Status
 	}
 
-	var buf bytes.Buffer
-	writer := bufio.NewWriter(&buf)
-	err = tpl.Execute(writer, values)
+	return task
+}
+
+func (b DockerBackend) handleContainerStop(ctx context.Context, containerId, stack string) error {
+	// Targets of the stopped container are removed from file_sd even when
+	// its exporters are kept or fail to be cleaned up
+	defer b.writeFileSD(ctx)
+
+	if b.stopOrder == StopOrderNone || stack == "" {
+		err := b.CleanupExporterByExportedID(ctx, containerId, true)
+		if IsErrExporterNotFound(err) {
+			log.GetLogger(ctx).Debug("No exporter to clean up.")
+			return nil
+		}
+
+		return err
+	}
+
+	exporters, err := b.exportersToStop(ctx, containerId, stack)
 	if err != nil {
-		return "", errors.WithStack(err)
+		return err
 	}
 
-	writer.Flush()
-	val := buf.String()
+	var lastErr error
+	for _, exporter := range exporters {
+		err := b.CleanupExporter(ctx, exporter.ID, true)
+		if err != nil && !IsErrExporterNotFound(err) {
+			log.GetLogger(ctx).Errorf("%+v", err)
+			lastErr = err
+		}
+	}
 
-	return val, nil
+	return lastErr
 }
 
-func (b Backend) handleContainerStop(ctx context.Context, containerId string) error {
-	exporter, found, err := b.FindAssociatedExporter(ctx, containerId)
+// handleContainerRename recreates the exporters of a renamed container, such
+// that their names and labels are derived from its new name
+func (b DockerBackend) handleContainerRename(ctx context.Context, containerId string, promNetworks []string) error {
+	container, err := b.cli.ContainerInspect(ctx, containerId)
+	if client.IsErrNotFound(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
 
+	exporters, err := b.FindAssociatedExporters(ctx, containerId)
 	if err != nil {
 		return err
-	} else if !found {
+	}
+
+	logger := log.GetLogger(ctx).WithField("exported.name", container.Name)
+	ctx = log.WithLogger(ctx, logger)
+
+	renamed := false
+	for _, exporter := range exporters {
+		if exporter.Labels[LABEL_EXPORTED_NAME] == container.Name {
+			continue
+		}
+
+		logger.WithField("exporter.cid", exporter.ID).Info("Exported container renamed, recreating its exporter...")
+		renamed = true
+
+		err := b.CleanupExporter(ctx, exporter.ID, true)
+		if err != nil && !IsErrExporterNotFound(err) {
+			return err
+		}
+	}
+
+	if !renamed || container.State == nil || !container.State.Running {
 		return nil
 	}
 
-	return b.CleanupExporter(ctx, exporter.ID, true)
+	return b.handleContainerStart(ctx, containerId, promNetworks)
+}
+
+// handleHealthStatus applies the configured action to the exporters of an
+// unhealthy exported container, and reverts it once the container is healthy
+func (b DockerBackend) handleHealthStatus(ctx context.Context, containerId, status string, promNetworks []string) error {
+	if status == "healthy" && b.startsOnHealthy() {
+		if err := b.handleContainerStart(ctx, containerId, promNetworks); err != nil {
+			return err
+		}
+	}
+
+	if b.unhealthyAction == UnhealthyActionNone {
+		return nil
+	}
+
+	exporters, err := b.FindAssociatedExporters(ctx, containerId)
+	if err != nil {
+		return err
+	}
+
+	for _, exporter := range exporters {
+		logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+			"exporter.cid":  exporter.ID,
+			"health.status": status,
+		})
+		ctx := log.WithLogger(ctx, logger)
+
+		if err := b.applyUnhealthyAction(ctx, exporter, status); err != nil {
+			return err
+		}
+	}
+
+	if b.unhealthyAction == UnhealthyActionAnnotate && len(exporters) > 0 {
+		b.writeFileSD(ctx)
+	}
+
+	return nil
+}
+
+func (b DockerBackend) applyUnhealthyAction(ctx context.Context, exporter types.Container, status string) error {
+	logger := log.GetLogger(ctx)
+	paused := exporter.State == "paused"
+
+	switch {
+	case status == "unhealthy" && b.unhealthyAction == UnhealthyActionAnnotate:
+		logger.Warn("Exported container is unhealthy, its exporter might report errors.")
+	case status == "healthy" && b.unhealthyAction == UnhealthyActionAnnotate:
+		logger.Info("Exported container is healthy again.")
+	case status == "unhealthy" && b.unhealthyAction == UnhealthyActionPause && !paused:
+		logger.Info("Exported container is unhealthy, pausing its exporter...")
+
+		if b.dryRun {
+			logger.Info("[dry-run] Would pause exporter container.")
+			return nil
+		}
+
+		return errors.WithStack(b.cli.ContainerPause(ctx, exporter.ID))
+	case status == "healthy" && b.unhealthyAction == UnhealthyActionPause && paused:
+		logger.Info("Exported container is healthy again, resuming its exporter...")
+
+		if b.dryRun {
+			logger.Info("[dry-run] Would unpause exporter container.")
+			return nil
+		}
+
+		return errors.WithStack(b.cli.ContainerUnpause(ctx, exporter.ID))
+	}
+
+	return nil
 }
@@ -0,0 +1,1072 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/sirupsen/logrus"
+)
+
+func TestReadLabelDoesNotEscapeValues(t *testing.T) {
+	task := models.NewTaskToExport("app-id", "/app", "app", map[string]string{
+		"autoexporter.dsn": "postgresql://user:p&ss<word>@{{.Name}}:5432/?sslmode=disable&connect_timeout=5",
+	})
+
+	val, err := readLabel(task, "autoexporter.dsn")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if expected := "postgresql://user:p&ss<word>@/app:5432/?sslmode=disable&connect_timeout=5"; val != expected {
+		t.Errorf("expected %q, got %q", expected, val)
+	}
+}
+
+func TestBackoffDelayGrowsAndIsBounded(t *testing.T) {
+	interval := 5 * time.Second
+	maxInterval := 30 * time.Second
+
+	expected := []time.Duration{
+		5 * time.Second,
+		10 * time.Second,
+		20 * time.Second,
+		30 * time.Second,
+		30 * time.Second,
+	}
+
+	for i, want := range expected {
+		attempt := uint(i + 1)
+		if got := backoffDelay(attempt, interval, maxInterval); got != want {
+			t.Errorf("attempt %d: expected delay %s, got %s", attempt, want, got)
+		}
+	}
+
+	// Large attempt numbers must not overflow past the cap
+	if got := backoffDelay(200, interval, maxInterval); got != maxInterval {
+		t.Errorf("expected delay to be capped to %s, got %s", maxInterval, got)
+	}
+}
+
+func TestRetryStopsOnSuccess(t *testing.T) {
+	calls := 0
+	err := retry(5, time.Millisecond, 2*time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestRetryReturnsLastError(t *testing.T) {
+	calls := 0
+	err := retry(3, time.Millisecond, 2*time.Millisecond, func() error {
+		calls++
+		return errors.New("permanent")
+	})
+
+	if err == nil || err.Error() != "permanent" {
+		t.Fatalf("expected the last error to be returned, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestRetryWaitsBetweenAttempts(t *testing.T) {
+	start := time.Now()
+	retry(3, 10*time.Millisecond, 15*time.Millisecond, func() error {
+		return errors.New("permanent")
+	})
+
+	// 10ms before the 2nd attempt, then 15ms (capped) before the 3rd one
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Errorf("expected retry to wait at least 25ms, waited %s", elapsed)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	b := NewDockerBackend(&fakeClient{}, WithRetry(7, time.Second, time.Minute))
+
+	if b.retryAttempts != 7 || b.retryInterval != time.Second || b.retryMaxInterval != time.Minute {
+		t.Errorf("unexpected retry settings: %d, %s, %s", b.retryAttempts, b.retryInterval, b.retryMaxInterval)
+	}
+}
+
+func TestListenForTasksToExportResubscribesOnError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	subscriptions := make(chan types.EventsOptions, 2)
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			calls++
+			subscriptions <- options
+
+			// Only the first stream fails
+			errCh := make(chan error, 1)
+			if calls == 1 {
+				errCh <- errors.New("connection reset by peer")
+			}
+
+			return make(chan events.Message), errCh
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli, WithRetry(3, time.Millisecond, time.Millisecond))
+	done := make(chan struct{})
+	go func() {
+		b.ListenForTasksToExport(ctx, []string{"prometheus"})
+		close(done)
+	}()
+
+	first := waitSubscription(t, subscriptions)
+	second := waitSubscription(t, subscriptions)
+
+	if second.Since != first.Since {
+		t.Errorf("expected to resume from %q when no event was received, got %q", first.Since, second.Since)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener did not return after ctx cancellation")
+	}
+}
+
+func TestListenForTasksToExportResubscribesOnClosedChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lastEvt := time.Unix(1546300800, 42)
+	calls := 0
+	subscriptions := make(chan types.EventsOptions, 2)
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			calls++
+			subscriptions <- options
+
+			// The first stream delivers an event emitted by an exporter,
+			// and is then closed
+			evtCh := make(chan events.Message, 1)
+			if calls == 1 {
+				evtCh <- events.Message{
+					Type:     events.ContainerEventType,
+					Action:   "start",
+					Actor:    events.Actor{ID: "exporter-id", Attributes: map[string]string{LABEL_EXPORTED_NAME: "/redis"}},
+					TimeNano: lastEvt.UnixNano(),
+				}
+				close(evtCh)
+			}
+
+			return evtCh, make(chan error)
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli, WithRetry(3, time.Millisecond, time.Millisecond))
+	done := make(chan struct{})
+	go func() {
+		b.ListenForTasksToExport(ctx, []string{"prometheus"})
+		close(done)
+	}()
+
+	waitSubscription(t, subscriptions)
+	second := waitSubscription(t, subscriptions)
+
+	if expected := "1546300800.000000042"; second.Since != expected {
+		t.Errorf("expected to resume from %q, got %q", expected, second.Since)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener did not return after ctx cancellation")
+	}
+}
+
+func TestReplayedEventsAreHandledOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := events.Message{
+		Type:     events.ContainerEventType,
+		Action:   "start",
+		Actor:    events.Actor{ID: "redis-id"},
+		TimeNano: time.Unix(1546300800, 42).UnixNano(),
+	}
+
+	calls := 0
+	subscriptions := make(chan types.EventsOptions, 2)
+	var mu sync.Mutex
+	inspected := map[string]int{}
+	handled := make(chan struct{})
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			calls++
+			subscriptions <- options
+
+			// The stream resumes from the last event received, which is
+			// replayed before the next one
+			evtCh := make(chan events.Message, 2)
+			evtCh <- start
+			if calls == 1 {
+				close(evtCh)
+			} else {
+				next := start
+				next.Actor.ID = "php-id"
+				next.TimeNano++
+				evtCh <- next
+			}
+
+			return evtCh, make(chan error)
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			mu.Lock()
+			inspected[id]++
+			mu.Unlock()
+
+			if id == "php-id" {
+				close(handled)
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli, WithRetry(3, time.Millisecond, time.Millisecond))
+	done := make(chan struct{})
+	go func() {
+		b.ListenForTasksToExport(ctx, []string{"prometheus"})
+		close(done)
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("the event following the replayed one has not been handled")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener did not return after ctx cancellation")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if inspected["redis-id"] != 1 {
+		t.Errorf("expected the replayed event to be handled once, got %d", inspected["redis-id"])
+	}
+}
+
+func TestOOMEventForcesExporterCleanup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exporter := types.Container{
+		ID:     "exporter-id",
+		Names:  []string{"/exporter.redis.redis"},
+		Labels: map[string]string{LABEL_EXPORTED_ID: "redis-id", LABEL_EXPORTED_NAME: "/redis"},
+	}
+	subscriptions := make(chan types.EventsOptions, 1)
+	removed := make(chan string, 1)
+
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			subscriptions <- options
+
+			evtCh := make(chan events.Message, 1)
+			evtCh <- events.Message{
+				Type:     events.ContainerEventType,
+				Action:   "oom",
+				Actor:    events.Actor{ID: "redis-id"},
+				TimeNano: time.Now().UnixNano(),
+			}
+
+			return evtCh, make(chan error)
+		},
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers([]types.Container{exporter}, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id == exporter.ID {
+				return exportedContainer(exporter.ID, exporter.Names[0], exporter.Labels), nil
+			}
+
+			// The exported container is still running, cleanup has to be forced
+			return exportedContainer(id, "/redis", nil), nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			removed <- id
+			return nil
+		},
+	}
+
+	oomKills := exportedOOMKills.Value()
+	var b Backend = NewDockerBackend(cli, WithOOMHandling(true))
+	go b.ListenForTasksToExport(ctx, []string{"prometheus"})
+
+	options := waitSubscription(t, subscriptions)
+	if events := subscribedEvents(options); !reflect.DeepEqual(events, []string{"die", "oom", "rename", "start"}) {
+		t.Errorf("expected oom events to be watched, got filters %v", options.Filters)
+	}
+
+	select {
+	case id := <-removed:
+		if id != exporter.ID {
+			t.Errorf("expected exporter %q to be removed, got %q", exporter.ID, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exporter has not been cleaned up after the oom event")
+	}
+
+	if got := exportedOOMKills.Value() - oomKills; got != 1 {
+		t.Errorf("expected 1 OOM kill to be counted, got %v", got)
+	}
+}
+
+func TestHealthyEventStartsExporters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	subscriptions := make(chan types.EventsOptions, 1)
+	created := make(chan string, 1)
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			subscriptions <- options
+
+			evtCh := make(chan events.Message, 1)
+			evtCh <- events.Message{
+				Type:     events.ContainerEventType,
+				Action:   "health_status: healthy",
+				Actor:    events.Actor{ID: "redis-id"},
+				TimeNano: time.Now().UnixNano(),
+			}
+
+			return evtCh, make(chan error)
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id != "redis-id" {
+				return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+			}
+			return exportedContainer(id, "/redis", nil), nil
+		},
+		containerListFn: noContainers,
+		imageInspectFn:  imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			created <- name
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli, WithEvents([]string{"die", "health_status"}), WithFinder(stubFinder{
+		"/redis": {stubExporter("redis", "redis_exporter")},
+	}))
+	go b.ListenForTasksToExport(ctx, []string{"prometheus"})
+
+	options := waitSubscription(t, subscriptions)
+	if events := subscribedEvents(options); !reflect.DeepEqual(events, []string{"die", "health_status"}) {
+		t.Errorf("expected only die and health_status events to be watched, got filters %v", options.Filters)
+	}
+
+	select {
+	case name := <-created:
+		if name != getExporterName("redis", "/redis", "redis-id") {
+			t.Errorf("unexpected exporter %q created", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exporter has not been started after the container became healthy")
+	}
+}
+
+func TestRenameEventRecreatesExporters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	exporters := []types.Container{{
+		ID:     "exporter-id",
+		Names:  []string{getExporterName("redis", "/redis", "redis-id")},
+		State:  "running",
+		Labels: map[string]string{LABEL_EXPORTED_ID: "redis-id", LABEL_EXPORTED_NAME: "/redis", LABEL_EXPORTER_TYPE: "redis"},
+	}}
+
+	removed := make(chan string, 1)
+	created := make(chan *container.Config, 1)
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			evtCh := make(chan events.Message, 1)
+			evtCh <- events.Message{
+				Type:     events.ContainerEventType,
+				Action:   "rename",
+				Actor:    events.Actor{ID: "redis-id", Attributes: map[string]string{"name": "cache", "oldName": "/redis"}},
+				TimeNano: time.Now().UnixNano(),
+			}
+
+			return evtCh, make(chan error)
+		},
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			return filterContainers(exporters, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if id == "redis-id" {
+				return exportedContainer(id, "/cache", nil), nil
+			}
+			for _, c := range exporters {
+				if c.ID == id || c.Names[0] == id {
+					return exportedContainer(c.ID, c.Names[0], c.Labels), nil
+				}
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			exporters = []types.Container{}
+			removed <- id
+			return nil
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			if name != getExporterName("redis", "/cache", "redis-id") {
+				t.Errorf("unexpected exporter %q created", name)
+			}
+			created <- config
+			return container.ContainerCreateCreatedBody{ID: "new-exporter-id"}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli, WithFinder(stubFinder{
+		"/cache": {stubExporter("redis", "redis_exporter")},
+	}))
+	go b.ListenForTasksToExport(ctx, []string{"prometheus"})
+
+	select {
+	case id := <-removed:
+		if id != "exporter-id" {
+			t.Errorf("expected the exporter of the old name to be removed, got %q", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exporter has not been removed after the rename event")
+	}
+
+	select {
+	case config := <-created:
+		if config.Labels[LABEL_EXPORTED_NAME] != "/cache" {
+			t.Errorf("expected the exporter to be labeled with the new name, got %v", config.Labels)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exporter has not been recreated after the rename event")
+	}
+}
+
+func TestValidateEvents(t *testing.T) {
+	if err := ValidateEvents([]string{"start", "health_status"}); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := ValidateEvents([]string{"start", "exec_start"}); err == nil {
+		t.Error("expected unsupported events to be rejected")
+	}
+}
+
+func TestOOMEventsAreNotWatchedByDefault(t *testing.T) {
+	b := NewDockerBackend(&fakeClient{})
+
+	if b.isWatchedAction("oom") {
+		t.Error("expected oom events to be ignored by default")
+	}
+}
+
+func TestHealthTransitions(t *testing.T) {
+	testcases := map[string]struct {
+		action   string
+		expected []string
+	}{
+		"pause": {
+			action:   UnhealthyActionPause,
+			expected: []string{"pause", "unpause"},
+		},
+		"annotate": {
+			action:   UnhealthyActionAnnotate,
+			expected: []string{},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		t.Run(tcname, func(t *testing.T) {
+			exporter := types.Container{
+				ID:     "exporter-id",
+				State:  "running",
+				Labels: map[string]string{LABEL_EXPORTED_ID: "redis-id"},
+			}
+			calls := []string{}
+
+			cli := &fakeClient{
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					return filterContainers([]types.Container{exporter}, options.Filters), nil
+				},
+				containerPauseFn: func(ctx context.Context, id string) error {
+					calls = append(calls, "pause")
+					exporter.State = "paused"
+					return nil
+				},
+				containerUnpauseFn: func(ctx context.Context, id string) error {
+					calls = append(calls, "unpause")
+					exporter.State = "running"
+					return nil
+				},
+			}
+
+			b := NewDockerBackend(cli, WithUnhealthyAction(tc.action))
+			for _, status := range []string{"unhealthy", "unhealthy", "healthy", "healthy"} {
+				if err := b.handleHealthStatus(context.Background(), "redis-id", status, []string{"prometheus"}); err != nil {
+					t.Fatalf("unexpected error: %+v", err)
+				}
+			}
+
+			if !reflect.DeepEqual(calls, tc.expected) {
+				t.Errorf("expected calls %v, got %v", tc.expected, calls)
+			}
+		})
+	}
+}
+
+func TestHealthStatusEventsAreWatchedWhenConfigured(t *testing.T) {
+	if NewDockerBackend(&fakeClient{}).isWatchedAction("health_status: unhealthy") {
+		t.Error("expected health_status events to be ignored by default")
+	}
+
+	b := NewDockerBackend(&fakeClient{}, WithUnhealthyAction(UnhealthyActionPause))
+	if !b.isWatchedAction("health_status: unhealthy") {
+		t.Error("expected health_status events to be watched")
+	}
+}
+
+func TestPodmanDiedEventCleansUpExporter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exporter := types.Container{
+		ID:     "exporter-id",
+		Names:  []string{"/exporter.redis.redis"},
+		Labels: map[string]string{LABEL_EXPORTED_ID: "redis-id", LABEL_EXPORTED_NAME: "/redis"},
+	}
+	subscriptions := make(chan types.EventsOptions, 1)
+	removed := make(chan string, 1)
+
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			subscriptions <- options
+
+			// Podman reports container death as "died", in the status field only
+			evtCh := make(chan events.Message, 1)
+			evtCh <- events.Message{
+				Type:     events.ContainerEventType,
+				Status:   "died",
+				Actor:    events.Actor{ID: "redis-id"},
+				TimeNano: time.Now().UnixNano(),
+			}
+
+			return evtCh, make(chan error)
+		},
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers([]types.Container{exporter}, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id == exporter.ID {
+				return exportedContainer(exporter.ID, exporter.Names[0], exporter.Labels), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			removed <- id
+			return nil
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli, WithPodmanCompat(true))
+	go b.ListenForTasksToExport(ctx, []string{"prometheus"})
+
+	options := waitSubscription(t, subscriptions)
+	if events := subscribedEvents(options); !reflect.DeepEqual(events, []string{"die", "died", "rename", "start"}) {
+		t.Errorf("expected died events to be watched, got filters %v", options.Filters)
+	}
+
+	select {
+	case id := <-removed:
+		if id != exporter.ID {
+			t.Errorf("expected exporter %q to be removed, got %q", exporter.ID, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exporter has not been cleaned up after the died event")
+	}
+}
+
+func TestIsPodman(t *testing.T) {
+	testcases := map[string]struct {
+		components []types.ComponentVersion
+		expected   bool
+	}{
+		"docker": {
+			components: []types.ComponentVersion{{Name: "Engine"}, {Name: "containerd"}},
+			expected:   false,
+		},
+		"podman": {
+			components: []types.ComponentVersion{{Name: "Podman Engine"}, {Name: "Conmon"}},
+			expected:   true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		t.Run(tcname, func(t *testing.T) {
+			cli := &fakeClient{
+				serverVersionFn: func(ctx context.Context) (types.Version, error) {
+					return types.Version{Components: tc.components}, nil
+				},
+			}
+
+			podman, err := IsPodman(context.Background(), cli)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if podman != tc.expected {
+				t.Errorf("expected IsPodman to be %t, got %t", tc.expected, podman)
+			}
+		})
+	}
+}
+
+func waitSubscription(t *testing.T, subscriptions <-chan types.EventsOptions) types.EventsOptions {
+	t.Helper()
+
+	select {
+	case options := <-subscriptions:
+		return options
+	case <-time.After(time.Second):
+		t.Fatal("listener did not subscribe to Docker events")
+	}
+
+	return types.EventsOptions{}
+}
+
+// subscribedEvents returns the sorted container actions subscribed to
+func subscribedEvents(options types.EventsOptions) []string {
+	events := options.Filters.Get("event")
+	sort.Strings(events)
+
+	return events
+}
+
+func TestRecreatedContainerGetsAFreshExporter(t *testing.T) {
+	// The exporter shares the netns of the previous redis container, which is
+	// dead: it restarts in loop and isn't listed without the All option
+	stale := types.Container{
+		ID:     "stale-exporter-id",
+		Names:  []string{"/exporter.redis.redis"},
+		State:  "restarting",
+		Labels: map[string]string{LABEL_EXPORTED_ID: "old-redis-id", LABEL_EXPORTED_NAME: "/redis", LABEL_EXPORTER_TYPE: "redis"},
+	}
+	containers := []types.Container{stale}
+
+	var removed []string
+	var created *container.HostConfig
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			listed := []types.Container{}
+			for _, c := range filterContainers(containers, options.Filters) {
+				if options.All || c.State == "running" {
+					listed = append(listed, c)
+				}
+			}
+			return listed, nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, c := range containers {
+				if c.ID == id || c.Names[0] == id {
+					return exportedContainer(c.ID, c.Names[0], c.Labels), nil
+				}
+			}
+			if id == "new-redis-id" {
+				return exportedContainer(id, "/redis", nil), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			removed = append(removed, id)
+			return nil
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			created = hostConfig
+			return container.ContainerCreateCreatedBody{ID: "new-exporter-id"}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli, WithFinder(stubFinder{
+		"/redis": {stubExporter("redis", "redis_exporter")},
+	}))
+
+	t.Run("die tears down the exporter even if not running", func(t *testing.T) {
+		removed = nil
+		if err := b.handleContainerStop(context.Background(), "old-redis-id", ""); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if !reflect.DeepEqual(removed, []string{stale.ID}) {
+			t.Errorf("expected stale exporter to be removed, got %v", removed)
+		}
+	})
+
+	t.Run("start replaces the exporter left by a missed die", func(t *testing.T) {
+		removed = nil
+		if err := b.handleContainerStart(context.Background(), "new-redis-id", []string{"prometheus"}); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		if !reflect.DeepEqual(removed, []string{stale.ID}) {
+			t.Errorf("expected stale exporter to be removed, got %v", removed)
+		}
+		if created == nil || created.NetworkMode != "container:new-redis-id" {
+			t.Errorf("expected exporter to share the netns of the new container, got %+v", created)
+		}
+	})
+
+	t.Run("stale exporters are reported as missing", func(t *testing.T) {
+		containers = []types.Container{
+			{ID: "new-redis-id", Names: []string{"/redis"}, State: "running"},
+			stale,
+		}
+
+		missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		if len(missing) != 1 || missing[0].Exported.ID != "new-redis-id" {
+			t.Errorf("expected the exporter of the new container to be missing, got %+v", missing)
+		}
+	})
+}
+
+func TestDieEventCancelsPendingStartup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evtCh := make(chan events.Message, 2)
+	evtCh <- events.Message{
+		Type:     events.ContainerEventType,
+		Action:   "start",
+		Actor:    events.Actor{ID: "redis-id"},
+		TimeNano: time.Now().UnixNano(),
+	}
+
+	pulling := make(chan struct{})
+	aborted := make(chan struct{})
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			return evtCh, make(chan error)
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id != "redis-id" {
+				return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+			}
+			return exportedContainer(id, "/redis", nil), nil
+		},
+		containerListFn: noContainers,
+		imageInspectFn:  imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			close(pulling)
+
+			// Blocks until the startup is cancelled
+			<-ctx.Done()
+			close(aborted)
+
+			return nil, ctx.Err()
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli, WithRetry(1, time.Millisecond, time.Millisecond), WithFinder(stubFinder{
+		"/redis": {stubExporter("redis", "redis_exporter")},
+	}))
+	go b.ListenForTasksToExport(ctx, []string{"prometheus"})
+
+	select {
+	case <-pulling:
+	case <-time.After(time.Second):
+		t.Fatal("exporter startup did not begin")
+	}
+
+	evtCh <- events.Message{
+		Type:     events.ContainerEventType,
+		Action:   "die",
+		Actor:    events.Actor{ID: "redis-id", Attributes: map[string]string{"exitCode": "0"}},
+		TimeNano: time.Now().UnixNano(),
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("pending startup was not cancelled by the die event")
+	}
+}
+
+func TestListenForTasksToExportWaitsForPendingStartupsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pulling := make(chan struct{})
+	aborted := make(chan struct{})
+	cli := &fakeClient{
+		eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+			evtCh := make(chan events.Message, 1)
+			evtCh <- events.Message{
+				Type:     events.ContainerEventType,
+				Action:   "start",
+				Actor:    events.Actor{ID: "redis-id"},
+				TimeNano: time.Now().UnixNano(),
+			}
+
+			return evtCh, make(chan error)
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id != "redis-id" {
+				return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+			}
+			return exportedContainer(id, "/redis", nil), nil
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			close(pulling)
+
+			// Blocks until the startup is cancelled
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			close(aborted)
+
+			return nil, ctx.Err()
+		},
+	}
+
+	var b Backend = NewDockerBackend(cli, WithRetry(1, time.Millisecond, time.Millisecond), WithFinder(stubFinder{
+		"/redis": {stubExporter("redis", "redis_exporter")},
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		b.ListenForTasksToExport(ctx, []string{"prometheus"})
+		close(done)
+	}()
+
+	select {
+	case <-pulling:
+	case <-time.After(time.Second):
+		t.Fatal("exporter startup did not begin")
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener did not return after shutdown")
+	}
+
+	select {
+	case <-aborted:
+	default:
+		t.Error("listener returned before the pending startup was aborted")
+	}
+}
+
+func TestCentralExportersAreNotRun(t *testing.T) {
+	snmp := stubExporter("snmp", "prom/snmp-exporter")
+	snmp.CentralAddress = "snmp:9116"
+	redis := stubExporter("redis", "redis_exporter")
+
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+	b := NewDockerBackend(cli, WithFinder(stubFinder{"/router": {snmp, redis}}))
+
+	exporters, err := b.resolveExporters(context.Background(), models.NewTaskToExport("router-id", "/router", "router:1", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(exporters) != 1 || exporters[0].PredefinedType != "redis" {
+		t.Errorf("expected only the redis exporter to be run, got %+v", exporters)
+	}
+}
+
+func TestDieEventExitCodeIsLoggedAndCounted(t *testing.T) {
+	testcases := map[string]struct {
+		exitCode         string
+		expectedLogged   bool
+		expectedCounted  float64
+		expectedExitCode interface{}
+	}{
+		"killed container": {
+			exitCode:         "137",
+			expectedLogged:   true,
+			expectedCounted:  1,
+			expectedExitCode: 137,
+		},
+		"clean exit": {
+			exitCode:         "0",
+			expectedExitCode: 0,
+		},
+		"missing exit code": {},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := logrus.New()
+			logger.Out = &buf
+			logger.Level = logrus.WarnLevel
+			ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+
+			failedExits := exportedFailedExits.Value()
+			ctx = withExitCode(ctx, map[string]string{"exitCode": tc.exitCode, "name": "redis"})
+
+			if logged := strings.Contains(buf.String(), "exported.exit_code="+tc.exitCode); logged != tc.expectedLogged {
+				t.Errorf("expected the exit code to be logged: %t, got logs %q", tc.expectedLogged, buf.String())
+			}
+			if got := exportedFailedExits.Value() - failedExits; got != tc.expectedCounted {
+				t.Errorf("expected %v failed exits to be counted, got %v", tc.expectedCounted, got)
+			}
+			if exitCode := log.GetLogger(ctx).Data["exported.exit_code"]; exitCode != tc.expectedExitCode {
+				t.Errorf("expected the logger to carry exit code %v, got %v", tc.expectedExitCode, exitCode)
+			}
+		})
+	}
+}
+
+func TestNewTaskToExportCarriesImageAndState(t *testing.T) {
+	container := exportedContainer("redis-id", "/cache", map[string]string{"app": "cache"})
+	container.Config.Image = "redis:5"
+	container.State.Status = "running"
+
+	task := newTaskToExport(container)
+	if task.Image != "redis:5" || task.State != "running" {
+		t.Errorf("expected the task to carry its image and state, got %+v", task)
+	}
+}
+
+func TestExportersAreMatchedOnImage(t *testing.T) {
+	containers := []types.Container{
+		{ID: "cache-id", Names: []string{"/cache"}, Image: "redis:5", State: "running"},
+		{ID: "web-id", Names: []string{"/web"}, Image: "nginx:1.17", State: "running"},
+	}
+
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(containers, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, c := range containers {
+				if c.ID == id {
+					container := exportedContainer(c.ID, c.Names[0], nil)
+					container.Config.Image = c.Image
+					container.State.Status = c.State
+					return container, nil
+				}
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+
+	b := NewDockerBackend(cli, WithFinder(models.NewPredefinedExporterFinder()))
+	missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	found := map[string]string{}
+	for _, exporter := range missing {
+		found[exporter.Exported.Name] = exporter.PredefinedType
+		if exporter.Exported.State != "running" {
+			t.Errorf("expected the exported task state to be set, got %+v", exporter.Exported)
+		}
+	}
+
+	// Exporters are matched on the image, not on the container name
+	expected := map[string]string{"/cache": "redis", "/web": "nginx"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected exporters %v, got %v", expected, found)
+	}
+}
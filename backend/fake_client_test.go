@@ -0,0 +1,224 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// fakeClient implements client.APIClient by delegating to its func fields.
+// Calling a method whose func field is nil panics, as the embedded
+// interface is nil.
+type fakeClient struct {
+	client.APIClient
+
+	containerListFn    func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	containerInspectFn func(ctx context.Context, id string) (types.ContainerJSON, error)
+	imagePullFn        func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error)
+	imageInspectFn     func(ctx context.Context, image string) (types.ImageInspect, []byte, error)
+	eventsFn           func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	containerStartFn   func(ctx context.Context, id string, options types.ContainerStartOptions) error
+	containerPauseFn   func(ctx context.Context, id string) error
+	containerUnpauseFn func(ctx context.Context, id string) error
+	containerStopFn    func(ctx context.Context, id string) error
+	containerRemoveFn  func(ctx context.Context, id string, options types.ContainerRemoveOptions) error
+	containerCreateFn  func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error)
+
+	serverVersionFn         func(ctx context.Context) (types.Version, error)
+	networkConnectFn        func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error
+	networkInspectFn        func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+	networkDisconnectFn     func(ctx context.Context, networkID, containerID string, force bool) error
+	taskListFn              func(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
+	serviceInspectWithRawFn func(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error)
+	taskInspectWithRawFn    func(ctx context.Context, taskID string) (swarm.Task, []byte, error)
+	serviceListFn           func(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	serviceCreateFn         func(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error)
+	serviceRemoveFn         func(ctx context.Context, serviceID string) error
+	secretListFn            func(ctx context.Context, options types.SecretListOptions) ([]swarm.Secret, error)
+	copyToContainerFn       func(ctx context.Context, container, path string, content io.Reader, options types.CopyToContainerOptions) error
+	pingFn                  func(ctx context.Context) (types.Ping, error)
+	distributionInspectFn   func(ctx context.Context, image, encodedRegistryAuth string) (registry.DistributionInspect, error)
+	networkCreateFn         func(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error)
+}
+
+func (c *fakeClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return c.containerListFn(ctx, options)
+}
+
+func (c *fakeClient) ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	return c.containerInspectFn(ctx, id)
+}
+
+func (c *fakeClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return c.eventsFn(ctx, options)
+}
+
+func (c *fakeClient) ContainerStart(ctx context.Context, id string, options types.ContainerStartOptions) error {
+	return c.containerStartFn(ctx, id, options)
+}
+
+func (c *fakeClient) ContainerPause(ctx context.Context, id string) error {
+	return c.containerPauseFn(ctx, id)
+}
+
+func (c *fakeClient) ContainerUnpause(ctx context.Context, id string) error {
+	return c.containerUnpauseFn(ctx, id)
+}
+
+func (c *fakeClient) ContainerStop(ctx context.Context, id string, timeout *time.Duration) error {
+	return c.containerStopFn(ctx, id)
+}
+
+func (c *fakeClient) ContainerRemove(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+	return c.containerRemoveFn(ctx, id, options)
+}
+
+func (c *fakeClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+	return c.containerCreateFn(config, hostConfig, networkingConfig, name)
+}
+
+func (c *fakeClient) ServerVersion(ctx context.Context) (types.Version, error) {
+	return c.serverVersionFn(ctx)
+}
+
+func (c *fakeClient) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	return c.networkConnectFn(ctx, networkID, containerID, config)
+}
+
+func (c *fakeClient) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	return c.networkDisconnectFn(ctx, networkID, containerID, force)
+}
+
+func (c *fakeClient) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	return c.networkCreateFn(ctx, name, options)
+}
+
+func (c *fakeClient) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return c.networkInspectFn(ctx, networkID, options)
+}
+
+func (c *fakeClient) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	return c.taskListFn(ctx, options)
+}
+
+func (c *fakeClient) ServiceInspectWithRaw(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+	return c.serviceInspectWithRawFn(ctx, serviceID, options)
+}
+
+func (c *fakeClient) TaskInspectWithRaw(ctx context.Context, taskID string) (swarm.Task, []byte, error) {
+	return c.taskInspectWithRawFn(ctx, taskID)
+}
+
+func (c *fakeClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	return c.serviceListFn(ctx, options)
+}
+
+func (c *fakeClient) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	return c.serviceCreateFn(ctx, service, options)
+}
+
+func (c *fakeClient) ServiceRemove(ctx context.Context, serviceID string) error {
+	return c.serviceRemoveFn(ctx, serviceID)
+}
+
+func (c *fakeClient) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	return c.imagePullFn(ctx, ref, options)
+}
+
+func (c *fakeClient) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+	return c.imageInspectFn(ctx, image)
+}
+
+func (c *fakeClient) CopyToContainer(ctx context.Context, container, path string, content io.Reader, options types.CopyToContainerOptions) error {
+	return c.copyToContainerFn(ctx, container, path, content, options)
+}
+
+func (c *fakeClient) SecretList(ctx context.Context, options types.SecretListOptions) ([]swarm.Secret, error) {
+	return c.secretListFn(ctx, options)
+}
+
+func (c *fakeClient) Ping(ctx context.Context) (types.Ping, error) {
+	return c.pingFn(ctx)
+}
+
+func (c *fakeClient) DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registry.DistributionInspect, error) {
+	return c.distributionInspectFn(ctx, image, encodedRegistryAuth)
+}
+
+// filterContainers returns the containers matching the label filters of args,
+// as the Docker daemon would do
+func filterContainers(containers []types.Container, args filters.Args) []types.Container {
+	filtered := []types.Container{}
+	for _, c := range containers {
+		if args.MatchKVList("label", c.Labels) {
+			filtered = append(filtered, c)
+		}
+	}
+
+	return filtered
+}
+
+// stubFinder resolves exporters from the exported container name
+type stubFinder map[string][]models.Exporter
+
+func (f stubFinder) FindMatchingExporters(exported models.TaskToExport) (map[string]models.Exporter, []error) {
+	exporters := map[string]models.Exporter{}
+	for _, exporter := range f[exported.Name] {
+		exporter.Exported = exported
+		exporters[exporter.PredefinedType] = exporter
+	}
+
+	return exporters, nil
+}
+
+func (f stubFinder) GetExporter(exporterType string, exported models.TaskToExport) (models.Exporter, error) {
+	return models.Exporter{}, errors.New("not implemented")
+}
+
+// stubExporter returns an exporter of the given type, with a port as set by
+// finders, to be returned by a stubFinder
+func stubExporter(exporterType, image string) models.Exporter {
+	exporter := models.NewExporter("", exporterType, image, nil, nil, models.TaskToExport{})
+	exporter.Port = "9100"
+	return exporter
+}
+
+// noContainers fakes ContainerList when no container matches
+func noContainers(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return []types.Container{}, nil
+}
+
+// imageNotFound fakes ImageInspectWithRaw for images not present locally
+func imageNotFound(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{}, nil, errdefs.NotFound(errors.New("no such image"))
+}
+
+// attachedNetwork returns a NetworkInspect func for networks the given
+// containers are attached to
+func attachedNetwork(containers ...string) func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+		resource := types.NetworkResource{ID: networkID, Containers: map[string]types.EndpointResource{}}
+		for _, container := range containers {
+			resource.Containers[container] = types.EndpointResource{Name: strings.TrimPrefix(container, "/")}
+		}
+		return resource, nil
+	}
+}
+
+// emptyNetwork inspects a network no container is attached to
+func emptyNetwork(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return types.NetworkResource{ID: networkID, Containers: map[string]types.EndpointResource{}}, nil
+}
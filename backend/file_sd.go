@@ -0,0 +1,181 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// Characters not allowed in Prometheus label names
+var invalidPromLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// fileSD writes the targets of running exporters into a file_sd_config file.
+// It's shared between copies of the DockerBackend such that concurrent
+// writes are serialized.
+type fileSD struct {
+	mu   sync.Mutex
+	path string
+	// Patterns of the exporter labels added to their target
+	labels []string
+}
+
+// writeFileSD regenerates the file_sd targets file, when enabled, from the
+// exporters currently running along with their exported container. Targets
+// are addressed by the name of their scrape target, resolved by Docker DNS on
+// Prometheus networks. Containers are listed while holding the lock, such
+// that the last write always reflects the latest state.
+func (b DockerBackend) writeFileSD(ctx context.Context) {
+	if b.fileSD == nil || b.dryRun {
+		return
+	}
+
+	logger := log.GetLogger(ctx)
+	b.fileSD.mu.Lock()
+	defer b.fileSD.mu.Unlock()
+
+	containers, err := b.ListExporterContainers(ctx)
+	if err != nil {
+		logger.Errorf("%+v", err)
+		return
+	}
+
+	cache := newInspectCache(b.cli)
+	staticConfig := models.NewStaticConfig()
+	for _, container := range containers {
+		if container.State != "running" {
+			continue
+		}
+
+		// Exporters of dead containers might be kept a bit longer (e.g.
+		// stopped after the rest of their stack) but are not scraped anymore
+		exported, err := cache.inspect(ctx, container.Labels[LABEL_EXPORTED_ID])
+		if client.IsErrNotFound(err) {
+			continue
+		} else if err != nil {
+			logger.Errorf("%+v", errors.WithStack(err))
+			return
+		}
+		if exported.State == nil || !exported.State.Running {
+			continue
+		}
+
+		port := container.Labels[LABEL_EXPORTER_PORT]
+		scrapeTarget := strings.TrimPrefix(container.Labels[LABEL_SCRAPE_TARGET], "/")
+		if port == "" || scrapeTarget == "" {
+			continue
+		}
+
+		labels := map[string]string{
+			"job":           fmt.Sprintf("autoexporter-%s", container.Labels[LABEL_EXPORTER_TYPE]),
+			"exported_name": strings.TrimPrefix(container.Labels[LABEL_EXPORTED_NAME], "/"),
+		}
+		for label, value := range container.Labels {
+			if strings.HasPrefix(label, "autoexporter.") || strings.HasPrefix(label, "prometheus.io/") || !matchesLabel(label, b.fileSD.labels) {
+				continue
+			}
+			labels[invalidPromLabelChars.ReplaceAllString(label, "_")] = value
+		}
+		if timeout := container.Labels[LABEL_SCRAPE_TIMEOUT]; timeout != "" {
+			labels[promLabelScrapeTimeout] = timeout
+		}
+		if interval := container.Labels[LABEL_SCRAPE_INTERVAL]; interval != "" {
+			labels[promLabelScrapeInterval] = interval
+		}
+		if path := container.Labels[LABEL_METRICS_PATH]; path != "" {
+			labels[promLabelMetricsPath] = path
+		}
+		for _, param := range labelsWithPrefix(container.Labels, LABEL_SCRAPE_PARAM_PREFIX) {
+			labels[promLabelScrapeParamPrefix+param] = container.Labels[LABEL_SCRAPE_PARAM_PREFIX+param]
+		}
+		if b.unhealthyAction == UnhealthyActionAnnotate && exported.State.Health != nil {
+			labels[promLabelHealth] = exported.State.Health.Status
+		}
+
+		staticConfig.AddTarget(fmt.Sprintf("%s:%s", scrapeTarget, port), labels)
+	}
+
+	if err := b.addCentralTargets(ctx, staticConfig); err != nil {
+		logger.Errorf("%+v", err)
+		return
+	}
+
+	if err := staticConfig.WriteFile(b.fileSD.path); err != nil {
+		logger.Errorf("%+v", err)
+		return
+	}
+
+	logger.Debugf("Targets file %q written with %d targets.", b.fileSD.path, len(staticConfig.Targets))
+}
+
+// addCentralTargets adds the running containers having central exporters as
+// targets of these exporters, since no exporter container is run for them
+func (b DockerBackend) addCentralTargets(ctx context.Context, staticConfig *models.StaticConfig) error {
+	containers, err := b.cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, container := range containers {
+		// Ignore exporters
+		if _, ok := container.Labels[LABEL_EXPORTED_NAME]; ok {
+			continue
+		}
+		if !b.filter.Allows(container.Names, container.Image, container.Labels) {
+			continue
+		}
+
+		exported := models.NewTaskToExport(container.ID, firstName(container.Names), container.Image, container.Labels)
+		exported.State = container.State
+		exporters, err := b.findExporters(ctx, exported)
+		if err != nil {
+			log.GetLogger(ctx).Errorf("%+v", err)
+			continue
+		}
+
+		for exporterType, exporter := range exporters {
+			if !exporter.IsCentral() {
+				continue
+			}
+
+			labels := map[string]string{
+				"job":           fmt.Sprintf("autoexporter-%s", exporterType),
+				"exported_name": strings.TrimPrefix(exported.Name, "/"),
+			}
+			for label, value := range scrapeOverrideLabels(exporter) {
+				labels[label] = value
+			}
+
+			staticConfig.AddTarget(exporter.CentralAddress, labels)
+		}
+	}
+
+	return nil
+}
+
+// scrapeOverrideLabels returns the labels overriding how Prometheus scrapes
+// the given exporter, when it defines its own scrape settings
+func scrapeOverrideLabels(exporter models.Exporter) map[string]string {
+	labels := map[string]string{}
+	if exporter.ScrapeTimeout != "" {
+		labels[promLabelScrapeTimeout] = exporter.ScrapeTimeout
+	}
+	if exporter.ScrapeInterval != "" {
+		labels[promLabelScrapeInterval] = exporter.ScrapeInterval
+	}
+	if exporter.MetricsPath != "" {
+		labels[promLabelMetricsPath] = exporter.MetricsPath
+	}
+	for param, value := range exporter.ScrapeParams {
+		labels[promLabelScrapeParamPrefix+param] = value
+	}
+
+	return labels
+}
@@ -0,0 +1,343 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/pkg/errors"
+)
+
+type fileSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func TestWriteFileSD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	containers := []types.Container{
+		{
+			ID:    "redis-exporter-id",
+			State: "running",
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:            "redis-id",
+				LABEL_EXPORTED_NAME:          "/redis",
+				LABEL_EXPORTER_TYPE:          "redis",
+				LABEL_EXPORTER_PORT:          "9121",
+				LABEL_SCRAPE_TARGET:          "/exporter.redis.redis",
+				LABEL_SCRAPE_TIMEOUT:         "5s",
+				LABEL_SCRAPE_INTERVAL:        "30s",
+				"com.docker.stack.namespace": "cache",
+				"com.example.owner":          "ops@example.com",
+			},
+		},
+		{
+			ID:    "nginx-exporter-id",
+			State: "running",
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:   "nginx-id",
+				LABEL_EXPORTED_NAME: "/nginx",
+				LABEL_EXPORTER_TYPE: "nginx",
+				LABEL_EXPORTER_PORT: "9113",
+				LABEL_SCRAPE_TARGET: "/exporter.nginx.nginx",
+			},
+		},
+		{
+			ID:    "php-exporter-id",
+			State: "restarting",
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:   "php-id",
+				LABEL_EXPORTER_TYPE: "php",
+				LABEL_EXPORTER_PORT: "9253",
+				LABEL_SCRAPE_TARGET: "/exporter.php.php",
+			},
+		},
+		{
+			// Exporters without scrape port can't be targeted
+			ID:    "legacy-exporter-id",
+			State: "running",
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:   "legacy-id",
+				LABEL_EXPORTER_TYPE: "redis",
+				LABEL_SCRAPE_TARGET: "/exporter.redis.legacy",
+			},
+		},
+	}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return containers, nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return exportedContainer(id, "", nil), nil
+		},
+	}
+
+	path := filepath.Join(dir, "targets.json")
+	b := NewDockerBackend(cli, WithFileSD(path, []string{"com.docker.stack.*"}))
+	b.writeFileSD(context.Background())
+
+	groups := readFileSD(t, path)
+	expected := []fileSDGroup{
+		{
+			Targets: []string{"exporter.nginx.nginx:9113"},
+			Labels: map[string]string{
+				"job":           "autoexporter-nginx",
+				"exported_name": "nginx",
+			},
+		},
+		{
+			Targets: []string{"exporter.redis.redis:9121"},
+			Labels: map[string]string{
+				"job":                        "autoexporter-redis",
+				"exported_name":              "redis",
+				"com_docker_stack_namespace": "cache",
+				promLabelScrapeTimeout:       "5s",
+				promLabelScrapeInterval:      "30s",
+			},
+		},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected targets %+v, got %+v", expected, groups)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(matches) != 0 {
+		t.Errorf("expected temporary files to be removed, got %v", matches)
+	}
+}
+
+func TestStoppedContainersAreRemovedFromFileSD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	exporterOf := func(exportedID, exportedName string) types.Container {
+		return types.Container{
+			ID:    exportedID + "-exporter",
+			State: "running",
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:   exportedID,
+				LABEL_EXPORTED_NAME: exportedName,
+				LABEL_EXPORTER_TYPE: "redis",
+				LABEL_EXPORTER_PORT: "9121",
+				LABEL_SCRAPE_TARGET: "/exporter.redis." + strings.TrimPrefix(exportedName, "/"),
+			},
+		}
+	}
+
+	var mutex sync.Mutex
+	containers := []types.Container{exporterOf("cache-id", "/cache"), exporterOf("session-id", "/session")}
+	running := map[string]bool{"cache-id": true, "session-id": true}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			return filterContainers(containers, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			for _, c := range containers {
+				if c.ID == id {
+					return exportedContainer(c.ID, "", c.Labels), nil
+				}
+			}
+			if !running[id] {
+				return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+			}
+			return exportedContainer(id, "", nil), nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			for i, c := range containers {
+				if c.ID == id {
+					containers = append(containers[:i], containers[i+1:]...)
+					break
+				}
+			}
+			return nil
+		},
+	}
+
+	path := filepath.Join(dir, "targets.json")
+	b := NewDockerBackend(cli, WithFileSD(path, nil))
+	b.writeFileSD(context.Background())
+
+	if groups := readFileSD(t, path); len(groups) != 2 {
+		t.Fatalf("expected 2 targets, got %+v", groups)
+	}
+
+	mutex.Lock()
+	delete(running, "session-id")
+	mutex.Unlock()
+
+	// Concurrent regenerations must not corrupt the file
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.writeFileSD(context.Background())
+		}()
+	}
+	if err := b.handleContainerStop(context.Background(), "session-id", ""); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	wg.Wait()
+
+	groups := readFileSD(t, path)
+	if len(groups) != 1 || !reflect.DeepEqual(groups[0].Targets, []string{"exporter.redis.cache:9121"}) {
+		t.Errorf("expected only the target of cache to remain, got %+v", groups)
+	}
+}
+
+func readFileSD(t *testing.T, path string) []fileSDGroup {
+	t.Helper()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	var groups []fileSDGroup
+	if err := json.Unmarshal(content, &groups); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Targets[0] < groups[j].Targets[0]
+	})
+
+	return groups
+}
+
+func TestWriteFileSDIsDisabledInDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "targets.json")
+	b := NewDockerBackend(&fakeClient{}, WithFileSD(path, nil), WithDryRun(true))
+	b.writeFileSD(context.Background())
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no targets file to be written in dry-run mode, got %v", err)
+	}
+}
+
+func TestUnhealthyActionAnnotateLabelsFileSDTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	containers := []types.Container{
+		{
+			ID:    "redis-exporter-id",
+			State: "running",
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:   "redis-id",
+				LABEL_EXPORTED_NAME: "/redis",
+				LABEL_EXPORTER_TYPE: "redis",
+				LABEL_EXPORTER_PORT: "9121",
+				LABEL_SCRAPE_TARGET: "/exporter.redis.redis",
+			},
+		},
+	}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(containers, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			exported := exportedContainer(id, "/redis", nil)
+			exported.State.Health = &types.Health{Status: "unhealthy"}
+			return exported, nil
+		},
+	}
+
+	path := filepath.Join(dir, "targets.json")
+	b := NewDockerBackend(cli, WithFileSD(path, nil), WithUnhealthyAction(UnhealthyActionAnnotate))
+	if err := b.handleHealthStatus(context.Background(), "redis-id", "unhealthy", []string{"prometheus"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	groups := readFileSD(t, path)
+	expected := []fileSDGroup{
+		{
+			Targets: []string{"exporter.redis.redis:9121"},
+			Labels: map[string]string{
+				"job":           "autoexporter-redis",
+				"exported_name": "redis",
+				promLabelHealth: "unhealthy",
+			},
+		},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected targets %+v, got %+v", expected, groups)
+	}
+}
+
+func TestCentralExportersAreRegisteredInFileSD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snmp := stubExporter("snmp", "prom/snmp-exporter")
+	snmp.CentralAddress = "snmp:9116"
+	snmp.MetricsPath = "/snmp"
+	snmp.ScrapeParams = map[string]string{"target": "192.168.1.1"}
+
+	containers := []types.Container{
+		{ID: "router-id", Names: []string{"/router"}, State: "running", Labels: map[string]string{"autoexporter.snmp.target": "192.168.1.1"}},
+	}
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(containers, options.Filters), nil
+		},
+	}
+
+	path := filepath.Join(dir, "targets.json")
+	b := NewDockerBackend(cli, WithFileSD(path, nil), WithFinder(stubFinder{"/router": {snmp}}))
+	b.writeFileSD(context.Background())
+
+	groups := readFileSD(t, path)
+	expected := []fileSDGroup{{
+		Targets: []string{"snmp:9116"},
+		Labels: map[string]string{
+			"job":                                 "autoexporter-snmp",
+			"exported_name":                       "router",
+			promLabelMetricsPath:                  "/snmp",
+			promLabelScrapeParamPrefix + "target": "192.168.1.1",
+		},
+	}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected targets %+v, got %+v", expected, groups)
+	}
+}
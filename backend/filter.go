@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"path"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// ContainerFilter restricts which containers are considered for export.
+// Label selectors are either "label" or "label=value", name patterns are
+// globs (e.g. "app-*") matched against names without leading slash.
+// Allowed images are either repositories (e.g. redis, matching any tag) or
+// full references (e.g. redis:5).
+type ContainerFilter struct {
+	IncludeLabels []string
+	ExcludeLabels []string
+	IncludeNames  []string
+	ExcludeNames  []string
+	AllowedImages []string
+}
+
+// Allows checks if a container with the given names, image and labels should
+// be exported. When allowed images are set, only containers running one of
+// them are exported. Excludes take precedence over includes, and a filter
+// without includes allows any container not excluded.
+func (f ContainerFilter) Allows(names []string, image string, labels map[string]string) bool {
+	if len(f.AllowedImages) > 0 && !matchesAnyImage(f.AllowedImages, image) {
+		return false
+	}
+
+	if matchesAnyLabel(f.ExcludeLabels, labels) || matchesAnyName(f.ExcludeNames, names) {
+		return false
+	}
+
+	if len(f.IncludeLabels) == 0 && len(f.IncludeNames) == 0 {
+		return true
+	}
+
+	return matchesAnyLabel(f.IncludeLabels, labels) || matchesAnyName(f.IncludeNames, names)
+}
+
+func matchesAnyLabel(selectors []string, labels map[string]string) bool {
+	for _, selector := range selectors {
+		parts := strings.SplitN(selector, "=", 2)
+		value, ok := labels[parts[0]]
+		if ok && (len(parts) == 1 || parts[1] == value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAnyName(patterns []string, names []string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, strings.TrimLeft(name, "/")); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchesAnyImage checks if the given image is one of the allowed images,
+// compared once normalized (e.g. redis is docker.io/library/redis)
+func matchesAnyImage(allowed []string, image string) bool {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		// Containers might have been created from an image ID
+		for _, a := range allowed {
+			if a == image {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, a := range allowed {
+		allowedNamed, err := reference.ParseNormalizedNamed(a)
+		if err != nil {
+			continue
+		}
+
+		if reference.IsNameOnly(allowedNamed) {
+			if allowedNamed.Name() == named.Name() {
+				return true
+			}
+		} else if allowedNamed.String() == reference.TagNameOnly(named).String() || allowedNamed.String() == named.String() {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,199 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestContainerFilterAllows(t *testing.T) {
+	testcases := map[string]struct {
+		filter   ContainerFilter
+		names    []string
+		image    string
+		labels   map[string]string
+		expected bool
+	}{
+		"no filter allows everything": {
+			filter:   ContainerFilter{},
+			names:    []string{"/redis"},
+			expected: true,
+		},
+		"include by label presence": {
+			filter:   ContainerFilter{IncludeLabels: []string{"monitoring"}},
+			names:    []string{"/redis"},
+			labels:   map[string]string{"monitoring": "whatever"},
+			expected: true,
+		},
+		"include by label value": {
+			filter:   ContainerFilter{IncludeLabels: []string{"monitoring=enabled"}},
+			names:    []string{"/redis"},
+			labels:   map[string]string{"monitoring": "disabled"},
+			expected: false,
+		},
+		"include by name pattern": {
+			filter:   ContainerFilter{IncludeNames: []string{"prod-*"}},
+			names:    []string{"/prod-redis"},
+			expected: true,
+		},
+		"not included": {
+			filter:   ContainerFilter{IncludeNames: []string{"prod-*"}},
+			names:    []string{"/staging-redis"},
+			expected: false,
+		},
+		"exclude by label": {
+			filter:   ContainerFilter{ExcludeLabels: []string{"autoexporter.ignore=true"}},
+			names:    []string{"/redis"},
+			labels:   map[string]string{"autoexporter.ignore": "true"},
+			expected: false,
+		},
+		"exclude by name pattern": {
+			filter:   ContainerFilter{ExcludeNames: []string{"*-test"}},
+			names:    []string{"/redis-test"},
+			expected: false,
+		},
+		"not excluded": {
+			filter:   ContainerFilter{ExcludeNames: []string{"*-test"}},
+			names:    []string{"/redis"},
+			expected: true,
+		},
+		"exclude takes precedence over include": {
+			filter:   ContainerFilter{IncludeNames: []string{"prod-*"}, ExcludeLabels: []string{"autoexporter.ignore"}},
+			names:    []string{"/prod-redis"},
+			labels:   map[string]string{"autoexporter.ignore": ""},
+			expected: false,
+		},
+		"included by either label or name": {
+			filter:   ContainerFilter{IncludeNames: []string{"prod-*"}, IncludeLabels: []string{"monitoring"}, ExcludeNames: []string{"*-test"}},
+			names:    []string{"/staging-redis"},
+			labels:   map[string]string{"monitoring": "enabled"},
+			expected: true,
+		},
+		"allowed image repository": {
+			filter:   ContainerFilter{AllowedImages: []string{"redis"}},
+			names:    []string{"/redis"},
+			image:    "docker.io/library/redis:5",
+			expected: true,
+		},
+		"allowed image reference": {
+			filter:   ContainerFilter{AllowedImages: []string{"redis:5"}},
+			names:    []string{"/redis"},
+			image:    "redis:5",
+			expected: true,
+		},
+		"allowed image reference defaults to latest": {
+			filter:   ContainerFilter{AllowedImages: []string{"redis:latest"}},
+			names:    []string{"/redis"},
+			image:    "redis",
+			expected: true,
+		},
+		"image with another tag": {
+			filter:   ContainerFilter{AllowedImages: []string{"redis:5"}},
+			names:    []string{"/redis"},
+			image:    "redis:6",
+			expected: false,
+		},
+		"image not allowed despite being included": {
+			filter:   ContainerFilter{AllowedImages: []string{"redis"}, IncludeNames: []string{"prod-*"}},
+			names:    []string{"/prod-memcached"},
+			image:    "memcached",
+			expected: false,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			if got := tc.filter.Allows(tc.names, tc.image, tc.labels); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestExcludedContainersAreIgnored(t *testing.T) {
+	containers := []types.Container{
+		{ID: "prod-redis-id", Names: []string{"/prod-redis"}},
+		{ID: "test-redis-id", Names: []string{"/test-redis"}},
+	}
+
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(containers, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, c := range containers {
+				if c.ID == id {
+					return exportedContainer(c.ID, c.Names[0], nil), nil
+				}
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+
+	redis := stubExporter("redis", "redis_exporter")
+	b := NewDockerBackend(cli,
+		WithContainerFilter(ContainerFilter{ExcludeNames: []string{"test-*"}}),
+		WithFinder(stubFinder{"/prod-redis": {redis}, "/test-redis": {redis}}),
+	)
+
+	missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(missing) != 1 || missing[0].Exported.ID != "prod-redis-id" {
+		t.Errorf("expected only the exporter of prod-redis to be missing, got %+v", missing)
+	}
+
+	// The event handler doesn't resolve exporters of excluded containers,
+	// otherwise it would try to pull the exporter image
+	if err := b.handleContainerStart(context.Background(), "test-redis-id", []string{"prometheus"}); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestNonAllowedImagesAreIgnored(t *testing.T) {
+	containers := []types.Container{
+		{ID: "redis-id", Names: []string{"/redis"}, Image: "redis:5"},
+		{ID: "cache-id", Names: []string{"/cache"}, Image: "bitnami/redis:5"},
+	}
+
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(containers, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, c := range containers {
+				if c.ID == id {
+					container := exportedContainer(c.ID, c.Names[0], nil)
+					container.Config.Image = c.Image
+					return container, nil
+				}
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+	}
+
+	// The finder matches both containers
+	redis := stubExporter("redis", "redis_exporter")
+	b := NewDockerBackend(cli,
+		WithContainerFilter(ContainerFilter{AllowedImages: []string{"redis"}}),
+		WithFinder(stubFinder{"/redis": {redis}, "/cache": {redis}}),
+	)
+
+	missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(missing) != 1 || missing[0].Exported.ID != "redis-id" {
+		t.Errorf("expected only the exporter of redis to be missing, got %+v", missing)
+	}
+
+	// Pulling the exporter image would panic on the fake client
+	if err := b.handleContainerStart(context.Background(), "cache-id", []string{"prometheus"}); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
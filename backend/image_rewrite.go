@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"strings"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// ImageRewrite replaces the From prefix of normalized image references by To,
+// e.g. docker.io/ by registry.internal/ to pull exporter images through a
+// mirror
+type ImageRewrite struct {
+	From string
+	To   string
+}
+
+// ParseImageRewrite parses a rewrite rule formatted as from=to
+func ParseImageRewrite(rule string) (ImageRewrite, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ImageRewrite{}, errors.Errorf("Invalid image rewrite %q. Should be formatted as from=to.", rule)
+	}
+
+	return ImageRewrite{From: parts[0], To: parts[1]}, nil
+}
+
+// rewriteImage applies the first rule matching the normalized form of the
+// given image (e.g. docker.io/library/redis:latest for redis). Images not
+// matching any rule are returned untouched.
+func rewriteImage(image string, rules []ImageRewrite) string {
+	if len(rules) == 0 {
+		return image
+	}
+
+	normalized := image
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		normalized = named.String()
+	}
+
+	for _, rule := range rules {
+		if strings.HasPrefix(normalized, rule.From) {
+			return rule.To + strings.TrimPrefix(normalized, rule.From)
+		}
+	}
+
+	return image
+}
+
+// rewriteImages rewrites the image of the given exporters, such that they're
+// pulled and run from the same reference
+func (b DockerBackend) rewriteImages(exporters map[string]models.Exporter) map[string]models.Exporter {
+	for exporterType, exporter := range exporters {
+		exporter.Image = rewriteImage(exporter.Image, b.imageRewrites)
+		exporters[exporterType] = exporter
+	}
+
+	return exporters
+}
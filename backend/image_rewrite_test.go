@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestParseImageRewrite(t *testing.T) {
+	testcases := map[string]struct {
+		rule        string
+		expected    ImageRewrite
+		expectedErr bool
+	}{
+		"valid rule": {
+			rule:     "docker.io/=registry.internal/",
+			expected: ImageRewrite{From: "docker.io/", To: "registry.internal/"},
+		},
+		"missing separator": {
+			rule:        "docker.io/",
+			expectedErr: true,
+		},
+		"empty target": {
+			rule:        "docker.io/=",
+			expectedErr: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			rewrite, err := ParseImageRewrite(tc.rule)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if rewrite != tc.expected {
+				t.Errorf("expected rule %+v, got %+v", tc.expected, rewrite)
+			}
+		})
+	}
+}
+
+func TestRewriteImage(t *testing.T) {
+	rules := []ImageRewrite{
+		{From: "quay.io/prometheus/", To: "registry.internal/prometheus/"},
+		{From: "docker.io/", To: "registry.internal/"},
+	}
+
+	testcases := map[string]struct {
+		image    string
+		rules    []ImageRewrite
+		expected string
+	}{
+		"no rules": {
+			image:    "oliver006/redis_exporter:latest",
+			expected: "oliver006/redis_exporter:latest",
+		},
+		"docker hub image": {
+			image:    "oliver006/redis_exporter:latest",
+			rules:    rules,
+			expected: "registry.internal/oliver006/redis_exporter:latest",
+		},
+		"official image": {
+			image:    "redis",
+			rules:    rules,
+			expected: "registry.internal/library/redis",
+		},
+		"first matching rule applies": {
+			image:    "quay.io/prometheus/node-exporter:v1.0.0",
+			rules:    rules,
+			expected: "registry.internal/prometheus/node-exporter:v1.0.0",
+		},
+		"no match passthrough": {
+			image:    "ghcr.io/acme/exporter:1.0",
+			rules:    rules,
+			expected: "ghcr.io/acme/exporter:1.0",
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			if image := rewriteImage(tc.image, tc.rules); image != tc.expected {
+				t.Errorf("expected image %q, got %q", tc.expected, image)
+			}
+		})
+	}
+}
+
+func TestRewrittenImageIsPulledAndRun(t *testing.T) {
+	var pulled, created string
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id == "redis-id" {
+				return exportedContainer(id, "/redis", nil), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerListFn: noContainers,
+		imageInspectFn:  imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			pulled = ref
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			created = config.Image
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli,
+		WithFinder(stubFinder{"/redis": {stubExporter("redis", "oliver006/redis_exporter")}}),
+		WithImageRewrites([]ImageRewrite{{From: "docker.io/", To: "registry.internal/"}}))
+
+	exporters, err := b.resolveExporters(context.Background(), models.NewTaskToExport("redis-id", "/redis", "redis:5", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(exporters) != 1 {
+		t.Fatalf("expected one exporter, got %+v", exporters)
+	}
+
+	exporter := exporters[0]
+	exporter.PromNetworks = []string{"prometheus"}
+	b.RunExporter(context.Background(), exporter)
+
+	expected := "registry.internal/oliver006/redis_exporter"
+	if pulled != expected || created != expected {
+		t.Errorf("expected image %q to be pulled and run, got %q pulled and %q run", expected, pulled, created)
+	}
+}
@@ -0,0 +1,26 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/NiR-/prom-autoexporter/models"
+)
+
+// Backend manages the lifecycle of exporters for a given container runtime
+type Backend interface {
+	// RunExporter starts the given exporter, until it's running or ctx is
+	// cancelled
+	RunExporter(ctx context.Context, exporter models.Exporter)
+	// CleanupExporter stops and removes an exporter. Unless force is true,
+	// exporters whose exported container is still running are kept.
+	CleanupExporter(ctx context.Context, cid string, force bool) error
+	// CleanupExporters cleans up stale exporters, or all of them when force
+	// is true
+	CleanupExporters(ctx context.Context, force bool) error
+	// FindMissingExporters returns the exporters that should be running but
+	// are not
+	FindMissingExporters(ctx context.Context, promNetworks []string) ([]models.Exporter, error)
+	// ListenForTasksToExport watches for containers starting and stopping,
+	// to start and stop their exporters accordingly, until ctx is cancelled
+	ListenForTasksToExport(ctx context.Context, promNetworks []string)
+}
@@ -0,0 +1,26 @@
+package backend
+
+import (
+	"math/rand"
+	"time"
+)
+
+// newJitterSource returns a random source seeded per instance, such that
+// instances started together don't run periodic tasks in lockstep
+func newJitterSource() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// jitteredInterval returns a random duration within [interval - jitter,
+// interval + jitter]. The jitter is capped to the interval, such that the
+// result is never negative.
+func jitteredInterval(interval, jitter time.Duration, rnd *rand.Rand) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	if jitter > interval {
+		jitter = interval
+	}
+
+	return interval - jitter + time.Duration(rnd.Int63n(int64(2*jitter)+1))
+}
@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestJitteredInterval(t *testing.T) {
+	testcases := map[string]struct {
+		interval    time.Duration
+		jitter      time.Duration
+		expectedMin time.Duration
+		expectedMax time.Duration
+	}{
+		"without jitter": {
+			interval:    time.Minute,
+			expectedMin: time.Minute,
+			expectedMax: time.Minute,
+		},
+		"with jitter": {
+			interval:    time.Minute,
+			jitter:      10 * time.Second,
+			expectedMin: 50 * time.Second,
+			expectedMax: 70 * time.Second,
+		},
+		"jitter larger than the interval": {
+			interval:    time.Minute,
+			jitter:      5 * time.Minute,
+			expectedMin: 0,
+			expectedMax: 2 * time.Minute,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			seen := map[time.Duration]bool{}
+
+			for i := 0; i < 100; i++ {
+				interval := jitteredInterval(tc.interval, tc.jitter, rnd)
+				if interval < tc.expectedMin || interval > tc.expectedMax {
+					t.Fatalf("expected interval within [%s, %s], got %s", tc.expectedMin, tc.expectedMax, interval)
+				}
+				seen[interval] = true
+			}
+
+			if tc.jitter > 0 && len(seen) < 2 {
+				t.Errorf("expected successive intervals to be randomized, got %v", seen)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package backend
+
+import "context"
+
+// LeaderElector tells whether this instance is the one allowed to mutate
+// Docker state, when several instances run for high availability. Followers
+// keep watching events but don't act on them.
+type LeaderElector interface {
+	IsLeader(ctx context.Context) bool
+}
+
+// singleInstance is the LeaderElector used when only one instance runs
+type singleInstance struct{}
+
+func (singleInstance) IsLeader(ctx context.Context) bool {
+	return true
+}
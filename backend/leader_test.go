@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+type staticElector bool
+
+func (e staticElector) IsLeader(ctx context.Context) bool {
+	return bool(e)
+}
+
+func TestOnlyTheLeaderProcessesEvents(t *testing.T) {
+	testcases := map[string]struct {
+		leader        bool
+		expectRemoval bool
+	}{
+		"follower ignores events": {leader: false, expectRemoval: false},
+		"leader processes events": {leader: true, expectRemoval: true},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			exporter := types.Container{
+				ID:     "exporter-id",
+				Names:  []string{"/exporter.redis.redis"},
+				Labels: map[string]string{LABEL_EXPORTED_ID: "redis-id", LABEL_EXPORTED_NAME: "/redis"},
+			}
+			removed := make(chan string, 1)
+			cli := &fakeClient{
+				eventsFn: func(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+					evtCh := make(chan events.Message, 1)
+					evtCh <- events.Message{
+						Type:     events.ContainerEventType,
+						Action:   "die",
+						Actor:    events.Actor{ID: "redis-id"},
+						TimeNano: time.Now().UnixNano(),
+					}
+
+					return evtCh, make(chan error)
+				},
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					return filterContainers([]types.Container{exporter}, options.Filters), nil
+				},
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if id == exporter.ID {
+						return exportedContainer(exporter.ID, exporter.Names[0], exporter.Labels), nil
+					}
+
+					redis := exportedContainer(id, "/redis", nil)
+					redis.State.Running = false
+					return redis, nil
+				},
+				containerStopFn: func(ctx context.Context, id string) error {
+					return nil
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					removed <- id
+					return nil
+				},
+			}
+
+			var b Backend = NewDockerBackend(cli, WithLeaderElector(staticElector(tc.leader)))
+			go b.ListenForTasksToExport(ctx, []string{"prometheus"})
+
+			select {
+			case <-removed:
+				if !tc.expectRemoval {
+					t.Error("expected the follower not to remove the exporter")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tc.expectRemoval {
+					t.Error("expected the leader to remove the exporter")
+				}
+			}
+		})
+	}
+}
+
+func TestFollowersDoNotReconcile(t *testing.T) {
+	// Any call to the Docker API would panic, as the fake client has no
+	// func field set
+	b := NewDockerBackend(&fakeClient{}, WithLeaderElector(staticElector(false)))
+	ctx := context.Background()
+
+	if err := b.StartMissingExporters(ctx, []string{"prometheus"}); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := b.CleanupExporters(ctx, true); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := b.CleanupExportersBySelector(ctx, map[string]string{"com.docker.stack.namespace": "web"}, true); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if err := b.RefreshAll(ctx, []string{"prometheus"}); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
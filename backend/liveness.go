@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/metrics"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	exporterRestarts = metrics.NewCounter(
+		"autoexporter_exporter_restarts_total",
+		"Number of exporters restarted because they failed the liveness check.",
+	)
+)
+
+// LivenessChecker returns an error when the metrics endpoint at the given
+// URL doesn't respond properly
+type LivenessChecker func(ctx context.Context, url string) error
+
+// NewHTTPLivenessChecker returns a LivenessChecker expecting a 2xx response
+// within the given timeout
+func NewHTTPLivenessChecker(timeout time.Duration) LivenessChecker {
+	client := &http.Client{Timeout: timeout}
+
+	return func(ctx context.Context, url string) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return errors.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+// CheckLivenessPeriodically checks every interval that running exporters
+// still serve their metrics, and restarts the ones that don't, until ctx is
+// cancelled
+func (b DockerBackend) CheckLivenessPeriodically(ctx context.Context, promNetworks []string, interval time.Duration) {
+	logger := log.GetLogger(ctx)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			logger.Debug("Checking exporters liveness...")
+
+			if err := b.checkExportersLiveness(ctx, promNetworks); err != nil {
+				logger.Errorf("%+v", err)
+			}
+		}
+	}
+}
+
+func (b DockerBackend) checkExportersLiveness(ctx context.Context, promNetworks []string) error {
+	if !b.elector.IsLeader(ctx) {
+		return nil
+	}
+
+	exporters, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_EXPORTED_ID),
+			filters.Arg("label", LABEL_EXPORTER_PORT),
+		),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, exporter := range exporters {
+		// Exporters paused while their exported container is unhealthy
+		// can't answer, and are resumed once it's healthy again
+		if exporter.State == "paused" {
+			continue
+		}
+
+		logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+			"exporter.cid":  exporter.ID,
+			"exporter.name": exporter.Names,
+		})
+		ctx := log.WithLogger(ctx, logger)
+
+		url, err := b.metricsURL(ctx, exporter, promNetworks)
+		if err != nil {
+			logger.Errorf("%+v", err)
+			continue
+		}
+
+		err = b.livenessChecker(ctx, url)
+		if err == nil {
+			continue
+		}
+
+		logger.WithError(err).Warnf("Exporter failed the liveness check on %s, restarting it...", url)
+
+		if err := b.restartExporter(ctx, exporter.ID); err != nil {
+			logger.Errorf("%+v", err)
+		}
+	}
+
+	return nil
+}
+
+// metricsURL returns the URL of the metrics endpoint of the given exporter,
+// reachable through its scrape target on the Prometheus network. It's scraped
+// with the same path and params as Prometheus does.
+func (b DockerBackend) metricsURL(ctx context.Context, exporter types.Container, promNetworks []string) (string, error) {
+	target, err := b.cli.ContainerInspect(ctx, exporter.Labels[LABEL_SCRAPE_TARGET])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	for _, promNetwork := range promNetworks {
+		endpoint, ok := target.NetworkSettings.Networks[promNetwork]
+		if ok && endpoint.IPAddress != "" {
+			return exporterURL(endpoint.IPAddress, exporter.Labels), nil
+		}
+	}
+
+	return "", errors.Errorf("scrape target %q is not connected to any of the networks %v", target.Name, promNetworks)
+}
+
+// exporterURL builds the metrics URL of the exporter having the given labels,
+// defaulting to /metrics when no metrics path is set
+func exporterURL(host string, labels map[string]string) string {
+	path := labels[LABEL_METRICS_PATH]
+	if path == "" {
+		path = "/metrics"
+	}
+
+	params := url.Values{}
+	for _, param := range labelsWithPrefix(labels, LABEL_SCRAPE_PARAM_PREFIX) {
+		params.Set(param, labels[LABEL_SCRAPE_PARAM_PREFIX+param])
+	}
+
+	u := url.URL{
+		Scheme:   "http",
+		Host:     fmt.Sprintf("%s:%s", host, labels[LABEL_EXPORTER_PORT]),
+		Path:     path,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+func (b DockerBackend) restartExporter(ctx context.Context, cid string) error {
+	if b.dryRun {
+		log.GetLogger(ctx).Infof("[dry-run] Would restart exporter container %q.", cid)
+		return nil
+	}
+
+	if err := b.cli.ContainerStop(ctx, cid, nil); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := b.cli.ContainerStart(ctx, cid, types.ContainerStartOptions{}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	exporterRestarts.Inc()
+	log.GetLogger(ctx).Info("Exporter container restarted.")
+
+	return nil
+}
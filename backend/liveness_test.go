@@ -0,0 +1,209 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestLivenessCheckRestartsWedgedExporters(t *testing.T) {
+	exporters := []types.Container{
+		{
+			ID:    "healthy-exporter-id",
+			Names: []string{"/exporter.redis.redis"},
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:   "redis-id",
+				LABEL_SCRAPE_TARGET: "/redis",
+				LABEL_EXPORTER_PORT: "9121",
+			},
+		},
+		{
+			ID:    "wedged-exporter-id",
+			Names: []string{"/exporter.mysql.mysql"},
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:   "mysql-id",
+				LABEL_SCRAPE_TARGET: "/mysql",
+				LABEL_EXPORTER_PORT: "9104",
+			},
+		},
+	}
+	addresses := map[string]string{"/redis": "10.0.0.2", "/mysql": "10.0.0.3"}
+
+	var stopped, started []string
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(exporters, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			target := exportedContainer(id+"-id", id, nil)
+			target.NetworkSettings = &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"prometheus": {IPAddress: addresses[id]},
+				},
+			}
+			return target, nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			stopped = append(stopped, id)
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			started = append(started, id)
+			return nil
+		},
+	}
+
+	var checked []string
+	checker := func(ctx context.Context, url string) error {
+		checked = append(checked, url)
+		if url == "http://10.0.0.3:9104/metrics" {
+			return errors.New("context deadline exceeded")
+		}
+		return nil
+	}
+
+	restarts := exporterRestarts.Value()
+	b := NewDockerBackend(cli, WithLivenessChecker(checker))
+	if err := b.checkExportersLiveness(context.Background(), []string{"prometheus"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if expected := []string{"http://10.0.0.2:9121/metrics", "http://10.0.0.3:9104/metrics"}; !reflect.DeepEqual(checked, expected) {
+		t.Errorf("expected %v to be checked, got %v", expected, checked)
+	}
+	if expected := []string{"wedged-exporter-id"}; !reflect.DeepEqual(stopped, expected) || !reflect.DeepEqual(started, expected) {
+		t.Errorf("expected only the wedged exporter to be restarted, got stopped %v and started %v", stopped, started)
+	}
+	if got := exporterRestarts.Value() - restarts; got != 1 {
+		t.Errorf("expected 1 restart to be counted, got %v", got)
+	}
+}
+
+func TestLivenessCheckSkipsPausedExporters(t *testing.T) {
+	exporter := types.Container{
+		ID:    "exporter-id",
+		State: "running",
+		Labels: map[string]string{
+			LABEL_EXPORTED_ID:   "redis-id",
+			LABEL_SCRAPE_TARGET: "/redis",
+			LABEL_EXPORTER_PORT: "9121",
+		},
+	}
+
+	var restarted bool
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers([]types.Container{exporter}, options.Filters), nil
+		},
+		containerPauseFn: func(ctx context.Context, id string) error {
+			exporter.State = "paused"
+			return nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			restarted = true
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+	}
+
+	checker := func(ctx context.Context, url string) error {
+		return errors.New("context deadline exceeded")
+	}
+
+	b := NewDockerBackend(cli, WithUnhealthyAction(UnhealthyActionPause), WithLivenessChecker(checker))
+	if err := b.handleHealthStatus(context.Background(), "redis-id", "unhealthy", []string{"prometheus"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if err := b.checkExportersLiveness(context.Background(), []string{"prometheus"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if exporter.State != "paused" || restarted {
+		t.Errorf("expected the paused exporter to be left paused, got state %q and restarted %t", exporter.State, restarted)
+	}
+}
+
+func TestExporterURL(t *testing.T) {
+	testcases := map[string]struct {
+		labels   map[string]string
+		expected string
+	}{
+		"default metrics path": {
+			labels:   map[string]string{LABEL_EXPORTER_PORT: "9121"},
+			expected: "http://10.0.0.2:9121/metrics",
+		},
+		"custom metrics path": {
+			labels: map[string]string{
+				LABEL_EXPORTER_PORT: "9115",
+				LABEL_METRICS_PATH:  "/probe",
+			},
+			expected: "http://10.0.0.2:9115/probe",
+		},
+		"with scrape params": {
+			labels: map[string]string{
+				LABEL_EXPORTER_PORT:                  "9115",
+				LABEL_METRICS_PATH:                   "/probe",
+				LABEL_SCRAPE_PARAM_PREFIX + "module": "tcp_connect",
+				LABEL_SCRAPE_PARAM_PREFIX + "target": "redis:6379",
+			},
+			expected: "http://10.0.0.2:9115/probe?module=tcp_connect&target=redis%3A6379",
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			if got := exporterURL("10.0.0.2", tc.labels); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHTTPLivenessChecker(t *testing.T) {
+	testcases := map[string]struct {
+		handler http.HandlerFunc
+		healthy bool
+	}{
+		"metrics served": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("up 1\n"))
+			},
+			healthy: true,
+		},
+		"server error": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			healthy: false,
+		},
+		"no response in time": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			},
+			healthy: false,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			defer srv.Close()
+
+			checker := NewHTTPLivenessChecker(50 * time.Millisecond)
+			if err := checker(context.Background(), srv.URL+"/metrics"); (err == nil) != tc.healthy {
+				t.Errorf("expected healthy to be %v, got error %v", tc.healthy, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/models"
+)
+
+var (
+	// Characters allowed by Docker in container names, besides the leading ones
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+	validName        = regexp.MustCompile(`^/?[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+)
+
+// exporterName returns the name of the exporter of the given type for task.
+// The template in the autoexporter.name label, rendered against the task and
+// the exporter type (e.g. "{{.Name}}-{{.Type}}"), takes precedence over the
+// default name unless it renders an empty or invalid name.
+func exporterName(ctx context.Context, exporterType string, task models.TaskToExport) string {
+	defaultName := getExporterName(exporterType, task.Name, task.ID)
+
+	tpl := task.Labels[LABEL_NAME_TEMPLATE]
+	if tpl == "" {
+		return defaultName
+	}
+
+	logger := log.GetLogger(ctx).WithField("exporter.type", exporterType)
+	name, err := models.RenderTpl(tpl, struct {
+		models.TaskToExport
+		Type string
+	}{task, exporterType})
+	if err != nil {
+		logger.Warnf("Invalid exporter name template, using the default name: %+v", err)
+		return defaultName
+	}
+
+	name = strings.TrimSpace(name)
+	if !validName.MatchString(name) {
+		logger.Warnf("Exporter name %q rendered from template is empty or invalid, using the default name.", name)
+		return defaultName
+	}
+
+	return "/" + strings.TrimPrefix(name, "/")
+}
+
+// getExporterName returns the name of an exporter container. The exported
+// name is sanitized to the characters allowed by Docker, and suffixed with a
+// short hash of the exported ID such that two containers whose sanitized
+// names are the same don't collide.
+func getExporterName(exporterType, containerName, exportedID string) string {
+	name := sanitizeName(strings.TrimLeft(containerName, "/"))
+	return fmt.Sprintf("/exporter.%s.%s.%s", sanitizeName(exporterType), name, shortIDHash(exportedID))
+}
+
+// getLegacyExporterName returns the name given to exporters before names
+// were sanitized and hashed, such that they're still recognized
+func getLegacyExporterName(exporterType, containerName string) string {
+	return fmt.Sprintf("/exporter.%s.%s", exporterType, strings.TrimLeft(containerName, "/"))
+}
+
+// getSuffixedExporterName disambiguates the exporter name using the ID of
+// the exported container, such that it stays stable across reconciles
+func getSuffixedExporterName(exporterName, exportedID string) string {
+	if len(exportedID) > 12 {
+		exportedID = exportedID[:12]
+	}
+
+	return fmt.Sprintf("%s.%s", exporterName, exportedID)
+}
+
+func sanitizeName(name string) string {
+	return invalidNameChars.ReplaceAllString(name, "_")
+}
+
+func shortIDHash(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(hash[:])[:8]
+}
@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"context"
+	"testing"
+
+	"github.com/NiR-/prom-autoexporter/models"
+)
+
+func TestGetExporterName(t *testing.T) {
+	testcases := map[string]struct {
+		exporterType  string
+		containerName string
+		exportedID    string
+		expected      string
+	}{
+		"regular name": {
+			exporterType:  "redis",
+			containerName: "/redis",
+			exportedID:    "redis-id",
+			expected:      "/exporter.redis.redis." + shortIDHash("redis-id"),
+		},
+		"swarm task name": {
+			exporterType:  "redis",
+			containerName: "stack_redis.1.y2cvkbq3fnbqqv0dhq0ah2v5s",
+			exportedID:    "task-id",
+			expected:      "/exporter.redis.stack_redis.1.y2cvkbq3fnbqqv0dhq0ah2v5s." + shortIDHash("task-id"),
+		},
+		"weird characters are replaced": {
+			exporterType:  "php fpm",
+			containerName: "/my app:latest@prod",
+			exportedID:    "app-id",
+			expected:      "/exporter.php_fpm.my_app_latest_prod." + shortIDHash("app-id"),
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			name := getExporterName(tc.exporterType, tc.containerName, tc.exportedID)
+			if name != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, name)
+			}
+			if !validName.MatchString(name) {
+				t.Errorf("%q is not a valid container name", name)
+			}
+			if again := getExporterName(tc.exporterType, tc.containerName, tc.exportedID); again != name {
+				t.Errorf("expected the name to be deterministic, got %q then %q", name, again)
+			}
+		})
+	}
+}
+
+func TestGetExporterNameDoesNotCollide(t *testing.T) {
+	// Both names are sanitized to "my_app"
+	first := getExporterName("redis", "/my app", "first-id")
+	second := getExporterName("redis", "/my_app", "second-id")
+
+	if first == second {
+		t.Errorf("expected distinct names, both are %q", first)
+	}
+}
+
+func TestExporterNameFromTemplate(t *testing.T) {
+	defaultName := getExporterName("redis", "/redis", "redis-id")
+
+	testcases := map[string]struct {
+		template string
+		expected string
+	}{
+		"without template": {
+			expected: defaultName,
+		},
+		"custom template": {
+			template: "{{ .Type }}-for-{{ .ID }}",
+			expected: "/redis-for-redis-id",
+		},
+		"invalid rendered name falls back to the default": {
+			template: "{{ .Name }} exporter",
+			expected: defaultName,
+		},
+		"empty rendered name falls back to the default": {
+			template: "{{ .Labels.missing }}",
+			expected: defaultName,
+		},
+		"unparsable template falls back to the default": {
+			template: "{{ .Name",
+			expected: defaultName,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			labels := map[string]string{}
+			if tc.template != "" {
+				labels[LABEL_NAME_TEMPLATE] = tc.template
+			}
+
+			task := models.NewTaskToExport("redis-id", "/redis", "redis:5", labels)
+			if name := exporterName(context.Background(), "redis", task); name != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, name)
+			}
+		})
+	}
+}
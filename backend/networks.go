@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// EnsureNetworks checks that the given Prometheus networks exist, such that
+// exporters don't fail to start later on. Missing networks are created when
+// create is true, as attachable overlay networks in swarm mode and as bridge
+// networks otherwise.
+func EnsureNetworks(ctx context.Context, cli client.APIClient, networks []string, create, swarmMode bool) error {
+	logger := log.GetLogger(ctx)
+
+	for _, promNetwork := range networks {
+		_, err := cli.NetworkInspect(ctx, promNetwork, types.NetworkInspectOptions{})
+		if err == nil {
+			continue
+		} else if !client.IsErrNotFound(err) {
+			return errors.WithStack(err)
+		}
+
+		if !create {
+			return errors.Errorf("Prometheus network %q does not exist. Create it first or use --create-network.", promNetwork)
+		}
+
+		options := types.NetworkCreate{CheckDuplicate: true, Driver: "bridge"}
+		if swarmMode {
+			options.Driver = "overlay"
+			options.Attachable = true
+		}
+
+		if _, err := cli.NetworkCreate(ctx, promNetwork, options); err != nil {
+			return errors.WithStack(err)
+		}
+
+		logger.Infof("Prometheus network %q created.", promNetwork)
+	}
+
+	return nil
+}
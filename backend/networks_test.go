@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestEnsureNetworks(t *testing.T) {
+	testcases := map[string]struct {
+		create          bool
+		swarmMode       bool
+		expectedErr     string
+		expectedCreated map[string]types.NetworkCreate
+	}{
+		"missing network fails": {
+			expectedErr:     `Prometheus network "missing" does not exist`,
+			expectedCreated: map[string]types.NetworkCreate{},
+		},
+		"missing network is created": {
+			create: true,
+			expectedCreated: map[string]types.NetworkCreate{
+				"missing": {CheckDuplicate: true, Driver: "bridge"},
+			},
+		},
+		"missing network is created in swarm mode": {
+			create:    true,
+			swarmMode: true,
+			expectedCreated: map[string]types.NetworkCreate{
+				"missing": {CheckDuplicate: true, Driver: "overlay", Attachable: true},
+			},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			created := map[string]types.NetworkCreate{}
+			cli := &fakeClient{
+				networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+					if networkID == "missing" {
+						return types.NetworkResource{}, errdefs.NotFound(errors.New("no such network"))
+					}
+					return emptyNetwork(ctx, networkID, options)
+				},
+				networkCreateFn: func(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+					created[name] = options
+					return types.NetworkCreateResponse{ID: name + "-id"}, nil
+				},
+			}
+
+			err := EnsureNetworks(context.Background(), cli, []string{"prometheus", "missing"}, tc.create, tc.swarmMode)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("expected error %q, got %v", tc.expectedErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if !reflect.DeepEqual(created, tc.expectedCreated) {
+				t.Errorf("expected created networks %+v, got %+v", tc.expectedCreated, created)
+			}
+		})
+	}
+}
+
+func TestEnsureNetworksFailsOnInspectError(t *testing.T) {
+	cli := &fakeClient{
+		networkInspectFn: func(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+			return types.NetworkResource{}, errors.New("cannot connect to the Docker daemon")
+		},
+	}
+
+	// NetworkCreate would panic on the fake client
+	if err := EnsureNetworks(context.Background(), cli, []string{"prometheus"}, true, false); err == nil {
+		t.Fatal("expected an error when the network can't be inspected")
+	}
+}
@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	LifecycleEventStarted = "started"
+	LifecycleEventStopped = "stopped"
+)
+
+// LifecycleObserver is notified when an exporter has been started or stopped.
+// It runs in its own goroutine, with a context cancelled after
+// observerTimeout, such that a slow observer can't stall the event loop.
+type LifecycleObserver func(ctx context.Context, event string, exporter models.Exporter) error
+
+// webhookEvent is the JSON payload posted by webhook observers. It only
+// identifies the exporter, such that its env vars and scrape credentials are
+// never sent.
+type webhookEvent struct {
+	Event        string `json:"event"`
+	Name         string `json:"name"`
+	Image        string `json:"image"`
+	ExportedID   string `json:"exported_id"`
+	ExportedName string `json:"exported_name"`
+}
+
+// NewWebhookObserver returns a LifecycleObserver posting the event and the
+// exporter identity as JSON to the given URL, and expecting a 2xx response
+func NewWebhookObserver(url string) LifecycleObserver {
+	client := &http.Client{}
+
+	return func(ctx context.Context, event string, exporter models.Exporter) error {
+		body, err := json.Marshal(webhookEvent{
+			Event:        event,
+			Name:         exporter.Name,
+			Image:        exporter.Image,
+			ExportedID:   exporter.Exported.ID,
+			ExportedName: exporter.Exported.Name,
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return errors.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+// notifyObserver calls the lifecycle observer, if any, in background
+func (b DockerBackend) notifyObserver(ctx context.Context, event string, exporter models.Exporter) {
+	if b.observer == nil {
+		return
+	}
+
+	logger := log.GetLogger(ctx).WithField("lifecycle.event", event)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(log.WithLogger(context.Background(), logger), b.observerTimeout)
+		defer cancel()
+
+		if err := b.observer(ctx, event, exporter); err != nil {
+			logger.Errorf("Lifecycle observer failed: %+v", err)
+		}
+	}()
+}
+
+// exporterFromContainer reconstructs an exporter from the name, image and
+// labels of its container. Labels missing on the container leave the
+// matching fields empty.
+func exporterFromContainer(name, image string, labels map[string]string, status string) models.Exporter {
+	exported := models.NewTaskToExport(
+		labels[LABEL_EXPORTED_ID],
+		labels[LABEL_EXPORTED_NAME],
+		"",
+		nil)
+
+	exporter := models.NewExporter(
+		strings.TrimPrefix(name, "/"),
+		labels[LABEL_EXPORTER_TYPE],
+		image,
+		nil,
+		nil,
+		exported)
+	exporter.Port = labels[LABEL_EXPORTER_PORT]
+	exporter.ScrapeTarget = labels[LABEL_SCRAPE_TARGET]
+	if labels[LABEL_NETWORK_MODE] == models.NetworkModeNetwork {
+		exporter.NetworkMode = models.NetworkModeNetwork
+	}
+	exporter.Status = status
+	if networks := labels[LABEL_PROM_NETWORK]; networks != "" {
+		exporter.PromNetworks = strings.Split(networks, ",")
+	}
+
+	return exporter
+}
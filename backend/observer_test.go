@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+type lifecycleEvent struct {
+	event    string
+	exporter models.Exporter
+}
+
+func TestLifecycleObserverIsNotifiedOnStartAndStop(t *testing.T) {
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerListFn: noContainers,
+		imageInspectFn:  imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+
+	events := make(chan lifecycleEvent, 2)
+	observer := func(ctx context.Context, event string, exporter models.Exporter) error {
+		events <- lifecycleEvent{event, exporter}
+		return nil
+	}
+
+	b := NewDockerBackend(cli, WithRetry(1, time.Millisecond, time.Millisecond), WithLifecycleObserver(observer, time.Second))
+	exporter := redisExporter()
+	exporter.PromNetworks = []string{"prometheus"}
+
+	b.RunExporter(context.Background(), exporter)
+
+	started := waitLifecycleEvent(t, events)
+	if started.event != LifecycleEventStarted {
+		t.Errorf("expected a %q event, got %q", LifecycleEventStarted, started.event)
+	}
+	if started.exporter.Name != exporter.Name || started.exporter.Exported.ID != "redis-id" {
+		t.Errorf("unexpected started exporter %+v", started.exporter)
+	}
+
+	err := b.StopExporter(context.Background(), exportedContainer("exporter-id", exporter.Name, map[string]string{
+		LABEL_EXPORTED_ID:   "redis-id",
+		LABEL_EXPORTED_NAME: "/redis",
+		LABEL_EXPORTER_TYPE: "redis",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	stopped := waitLifecycleEvent(t, events)
+	if stopped.event != LifecycleEventStopped {
+		t.Errorf("expected a %q event, got %q", LifecycleEventStopped, stopped.event)
+	}
+	if stopped.exporter.PredefinedType != "redis" || stopped.exporter.Exported.ID != "redis-id" || stopped.exporter.Exported.Name != "/redis" {
+		t.Errorf("unexpected stopped exporter %+v", stopped.exporter)
+	}
+}
+
+func TestSlowLifecycleObserverDoesNotBlock(t *testing.T) {
+	cli := &fakeClient{
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+
+	cancelled := make(chan struct{})
+	observer := func(ctx context.Context, event string, exporter models.Exporter) error {
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}
+
+	b := NewDockerBackend(cli, WithLifecycleObserver(observer, 50*time.Millisecond))
+
+	done := make(chan error)
+	go func() {
+		done <- b.StopExporter(context.Background(), exportedContainer("exporter-id", "/exporter", nil))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("StopExporter waited for the observer")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the observer context wasn't cancelled after its timeout")
+	}
+}
+
+func TestWebhookObserverPostsTheEvent(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("unexpected error: %+v", err)
+		}
+		received <- payload
+	}))
+	defer srv.Close()
+
+	exporter := redisExporter()
+	exporter.EnvVars = []string{"REDIS_PASSWORD=s3cr3t"}
+	exporter.ScrapeAuth = models.ScrapeAuth{Type: models.ScrapeAuthBasic, Password: "s3cr3t"}
+
+	observer := NewWebhookObserver(srv.URL)
+	if err := observer(context.Background(), LifecycleEventStarted, exporter); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	// Env vars and scrape credentials are never posted
+	expected := map[string]interface{}{
+		"event":         LifecycleEventStarted,
+		"name":          exporter.Name,
+		"image":         "redis_exporter",
+		"exported_id":   "redis-id",
+		"exported_name": "/redis",
+	}
+	if payload := <-received; !reflect.DeepEqual(payload, expected) {
+		t.Errorf("expected payload %v, got %v", expected, payload)
+	}
+}
+
+func waitLifecycleEvent(t *testing.T, events <-chan lifecycleEvent) lifecycleEvent {
+	t.Helper()
+
+	select {
+	case evt := <-events:
+		return evt
+	case <-time.After(time.Second):
+		t.Fatal("the lifecycle observer wasn't notified")
+	}
+
+	return lifecycleEvent{}
+}
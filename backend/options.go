@@ -0,0 +1,304 @@
+package backend
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetryAttempts    = 3
+	defaultRetryInterval    = 5 * time.Second
+	defaultRetryMaxInterval = 1 * time.Minute
+	defaultLivenessTimeout  = 5 * time.Second
+	// Exported containers health is polled every waitHealthyInterval, up to
+	// the wait timeout
+	defaultWaitHealthyTimeout = 2 * time.Minute
+	waitHealthyInterval       = 2 * time.Second
+	defaultObserverTimeout    = 10 * time.Second
+	defaultAPITimeout         = 30 * time.Second
+	defaultPullTimeout        = 10 * time.Minute
+)
+
+// Container actions handled by the DockerBackend. Exporters are started on
+// start events, on health_status events when the container becomes healthy,
+// and recreated on rename events.
+var (
+	DefaultEvents   = []string{"start", "die", "rename"}
+	SupportedEvents = []string{"start", "die", "oom", "health_status", "rename"}
+)
+
+// Option configures optional behaviors of the DockerBackend
+type Option func(*DockerBackend)
+
+// WithRetry configures how many times event handlers are attempted and the
+// bounds of the exponential back-off applied between two attempts
+func WithRetry(attempts uint, interval, maxInterval time.Duration) Option {
+	return func(b *DockerBackend) {
+		b.retryAttempts = attempts
+		b.retryInterval = interval
+		b.retryMaxInterval = maxInterval
+	}
+}
+
+// WithDryRun enables the dry-run mode: actions that would change Docker
+// state are logged with their parameters instead of being executed
+func WithDryRun(dryRun bool) Option {
+	return func(b *DockerBackend) {
+		b.dryRun = dryRun
+	}
+}
+
+// WithOOMHandling enables watching oom events, to forcefully clean up the
+// exporters of OOM killed containers
+func WithOOMHandling(enabled bool) Option {
+	return func(b *DockerBackend) {
+		b.handleOOM = enabled
+	}
+}
+
+// WithFinder replaces the finder used to resolve which exporters should run
+// for a given container
+func WithFinder(finder models.ExporterFinder) Option {
+	return func(b *DockerBackend) {
+		b.finder.set(finder)
+	}
+}
+
+// WithInit runs all the exporters with an init process (e.g. tini) reaping
+// zombie processes. Exporters can also enable it individually.
+func WithInit(enabled bool) Option {
+	return func(b *DockerBackend) {
+		b.init = enabled
+	}
+}
+
+const (
+	// Exporters are left untouched when their exported container is unhealthy
+	UnhealthyActionNone = ""
+	// Exporters are paused while their exported container is unhealthy
+	UnhealthyActionPause = "pause"
+	// Health transitions of exported containers are logged, and their health
+	// status is added as a label to the file_sd targets of their exporters
+	UnhealthyActionAnnotate = "annotate"
+)
+
+// WithUnhealthyAction configures what to do with exporters when their
+// exported container becomes unhealthy and then healthy again
+func WithUnhealthyAction(action string) Option {
+	return func(b *DockerBackend) {
+		b.unhealthyAction = action
+	}
+}
+
+// WithPodmanCompat adjusts the backend to the quirks of Podman
+// Docker-compatible API
+func WithPodmanCompat(enabled bool) Option {
+	return func(b *DockerBackend) {
+		b.podmanCompat = enabled
+	}
+}
+
+// WithStopOrder configures when exporters are stopped relative to the other
+// containers of the compose project or swarm stack of their exported container
+func WithStopOrder(order string) Option {
+	return func(b *DockerBackend) {
+		b.stopOrder = order
+	}
+}
+
+// WithRegistryAuths sets the credentials used to pull images from private
+// registries, indexed by registry address
+func WithRegistryAuths(auths map[string]types.AuthConfig) Option {
+	return func(b *DockerBackend) {
+		b.registryAuths = auths
+	}
+}
+
+const (
+	// Exporters colliding with unmanaged containers are skipped
+	CollisionPolicySkip = "skip"
+	// Exporters colliding with unmanaged containers are renamed with a suffix
+	CollisionPolicySuffix = "suffix"
+)
+
+// WithCollisionPolicy configures what to do when a container not managed by
+// prom-autoexporter already has the name of an exporter
+func WithCollisionPolicy(policy string) Option {
+	return func(b *DockerBackend) {
+		b.collisionPolicy = policy
+	}
+}
+
+// WithDefaultScrapePort sets the port scraped when exporters don't define
+// one. It should be validated with ValidatePort first.
+func WithDefaultScrapePort(port string) Option {
+	return func(b *DockerBackend) {
+		b.defaultScrapePort = port
+	}
+}
+
+// ValidatePort checks that port is a valid TCP port number
+func ValidatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return errors.Errorf("invalid port %q, should be between 1 and 65535", port)
+	}
+
+	return nil
+}
+
+// WithLivenessChecker replaces the checker used to verify that exporters
+// still serve their metrics
+func WithLivenessChecker(checker LivenessChecker) Option {
+	return func(b *DockerBackend) {
+		b.livenessChecker = checker
+	}
+}
+
+// WithContainerFilter restricts which containers are considered for export
+func WithContainerFilter(filter ContainerFilter) Option {
+	return func(b *DockerBackend) {
+		b.filter = filter
+	}
+}
+
+// WithRulesVersion sets the version of the exporter rules (e.g. git SHA)
+// stamped on created exporters, to find the ones created by older rules
+func WithRulesVersion(version string) Option {
+	return func(b *DockerBackend) {
+		b.rulesVersion = version
+	}
+}
+
+// WithDisconnectFailure configures whether exporters cleanup is aborted or
+// proceeds when their scrape target can't be disconnected from the
+// Prometheus network
+func WithDisconnectFailure(behavior string) Option {
+	return func(b *DockerBackend) {
+		b.disconnectFailure = behavior
+	}
+}
+
+// WithPropagatedLabels sets the labels of exported containers copied onto
+// their exporters. Patterns ending with "*" match label prefixes (e.g.
+// "prometheus.*"), others match exact label names.
+func WithPropagatedLabels(patterns []string) Option {
+	return func(b *DockerBackend) {
+		b.labelsToPropagate = patterns
+	}
+}
+
+// WithLeaderElector gates all mutations of Docker state behind the given
+// elector, such that only the leader acts when several instances run
+func WithLeaderElector(elector LeaderElector) Option {
+	return func(b *DockerBackend) {
+		b.elector = elector
+	}
+}
+
+// WithWaitHealthyTimeout sets the maximum time spent waiting for exported
+// containers labeled with LABEL_WAIT_HEALTHY to be healthy
+func WithWaitHealthyTimeout(timeout time.Duration) Option {
+	return func(b *DockerBackend) {
+		b.waitHealthyTimeout = timeout
+	}
+}
+
+// WithLifecycleObserver sets the observer notified when exporters are
+// started or stopped, and how long it's given to complete
+func WithLifecycleObserver(observer LifecycleObserver, timeout time.Duration) Option {
+	return func(b *DockerBackend) {
+		b.observer = observer
+		b.observerTimeout = timeout
+	}
+}
+
+// WithFileSD enables writing the targets of running exporters to the given
+// path, following Prometheus file_sd_config format. Only the exporter labels
+// matching the given patterns are added to their target, patterns ending
+// with "*" match label prefixes.
+func WithFileSD(path string, labels []string) Option {
+	return func(b *DockerBackend) {
+		b.fileSD = &fileSD{path: path, labels: labels}
+	}
+}
+
+// WithQuarantine stops recreating exporters restarted at least threshold
+// times within the given window, until their target changes
+func WithQuarantine(threshold int, window time.Duration) Option {
+	return func(b *DockerBackend) {
+		b.quarantine = newQuarantine(threshold, window)
+	}
+}
+
+// WithEvents sets the container actions subscribed to, in place of
+// DefaultEvents. Subscribing to health_status without start makes exporters
+// start only once their exported container is healthy.
+func WithEvents(actions []string) Option {
+	return func(b *DockerBackend) {
+		b.events = actions
+	}
+}
+
+// ValidateEvents checks that all the given actions are supported
+func ValidateEvents(actions []string) error {
+	for _, action := range actions {
+		supported := false
+		for _, s := range SupportedEvents {
+			supported = supported || action == s
+		}
+		if !supported {
+			return errors.Errorf("Unsupported event %q. Should be one of: %s.", action, strings.Join(SupportedEvents, ", "))
+		}
+	}
+
+	return nil
+}
+
+// WithTimeouts sets the maximum duration of Docker API calls, and of image
+// pulls. Each of them is left unbounded when its timeout is 0.
+func WithTimeouts(apiTimeout, pullTimeout time.Duration) Option {
+	return func(b *DockerBackend) {
+		b.apiTimeout = apiTimeout
+		b.pullTimeout = pullTimeout
+	}
+}
+
+// WithReconcileJitter randomizes each periodic reconciliation interval
+// within plus or minus the given jitter, to spread the Docker API load of
+// several instances over time
+func WithReconcileJitter(jitter time.Duration) Option {
+	return func(b *DockerBackend) {
+		b.reconcileJitter = jitter
+	}
+}
+
+// WithAllowedBindSources sets the host paths under which the bind labels of
+// exported containers can mount sources. Bind labels are rejected when empty.
+func WithAllowedBindSources(paths []string) Option {
+	return func(b *DockerBackend) {
+		b.allowedBindSources = paths
+	}
+}
+
+// WithAllowedEnvFileSources sets the host paths under which the env-file
+// labels of exported containers can mount files. Env-file labels are rejected
+// when empty.
+func WithAllowedEnvFileSources(paths []string) Option {
+	return func(b *DockerBackend) {
+		b.allowedEnvFileSources = paths
+	}
+}
+
+// WithImageRewrites sets the rules rewriting exporter images before they're
+// pulled and run, the first matching rule applies
+func WithImageRewrites(rules []ImageRewrite) Option {
+	return func(b *DockerBackend) {
+		b.imageRewrites = rules
+	}
+}
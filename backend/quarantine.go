@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/metrics"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	exportersQuarantined = metrics.NewGauge(
+		"autoexporter_exporters_quarantined",
+		"Number of exporters not recreated anymore because they restarted too often.",
+	)
+)
+
+// quarantine tracks the restarts of exporter containers, such that
+// crash-looping exporters stop being recreated. It's shared between copies
+// of the DockerBackend.
+type quarantine struct {
+	mutex     sync.Mutex
+	threshold int
+	window    time.Duration
+	// Restarts tracking indexed by exporter names
+	entries map[string]*quarantineEntry
+}
+
+type quarantineEntry struct {
+	// Identifies the exported container and the exporter spec, an exporter
+	// is released from quarantine when its target changes
+	target string
+	// Container ID and restart count seen on the last observation, used to
+	// only record new restarts
+	containerID  string
+	restartCount int
+	restarts     []time.Time
+	quarantined  bool
+}
+
+func newQuarantine(threshold int, window time.Duration) *quarantine {
+	return &quarantine{
+		threshold: threshold,
+		window:    window,
+		entries:   make(map[string]*quarantineEntry, 0),
+	}
+}
+
+// observe records the restarts of the given exporter container that happened
+// since the last observation, and returns true when the exporter has
+// restarted at least threshold times within the window
+func (q *quarantine) observe(name, target, containerID string, restartCount int, now time.Time) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entry, ok := q.entries[name]
+	if !ok || entry.target != target {
+		entry = &quarantineEntry{target: target}
+		q.entries[name] = entry
+	}
+
+	restarts := restartCount
+	if entry.containerID == containerID {
+		restarts -= entry.restartCount
+	}
+	for i := 0; i < restarts; i++ {
+		entry.restarts = append(entry.restarts, now)
+	}
+	entry.containerID = containerID
+	entry.restartCount = restartCount
+
+	recent := entry.restarts[:0]
+	for _, restart := range entry.restarts {
+		if now.Sub(restart) <= q.window {
+			recent = append(recent, restart)
+		}
+	}
+	entry.restarts = recent
+	entry.quarantined = entry.quarantined || len(entry.restarts) >= q.threshold
+
+	exportersQuarantined.Set(float64(q.count()))
+
+	return entry.quarantined
+}
+
+// forget drops the restarts tracked for the given exporter, when they were
+// observed on the given container
+func (q *quarantine) forget(name, containerID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if entry, ok := q.entries[name]; ok && entry.containerID == containerID {
+		delete(q.entries, name)
+	}
+
+	exportersQuarantined.Set(float64(q.count()))
+}
+
+func (q *quarantine) count() int {
+	count := 0
+	for _, entry := range q.entries {
+		if entry.quarantined {
+			count++
+		}
+	}
+
+	return count
+}
+
+// isQuarantined checks the restarts of the existing container of the given
+// exporter, if any, and returns true when the exporter should not be
+// (re)created
+func (b DockerBackend) isQuarantined(ctx context.Context, exporter models.Exporter) (bool, error) {
+	if b.quarantine == nil {
+		return false, nil
+	}
+
+	existing, err := b.cli.ContainerInspect(ctx, exporter.Name)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	target := exporter.Exported.ID + "/" + exporter.SpecHash()
+	quarantined := b.quarantine.observe(exporter.Name, target, existing.ID, restartCount(existing), time.Now())
+	if quarantined {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"exporter.cid":           existing.ID,
+			"exporter.restart_count": existing.RestartCount,
+		}).Warn("Exporter quarantined after restarting too often, it won't be recreated until its target changes.")
+	}
+
+	return quarantined, nil
+}
+
+// restartCount returns the number of restarts of the given exporter
+// container. Exporters which already exited after exhausting their restart
+// policy count as one more restart.
+func restartCount(container types.ContainerJSON) int {
+	count := container.RestartCount
+	if container.State != nil && container.State.Status == "exited" && container.State.ExitCode != 0 {
+		count++
+	}
+
+	return count
+}
+
+// observeExporterEvent records the restarts of an exporter container as soon
+// as it dies, and forgets them once the container is destroyed
+func (b DockerBackend) observeExporterEvent(ctx context.Context, evt events.Message) {
+	if b.quarantine == nil {
+		return
+	}
+
+	name := "/" + strings.TrimPrefix(evt.Actor.Attributes["name"], "/")
+	switch evt.Action {
+	case "destroy":
+		b.quarantine.forget(name, evt.Actor.ID)
+	case "die":
+		existing, err := b.cli.ContainerInspect(ctx, evt.Actor.ID)
+		if client.IsErrNotFound(err) {
+			return
+		} else if err != nil {
+			log.GetLogger(ctx).Errorf("%+v", errors.WithStack(err))
+			return
+		}
+
+		target := existing.Config.Labels[LABEL_EXPORTED_ID] + "/" + existing.Config.Labels[LABEL_EXPORTER_SPEC_HASH]
+		b.quarantine.observe(name, target, existing.ID, restartCount(existing), time.Now())
+	}
+}
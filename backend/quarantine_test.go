@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestQuarantineObserve(t *testing.T) {
+	now := time.Now()
+	q := newQuarantine(3, time.Minute)
+
+	if q.observe("/exporter", "redis-id/hash", "exporter-id", 1, now) {
+		t.Fatal("expected 1 restart not to quarantine the exporter")
+	}
+	// Same container seen again without new restarts
+	if q.observe("/exporter", "redis-id/hash", "exporter-id", 1, now.Add(10*time.Second)) {
+		t.Fatal("expected restarts not to be counted twice")
+	}
+	if !q.observe("/exporter", "redis-id/hash", "exporter-id", 3, now.Add(20*time.Second)) {
+		t.Fatal("expected 3 restarts within the window to quarantine the exporter")
+	}
+	if !q.observe("/exporter", "redis-id/hash", "exporter-id", 3, now.Add(5*time.Minute)) {
+		t.Fatal("expected the exporter to stay quarantined once restarts are out of the window")
+	}
+	if q.observe("/exporter", "new-redis-id/hash", "new-exporter-id", 0, now.Add(5*time.Minute)) {
+		t.Fatal("expected the exporter to be released when its target changes")
+	}
+}
+
+func TestQuarantineForgetsRestartsOutOfWindow(t *testing.T) {
+	now := time.Now()
+	q := newQuarantine(3, time.Minute)
+
+	q.observe("/exporter", "redis-id/hash", "exporter-id", 2, now)
+	// The container has been recreated, its restart count starts over
+	if q.observe("/exporter", "redis-id/hash", "new-exporter-id", 1, now.Add(2*time.Minute)) {
+		t.Fatal("expected restarts out of the window to be forgotten")
+	}
+}
+
+func TestQuarantineTracksExporterEvents(t *testing.T) {
+	restarts := 0
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			exporter := exportedContainer(id, "/exporter.redis.redis", map[string]string{
+				LABEL_EXPORTED_ID:        "redis-id",
+				LABEL_EXPORTER_SPEC_HASH: "hash",
+			})
+			exporter.RestartCount = restarts
+			exporter.State = &types.ContainerState{Status: "restarting"}
+			return exporter, nil
+		},
+	}
+
+	b := NewDockerBackend(cli, WithQuarantine(2, time.Minute))
+	ctx := context.Background()
+	event := func(action string) events.Message {
+		return events.Message{
+			Action: action,
+			Actor: events.Actor{
+				ID:         "exporter-id",
+				Attributes: map[string]string{"name": "exporter.redis.redis", LABEL_EXPORTED_NAME: "/redis"},
+			},
+		}
+	}
+
+	for restarts = 1; restarts <= 2; restarts++ {
+		b.observeExporterEvent(ctx, event("die"))
+	}
+
+	entry, ok := b.quarantine.entries["/exporter.redis.redis"]
+	if !ok || !entry.quarantined {
+		t.Fatalf("expected the exporter to be quarantined after dying twice, got %+v", entry)
+	}
+
+	b.observeExporterEvent(ctx, event("destroy"))
+	if _, ok := b.quarantine.entries["/exporter.redis.redis"]; ok {
+		t.Error("expected the exporter to be forgotten once destroyed")
+	}
+}
+
+func TestRunExporterSkipsQuarantinedExporters(t *testing.T) {
+	exporter := redisExporter()
+	exporter.PromNetworks = []string{"prometheus"}
+
+	inspected := 0
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			inspected++
+			crashLooping := exportedContainer("exporter-id", exporter.Name, nil)
+			crashLooping.RestartCount = 5
+			crashLooping.State = &types.ContainerState{Status: "restarting"}
+			return crashLooping, nil
+		},
+	}
+
+	// Any other call would panic on the fake client
+	b := NewDockerBackend(cli, WithQuarantine(3, time.Minute))
+	b.RunExporter(context.Background(), exporter)
+
+	if inspected != 1 {
+		t.Errorf("expected the existing exporter to be inspected once, got %d", inspected)
+	}
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// SetFinder replaces the finder used to resolve exporters. Exporters already
+// running are not affected until RefreshAll is called.
+func (b DockerBackend) SetFinder(finder models.ExporterFinder) {
+	b.finder.set(finder)
+}
+
+// RefreshAll resolves exporters again for every running container and
+// reconciles them with running exporters: newly matched exporters are
+// started, exporters not matched anymore are removed and changed exporters
+// are recreated.
+func (b DockerBackend) RefreshAll(ctx context.Context, promNetworks []string) error {
+	if !b.elector.IsLeader(ctx) {
+		log.GetLogger(ctx).Debug("Not the leader, skipping refresh.")
+		return nil
+	}
+
+	containers, err := b.cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	exporters, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_EXPORTED_ID),
+		),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Exporters indexed by exported container ID, then by exporter name
+	current := make(map[string]map[string]types.Container, len(exporters))
+	for _, exporter := range exporters {
+		exportedID := exporter.Labels[LABEL_EXPORTED_ID]
+		if _, ok := current[exportedID]; !ok {
+			current[exportedID] = map[string]types.Container{}
+		}
+		if len(exporter.Names) > 0 {
+			current[exportedID][exporter.Names[0]] = exporter
+		}
+	}
+
+	for _, container := range containers {
+		// Ignore exporters
+		if _, ok := container.Labels[LABEL_EXPORTED_NAME]; ok {
+			continue
+		}
+
+		if !b.filter.Allows(container.Names, container.Image, container.Labels) {
+			continue
+		}
+
+		logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+			"exported.id":   container.ID,
+			"exported.name": firstName(container.Names),
+		})
+		ctx := log.WithLogger(ctx, logger)
+
+		if err := b.refreshExporters(ctx, container.ID, current[container.ID], promNetworks); err != nil {
+			logger.Errorf("%+v", err)
+		}
+	}
+
+	return nil
+}
+
+// refreshExporters reconciles the exporters of a single exported container
+// with the ones currently running (indexed by name)
+func (b DockerBackend) refreshExporters(ctx context.Context, exportedID string, current map[string]types.Container, promNetworks []string) error {
+	exported, err := b.cli.ContainerInspect(ctx, exportedID)
+	if client.IsErrNotFound(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	desired, err := b.resolveExporters(ctx, newTaskToExport(exported))
+	if err != nil {
+		return err
+	}
+
+	desiredNames := make(map[string]bool, len(desired))
+	for _, exporter := range desired {
+		desiredNames[exporter.Name] = true
+	}
+
+	for name, running := range current {
+		if desiredNames[name] {
+			continue
+		}
+
+		logger := log.GetLogger(ctx).WithField("exporter.name", name)
+		logger.Info("Exporter not matched anymore, removing it...")
+
+		if err := b.CleanupExporter(log.WithLogger(ctx, logger), running.ID, true); err != nil && !IsErrExporterNotFound(err) {
+			logger.Errorf("%+v", err)
+		}
+	}
+
+	for _, exporter := range desired {
+		logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+			"exporter.name":  exporter.Name,
+			"exporter.image": exporter.Image,
+		})
+		ctx := log.WithLogger(ctx, logger)
+
+		if running, exists := current[exporter.Name]; exists {
+			if running.Labels[LABEL_EXPORTER_SPEC_HASH] == exporter.SpecHash() && !sourceChanged(running.Labels, exporter) {
+				continue
+			}
+
+			logger.Info("Exporter changed, recreating it...")
+			if err := b.CleanupExporter(ctx, running.ID, true); err != nil {
+				logger.Errorf("%+v", err)
+				continue
+			}
+		}
+
+		logger.Info("Starting exporter...")
+
+		exporter.PromNetworks = promNetworks
+		b.RunExporter(ctx, exporter)
+	}
+
+	return nil
+}
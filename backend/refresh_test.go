@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestRefreshAllReconcilesExportersWithNewRules(t *testing.T) {
+	unchanged := stubExporter("redis", "redis_exporter:1")
+	changed := stubExporter("php", "php_exporter:2")
+	added := stubExporter("nginx", "nginx_exporter:1")
+
+	exporterOf := func(id, exporterType, exportedID, exportedName, specHash string) types.Container {
+		return types.Container{
+			ID:    id,
+			Names: []string{getExporterName(exporterType, exportedName, exportedID)},
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:        exportedID,
+				LABEL_EXPORTED_NAME:      exportedName,
+				LABEL_EXPORTER_SPEC_HASH: specHash,
+			},
+		}
+	}
+	exporters := []types.Container{
+		exporterOf("redis-exporter-id", "redis", "redis-id", "/redis", unchanged.SpecHash()),
+		exporterOf("php-exporter-id", "php", "php-id", "/php", "outdated"),
+		exporterOf("es-exporter-id", "elasticsearch", "es-id", "/elasticsearch", "whatever"),
+	}
+	containers := append([]types.Container{
+		{ID: "redis-id", Names: []string{"/redis"}},
+		{ID: "php-id", Names: []string{"/php"}},
+		{ID: "es-id", Names: []string{"/elasticsearch"}},
+		{ID: "nginx-id", Names: []string{"/nginx"}},
+	}, exporters...)
+	names := map[string]string{}
+	for _, c := range containers {
+		names[c.ID] = c.Names[0]
+	}
+
+	var created, removed []string
+	cli := &fakeClient{
+		containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+			return filterContainers(containers, options.Filters), nil
+		},
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			for _, e := range exporters {
+				if e.ID == id {
+					return exportedContainer(e.ID, e.Names[0], e.Labels), nil
+				}
+			}
+			if name, ok := names[id]; ok {
+				return exportedContainer(id, name, nil), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			removed = append(removed, id)
+			return nil
+		},
+		imageInspectFn: imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			created = append(created, name)
+			return container.ContainerCreateCreatedBody{ID: name}, nil
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+	}
+
+	// The elasticsearch exporter is not matched anymore, the php one changed
+	// and the nginx one is new
+	b := NewDockerBackend(cli, WithFinder(stubFinder{
+		"/redis": {unchanged},
+		"/php":   {changed},
+		"/nginx": {added},
+	}))
+	if err := b.RefreshAll(context.Background(), []string{"prometheus"}); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	sort.Strings(created)
+	sort.Strings(removed)
+
+	if expected := []string{getExporterName("nginx", "/nginx", "nginx-id"), getExporterName("php", "/php", "php-id")}; !reflect.DeepEqual(created, expected) {
+		t.Errorf("expected exporters %v to be created, got %v", expected, created)
+	}
+	if expected := []string{"es-exporter-id", "php-exporter-id"}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected exporters %v to be removed, got %v", expected, removed)
+	}
+}
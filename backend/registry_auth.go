@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// Key used by docker CLI to store Docker Hub credentials
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// dockerConfig is the subset of docker CLI config file (~/.docker/config.json)
+// needed to authenticate against registries
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// LoadRegistryAuths reads the credentials stored in the given docker CLI
+// config file. They're indexed by registry address, as in the file.
+func LoadRegistryAuths(path string) (map[string]types.AuthConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var config dockerConfig
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, errors.Wrapf(err, "invalid docker config file %q", path)
+	}
+
+	auths := make(map[string]types.AuthConfig, len(config.Auths))
+	for registry, entry := range config.Auths {
+		auth := types.AuthConfig{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			ServerAddress: registry,
+		}
+
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid auth for registry %q", registry)
+			}
+
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid auth for registry %q", registry)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+
+		auths[registry] = auth
+	}
+
+	return auths, nil
+}
+
+// registryAuth returns the encoded credentials to use to pull the given
+// image, or an empty string when no credentials match its registry
+func (b DockerBackend) registryAuth(image string) (string, error) {
+	if len(b.registryAuths) == 0 {
+		return "", nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	domain := reference.Domain(named)
+	candidates := []string{domain, "https://" + domain, "http://" + domain}
+	if domain == "docker.io" {
+		candidates = append(candidates, dockerHubAuthKey, "index.docker.io")
+	}
+
+	for _, candidate := range candidates {
+		auth, ok := b.registryAuths[candidate]
+		if !ok {
+			continue
+		}
+
+		encoded, err := json.Marshal(auth)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		return base64.URLEncoding.EncodeToString(encoded), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+)
+
+func TestLoadRegistryAuths(t *testing.T) {
+	f, err := ioutil.TempFile("", "docker-config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("bot:s3cr3t:with:colons"))
+	if _, err := f.WriteString(`{"auths": {
+		"registry.example.com": {"auth": "` + encoded + `"},
+		"https://index.docker.io/v1/": {"username": "hub", "password": "hubpass"}
+	}}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	auths, err := LoadRegistryAuths(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if auth := auths["registry.example.com"]; auth.Username != "bot" || auth.Password != "s3cr3t:with:colons" {
+		t.Errorf("unexpected credentials decoded from auth field: %+v", auth)
+	}
+	if auth := auths["https://index.docker.io/v1/"]; auth.Username != "hub" || auth.Password != "hubpass" {
+		t.Errorf("unexpected credentials: %+v", auth)
+	}
+}
+
+func TestPullImageUsesRegistryAuth(t *testing.T) {
+	auths := map[string]types.AuthConfig{
+		"registry.example.com":        {Username: "bot", Password: "s3cr3t", ServerAddress: "registry.example.com"},
+		"https://index.docker.io/v1/": {Username: "hub", Password: "hubpass", ServerAddress: "https://index.docker.io/v1/"},
+	}
+
+	encode := func(auth types.AuthConfig) string {
+		encoded, _ := json.Marshal(auth)
+		return base64.URLEncoding.EncodeToString(encoded)
+	}
+
+	testcases := map[string]struct {
+		image    string
+		expected string
+	}{
+		"matching private registry": {
+			image:    "registry.example.com/exporters/myapp:1.0",
+			expected: encode(auths["registry.example.com"]),
+		},
+		"docker hub": {
+			image:    "oliver006/redis_exporter",
+			expected: encode(auths["https://index.docker.io/v1/"]),
+		},
+		"unmatched registry": {
+			image:    "quay.io/prometheus/node-exporter",
+			expected: "",
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			var registryAuth string
+			cli := &fakeClient{
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					registryAuth = options.RegistryAuth
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+			}
+
+			exporter := models.NewExporter("", "myapp", tc.image, nil, nil, models.TaskToExport{})
+			exporter.ImagePullPolicy = models.PullPolicyAlways
+
+			b := NewDockerBackend(cli, WithRegistryAuths(auths))
+			if err := b.pullImage(context.Background(), exporter); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if registryAuth != tc.expected {
+				t.Errorf("expected registry auth %q, got %q", tc.expected, registryAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package backend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Prefix of the labels mounting a host file in exporters, such that
+	// secrets never live in labels. The env var suffixed with _FILE points to
+	// the mounted file, e.g. autoexporter.env-file.DATA_SOURCE_NAME=/run/secrets/dsn
+	// sets DATA_SOURCE_NAME_FILE=/run/secrets/DATA_SOURCE_NAME. Only files
+	// under the allowed paths can be mounted this way, for the env vars the
+	// exporter reads from files.
+	LABEL_ENV_FILE_PREFIX = "autoexporter.env-file."
+	// Prefix of the labels mounting a Docker secret in Swarm exporters. The
+	// env var suffixed with _FILE points to the mounted secret, e.g.
+	// autoexporter.env-secret.DATA_SOURCE_NAME=dsn sets
+	// DATA_SOURCE_NAME_FILE=/run/secrets/dsn
+	LABEL_ENV_SECRET_PREFIX = "autoexporter.env-secret."
+)
+
+// Directory where the files referenced by env-file labels are mounted
+const envFileDir = "/run/secrets/"
+
+// Env var names, also used as the names of the mounted files
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkFileEnvVar checks that the env var set by the given label is a valid
+// name, that the exporter reads from the file its _FILE variant points to
+func checkFileEnvVar(exporter models.Exporter, label, name string) error {
+	if !envVarName.MatchString(name) {
+		return errors.Errorf("invalid env var name %q in label %s", name, label)
+	}
+
+	for _, fileEnvVar := range exporter.FileEnvVars {
+		if fileEnvVar == name {
+			return nil
+		}
+	}
+
+	return errors.Errorf("exporter %q doesn't read %s from a file, it can't be set by label %s", exporter.PredefinedType, name, label)
+}
+
+// envFileBinds returns the read-only binds of the host files referenced by
+// the env-file labels of the exported container, along with the env vars
+// pointing to them, sorted by name. Files are never read by
+// prom-autoexporter. An error is returned when a file is not allowed or is
+// not a regular file, as Docker would create a directory in place of missing
+// ones.
+func envFileBinds(exporter models.Exporter, allowed []string) ([]string, []string, error) {
+	labels := exporter.Exported.Labels
+	binds := []string{}
+	envVars := []string{}
+
+	for _, name := range labelsWithPrefix(labels, LABEL_ENV_FILE_PREFIX) {
+		label := LABEL_ENV_FILE_PREFIX + name
+		path := labels[label]
+
+		if err := checkFileEnvVar(exporter, label, name); err != nil {
+			return nil, nil, err
+		}
+		if !filepath.IsAbs(path) || strings.Contains(path, ":") {
+			return nil, nil, errors.Errorf("invalid path %q in label %s, should be an absolute path", path, label)
+		}
+		if !isBindAllowed(path, allowed) {
+			return nil, nil, errors.Errorf("path %q in label %s is not allowed", path, label)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "file referenced by label %s", label)
+		} else if !info.Mode().IsRegular() {
+			return nil, nil, errors.Errorf("path %q in label %s is not a regular file", path, label)
+		}
+
+		binds = append(binds, filepath.Clean(path)+":"+envFileDir+name+":ro")
+		envVars = append(envVars, name+"_FILE="+envFileDir+name)
+	}
+
+	return binds, envVars, nil
+}
+
+// secretReferences resolves the Docker secrets referenced by the env-secret
+// labels of the exported task, and returns them along with the env vars
+// pointing to their files
+func (b SwarmBackend) secretReferences(ctx context.Context, exporter models.Exporter) ([]*swarm.SecretReference, []string, error) {
+	labels := exporter.Exported.Labels
+	refs := []*swarm.SecretReference{}
+	envVars := []string{}
+
+	for _, name := range labelsWithPrefix(labels, LABEL_ENV_SECRET_PREFIX) {
+		secretName := labels[LABEL_ENV_SECRET_PREFIX+name]
+		if err := checkFileEnvVar(exporter, LABEL_ENV_SECRET_PREFIX+name, name); err != nil {
+			return nil, nil, err
+		}
+
+		secrets, err := b.cli.SecretList(ctx, types.SecretListOptions{
+			Filters: filters.NewArgs(filters.Arg("name", secretName)),
+		})
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		// The name filter matches prefixes
+		var secretID string
+		for _, secret := range secrets {
+			if secret.Spec.Name == secretName {
+				secretID = secret.ID
+			}
+		}
+		if secretID == "" {
+			return nil, nil, errors.Errorf("secret %q referenced by env var %s not found", secretName, name)
+		}
+
+		refs = append(refs, &swarm.SecretReference{
+			SecretID:   secretID,
+			SecretName: secretName,
+			File: &swarm.SecretReferenceFileTarget{
+				Name: secretName,
+				UID:  "0",
+				GID:  "0",
+				Mode: 0444,
+			},
+		})
+		envVars = append(envVars, name+"_FILE=/run/secrets/"+secretName)
+	}
+
+	return refs, envVars, nil
+}
+
+// labelsWithPrefix returns the sorted suffixes of the labels starting with
+// the given prefix
+func labelsWithPrefix(labels map[string]string, prefix string) []string {
+	suffixes := []string{}
+	for label := range labels {
+		if strings.HasPrefix(label, prefix) && len(label) > len(prefix) {
+			suffixes = append(suffixes, strings.TrimPrefix(label, prefix))
+		}
+	}
+	sort.Strings(suffixes)
+
+	return suffixes
+}
@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func TestEnvFileBinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"dsn", "password"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("s3cr3t"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "db"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	allowed := []string{dir}
+
+	testcases := map[string]struct {
+		labels        map[string]string
+		expectedBinds []string
+		expectedEnv   []string
+		expectedErr   bool
+	}{
+		"allowed files": {
+			labels: map[string]string{
+				LABEL_ENV_FILE_PREFIX + "DATA_SOURCE_NAME": dir + "/dsn",
+				LABEL_ENV_FILE_PREFIX + "PASSWORD":         dir + "/db/../password",
+				"autoexporter.env.LOG_LEVEL":               "debug",
+			},
+			expectedBinds: []string{
+				dir + "/dsn:/run/secrets/DATA_SOURCE_NAME:ro",
+				dir + "/password:/run/secrets/PASSWORD:ro",
+			},
+			expectedEnv: []string{
+				"DATA_SOURCE_NAME_FILE=/run/secrets/DATA_SOURCE_NAME",
+				"PASSWORD_FILE=/run/secrets/PASSWORD",
+			},
+		},
+		"missing file": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "DATA_SOURCE_NAME": dir + "/missing"},
+			expectedErr: true,
+		},
+		"not a regular file": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "DATA_SOURCE_NAME": dir + "/db"},
+			expectedErr: true,
+		},
+		"file not allowed": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "DATA_SOURCE_NAME": "/etc/shadow"},
+			expectedErr: true,
+		},
+		"escaping the allowed path": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "DATA_SOURCE_NAME": dir + "/../../etc/shadow"},
+			expectedErr: true,
+		},
+		"relative path": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "DATA_SOURCE_NAME": "secrets/dsn"},
+			expectedErr: true,
+		},
+		"bind options": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "DATA_SOURCE_NAME": dir + "/dsn:/etc/shadow"},
+			expectedErr: true,
+		},
+		"env var name with a colon": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "DSN:/etc/passwd": dir + "/dsn"},
+			expectedErr: true,
+		},
+		"env var name with a path": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "../../etc/DSN": dir + "/dsn"},
+			expectedErr: true,
+		},
+		"env var not read from a file by the exporter": {
+			labels:      map[string]string{LABEL_ENV_FILE_PREFIX + "REDIS_PASSWORD": dir + "/password"},
+			expectedErr: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exporter := redisExporter()
+			exporter.Exported.Labels = tc.labels
+			exporter.FileEnvVars = []string{"DATA_SOURCE_NAME", "PASSWORD"}
+
+			binds, envVars, err := envFileBinds(exporter, allowed)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error, got binds %v", binds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(binds, tc.expectedBinds) {
+				t.Errorf("expected binds %v, got %v", tc.expectedBinds, binds)
+			}
+			if !reflect.DeepEqual(envVars, tc.expectedEnv) {
+				t.Errorf("expected env vars %v, got %v", tc.expectedEnv, envVars)
+			}
+		})
+	}
+
+	exporter := redisExporter()
+	exporter.Exported.Labels = map[string]string{LABEL_ENV_FILE_PREFIX + "DATA_SOURCE_NAME": dir + "/dsn"}
+	exporter.FileEnvVars = []string{"DATA_SOURCE_NAME"}
+	if _, _, err := envFileBinds(exporter, nil); err == nil {
+		t.Error("expected env-file labels to be rejected without allowed paths")
+	}
+}
+
+func TestCreateContainerMountsEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "redis"), []byte("s3cr3t"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := redisExporter()
+	exporter.Exported.Labels = map[string]string{LABEL_ENV_FILE_PREFIX + "REDIS_PASSWORD": dir + "/redis"}
+	exporter.FileEnvVars = []string{"REDIS_PASSWORD"}
+
+	config, hostConfig := createExporterContainer(t, exporter, WithAllowedEnvFileSources([]string{dir}))
+
+	if expected := []string{dir + "/redis:/run/secrets/REDIS_PASSWORD:ro"}; !reflect.DeepEqual(hostConfig.Binds, expected) {
+		t.Errorf("expected binds %v, got %v", expected, hostConfig.Binds)
+	}
+	if expected := []string{"REDIS_PASSWORD_FILE=/run/secrets/REDIS_PASSWORD"}; !reflect.DeepEqual(config.Env, expected) {
+		t.Errorf("expected env vars %v, got %v", expected, config.Env)
+	}
+}
+
+func TestCreateContainerFailsOnMissingEnvFile(t *testing.T) {
+	exporter := redisExporter()
+	exporter.Exported.Labels = map[string]string{LABEL_ENV_FILE_PREFIX + "REDIS_PASSWORD": "/run/secrets/missing-redis-password"}
+	exporter.FileEnvVars = []string{"REDIS_PASSWORD"}
+
+	cli := &fakeClient{
+		containerCreateFn: func(c *container.Config, hc *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			t.Error("unexpected container creation")
+			return container.ContainerCreateCreatedBody{}, nil
+		},
+	}
+
+	b := NewDockerBackend(cli, WithAllowedEnvFileSources([]string{"/run/secrets"}))
+	if _, err := b.createContainer(context.Background(), exporter, newLifecycleID()); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestSecretReferences(t *testing.T) {
+	cli := &fakeClient{
+		secretListFn: func(ctx context.Context, options types.SecretListOptions) ([]swarm.Secret, error) {
+			// The name filter matches prefixes
+			return []swarm.Secret{
+				{ID: "dsn-prod-id", Spec: swarm.SecretSpec{Annotations: swarm.Annotations{Name: "dsn-prod"}}},
+				{ID: "dsn-id", Spec: swarm.SecretSpec{Annotations: swarm.Annotations{Name: "dsn"}}},
+			}, nil
+		},
+	}
+	b := NewSwarmBackend(cli, stubFinder{}, false)
+
+	exporter := redisExporter()
+	exporter.FileEnvVars = []string{"DATA_SOURCE_NAME"}
+	withSecret := func(labels map[string]string) models.Exporter {
+		e := exporter
+		e.Exported.Labels = labels
+		return e
+	}
+
+	refs, envVars, err := b.secretReferences(context.Background(), withSecret(map[string]string{
+		LABEL_ENV_SECRET_PREFIX + "DATA_SOURCE_NAME": "dsn",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if len(refs) != 1 || refs[0].SecretID != "dsn-id" || refs[0].File.Name != "dsn" {
+		t.Errorf("unexpected secret references %+v", refs)
+	}
+	if expected := []string{"DATA_SOURCE_NAME_FILE=/run/secrets/dsn"}; !reflect.DeepEqual(envVars, expected) {
+		t.Errorf("expected env vars %v, got %v", expected, envVars)
+	}
+
+	if _, _, err := b.secretReferences(context.Background(), withSecret(map[string]string{
+		LABEL_ENV_SECRET_PREFIX + "DATA_SOURCE_NAME": "dsn-staging",
+	})); err == nil {
+		t.Error("expected an error when the secret doesn't exist")
+	}
+	if _, _, err := b.secretReferences(context.Background(), withSecret(map[string]string{
+		LABEL_ENV_SECRET_PREFIX + "REDIS_PASSWORD": "dsn",
+	})); err == nil {
+		t.Error("expected an error when the exporter doesn't read the env var from a file")
+	}
+}
@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+// How long events are remembered, it only has to cover the overlap of the
+// event stream across reconnects
+const seenEventsTTL = 5 * time.Minute
+
+// seenEvents remembers recently handled events, such that the events
+// replayed when subscribing again to the event stream are not handled
+// twice. It's only used by the event loop and isn't thread-safe.
+type seenEvents struct {
+	ttl       time.Duration
+	events    map[string]time.Time
+	lastPrune time.Time
+}
+
+func newSeenEvents(ttl time.Duration) *seenEvents {
+	return &seenEvents{ttl: ttl, events: make(map[string]time.Time)}
+}
+
+// markSeen records the given event and returns false if it was already seen.
+// Events without timestamp can't be told apart and are never deduplicated.
+func (s *seenEvents) markSeen(evt events.Message, now time.Time) bool {
+	if evt.TimeNano == 0 {
+		return true
+	}
+
+	if now.Sub(s.lastPrune) > s.ttl {
+		for key, seenAt := range s.events {
+			if now.Sub(seenAt) > s.ttl {
+				delete(s.events, key)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	key := fmt.Sprintf("%s/%s/%d", evt.Actor.ID, evt.Action, evt.TimeNano)
+	if _, ok := s.events[key]; ok {
+		return false
+	}
+
+	s.events[key] = now
+	return true
+}
@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestSeenEvents(t *testing.T) {
+	now := time.Now()
+	seen := newSeenEvents(time.Minute)
+
+	start := events.Message{Action: "start", Actor: events.Actor{ID: "redis-id"}, TimeNano: now.UnixNano()}
+	if !seen.markSeen(start, now) {
+		t.Fatal("expected the first event not to be seen yet")
+	}
+	if seen.markSeen(start, now.Add(time.Second)) {
+		t.Fatal("expected the replayed event to be seen")
+	}
+
+	die := start
+	die.Action = "die"
+	if !seen.markSeen(die, now) {
+		t.Error("expected events with another action not to be seen")
+	}
+
+	restart := start
+	restart.TimeNano++
+	if !seen.markSeen(restart, now) {
+		t.Error("expected events emitted at another time not to be seen")
+	}
+
+	if !seen.markSeen(start, now.Add(2*time.Minute)) {
+		t.Error("expected events to be forgotten after the ttl")
+	}
+}
+
+func TestEventsWithoutTimestampAreNotDeduplicated(t *testing.T) {
+	seen := newSeenEvents(time.Minute)
+	evt := events.Message{Action: "start", Actor: events.Actor{ID: "redis-id"}}
+
+	if !seen.markSeen(evt, time.Now()) || !seen.markSeen(evt, time.Now()) {
+		t.Error("expected events without timestamp to never be seen")
+	}
+}
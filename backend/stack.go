@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"context"
+	"sort"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Stack of the exported container, copied from compose/swarm labels
+	LABEL_EXPORTED_STACK = "autoexporter.exported.stack"
+
+	labelComposeProject = "com.docker.compose.project"
+	labelStackNamespace = "com.docker.stack.namespace"
+)
+
+const (
+	// Exporters are stopped along with their own exported container
+	StopOrderNone = ""
+	// Exporters of a whole stack are stopped as soon as one of its
+	// containers stops
+	StopOrderExportersFirst = "exporters-first"
+	// Exporters of a stack are stopped once all its containers are stopped
+	StopOrderExportersLast = "exporters-last"
+)
+
+// stackOf returns the name of the compose project or swarm stack the
+// container having the given labels belongs to, or an empty string
+func stackOf(labels map[string]string) string {
+	if stack, ok := labels[labelStackNamespace]; ok {
+		return stack
+	}
+
+	return labels[labelComposeProject]
+}
+
+// groupByStack groups exporters by the stack of their exported container.
+// Stack names are returned sorted, exporters without stack are grouped under
+// an empty name.
+func groupByStack(exporters []types.Container) ([]string, map[string][]types.Container) {
+	groups := make(map[string][]types.Container, 0)
+	for _, exporter := range exporters {
+		stack := exporter.Labels[LABEL_EXPORTED_STACK]
+		groups[stack] = append(groups[stack], exporter)
+	}
+
+	stacks := make([]string, 0, len(groups))
+	for stack := range groups {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	return stacks, groups
+}
+
+// exportersToStop returns the exporters to clean up once the given exported
+// container stopped, according to the configured stop order
+func (b DockerBackend) exportersToStop(ctx context.Context, exportedID, stack string) ([]types.Container, error) {
+	if b.stopOrder == StopOrderNone || stack == "" {
+		return b.FindAssociatedExporters(ctx, exportedID)
+	}
+
+	if b.stopOrder == StopOrderExportersLast {
+		running, err := b.stackRunning(ctx, stack)
+		if err != nil {
+			return nil, err
+		}
+		if running {
+			// The exporters of the stopped container are useless now
+			return b.FindAssociatedExporters(ctx, exportedID)
+		}
+	}
+
+	exporters, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_EXPORTED_STACK+"="+stack),
+		),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"stack":      stack,
+		"stop_order": b.stopOrder,
+	}).Debugf("Stopping %d exporters of the stack.", len(exporters))
+
+	return exporters, nil
+}
+
+// stackRunning checks if any container of the given stack, except exporters,
+// is still running
+func (b DockerBackend) stackRunning(ctx context.Context, stack string) (bool, error) {
+	for _, label := range []string{labelStackNamespace, labelComposeProject} {
+		containers, err := b.cli.ContainerList(ctx, types.ContainerListOptions{
+			Filters: filters.NewArgs(
+				filters.Arg("label", label+"="+stack),
+			),
+		})
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+
+		for _, container := range containers {
+			if _, ok := container.Labels[LABEL_EXPORTED_NAME]; !ok {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,128 @@
+package backend
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func stackExporter(id, exportedID, stack string) types.Container {
+	labels := map[string]string{LABEL_EXPORTED_ID: exportedID, LABEL_EXPORTED_NAME: "/" + exportedID}
+	if stack != "" {
+		labels[LABEL_EXPORTED_STACK] = stack
+	}
+
+	return types.Container{ID: id, Names: []string{"/exporter.redis." + exportedID}, Labels: labels}
+}
+
+func TestGroupByStack(t *testing.T) {
+	exporters := []types.Container{
+		stackExporter("shop-redis-exporter", "shop-redis", "shop"),
+		stackExporter("blog-mysql-exporter", "blog-mysql", "blog"),
+		stackExporter("standalone-exporter", "standalone", ""),
+		stackExporter("shop-mysql-exporter", "shop-mysql", "shop"),
+	}
+
+	stacks, groups := groupByStack(exporters)
+
+	if expected := []string{"", "blog", "shop"}; !reflect.DeepEqual(stacks, expected) {
+		t.Errorf("expected stacks %v, got %v", expected, stacks)
+	}
+
+	expected := map[string][]string{
+		"":     {"standalone-exporter"},
+		"blog": {"blog-mysql-exporter"},
+		"shop": {"shop-redis-exporter", "shop-mysql-exporter"},
+	}
+	for stack, ids := range expected {
+		got := []string{}
+		for _, exporter := range groups[stack] {
+			got = append(got, exporter.ID)
+		}
+		if !reflect.DeepEqual(got, ids) {
+			t.Errorf("expected exporters %v in stack %q, got %v", ids, stack, got)
+		}
+	}
+}
+
+func TestStopOrder(t *testing.T) {
+	testcases := map[string]struct {
+		stopOrder    string
+		stack        string
+		stackRunning bool
+		expected     []string
+	}{
+		"exporters are stopped with their own container by default": {
+			stopOrder:    StopOrderNone,
+			stack:        "shop",
+			stackRunning: true,
+			expected:     []string{"shop-redis-exporter"},
+		},
+		"exporters of the whole stack are stopped first": {
+			stopOrder:    StopOrderExportersFirst,
+			stack:        "shop",
+			stackRunning: true,
+			expected:     []string{"shop-mysql-exporter", "shop-redis-exporter"},
+		},
+		"exporters of the stack are kept until the stack is stopped": {
+			stopOrder:    StopOrderExportersLast,
+			stack:        "shop",
+			stackRunning: true,
+			expected:     []string{"shop-redis-exporter"},
+		},
+		"exporters of the stack are stopped last": {
+			stopOrder:    StopOrderExportersLast,
+			stack:        "shop",
+			stackRunning: false,
+			expected:     []string{"shop-mysql-exporter", "shop-redis-exporter"},
+		},
+		"containers without stack are stopped alone": {
+			stopOrder:    StopOrderExportersFirst,
+			stack:        "",
+			stackRunning: true,
+			expected:     []string{"shop-redis-exporter"},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			containers := []types.Container{
+				stackExporter("shop-redis-exporter", "shop-redis", "shop"),
+				stackExporter("shop-mysql-exporter", "shop-mysql", "shop"),
+				stackExporter("blog-mysql-exporter", "blog-mysql", "blog"),
+			}
+			if tc.stackRunning {
+				containers = append(containers, types.Container{
+					ID:     "shop-mysql",
+					Labels: map[string]string{labelComposeProject: "shop"},
+				})
+			}
+
+			cli := &fakeClient{
+				containerListFn: func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+					return filterContainers(containers, options.Filters), nil
+				},
+			}
+
+			b := NewDockerBackend(cli, WithStopOrder(tc.stopOrder))
+			exporters, err := b.exportersToStop(context.Background(), "shop-redis", tc.stack)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			got := []string{}
+			for _, exporter := range exporters {
+				got = append(got, exporter.ID)
+			}
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected exporters %v to be stopped, got %v", tc.expected, got)
+			}
+		})
+	}
+}
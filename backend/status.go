@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The exporter is being started, its status step tells which startup
+	// step is running
+	ExporterStatePending = "pending"
+	ExporterStateRunning = "running"
+	// The startup failed, its status error tells why
+	ExporterStateFailed = "failed"
+)
+
+// ExporterStatus reports where an exporter stands in its lifecycle. The last
+// error is kept across later startups, until the exporter is removed.
+type ExporterStatus struct {
+	State       string    `json:"state"`
+	Step        string    `json:"step,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// statusRegistry holds the status of the exporters started by the backend,
+// indexed by exporter names. It's shared between copies of the DockerBackend.
+type statusRegistry struct {
+	mutex    sync.RWMutex
+	statuses map[string]ExporterStatus
+}
+
+func newStatusRegistry() *statusRegistry {
+	return &statusRegistry{statuses: make(map[string]ExporterStatus, 0)}
+}
+
+func (r *statusRegistry) set(name, state, step string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	name = strings.TrimPrefix(name, "/")
+	status := r.statuses[name]
+	status.State = state
+	status.Step = step
+	status.UpdatedAt = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorAt = status.UpdatedAt
+	}
+
+	r.statuses[name] = status
+}
+
+func (r *statusRegistry) get(name string) (ExporterStatus, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	status, ok := r.statuses[strings.TrimPrefix(name, "/")]
+	return status, ok
+}
+
+func (r *statusRegistry) remove(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.statuses, strings.TrimPrefix(name, "/"))
+}
+
+// GetExporterStatus returns the status of the exporter with the given name,
+// and false when it hasn't been started by this instance
+func (b DockerBackend) GetExporterStatus(name string) (ExporterStatus, bool) {
+	return b.statuses.get(name)
+}
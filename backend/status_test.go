@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestExporterStatusTransitions(t *testing.T) {
+	testcases := map[string]struct {
+		startErr      error
+		expectedSteps []string
+		expectedFinal ExporterStatus
+	}{
+		"successful startup": {
+			expectedSteps: []string{stepPullImage, stepCreate, stepConnect, stepStart},
+			expectedFinal: ExporterStatus{State: ExporterStateRunning},
+		},
+		"failed startup": {
+			startErr:      errors.New("oci runtime error"),
+			expectedSteps: []string{stepPullImage, stepCreate, stepConnect, stepStart},
+			expectedFinal: ExporterStatus{State: ExporterStateFailed, Step: stepStart, LastError: "oci runtime error"},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exporter := redisExporter()
+			exporter.PromNetworks = []string{"prometheus"}
+
+			var b DockerBackend
+			steps := []string{}
+			observe := func() {
+				status, ok := b.GetExporterStatus(exporter.Name)
+				if !ok || status.State != ExporterStatePending {
+					t.Errorf("expected the exporter to be pending, got %+v", status)
+				}
+				steps = append(steps, status.Step)
+			}
+
+			cli := &fakeClient{
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if id == "redis-id" {
+						return exportedContainer(id, "/redis", nil), nil
+					}
+					return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+				},
+				containerListFn: noContainers,
+				imageInspectFn:  imageNotFound,
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					observe()
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+				containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+					observe()
+					return container.ContainerCreateCreatedBody{ID: "exporter-id"}, nil
+				},
+				networkInspectFn: emptyNetwork,
+				networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+					observe()
+					return nil
+				},
+				containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+					observe()
+					return tc.startErr
+				},
+				containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+					return nil
+				},
+			}
+
+			b = NewDockerBackend(cli)
+			if _, ok := b.GetExporterStatus(exporter.Name); ok {
+				t.Fatal("expected no status before the exporter is started")
+			}
+
+			b.RunExporter(context.Background(), exporter)
+
+			if !reflect.DeepEqual(steps, tc.expectedSteps) {
+				t.Errorf("expected steps %v, got %v", tc.expectedSteps, steps)
+			}
+
+			status, ok := b.GetExporterStatus(strings.TrimPrefix(exporter.Name, "/"))
+			if !ok {
+				t.Fatal("expected the exporter to have a status")
+			}
+			status.UpdatedAt = tc.expectedFinal.UpdatedAt
+			status.LastErrorAt = tc.expectedFinal.LastErrorAt
+			if status != tc.expectedFinal {
+				t.Errorf("expected status %+v, got %+v", tc.expectedFinal, status)
+			}
+		})
+	}
+}
+
+func TestStoppedExportersHaveNoStatus(t *testing.T) {
+	cli := &fakeClient{
+		containerStopFn: func(ctx context.Context, id string) error {
+			return nil
+		},
+		containerRemoveFn: func(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	b.statuses.set("/exporter.redis.redis", ExporterStateRunning, "", nil)
+
+	if err := b.StopExporter(context.Background(), exportedContainer("exporter-id", "/exporter.redis.redis", nil)); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if status, ok := b.GetExporterStatus("/exporter.redis.redis"); ok {
+		t.Errorf("expected the status to be removed, got %+v", status)
+	}
+}
+
+func TestLastErrorIsKeptAcrossStartups(t *testing.T) {
+	exporter := redisExporter()
+	exporter.PromNetworks = []string{"prometheus"}
+
+	createErr := errors.New("conflict: the container name is already in use")
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if id == "redis-id" {
+				return exportedContainer(id, "/redis", nil), nil
+			}
+			return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+		},
+		containerListFn: noContainers,
+		imageInspectFn:  imageNotFound,
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerCreateFn: func(config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+			return container.ContainerCreateCreatedBody{ID: "exporter-id"}, createErr
+		},
+		networkInspectFn: emptyNetwork,
+		networkConnectFn: func(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+			return nil
+		},
+		containerStartFn: func(ctx context.Context, id string, options types.ContainerStartOptions) error {
+			return nil
+		},
+	}
+
+	b := NewDockerBackend(cli)
+	b.RunExporter(context.Background(), exporter)
+
+	status, ok := b.GetExporterStatus(exporter.Name)
+	if !ok || status.State != ExporterStateFailed || status.Step != stepCreate {
+		t.Fatalf("expected the exporter to have failed to be created, got %+v", status)
+	}
+	if status.LastError != createErr.Error() || status.LastErrorAt.IsZero() {
+		t.Errorf("expected the create error to be retrievable, got %+v", status)
+	}
+
+	createErr = nil
+	b.RunExporter(context.Background(), exporter)
+
+	status, _ = b.GetExporterStatus(exporter.Name)
+	if status.State != ExporterStateRunning {
+		t.Errorf("expected the exporter to be running, got %+v", status)
+	}
+	if status.LastError != "conflict: the container name is already in use" {
+		t.Errorf("expected the last error to be kept, got %+v", status)
+	}
+
+	cli.containerListFn = func(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+		return []types.Container{{
+			ID:     "exporter-id",
+			Names:  []string{exporter.Name},
+			Labels: map[string]string{LABEL_EXPORTER_NAME: exporter.Name},
+			State:  "running",
+		}}, nil
+	}
+
+	exporters, err := b.ListExporters(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(exporters) != 1 || exporters[0].LastError != status.LastError {
+		t.Errorf("expected the listed exporter to carry its last error, got %+v", exporters)
+	}
+}
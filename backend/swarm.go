@@ -0,0 +1,413 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var _ Backend = SwarmBackend{}
+
+// localhost used as the host of an address, e.g. in redis://localhost:6379,
+// localhost:9000 or the mysql DSN user:password@(localhost:3306)/. The
+// character before and after it are captured, as they're kept.
+var localhostAddr = regexp.MustCompile(`(^|[=/@(])localhost([:/)]|$)`)
+
+const defaultSwarmPollInterval = 10 * time.Second
+
+// SwarmBackend runs exporters as Swarm services, each one constrained to the
+// node of its exported task. As services can't join the network namespace
+// of another container, exporters reach their exported task through the
+// Prometheus network.
+type SwarmBackend struct {
+	cli    client.APIClient
+	finder *finderHolder
+	dryRun bool
+	// Swarm doesn't emit task events, so tasks are polled
+	pollInterval time.Duration
+}
+
+func NewSwarmBackend(cli client.APIClient, finder models.ExporterFinder, dryRun bool) SwarmBackend {
+	return SwarmBackend{
+		cli:          cli,
+		finder:       &finderHolder{finder: finder},
+		dryRun:       dryRun,
+		pollInterval: defaultSwarmPollInterval,
+	}
+}
+
+// RunExporter creates the exporter service on the node of the exported task,
+// replacing the existing one when its spec changed. Services can't join the
+// network namespace of the exported task, so exporters reaching it on
+// localhost are pointed to its address on a Prometheus network instead, and
+// refused when it has none.
+func (b SwarmBackend) RunExporter(ctx context.Context, exporter models.Exporter) {
+	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+		"exported.id":    exporter.Exported.ID,
+		"exporter.name":  exporter.Name,
+		"exporter.image": exporter.Image,
+	})
+	ctx = log.WithLogger(ctx, logger)
+
+	// The hash is taken before the exporter is retargeted, such that it can
+	// be compared to the one of the exporters found for running tasks
+	specHash := exporter.SpecHash()
+
+	task, _, err := b.cli.TaskInspectWithRaw(ctx, exporter.Exported.ID)
+	if err != nil {
+		logger.Errorf("%+v", errors.WithStack(err))
+		return
+	}
+
+	if !exporter.HasOwnNetns() {
+		addr, ok := taskAddress(task, exporter.PromNetworks)
+		if !ok {
+			logger.Errorf("Exporter %q can't share the network namespace of its exported task on Swarm, and the task isn't attached to any Prometheus network.", exporter.Name)
+			return
+		}
+		exporter = withTargetAddress(exporter, addr)
+	}
+
+	spec := newExporterServiceSpec(exporter, task.NodeID)
+	spec.Labels[LABEL_EXPORTER_SPEC_HASH] = specHash
+
+	secrets, secretEnv, err := b.secretReferences(ctx, exporter)
+	if err != nil {
+		logger.Errorf("%+v", err)
+		return
+	}
+	spec.TaskTemplate.ContainerSpec.Secrets = secrets
+	spec.TaskTemplate.ContainerSpec.Env = append(append([]string{}, exporter.EnvVars...), secretEnv...)
+
+	upToDate, err := b.removeStaleService(ctx, spec.Name, specHash)
+	if err != nil {
+		logger.Errorf("%+v", err)
+		return
+	} else if upToDate {
+		logger.Debug("Exporter service already up to date.")
+		return
+	}
+
+	if b.dryRun {
+		logger.WithField("spec", fmt.Sprintf("%+v", spec)).Infof("[dry-run] Would create exporter service %q.", spec.Name)
+		return
+	}
+
+	if _, err := b.cli.ServiceCreate(ctx, spec, types.ServiceCreateOptions{}); err != nil {
+		logger.Errorf("%+v", errors.WithStack(err))
+		return
+	}
+
+	logger.Info("Exporter service created.")
+}
+
+// taskAddress returns the address of the given task on the first of the
+// given networks it's attached to
+func taskAddress(task swarm.Task, promNetworks []string) (string, bool) {
+	for _, promNetwork := range promNetworks {
+		for _, attachment := range task.NetworksAttachments {
+			if attachment.Network.ID != promNetwork && attachment.Network.Spec.Name != promNetwork {
+				continue
+			}
+
+			for _, addr := range attachment.Addresses {
+				ip, _, err := net.ParseCIDR(addr)
+				if err != nil {
+					continue
+				}
+				if ip.To4() == nil {
+					return "[" + ip.String() + "]", true
+				}
+				return ip.String(), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// withTargetAddress replaces localhost by the given address where it's the
+// host of an address in the command and env vars of the exporter. Other
+// occurrences (e.g. in passwords or in localhost.example) are left untouched.
+func withTargetAddress(exporter models.Exporter, addr string) models.Exporter {
+	retarget := func(values []string) []string {
+		res := make([]string, 0, len(values))
+		for _, value := range values {
+			res = append(res, localhostAddr.ReplaceAllString(value, "${1}"+addr+"${2}"))
+		}
+		return res
+	}
+
+	exporter.Cmd = retarget(exporter.Cmd)
+	exporter.EnvVars = retarget(exporter.EnvVars)
+
+	return exporter
+}
+
+func newExporterServiceSpec(exporter models.Exporter, nodeID string) swarm.ServiceSpec {
+	labels := map[string]string{
+		LABEL_EXPORTED_ID:        exporter.Exported.ID,
+		LABEL_EXPORTED_NAME:      exporter.Exported.Name,
+		LABEL_EXPORTER_TYPE:      exporter.PredefinedType,
+		LABEL_EXPORTER_SPEC_HASH: exporter.SpecHash(),
+	}
+
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name:   getSwarmExporterName(exporter.Name),
+			Labels: labels,
+		},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{
+				Image:   exporter.Image,
+				Command: exporter.Entrypoint,
+				Args:    exporter.Cmd,
+				Env:     exporter.EnvVars,
+				User:    exporter.User,
+				Labels:  labels,
+			},
+			Placement: &swarm.Placement{
+				Constraints: []string{"node.id==" + nodeID},
+			},
+		},
+	}
+
+	for _, promNetwork := range exporter.PromNetworks {
+		spec.TaskTemplate.Networks = append(spec.TaskTemplate.Networks, swarm.NetworkAttachmentConfig{
+			Target: promNetwork,
+		})
+	}
+
+	return spec
+}
+
+// CleanupExporter removes the given exporter service. Unless force is true,
+// it's kept while its exported task is still running.
+func (b SwarmBackend) CleanupExporter(ctx context.Context, serviceID string, force bool) error {
+	service, _, err := b.cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	exportedID := service.Spec.Labels[LABEL_EXPORTED_ID]
+	task, _, err := b.cli.TaskInspectWithRaw(ctx, exportedID)
+
+	if err != nil && !client.IsErrNotFound(err) {
+		return errors.WithStack(err)
+	} else if err == nil && task.Status.State == swarm.TaskStateRunning && !force {
+		return newErrExportedTaskStillRunning(serviceID, exportedID)
+	}
+
+	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+		"exported.id":   exportedID,
+		"exporter.name": service.Spec.Name,
+	})
+
+	if b.dryRun {
+		logger.Infof("[dry-run] Would remove exporter service %q.", service.ID)
+		return nil
+	}
+
+	if err := b.cli.ServiceRemove(ctx, service.ID); err != nil {
+		return errors.WithStack(err)
+	}
+
+	logger.Info("Exporter service removed.")
+
+	return nil
+}
+
+// CleanupExporters removes exporter services whose exported task is not
+// running anymore, or all of them when force is true. Failures are returned
+// together once every service has been processed.
+func (b SwarmBackend) CleanupExporters(ctx context.Context, force bool) error {
+	services, err := b.cli.ServiceList(ctx, types.ServiceListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("label", LABEL_EXPORTED_ID),
+		),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var failures []error
+	for _, service := range services {
+		err := b.CleanupExporter(ctx, service.ID, force)
+		if err != nil && !IsErrExportedStillRunning(err) {
+			failures = append(failures, errors.Wrapf(err, "cleaning up exporter service %q", service.Spec.Name))
+		}
+	}
+
+	if len(failures) > 0 {
+		return errCleanupFailed{failures}
+	}
+
+	return nil
+}
+
+// FindMissingExporters returns the exporters of running tasks that don't
+// have an exporter service yet
+func (b SwarmBackend) FindMissingExporters(ctx context.Context, promNetworks []string) ([]models.Exporter, error) {
+	tasks, err := b.cli.TaskList(ctx, types.TaskListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("desired-state", "running"),
+		),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	services := map[string]swarm.Service{}
+	missing := make([]models.Exporter, 0)
+	logger := log.GetLogger(ctx)
+
+	for _, task := range tasks {
+		if task.Spec.ContainerSpec == nil {
+			continue
+		}
+
+		// Cache services, as multiple tasks might come from the same one
+		if _, ok := services[task.ServiceID]; !ok {
+			service, _, err := b.cli.ServiceInspectWithRaw(ctx, task.ServiceID, types.ServiceInspectOptions{})
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			services[task.ServiceID] = service
+		}
+
+		service := services[task.ServiceID]
+
+		// Ignore exporters
+		if _, ok := service.Spec.Labels[LABEL_EXPORTED_NAME]; ok {
+			continue
+		}
+
+		taskName := fmt.Sprintf("%s.%d", service.Spec.Name, task.Slot)
+		exported := models.NewTaskToExport(task.ID, taskName, task.Spec.ContainerSpec.Image, task.Spec.ContainerSpec.Labels)
+		exported.State = string(task.Status.State)
+
+		exporters, err := lookupExporters(ctx, b.finder.get(), exported)
+		if err != nil {
+			logger.Errorf("%+v", err)
+			continue
+		}
+
+		for exporterType, exporter := range exporters {
+			// Central exporters are only registered in service discovery
+			if exporter.IsCentral() {
+				continue
+			}
+
+			exporter.Name = exporterName(ctx, exporterType, exported)
+			exporter.PromNetworks = promNetworks
+
+			upToDate, err := b.serviceUpToDate(ctx, getSwarmExporterName(exporter.Name), exporter.SpecHash())
+			if err != nil {
+				return nil, err
+			} else if upToDate {
+				continue
+			}
+
+			missing = append(missing, exporter)
+		}
+	}
+
+	return missing, nil
+}
+
+// serviceUpToDate checks if a service with the given name exists and runs
+// the exporter having the given spec hash. As service names embed the ID of
+// the exported task, it's the only thing that can change.
+func (b SwarmBackend) serviceUpToDate(ctx context.Context, name, specHash string) (bool, error) {
+	service, _, err := b.cli.ServiceInspectWithRaw(ctx, name, types.ServiceInspectOptions{})
+	if client.IsErrNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return service.Spec.Labels[LABEL_EXPORTER_SPEC_HASH] == specHash, nil
+}
+
+// removeStaleService removes the exporter service having the given name when
+// it runs another spec, as the new service couldn't be created otherwise. It
+// returns whether the existing service is up to date instead.
+func (b SwarmBackend) removeStaleService(ctx context.Context, name, specHash string) (bool, error) {
+	service, _, err := b.cli.ServiceInspectWithRaw(ctx, name, types.ServiceInspectOptions{})
+	if client.IsErrNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	if _, ok := service.Spec.Labels[LABEL_EXPORTED_ID]; !ok {
+		return false, errors.Errorf("service %q is not managed by prom-autoexporter, it won't be removed", name)
+	}
+
+	staleHash := service.Spec.Labels[LABEL_EXPORTER_SPEC_HASH]
+	if staleHash == specHash {
+		return true, nil
+	}
+
+	logger := log.GetLogger(ctx).WithField("stale.spec.hash", staleHash)
+
+	if b.dryRun {
+		logger.Infof("[dry-run] Would remove stale exporter service %q.", service.ID)
+		return false, nil
+	}
+
+	if err := b.cli.ServiceRemove(ctx, service.ID); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	logger.Info("Stale exporter service removed.")
+
+	return false, nil
+}
+
+// ListenForTasksToExport polls running tasks, to create missing exporter
+// services and remove the ones of vanished tasks, until ctx is cancelled
+func (b SwarmBackend) ListenForTasksToExport(ctx context.Context, promNetworks []string) {
+	logger := log.GetLogger(ctx)
+	t := time.NewTicker(b.pollInterval)
+	defer t.Stop()
+
+	for {
+		if err := b.CleanupExporters(ctx, false); err != nil {
+			logger.Errorf("%+v", err)
+		}
+
+		missing, err := b.FindMissingExporters(ctx, promNetworks)
+		if err != nil {
+			logger.Errorf("%+v", err)
+		}
+
+		for _, exporter := range missing {
+			b.RunExporter(ctx, exporter)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// getSwarmExporterName turns an exporter name into a valid service name
+func getSwarmExporterName(exporterName string) string {
+	return strings.TrimLeft(exporterName, "/")
+}
@@ -0,0 +1,420 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/errdefs"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// swarmWorld is a fake swarm cluster made of tasks and services
+type swarmWorld struct {
+	tasks    []swarm.Task
+	services map[string]swarm.Service
+	created  []swarm.ServiceSpec
+	removed  []string
+}
+
+func newSwarmClient(w *swarmWorld) *fakeClient {
+	return &fakeClient{
+		taskListFn: func(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+			return w.tasks, nil
+		},
+		taskInspectWithRawFn: func(ctx context.Context, taskID string) (swarm.Task, []byte, error) {
+			for _, task := range w.tasks {
+				if task.ID == taskID {
+					return task, nil, nil
+				}
+			}
+			return swarm.Task{}, nil, errdefs.NotFound(errors.New("no such task"))
+		},
+		serviceInspectWithRawFn: func(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+			for _, service := range w.services {
+				if service.ID == serviceID || service.Spec.Name == serviceID {
+					return service, nil, nil
+				}
+			}
+			return swarm.Service{}, nil, errdefs.NotFound(errors.New("no such service"))
+		},
+		serviceListFn: func(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+			services := []swarm.Service{}
+			for _, service := range w.services {
+				if options.Filters.MatchKVList("label", service.Spec.Labels) {
+					services = append(services, service)
+				}
+			}
+			sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+			return services, nil
+		},
+		serviceCreateFn: func(ctx context.Context, spec swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+			w.created = append(w.created, spec)
+			return types.ServiceCreateResponse{ID: spec.Name + "-id"}, nil
+		},
+		serviceRemoveFn: func(ctx context.Context, serviceID string) error {
+			w.removed = append(w.removed, serviceID)
+			return nil
+		},
+	}
+}
+
+func swarmTask(id, serviceID, nodeID string, slot int, state swarm.TaskState) swarm.Task {
+	return swarm.Task{
+		ID:        id,
+		ServiceID: serviceID,
+		NodeID:    nodeID,
+		Slot:      slot,
+		Spec:      swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "redis:5"}},
+		Status:    swarm.TaskStatus{State: state},
+	}
+}
+
+// attachedTask attaches the given task to the prometheus network
+func attachedTask(task swarm.Task, addr string) swarm.Task {
+	task.NetworksAttachments = []swarm.NetworkAttachment{{
+		Network: swarm.Network{
+			ID:   "prometheus-id",
+			Spec: swarm.NetworkSpec{Annotations: swarm.Annotations{Name: "prometheus"}},
+		},
+		Addresses: []string{addr},
+	}}
+	return task
+}
+
+func exporterService(id, name, exportedID string) swarm.Service {
+	return swarm.Service{
+		ID: id,
+		Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{
+			Name: name,
+			Labels: map[string]string{
+				LABEL_EXPORTED_ID:        exportedID,
+				LABEL_EXPORTED_NAME:      "redis",
+				LABEL_EXPORTER_SPEC_HASH: stubExporter("redis", "redis_exporter").SpecHash(),
+			},
+		}},
+	}
+}
+
+func TestSwarmFindMissingExporters(t *testing.T) {
+	w := &swarmWorld{
+		tasks: []swarm.Task{
+			swarmTask("task-1", "redis-service-id", "node-1", 1, swarm.TaskStateRunning),
+			swarmTask("task-2", "redis-service-id", "node-2", 2, swarm.TaskStateRunning),
+			swarmTask("exporter-task", "exporter-service-id", "node-1", 1, swarm.TaskStateRunning),
+		},
+		services: map[string]swarm.Service{
+			"redis":    {ID: "redis-service-id", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "redis"}}},
+			"exporter": exporterService("exporter-service-id", getSwarmExporterName(getExporterName("redis", "redis.1", "task-1")), "task-1"),
+		},
+	}
+
+	b := NewSwarmBackend(newSwarmClient(w), stubFinder{
+		"redis.1": {stubExporter("redis", "redis_exporter")},
+		"redis.2": {stubExporter("redis", "redis_exporter")},
+	}, false)
+
+	missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if len(missing) != 1 {
+		t.Fatalf("expected only the exporter of task-2 to be missing, got %+v", missing)
+	}
+	if missing[0].Name != getExporterName("redis", "redis.2", "task-2") || missing[0].Exported.ID != "task-2" || !reflect.DeepEqual(missing[0].PromNetworks, []string{"prometheus"}) {
+		t.Errorf("unexpected missing exporter %+v", missing[0])
+	}
+}
+
+func TestSwarmFindMissingExportersReportsStaleServices(t *testing.T) {
+	w := &swarmWorld{
+		tasks: []swarm.Task{swarmTask("task-1", "redis-service-id", "node-1", 1, swarm.TaskStateRunning)},
+		services: map[string]swarm.Service{
+			"redis":    {ID: "redis-service-id", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "redis"}}},
+			"exporter": exporterService("exporter-service-id", getSwarmExporterName(getExporterName("redis", "redis.1", "task-1")), "task-1"),
+		},
+	}
+
+	b := NewSwarmBackend(newSwarmClient(w), stubFinder{
+		"redis.1": {stubExporter("redis", "redis_exporter:v2")},
+	}, false)
+
+	missing, err := b.FindMissingExporters(context.Background(), []string{"prometheus"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(missing) != 1 || missing[0].Image != "redis_exporter:v2" {
+		t.Errorf("expected the exporter with a new spec to be missing, got %+v", missing)
+	}
+}
+
+func TestSwarmRunExporterCreatesServiceOnTaskNode(t *testing.T) {
+	w := &swarmWorld{
+		tasks: []swarm.Task{attachedTask(swarmTask("task-2", "redis-service-id", "node-2", 2, swarm.TaskStateRunning), "10.0.1.5/24")},
+	}
+
+	exporter := models.NewExporter("/exporter.redis.redis.2", "redis", "redis_exporter", []string{"--redis.addr=redis://localhost:6379"}, nil, models.NewTaskToExport("task-2", "redis.2", "redis:5", nil))
+	exporter.PromNetworks = []string{"prometheus"}
+	exporter.Entrypoint = []string{"/wrapper.sh"}
+
+	b := NewSwarmBackend(newSwarmClient(w), stubFinder{}, false)
+	b.RunExporter(context.Background(), exporter)
+
+	if len(w.created) != 1 {
+		t.Fatalf("expected 1 service to be created, got %d", len(w.created))
+	}
+
+	spec := w.created[0]
+	if spec.Name != "exporter.redis.redis.2" {
+		t.Errorf("unexpected service name %q", spec.Name)
+	}
+	if expected := []string{"node.id==node-2"}; !reflect.DeepEqual(spec.TaskTemplate.Placement.Constraints, expected) {
+		t.Errorf("expected constraints %v, got %v", expected, spec.TaskTemplate.Placement.Constraints)
+	}
+	if len(spec.TaskTemplate.Networks) != 1 || spec.TaskTemplate.Networks[0].Target != "prometheus" {
+		t.Errorf("expected the service to join the prometheus network, got %+v", spec.TaskTemplate.Networks)
+	}
+	if spec.Labels[LABEL_EXPORTED_ID] != "task-2" || spec.TaskTemplate.ContainerSpec.Image != "redis_exporter" {
+		t.Errorf("unexpected service spec %+v", spec)
+	}
+	// The exported task is reached through the prometheus network
+	expectedArgs := []string{"--redis.addr=redis://10.0.1.5:6379"}
+	if containerSpec := spec.TaskTemplate.ContainerSpec; !reflect.DeepEqual(containerSpec.Command, exporter.Entrypoint) || !reflect.DeepEqual(containerSpec.Args, expectedArgs) {
+		t.Errorf("expected command %v and args %v, got %v and %v", exporter.Entrypoint, expectedArgs, containerSpec.Command, containerSpec.Args)
+	}
+}
+
+func TestSwarmRunExporterTargetsTaskAddress(t *testing.T) {
+	testcases := map[string]struct {
+		task          swarm.Task
+		networkMode   string
+		expectedArgs  []string
+		expectedEnv   []string
+		expectRefused bool
+	}{
+		"ipv4 address": {
+			task:         attachedTask(swarmTask("task-1", "redis-service-id", "node-1", 1, swarm.TaskStateRunning), "10.0.1.5/24"),
+			expectedArgs: []string{"--redis.addr=redis://10.0.1.5:6379"},
+			expectedEnv:  []string{"REDIS_ADDR=10.0.1.5:6379"},
+		},
+		"ipv6 address": {
+			task:         attachedTask(swarmTask("task-1", "redis-service-id", "node-1", 1, swarm.TaskStateRunning), "fd00::5/64"),
+			expectedArgs: []string{"--redis.addr=redis://[fd00::5]:6379"},
+			expectedEnv:  []string{"REDIS_ADDR=[fd00::5]:6379"},
+		},
+		"task not attached to a prometheus network": {
+			task:          swarmTask("task-1", "redis-service-id", "node-1", 1, swarm.TaskStateRunning),
+			expectRefused: true,
+		},
+		"exporter running in its own network namespace": {
+			task:         swarmTask("task-1", "redis-service-id", "node-1", 1, swarm.TaskStateRunning),
+			networkMode:  models.NetworkModeNetwork,
+			expectedArgs: []string{"--redis.addr=redis://localhost:6379"},
+			expectedEnv:  []string{"REDIS_ADDR=localhost:6379"},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			w := &swarmWorld{tasks: []swarm.Task{tc.task}}
+
+			exporter := models.NewExporter("/exporter.redis.redis.1", "redis", "redis_exporter", []string{"--redis.addr=redis://localhost:6379"}, []string{"REDIS_ADDR=localhost:6379"}, models.NewTaskToExport("task-1", "redis.1", "redis:5", nil))
+			exporter.PromNetworks = []string{"prometheus"}
+			exporter.NetworkMode = tc.networkMode
+
+			b := NewSwarmBackend(newSwarmClient(w), stubFinder{}, false)
+			b.RunExporter(context.Background(), exporter)
+
+			if tc.expectRefused {
+				if len(w.created) != 0 {
+					t.Errorf("expected no service to be created, got %+v", w.created)
+				}
+				return
+			}
+			if len(w.created) != 1 {
+				t.Fatalf("expected 1 service to be created, got %d", len(w.created))
+			}
+
+			containerSpec := w.created[0].TaskTemplate.ContainerSpec
+			if !reflect.DeepEqual(containerSpec.Args, tc.expectedArgs) {
+				t.Errorf("expected args %v, got %v", tc.expectedArgs, containerSpec.Args)
+			}
+			if !reflect.DeepEqual(containerSpec.Env, tc.expectedEnv) {
+				t.Errorf("expected env vars %v, got %v", tc.expectedEnv, containerSpec.Env)
+			}
+		})
+	}
+}
+
+func TestWithTargetAddress(t *testing.T) {
+	testcases := map[string]struct {
+		value    string
+		expected string
+	}{
+		"url":             {value: "--scrape-uri=http://localhost:24220/api", expected: "--scrape-uri=http://10.0.1.5:24220/api"},
+		"host and port":   {value: "REDIS_ADDR=localhost:6379", expected: "REDIS_ADDR=10.0.1.5:6379"},
+		"host only":       {value: "--host=localhost", expected: "--host=10.0.1.5"},
+		"mysql dsn":       {value: "DATA_SOURCE_NAME=exporter:pw@(localhost:3306)/", expected: "DATA_SOURCE_NAME=exporter:pw@(10.0.1.5:3306)/"},
+		"postgres dsn":    {value: "DATA_SOURCE_NAME=postgresql://postgres:pw@localhost:5432/postgres", expected: "DATA_SOURCE_NAME=postgresql://postgres:pw@10.0.1.5:5432/postgres"},
+		"password":        {value: "DATA_SOURCE_NAME=exporter:mylocalhostpw@(localhost:3306)/", expected: "DATA_SOURCE_NAME=exporter:mylocalhostpw@(10.0.1.5:3306)/"},
+		"other host":      {value: "--redis.addr=redis://localhost.example:6379", expected: "--redis.addr=redis://localhost.example:6379"},
+		"other subdomain": {value: "--host=db.localhost", expected: "--host=db.localhost"},
+		"not an address":  {value: "--log.format=localhost-logs", expected: "--log.format=localhost-logs"},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exporter := models.NewExporter("/exporter.redis.redis.1", "redis", "redis_exporter", []string{tc.value}, []string{tc.value}, models.TaskToExport{})
+			exporter = withTargetAddress(exporter, "10.0.1.5")
+
+			if exporter.Cmd[0] != tc.expected || exporter.EnvVars[0] != tc.expected {
+				t.Errorf("expected %q, got cmd %q and env %q", tc.expected, exporter.Cmd[0], exporter.EnvVars[0])
+			}
+		})
+	}
+}
+
+func TestSwarmRunExporterReplacesStaleService(t *testing.T) {
+	testcases := map[string]struct {
+		image          string
+		expectReplaced bool
+	}{
+		"spec changed": {
+			image:          "redis_exporter:v2",
+			expectReplaced: true,
+		},
+		"up to date": {
+			image:          "redis_exporter",
+			expectReplaced: false,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			name := getSwarmExporterName(getExporterName("redis", "redis.1", "task-1"))
+			w := &swarmWorld{
+				tasks: []swarm.Task{attachedTask(swarmTask("task-1", "redis-service-id", "node-1", 1, swarm.TaskStateRunning), "10.0.1.5/24")},
+				services: map[string]swarm.Service{
+					"existing": exporterService("existing-exporter-id", name, "task-1"),
+				},
+			}
+
+			exporter := stubExporter("redis", tc.image)
+			exporter.Name = name
+			exporter.Exported = models.NewTaskToExport("task-1", "redis.1", "redis:5", nil)
+			exporter.PromNetworks = []string{"prometheus"}
+
+			b := NewSwarmBackend(newSwarmClient(w), stubFinder{}, false)
+			b.RunExporter(context.Background(), exporter)
+
+			if !tc.expectReplaced {
+				if len(w.removed) != 0 || len(w.created) != 0 {
+					t.Errorf("expected the service to be kept, got %v removed and %d created", w.removed, len(w.created))
+				}
+				return
+			}
+			if !reflect.DeepEqual(w.removed, []string{"existing-exporter-id"}) {
+				t.Errorf("expected the stale service to be removed, got %v", w.removed)
+			}
+			if len(w.created) != 1 || w.created[0].Labels[LABEL_EXPORTER_SPEC_HASH] != exporter.SpecHash() {
+				t.Errorf("expected the service to be recreated with the new spec, got %+v", w.created)
+			}
+		})
+	}
+}
+
+func TestSwarmRunExporterKeepsUnmanagedServices(t *testing.T) {
+	w := &swarmWorld{
+		tasks: []swarm.Task{attachedTask(swarmTask("task-1", "redis-service-id", "node-1", 1, swarm.TaskStateRunning), "10.0.1.5/24")},
+		services: map[string]swarm.Service{
+			"redis": {ID: "redis-service-id", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "exporter.redis.redis"}}},
+		},
+	}
+
+	exporter := stubExporter("redis", "redis_exporter")
+	exporter.Name = "exporter.redis.redis"
+	exporter.Exported = models.NewTaskToExport("task-1", "redis.1", "redis:5", nil)
+	exporter.PromNetworks = []string{"prometheus"}
+
+	b := NewSwarmBackend(newSwarmClient(w), stubFinder{}, false)
+	b.RunExporter(context.Background(), exporter)
+
+	if len(w.removed) != 0 || len(w.created) != 0 {
+		t.Errorf("expected the unmanaged service to be kept, got %v removed and %d created", w.removed, len(w.created))
+	}
+}
+
+func TestSwarmCleanupExporters(t *testing.T) {
+	testcases := map[string]struct {
+		force    bool
+		expected []string
+	}{
+		"exporters of vanished tasks are removed": {
+			force:    false,
+			expected: []string{"gone-exporter-id", "stopped-exporter-id"},
+		},
+		"all exporters are removed when forced": {
+			force:    true,
+			expected: []string{"gone-exporter-id", "running-exporter-id", "stopped-exporter-id"},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			w := &swarmWorld{
+				tasks: []swarm.Task{
+					swarmTask("running-task", "redis-service-id", "node-1", 1, swarm.TaskStateRunning),
+					swarmTask("stopped-task", "redis-service-id", "node-1", 2, swarm.TaskStateShutdown),
+				},
+				services: map[string]swarm.Service{
+					"running": exporterService("running-exporter-id", "exporter.redis.redis.1", "running-task"),
+					"stopped": exporterService("stopped-exporter-id", "exporter.redis.redis.2", "stopped-task"),
+					"gone":    exporterService("gone-exporter-id", "exporter.redis.redis.3", "gone-task"),
+				},
+			}
+
+			var b Backend = NewSwarmBackend(newSwarmClient(w), stubFinder{}, false)
+			if err := b.CleanupExporters(context.Background(), tc.force); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			sort.Strings(w.removed)
+			if !reflect.DeepEqual(w.removed, tc.expected) {
+				t.Errorf("expected services %v to be removed, got %v", tc.expected, w.removed)
+			}
+		})
+	}
+}
+
+func TestSwarmCleanupExportersReturnsEveryFailure(t *testing.T) {
+	w := &swarmWorld{
+		services: map[string]swarm.Service{
+			"first":  exporterService("first-exporter-id", "exporter.redis.redis.1", "first-task"),
+			"second": exporterService("second-exporter-id", "exporter.redis.redis.2", "second-task"),
+		},
+	}
+	cli := newSwarmClient(w)
+	cli.serviceRemoveFn = func(ctx context.Context, serviceID string) error {
+		return errors.New("daemon unavailable")
+	}
+
+	b := NewSwarmBackend(cli, stubFinder{}, false)
+	err := b.CleanupExporters(context.Background(), true)
+	failed, ok := pkgerrors.Cause(err).(errCleanupFailed)
+	if !ok {
+		t.Fatalf("expected a cleanup error, got %+v", err)
+	}
+	if len(failed.failures) != 2 {
+		t.Errorf("expected 2 failures, got %v", failed.failures)
+	}
+}
@@ -0,0 +1,250 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// timeoutClient bounds the duration of the Docker API calls made by the
+// backends, such that a hung daemon can't block them indefinitely. Image
+// pulls have their own timeout as they're way longer than other calls, and
+// streamed events are not bounded. A zero timeout leaves the related calls
+// unbounded.
+type timeoutClient struct {
+	client.APIClient
+	timeout     time.Duration
+	pullTimeout time.Duration
+}
+
+// NewTimeoutClient wraps the given client such that its calls are bounded by
+// timeout, and image pulls by pullTimeout.
+func NewTimeoutClient(cli client.APIClient, timeout, pullTimeout time.Duration) client.APIClient {
+	return newTimeoutClient(cli, timeout, pullTimeout)
+}
+
+func newTimeoutClient(cli client.APIClient, timeout, pullTimeout time.Duration) timeoutClient {
+	// Timeouts of already wrapped clients are superseded
+	if wrapped, ok := cli.(timeoutClient); ok {
+		cli = wrapped.APIClient
+	}
+
+	return timeoutClient{
+		APIClient:   cli,
+		timeout:     timeout,
+		pullTimeout: pullTimeout,
+	}
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (c timeoutClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ContainerInspect(ctx, containerID)
+}
+
+func (c timeoutClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ContainerList(ctx, options)
+}
+
+func (c timeoutClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ContainerCreate(ctx, config, hostConfig, networkingConfig, containerName)
+}
+
+func (c timeoutClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ContainerStart(ctx, containerID, options)
+}
+
+func (c timeoutClient) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ContainerStop(ctx, containerID, timeout)
+}
+
+func (c timeoutClient) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ContainerRemove(ctx, containerID, options)
+}
+
+func (c timeoutClient) ContainerPause(ctx context.Context, containerID string) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ContainerPause(ctx, containerID)
+}
+
+func (c timeoutClient) ContainerUnpause(ctx context.Context, containerID string) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ContainerUnpause(ctx, containerID)
+}
+
+func (c timeoutClient) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.NetworkConnect(ctx, networkID, containerID, config)
+}
+
+func (c timeoutClient) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.NetworkDisconnect(ctx, networkID, containerID, force)
+}
+
+func (c timeoutClient) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.NetworkInspect(ctx, networkID, options)
+}
+
+func (c timeoutClient) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ImageInspectWithRaw(ctx, imageID)
+}
+
+// ImagePull bounds the whole pull, including the read of the progress stream.
+// The timeout is released when the stream is closed.
+func (c timeoutClient) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	ctx, cancel := withTimeout(ctx, c.pullTimeout)
+
+	rc, err := c.APIClient.ImagePull(ctx, ref, options)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return cancelOnClose{rc, cancel}, nil
+}
+
+func (c timeoutClient) ServerVersion(ctx context.Context) (types.Version, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ServerVersion(ctx)
+}
+
+func (c timeoutClient) Ping(ctx context.Context) (types.Ping, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.Ping(ctx)
+}
+
+func (c timeoutClient) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.CopyToContainer(ctx, containerID, dstPath, content, options)
+}
+
+func (c timeoutClient) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.NetworkCreate(ctx, name, options)
+}
+
+func (c timeoutClient) DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registry.DistributionInspect, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.DistributionInspect(ctx, image, encodedRegistryAuth)
+}
+
+func (c timeoutClient) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.TaskList(ctx, options)
+}
+
+func (c timeoutClient) ServiceInspectWithRaw(ctx context.Context, serviceID string, options types.ServiceInspectOptions) (swarm.Service, []byte, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ServiceInspectWithRaw(ctx, serviceID, options)
+}
+
+func (c timeoutClient) TaskInspectWithRaw(ctx context.Context, taskID string) (swarm.Task, []byte, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.TaskInspectWithRaw(ctx, taskID)
+}
+
+func (c timeoutClient) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ServiceCreate(ctx, service, options)
+}
+
+func (c timeoutClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ServiceList(ctx, options)
+}
+
+func (c timeoutClient) ServiceRemove(ctx context.Context, serviceID string) error {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.ServiceRemove(ctx, serviceID)
+}
+
+func (c timeoutClient) SecretList(ctx context.Context, options types.SecretListOptions) ([]swarm.Secret, error) {
+	ctx, cancel := withTimeout(ctx, c.timeout)
+	defer cancel()
+
+	return c.APIClient.SecretList(ctx, options)
+}
+
+// Events isn't bounded, as the stream is expected to last as long as ctx.
+func (c timeoutClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return c.APIClient.Events(ctx, options)
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r cancelOnClose) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
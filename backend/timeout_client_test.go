@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// blockUntilCancelled fakes a hung daemon
+func blockUntilCancelled(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDockerCallsTimeOut(t *testing.T) {
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			return types.ContainerJSON{}, blockUntilCancelled(ctx)
+		},
+		imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return nil, blockUntilCancelled(ctx)
+		},
+	}
+
+	b := NewDockerBackend(cli, WithTimeouts(10*time.Millisecond, 20*time.Millisecond))
+
+	done := make(chan error)
+	go func() {
+		_, err := b.cli.ContainerInspect(context.Background(), "redis-id")
+		done <- err
+	}()
+	assertDeadlineExceeded(t, done)
+
+	go func() {
+		done <- b.pullImage(context.Background(), redisExporter())
+	}()
+	assertDeadlineExceeded(t, done)
+}
+
+func TestDockerCallsAreNotBoundedWithoutTimeout(t *testing.T) {
+	cli := &fakeClient{
+		containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			if _, ok := ctx.Deadline(); ok {
+				t.Error("expected no deadline on the call")
+			}
+			return exportedContainer(id, "/redis", nil), nil
+		},
+	}
+
+	b := NewDockerBackend(cli, WithTimeouts(0, 0))
+	if _, err := b.cli.ContainerInspect(context.Background(), "redis-id"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+}
+
+func assertDeadlineExceeded(t *testing.T, done <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		if errors.Cause(err) != context.DeadlineExceeded {
+			t.Errorf("expected a deadline exceeded error, got %+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the call hung despite the timeout")
+	}
+}
+
+func TestTimeoutsAreAppliedIndependently(t *testing.T) {
+	testcases := map[string]struct {
+		apiTimeout         time.Duration
+		pullTimeout        time.Duration
+		expectAPIDeadline  bool
+		expectPullDeadline bool
+	}{
+		"api calls only": {
+			apiTimeout:        time.Minute,
+			expectAPIDeadline: true,
+		},
+		"image pulls only": {
+			pullTimeout:        time.Minute,
+			expectPullDeadline: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			cli := &fakeClient{
+				containerInspectFn: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+					if _, ok := ctx.Deadline(); ok != tc.expectAPIDeadline {
+						t.Errorf("expected API call deadline to be %t, got %t", tc.expectAPIDeadline, ok)
+					}
+					return exportedContainer(id, "/redis", nil), nil
+				},
+				imagePullFn: func(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+					if _, ok := ctx.Deadline(); ok != tc.expectPullDeadline {
+						t.Errorf("expected image pull deadline to be %t, got %t", tc.expectPullDeadline, ok)
+					}
+					return ioutil.NopCloser(strings.NewReader("")), nil
+				},
+			}
+
+			b := NewDockerBackend(cli, WithTimeouts(tc.apiTimeout, tc.pullTimeout))
+			if _, err := b.cli.ContainerInspect(context.Background(), "redis-id"); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			rc, err := b.cli.ImagePull(context.Background(), "oliver006/redis_exporter", types.ImagePullOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			rc.Close()
+		})
+	}
+}
+
+func TestEveryDockerCallIsBounded(t *testing.T) {
+	cli := &deadlineClient{}
+	tc := NewTimeoutClient(cli, time.Minute, time.Minute)
+	ctx := context.Background()
+
+	calls := map[string]func(){
+		"ServerVersion":       func() { tc.ServerVersion(ctx) },
+		"Ping":                func() { tc.Ping(ctx) },
+		"CopyToContainer":     func() { tc.CopyToContainer(ctx, "exporter-id", "/", nil, types.CopyToContainerOptions{}) },
+		"NetworkCreate":       func() { tc.NetworkCreate(ctx, "prometheus", types.NetworkCreate{}) },
+		"DistributionInspect": func() { tc.DistributionInspect(ctx, "oliver006/redis_exporter", "") },
+		"TaskInspectWithRaw":  func() { tc.TaskInspectWithRaw(ctx, "task-id") },
+		"ServiceCreate":       func() { tc.ServiceCreate(ctx, swarm.ServiceSpec{}, types.ServiceCreateOptions{}) },
+		"ServiceList":         func() { tc.ServiceList(ctx, types.ServiceListOptions{}) },
+		"ServiceRemove":       func() { tc.ServiceRemove(ctx, "service-id") },
+		"SecretList":          func() { tc.SecretList(ctx, types.SecretListOptions{}) },
+	}
+
+	for name, call := range calls {
+		cli.bounded = false
+		call()
+		if !cli.bounded {
+			t.Errorf("expected %s to be bounded", name)
+		}
+	}
+}
+
+// deadlineClient records whether the last call had a deadline
+type deadlineClient struct {
+	client.APIClient
+	bounded bool
+}
+
+func (c *deadlineClient) record(ctx context.Context) {
+	_, c.bounded = ctx.Deadline()
+}
+
+func (c *deadlineClient) ServerVersion(ctx context.Context) (types.Version, error) {
+	c.record(ctx)
+	return types.Version{}, nil
+}
+
+func (c *deadlineClient) Ping(ctx context.Context) (types.Ping, error) {
+	c.record(ctx)
+	return types.Ping{}, nil
+}
+
+func (c *deadlineClient) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+	c.record(ctx)
+	return nil
+}
+
+func (c *deadlineClient) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	c.record(ctx)
+	return types.NetworkCreateResponse{}, nil
+}
+
+func (c *deadlineClient) DistributionInspect(ctx context.Context, image, encodedRegistryAuth string) (registry.DistributionInspect, error) {
+	c.record(ctx)
+	return registry.DistributionInspect{}, nil
+}
+
+func (c *deadlineClient) TaskInspectWithRaw(ctx context.Context, taskID string) (swarm.Task, []byte, error) {
+	c.record(ctx)
+	return swarm.Task{}, nil, nil
+}
+
+func (c *deadlineClient) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	c.record(ctx)
+	return types.ServiceCreateResponse{}, nil
+}
+
+func (c *deadlineClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	c.record(ctx)
+	return nil, nil
+}
+
+func (c *deadlineClient) ServiceRemove(ctx context.Context, serviceID string) error {
+	c.record(ctx)
+	return nil
+}
+
+func (c *deadlineClient) SecretList(ctx context.Context, options types.SecretListOptions) ([]swarm.Secret, error) {
+	c.record(ctx)
+	return nil, nil
+}
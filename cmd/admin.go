@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/backend"
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// exporterStatus is the JSON representation of an exporter returned by the
+// admin API
+type exporterStatus struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	ExportedID   string `json:"exported_id"`
+	ExportedName string `json:"exported_name"`
+	Status       string `json:"status"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+// adminBackend holds the backend methods used by the admin API
+type adminBackend interface {
+	ListExporters(ctx context.Context) ([]models.Exporter, error)
+	GetExporterStatus(name string) (backend.ExporterStatus, bool)
+	CleanupExporter(ctx context.Context, cid string, force bool) error
+	StartMissingExporters(ctx context.Context, promNetworks []string) error
+}
+
+// Time given to in-flight admin requests to complete on shutdown
+const adminShutdownTimeout = 5 * time.Second
+
+// checkAdminAddr checks that the admin API is either protected by a token or
+// only reachable from the host, as it can remove any exporter
+func checkAdminAddr(addr, token string) error {
+	if token != "" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid admin address %q", addr)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.Errorf("Admin API exposed on %q requires a token. Set --admin-token or listen on a loopback address (e.g. 127.0.0.1:9097).", addr)
+	}
+
+	return nil
+}
+
+// serveAdmin exposes the admin API used to introspect and manage exporters
+// until ctx is cancelled. GET /exporters lists exporters,
+// GET /exporters/{name}/status returns the startup status of an exporter,
+// POST /exporters/{name}/cleanup forcefully cleans up an exporter and
+// POST /reconcile starts missing exporters. Requests have to carry the given
+// token as a bearer token, unless it's empty.
+func serveAdmin(ctx context.Context, addr, token string, b adminBackend, promNetworks []string) {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: adminHandler(ctx, b, promNetworks, token),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logrus.Errorf("%+v", errors.WithStack(err))
+		}
+	}()
+
+	logrus.Infof("Exposing admin API on %s...", addr)
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logrus.Errorf("%+v", errors.WithStack(err))
+	}
+}
+
+func adminHandler(ctx context.Context, b adminBackend, promNetworks []string, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/exporters", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		exporters, err := b.ListExporters(ctx)
+		if err != nil {
+			logrus.Errorf("%+v", err)
+			http.Error(w, "failed to list exporters", http.StatusInternalServerError)
+			return
+		}
+
+		statuses := make([]exporterStatus, 0, len(exporters))
+		for _, exporter := range exporters {
+			statuses = append(statuses, exporterStatus{
+				Name:         exporter.Name,
+				Type:         exporter.PredefinedType,
+				ExportedID:   exporter.Exported.ID,
+				ExportedName: exporter.Exported.Name,
+				Status:       exporter.Status,
+				LastError:    exporter.LastError,
+			})
+		}
+
+		writeJSON(w, statuses)
+	})
+	mux.HandleFunc("/exporters/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/exporters/")
+		if strings.HasSuffix(name, "/status") {
+			exporterStatusHandler(w, r, b, strings.TrimSuffix(name, "/status"))
+			return
+		} else if !strings.HasSuffix(name, "/cleanup") {
+			http.NotFound(w, r)
+			return
+		}
+		name = strings.TrimSuffix(name, "/cleanup")
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		logger := log.GetLogger(ctx).WithField("exporter.name", name)
+		err := b.CleanupExporter(log.WithLogger(ctx, logger), name, true)
+		if backend.IsErrExporterNotFound(err) {
+			http.Error(w, "exporter not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Errorf("%+v", err)
+			http.Error(w, "failed to clean up exporter", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := b.StartMissingExporters(ctx, promNetworks); err != nil {
+			logrus.Errorf("%+v", err)
+			http.Error(w, "failed to reconcile exporters", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	if token == "" {
+		return mux
+	}
+
+	return requireToken(token, mux)
+}
+
+// requireToken rejects requests not carrying the given bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// exporterStatusHandler returns the startup status of the given exporter,
+// including its last error, even when its container has been removed
+func exporterStatusHandler(w http.ResponseWriter, r *http.Request, b adminBackend, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, ok := b.GetExporterStatus(name)
+	if !ok {
+		http.Error(w, "exporter not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, status)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		logrus.Errorf("%+v", errors.WithStack(err))
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
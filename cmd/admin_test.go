@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/backend"
+	"github.com/NiR-/prom-autoexporter/models"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// notFoundClient is a Docker client knowing no exporter, only the redis
+// container
+type notFoundClient struct {
+	client.APIClient
+}
+
+func (notFoundClient) ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	if id == "redis" {
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{ID: "redis-id", Name: "/redis"},
+			Config:            &container.Config{Labels: map[string]string{}},
+		}, nil
+	}
+	return types.ContainerJSON{}, errdefs.NotFound(errors.New("no such container"))
+}
+
+// fakeAdminBackend records the calls made by the admin API
+type fakeAdminBackend struct {
+	exporters  []models.Exporter
+	statuses   map[string]backend.ExporterStatus
+	cleanedUp  []string
+	reconciled [][]string
+	err        error
+}
+
+func (b *fakeAdminBackend) ListExporters(ctx context.Context) ([]models.Exporter, error) {
+	return b.exporters, b.err
+}
+
+func (b *fakeAdminBackend) GetExporterStatus(name string) (backend.ExporterStatus, bool) {
+	status, ok := b.statuses[name]
+	return status, ok
+}
+
+func (b *fakeAdminBackend) CleanupExporter(ctx context.Context, cid string, force bool) error {
+	if !force {
+		return errors.New("expected cleanup to be forced")
+	}
+	for _, exporter := range b.exporters {
+		if exporter.Name == cid {
+			b.cleanedUp = append(b.cleanedUp, cid)
+			return b.err
+		}
+	}
+
+	// Mirror DockerBackend, which returns a typed error for unknown exporters
+	fake := backend.NewDockerBackend(notFoundClient{})
+	return fake.CleanupExporter(ctx, cid, force)
+}
+
+func (b *fakeAdminBackend) StartMissingExporters(ctx context.Context, promNetworks []string) error {
+	b.reconciled = append(b.reconciled, promNetworks)
+	return b.err
+}
+
+func TestAdminListExporters(t *testing.T) {
+	exporter := models.NewExporter("exporter.redis.redis", "redis", "oliver006/redis_exporter", nil, nil, models.NewTaskToExport("redis-id", "/redis", "", nil))
+	exporter.Status = "running"
+	exporter.LastError = "oci runtime error"
+	b := &fakeAdminBackend{exporters: []models.Exporter{exporter}}
+
+	rec := httptest.NewRecorder()
+	adminHandler(context.Background(), b, []string{"prometheus"}, "").ServeHTTP(rec, httptest.NewRequest("GET", "/exporters", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var got []map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	expected := []map[string]string{{
+		"name":          "exporter.redis.redis",
+		"type":          "redis",
+		"exported_id":   "redis-id",
+		"exported_name": "/redis",
+		"status":        "running",
+		"last_error":    "oci runtime error",
+	}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestAdminCleanupExporter(t *testing.T) {
+	testcases := map[string]struct {
+		method         string
+		path           string
+		expectedStatus int
+		expectedCalls  []string
+	}{
+		"cleaned up": {
+			method:         "POST",
+			path:           "/exporters/exporter.redis.redis/cleanup",
+			expectedStatus: http.StatusNoContent,
+			expectedCalls:  []string{"exporter.redis.redis"},
+		},
+		"unknown exporter": {
+			method:         "POST",
+			path:           "/exporters/exporter.nginx.nginx/cleanup",
+			expectedStatus: http.StatusNotFound,
+		},
+		"container not managed": {
+			method:         "POST",
+			path:           "/exporters/redis/cleanup",
+			expectedStatus: http.StatusNotFound,
+		},
+		"unknown action": {
+			method:         "POST",
+			path:           "/exporters/exporter.redis.redis/restart",
+			expectedStatus: http.StatusNotFound,
+		},
+		"wrong method": {
+			method:         "GET",
+			path:           "/exporters/exporter.redis.redis/cleanup",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			b := &fakeAdminBackend{exporters: []models.Exporter{{Name: "exporter.redis.redis"}}}
+
+			rec := httptest.NewRecorder()
+			adminHandler(context.Background(), b, []string{"prometheus"}, "").ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rec.Code)
+			}
+			if !reflect.DeepEqual(b.cleanedUp, tc.expectedCalls) {
+				t.Errorf("expected cleanups %v, got %v", tc.expectedCalls, b.cleanedUp)
+			}
+		})
+	}
+}
+
+func TestAdminExporterStatus(t *testing.T) {
+	b := &fakeAdminBackend{statuses: map[string]backend.ExporterStatus{
+		"exporter.redis.redis": {State: backend.ExporterStateFailed, Step: "create", LastError: "oci runtime error"},
+	}}
+	handler := adminHandler(context.Background(), b, []string{"prometheus"}, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/exporters/exporter.redis.redis/status", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var got backend.ExporterStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if got.State != backend.ExporterStateFailed || got.LastError != "oci runtime error" {
+		t.Errorf("unexpected status %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/exporters/exporter.nginx.nginx/status", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+}
+
+func TestAdminReconcile(t *testing.T) {
+	b := &fakeAdminBackend{}
+
+	rec := httptest.NewRecorder()
+	adminHandler(context.Background(), b, []string{"prometheus"}, "").ServeHTTP(rec, httptest.NewRequest("POST", "/reconcile", nil))
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("expected status 202, got %d", rec.Code)
+	}
+	if expected := [][]string{{"prometheus"}}; !reflect.DeepEqual(b.reconciled, expected) {
+		t.Errorf("expected reconciliations %v, got %v", expected, b.reconciled)
+	}
+
+	b.err = errors.New("cannot connect to the Docker daemon")
+	rec = httptest.NewRecorder()
+	adminHandler(context.Background(), b, []string{"prometheus"}, "").ServeHTTP(rec, httptest.NewRequest("POST", "/reconcile", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", rec.Code)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	testcases := map[string]struct {
+		authorization  string
+		expectedStatus int
+	}{
+		"valid token": {
+			authorization:  "Bearer s3cr3t",
+			expectedStatus: http.StatusOK,
+		},
+		"invalid token": {
+			authorization:  "Bearer guessed",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		"missing token": {
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			b := &fakeAdminBackend{}
+
+			req := httptest.NewRequest("GET", "/exporters", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+
+			rec := httptest.NewRecorder()
+			adminHandler(context.Background(), b, []string{"prometheus"}, "s3cr3t").ServeHTTP(rec, req)
+
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("expected status %d, got %d", tc.expectedStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestCheckAdminAddr(t *testing.T) {
+	testcases := map[string]struct {
+		addr        string
+		token       string
+		expectedErr bool
+	}{
+		"loopback ipv4": {
+			addr: "127.0.0.1:9097",
+		},
+		"loopback ipv6": {
+			addr: "[::1]:9097",
+		},
+		"localhost": {
+			addr: "localhost:9097",
+		},
+		"all interfaces without token": {
+			addr:        ":9097",
+			expectedErr: true,
+		},
+		"public address without token": {
+			addr:        "10.0.0.1:9097",
+			expectedErr: true,
+		},
+		"all interfaces with token": {
+			addr:  ":9097",
+			token: "s3cr3t",
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			err := checkAdminAddr(tc.addr, tc.token)
+			if tc.expectedErr && err == nil {
+				t.Error("expected an error")
+			} else if !tc.expectedErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		})
+	}
+}
+
+func TestServeAdminStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		serveAdmin(ctx, "127.0.0.1:0", "", &fakeAdminBackend{}, []string{"prometheus"})
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("admin API did not stop after ctx cancellation")
+	}
+}
@@ -2,39 +2,67 @@ package cmd
 
 import (
 	"context"
-	"os"
+	"net/http"
 	"time"
 
 	"github.com/NiR-/prom-autoexporter/backend"
 	"github.com/NiR-/prom-autoexporter/log"
-	"github.com/docker/docker/client"
+	"github.com/NiR-/prom-autoexporter/models"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
 func AutoConfig(c *cli.Context) {
-	promNetwork := c.String("network")
+	promNetworks := c.StringSlice("network")
 	interval := c.Duration("interval")
 	filepath := c.String("filepath")
 
 	ctx := log.WithDefaultLogger(context.Background())
-	log.ConfigureDefaultLogger(c.String("level"))
+	if err := log.ConfigureLogger(c.String("level"), c.String("log-format")); err != nil {
+		logrus.Errorf("%+v", err)
+		return
+	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	cli, err := backend.NewClient()
 	if err != nil {
-		logrus.Errorf("%+v", errors.WithStack(err))
+		logrus.Errorf("%+v", err)
 		return
 	}
 
 	defer cli.Close()
-	cli.NegotiateAPIVersion(ctx)
 
-	b := backend.NewBackend(cli)
+	finder, err := newFinder(c.String("exporters-config"), c.StringSlice("disable-exporter"))
+	if err != nil {
+		logrus.Errorf("%+v", err)
+		return
+	}
+
+	defaultScrapePort := c.String("default-scrape-port")
+	if defaultScrapePort != "" {
+		if err := backend.ValidatePort(defaultScrapePort); err != nil {
+			logrus.Errorf("%+v", err)
+			return
+		}
+	}
+
+	b := backend.NewDockerBackend(cli,
+		backend.WithFinder(finder),
+		backend.WithDefaultScrapePort(defaultScrapePort),
+	)
+
+	if httpSDAddr := c.String("http-sd-addr"); httpSDAddr != "" {
+		go serveHTTPSD(ctx, httpSDAddr, b, promNetworks)
+	}
+
+	if filepath == "" {
+		select {}
+	}
+
 	t := time.NewTicker(interval)
 
 	reconfigure := func() {
-		if err := reconfigurePrometheus(ctx, b, promNetwork, filepath); err != nil {
+		if err := reconfigurePrometheus(ctx, b, promNetworks, filepath); err != nil {
 			logrus.Errorf("%+v", err)
 		}
 	}
@@ -49,26 +77,52 @@ func AutoConfig(c *cli.Context) {
 	}
 }
 
-func reconfigurePrometheus(ctx context.Context, b backend.Backend, promNetwork string, filepath string) error {
+func reconfigurePrometheus(ctx context.Context, b backend.DockerBackend, promNetworks []string, filepath string) error {
 	logrus.Info("Reconfiguring prometheus...")
 
-	staticConfig, err := b.GetPromStaticConfig(ctx, promNetwork)
+	staticConfig, err := b.GetPromStaticConfig(ctx, promNetworks)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+	return staticConfig.WriteFile(filepath)
+}
 
-	configfile, err := staticConfig.ToJSON()
-	if err != nil {
-		return err
+// serveHTTPSD exposes the targets of running exporters on /sd, following
+// Prometheus http_sd format. Targets are computed on each request.
+func serveHTTPSD(ctx context.Context, addr string, b backend.DockerBackend, promNetworks []string) {
+	mux := http.NewServeMux()
+	mux.Handle("/sd", httpSDHandler(ctx, b, promNetworks))
+
+	logrus.Infof("Exposing http_sd targets on %s...", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("%+v", errors.WithStack(err))
 	}
+}
+
+// staticConfigGetter computes the targets of running exporters
+type staticConfigGetter interface {
+	GetPromStaticConfig(ctx context.Context, promNetworks []string) (*models.StaticConfig, error)
+}
 
-	f.Write(configfile)
+func httpSDHandler(ctx context.Context, b staticConfigGetter, promNetworks []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		staticConfig, err := b.GetPromStaticConfig(ctx, promNetworks)
+		if err != nil {
+			logrus.Errorf("%+v", err)
+			http.Error(w, "failed to list targets", http.StatusInternalServerError)
+			return
+		}
+
+		content, err := staticConfig.ToJSON()
+		if err != nil {
+			logrus.Errorf("%+v", errors.WithStack(err))
+			http.Error(w, "failed to list targets", http.StatusInternalServerError)
+			return
+		}
 
-	return nil
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(content)
+	})
 }
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/NiR-/prom-autoexporter/models"
+)
+
+type staticConfigFunc func(ctx context.Context, promNetworks []string) (*models.StaticConfig, error)
+
+func (f staticConfigFunc) GetPromStaticConfig(ctx context.Context, promNetworks []string) (*models.StaticConfig, error) {
+	return f(ctx, promNetworks)
+}
+
+type httpSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func TestHTTPSDHandler(t *testing.T) {
+	running := map[string]map[string]string{
+		"10.0.0.2:9121": {"job": "redis", "container_name": "/redis"},
+		"10.0.0.3:9104": {"job": "mysql", "container_name": "/db"},
+	}
+	getter := staticConfigFunc(func(ctx context.Context, promNetworks []string) (*models.StaticConfig, error) {
+		if !reflect.DeepEqual(promNetworks, []string{"prometheus"}) {
+			t.Errorf("expected targets of network %q, got %v", "prometheus", promNetworks)
+		}
+
+		staticConfig := models.NewStaticConfig()
+		for target, labels := range running {
+			staticConfig.AddTarget(target, labels)
+		}
+		return staticConfig, nil
+	})
+
+	rec := httptest.NewRecorder()
+	httpSDHandler(context.Background(), getter, []string{"prometheus"}).ServeHTTP(rec, httptest.NewRequest("GET", "/sd", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected JSON content type, got %q", got)
+	}
+
+	var groups []httpSDGroup
+	if err := json.Unmarshal(rec.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	got := map[string]map[string]string{}
+	for _, group := range groups {
+		if len(group.Targets) != 1 {
+			t.Fatalf("expected one target per group, got %v", group.Targets)
+		}
+		got[group.Targets[0]] = group.Labels
+	}
+	if !reflect.DeepEqual(got, running) {
+		t.Errorf("expected targets %v, got %v", running, got)
+	}
+}
+
+func TestHTTPSDHandlerFailure(t *testing.T) {
+	getter := staticConfigFunc(func(ctx context.Context, promNetworks []string) (*models.StaticConfig, error) {
+		return nil, errors.New("cannot connect to the Docker daemon")
+	})
+
+	rec := httptest.NewRecorder()
+	httpSDHandler(context.Background(), getter, []string{"prometheus"}).ServeHTTP(rec, httptest.NewRequest("GET", "/sd", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", rec.Code)
+	}
+}
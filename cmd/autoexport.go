@@ -2,51 +2,305 @@ package cmd
 
 import (
 	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/NiR-/prom-autoexporter/backend"
 	"github.com/NiR-/prom-autoexporter/log"
-	"github.com/docker/docker/client"
+	"github.com/NiR-/prom-autoexporter/metrics"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
-func AutoExport(c *cli.Context) {
-	promNetwork := c.String("network")
+func AutoExport(c *cli.Context) error {
+	promNetworks := c.StringSlice("network")
 	forceRecreate := c.Bool("force-recreate")
+	metricsAddr := c.String("metrics-addr")
+	reconcileInterval := c.Duration("reconcile-interval")
 
-	ctx := log.WithDefaultLogger(context.Background())
-	log.ConfigureDefaultLogger(c.String("level"))
+	ctx, cancel := context.WithCancel(log.WithDefaultLogger(context.Background()))
+	defer cancel()
+	if err := log.ConfigureLogger(c.String("level"), c.String("log-format")); err != nil {
+		logrus.Errorf("%+v", err)
+		return nil
+	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	dockerClient, err := backend.NewClient()
 	if err != nil {
-		logrus.Errorf("%+v", errors.WithStack(err))
-		return
+		logrus.Errorf("%+v", err)
+		return nil
 	}
 
-	defer cli.Close()
-	cli.NegotiateAPIVersion(ctx)
+	defer dockerClient.Close()
 
-	b := backend.NewBackend(cli)
+	// Calls made outside of the Docker backend are bounded too
+	apiClient := backend.NewTimeoutClient(dockerClient, c.Duration("docker-timeout"), c.Duration("pull-timeout"))
 
-	logrus.Info("Removing stale exporters...")
+	unhealthyAction := c.String("unhealthy-action")
+	switch unhealthyAction {
+	case backend.UnhealthyActionNone, backend.UnhealthyActionPause, backend.UnhealthyActionAnnotate:
+	default:
+		logrus.Errorf("Invalid unhealthy action %q. Should be one of: pause or annotate.", unhealthyAction)
+		return nil
+	}
+
+	stopOrder := c.String("stop-order")
+	switch stopOrder {
+	case backend.StopOrderNone, backend.StopOrderExportersFirst, backend.StopOrderExportersLast:
+	default:
+		logrus.Errorf("Invalid stop order %q. Should be one of: exporters-first or exporters-last.", stopOrder)
+		return nil
+	}
+
+	collisionPolicy := c.String("name-collision")
+	switch collisionPolicy {
+	case backend.CollisionPolicySkip, backend.CollisionPolicySuffix:
+	default:
+		logrus.Errorf("Invalid name collision policy %q. Should be one of: skip or suffix.", collisionPolicy)
+		return nil
+	}
+
+	disconnectFailure := c.String("disconnect-failure")
+	switch disconnectFailure {
+	case backend.DisconnectFailureAbort, backend.DisconnectFailureBestEffort:
+	default:
+		logrus.Errorf("Invalid disconnect failure behavior %q. Should be one of: abort or best-effort.", disconnectFailure)
+		return nil
+	}
+
+	watchedEvents := c.StringSlice("event")
+	if err := backend.ValidateEvents(watchedEvents); err != nil {
+		logrus.Errorf("%+v", err)
+		return nil
+	}
+
+	defaultScrapePort := c.String("default-scrape-port")
+	if defaultScrapePort != "" {
+		if err := backend.ValidatePort(defaultScrapePort); err != nil {
+			logrus.Errorf("%+v", err)
+			return nil
+		}
+	}
+
+	if c.Bool("swarm") {
+		if err := checkSwarmFlags(c.String("admin-addr"), c.Bool("once")); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	if adminAddr := c.String("admin-addr"); adminAddr != "" {
+		if err := checkAdminAddr(adminAddr, c.String("admin-token")); err != nil {
+			logrus.Errorf("%+v", err)
+			return nil
+		}
+	}
 
-	if forceRecreate {
-		if err := b.CleanupAllExporters(ctx); err != nil {
+	podmanCompat := c.Bool("podman-compat")
+	if !podmanCompat {
+		if podmanCompat, err = backend.IsPodman(ctx, apiClient); err != nil {
 			logrus.Errorf("%+v", err)
+			return nil
 		}
-	} else {
-		if err := b.CleanupStaleExporters(ctx); err != nil {
+	}
+
+	finder, err := newFinder(c.String("exporters-config"), c.StringSlice("disable-exporter"))
+	if err != nil {
+		logrus.Errorf("%+v", err)
+		return nil
+	}
+
+	if err := backend.EnsureNetworks(ctx, apiClient, promNetworks, c.Bool("create-network"), c.Bool("swarm")); err != nil {
+		logrus.Errorf("%+v", err)
+		return nil
+	}
+
+	if c.Bool("swarm") {
+		if metricsAddr != "" {
+			go serveMetrics(metricsAddr)
+		}
+
+		go cancelOnShutdown(cancel)
+
+		b := backend.NewSwarmBackend(apiClient, finder, c.Bool("dry-run"))
+		listenUntilShutdown(ctx, b, promNetworks, c.Bool("cleanup-on-exit"))
+		return nil
+	}
+
+	opts := []backend.Option{
+		backend.WithFinder(finder),
+		backend.WithRetry(c.Uint("retry-attempts"), c.Duration("retry-interval"), c.Duration("retry-max-interval")),
+		backend.WithDryRun(c.Bool("dry-run")),
+		backend.WithOOMHandling(c.Bool("handle-oom")),
+		backend.WithInit(c.Bool("init")),
+		backend.WithUnhealthyAction(unhealthyAction),
+		backend.WithPodmanCompat(podmanCompat),
+		backend.WithStopOrder(stopOrder),
+		backend.WithCollisionPolicy(collisionPolicy),
+		backend.WithDefaultScrapePort(defaultScrapePort),
+		backend.WithLivenessChecker(backend.NewHTTPLivenessChecker(c.Duration("liveness-timeout"))),
+		backend.WithContainerFilter(backend.ContainerFilter{
+			IncludeLabels: c.StringSlice("include-label"),
+			ExcludeLabels: c.StringSlice("exclude-label"),
+			IncludeNames:  c.StringSlice("include-name"),
+			ExcludeNames:  c.StringSlice("exclude-name"),
+			AllowedImages: c.StringSlice("allow-image"),
+		}),
+		backend.WithRulesVersion(c.String("rules-version")),
+		backend.WithDisconnectFailure(disconnectFailure),
+		backend.WithPropagatedLabels(c.StringSlice("propagate-label")),
+		backend.WithWaitHealthyTimeout(c.Duration("wait-healthy-timeout")),
+		backend.WithReconcileJitter(c.Duration("reconcile-jitter")),
+		backend.WithAllowedBindSources(c.StringSlice("allow-bind-source")),
+		backend.WithAllowedEnvFileSources(c.StringSlice("allow-env-file-source")),
+		backend.WithEvents(watchedEvents),
+		backend.WithTimeouts(c.Duration("docker-timeout"), c.Duration("pull-timeout")),
+	}
+	if registryConfig := c.String("registry-config"); registryConfig != "" {
+		auths, err := backend.LoadRegistryAuths(registryConfig)
+		if err != nil {
 			logrus.Errorf("%+v", err)
+			return nil
+		}
+		opts = append(opts, backend.WithRegistryAuths(auths))
+	}
+	if rules := c.StringSlice("image-rewrite"); len(rules) > 0 {
+		rewrites := make([]backend.ImageRewrite, 0, len(rules))
+		for _, rule := range rules {
+			rewrite, err := backend.ParseImageRewrite(rule)
+			if err != nil {
+				logrus.Errorf("%+v", err)
+				return nil
+			}
+			rewrites = append(rewrites, rewrite)
 		}
+		opts = append(opts, backend.WithImageRewrites(rewrites))
+	}
+	if threshold := c.Int("quarantine-threshold"); threshold > 0 {
+		opts = append(opts, backend.WithQuarantine(threshold, c.Duration("quarantine-window")))
+	}
+	if fileSD := c.String("file-sd"); fileSD != "" {
+		opts = append(opts, backend.WithFileSD(fileSD, c.StringSlice("file-sd-label")))
+	}
+	if webhook := c.String("lifecycle-webhook"); webhook != "" {
+		opts = append(opts, backend.WithLifecycleObserver(backend.NewWebhookObserver(webhook), c.Duration("lifecycle-webhook-timeout")))
+	}
+
+	b := backend.NewDockerBackend(apiClient, opts...)
+
+	if c.Bool("once") {
+		if err := b.ReconcileOnce(ctx, promNetworks); err != nil {
+			logrus.Errorf("%+v", err)
+			return cli.NewExitError("Reconciliation failed.", 1)
+		}
+		return nil
+	}
+
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
+
+	if adminAddr := c.String("admin-addr"); adminAddr != "" {
+		go serveAdmin(ctx, adminAddr, c.String("admin-token"), b, promNetworks)
+	}
+
+	go reloadOnSighup(ctx, b, c.String("exporters-config"), c.StringSlice("disable-exporter"), promNetworks)
+	go cancelOnShutdown(cancel)
+
+	logrus.Info("Removing stale exporters...")
+
+	// Exporters of running containers are expected to be kept
+	if err := b.CleanupExporters(ctx, forceRecreate); err != nil && !backend.IsErrExportedStillRunning(err) {
+		logrus.Errorf("%+v", err)
 	}
 
 	logrus.Info("Starting missing exporters...")
 
-	if err := b.StartMissingExporters(ctx, promNetwork); err != nil {
+	if err := b.ReconcileOnStartup(ctx, promNetworks, reconcileInterval); err != nil {
 		logrus.Errorf("%+v", err)
 	}
 
-	logrus.Info("Start listening for new Docker events...")
-	b.ListenEventsForExported(ctx, promNetwork)
+	if livenessInterval := c.Duration("liveness-interval"); livenessInterval > 0 {
+		go b.CheckLivenessPeriodically(ctx, promNetworks, livenessInterval)
+	}
+
+	listenUntilShutdown(ctx, b, promNetworks, c.Bool("cleanup-on-exit"))
+
+	return nil
+}
+
+// listenUntilShutdown runs the backend event loop until ctx is cancelled,
+// and then removes all exporters when cleanupOnExit is true
+func listenUntilShutdown(ctx context.Context, b backend.Backend, promNetworks []string, cleanupOnExit bool) {
+	logrus.Info("Start listening for new events...")
+	b.ListenForTasksToExport(ctx, promNetworks)
+
+	if !cleanupOnExit {
+		return
+	}
+
+	logrus.Info("Removing all exporters before exiting...")
+
+	// ctx is already cancelled at this point
+	if err := b.CleanupExporters(log.WithDefaultLogger(context.Background()), true); err != nil {
+		logrus.Errorf("%+v", err)
+	}
+}
+
+// checkSwarmFlags rejects the flags only supported by the Docker backend
+func checkSwarmFlags(adminAddr string, once bool) error {
+	if adminAddr != "" {
+		return errors.New("The admin API (--admin-addr) is not supported in Swarm mode.")
+	}
+	if once {
+		return errors.New("One-shot reconciliation (--once) is not supported in Swarm mode.")
+	}
+
+	return nil
+}
+
+// cancelOnShutdown calls cancel when SIGTERM or SIGINT is received
+func cancelOnShutdown(cancel context.CancelFunc) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-sigCh
+	logrus.Infof("Received %s, shutting down...", sig)
+	cancel()
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	logrus.Infof("Exposing metrics on %s...", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("%+v", errors.WithStack(err))
+	}
+}
+
+// reloadOnSighup reloads the exporters config file and refreshes running
+// exporters whenever SIGHUP is received
+func reloadOnSighup(ctx context.Context, b backend.DockerBackend, configPath string, disabled []string, promNetworks []string) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	for range sigCh {
+		logrus.Info("Reloading exporters config...")
+
+		finder, err := newFinder(configPath, disabled)
+		if err != nil {
+			logrus.Errorf("%+v", err)
+			continue
+		}
+
+		b.SetFinder(finder)
+
+		if err := b.RefreshAll(ctx, promNetworks); err != nil {
+			logrus.Errorf("%+v", err)
+		}
+	}
 }
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/NiR-/prom-autoexporter/backend"
+)
+
+// fakeBackend listens for tasks until its context is cancelled and records
+// cleanups
+type fakeBackend struct {
+	backend.Backend
+	cleanups []bool
+}
+
+func (b *fakeBackend) ListenForTasksToExport(ctx context.Context, promNetworks []string) {
+	<-ctx.Done()
+}
+
+func (b *fakeBackend) CleanupExporters(ctx context.Context, force bool) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	b.cleanups = append(b.cleanups, force)
+	return nil
+}
+
+func TestListenUntilShutdown(t *testing.T) {
+	testcases := map[string]struct {
+		cleanupOnExit bool
+		expected      int
+	}{
+		"exporters are removed on exit when asked": {
+			cleanupOnExit: true,
+			expected:      1,
+		},
+		"exporters are left running by default": {
+			cleanupOnExit: false,
+			expected:      0,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			b := &fakeBackend{}
+			ctx, cancel := context.WithCancel(context.Background())
+
+			done := make(chan struct{})
+			go func() {
+				listenUntilShutdown(ctx, b, []string{"prometheus"}, tc.cleanupOnExit)
+				close(done)
+			}()
+
+			// Simulates the reception of SIGTERM
+			cancel()
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("listener did not return after shutdown")
+			}
+
+			if len(b.cleanups) != tc.expected {
+				t.Fatalf("expected %d cleanup, got %d", tc.expected, len(b.cleanups))
+			}
+			if tc.expected > 0 && !b.cleanups[0] {
+				t.Errorf("expected cleanup to be forced")
+			}
+		})
+	}
+}
+
+func TestCheckSwarmFlags(t *testing.T) {
+	testcases := map[string]struct {
+		adminAddr   string
+		once        bool
+		expectedErr bool
+	}{
+		"no docker-only flag": {},
+		"admin API":           {adminAddr: "127.0.0.1:9099", expectedErr: true},
+		"one-shot reconcile":  {once: true, expectedErr: true},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			err := checkSwarmFlags(tc.adminAddr, tc.once)
+			if tc.expectedErr && err == nil {
+				t.Error("expected an error")
+			} else if !tc.expectedErr && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		})
+	}
+}
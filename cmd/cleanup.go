@@ -2,30 +2,40 @@ package cmd
 
 import (
 	"context"
+	"strings"
 
 	"github.com/NiR-/prom-autoexporter/backend"
 	"github.com/NiR-/prom-autoexporter/log"
-	"github.com/docker/docker/client"
-	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
 func Cleanup(c *cli.Context) {
 	ctx := log.WithDefaultLogger(context.Background())
-	log.ConfigureDefaultLogger(c.String("level"))
+	if err := log.ConfigureLogger(c.String("level"), c.String("log-format")); err != nil {
+		logrus.Fatalf("%+v", err)
+	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	cli, err := backend.NewClient()
 	if err != nil {
-		logrus.Fatalf("%+v", errors.WithStack(err))
+		logrus.Fatalf("%+v", err)
 	}
 
 	defer cli.Close()
-	cli.NegotiateAPIVersion(ctx)
 
-	b := backend.NewBackend(cli)
+	b := backend.NewDockerBackend(cli, backend.WithDryRun(c.Bool("dry-run")))
+
+	selector := map[string]string{}
+	for _, s := range c.StringSlice("selector") {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) == 2 {
+			selector[parts[0]] = parts[1]
+		} else {
+			selector[parts[0]] = ""
+		}
+	}
 
-	if err := b.CleanupAllExporters(ctx); err != nil {
+	if err := b.CleanupExportersBySelector(ctx, selector, true); err != nil {
 		logrus.Fatalf("%+v", err)
 	}
 }
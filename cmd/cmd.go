@@ -3,6 +3,7 @@ package cmd
 import (
 	"time"
 
+	"github.com/NiR-/prom-autoexporter/models"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
@@ -17,13 +18,215 @@ func BuildCommands() []cli.Command {
 					Usage: "Set the level of the logger",
 				},
 				cli.StringFlag{
+					Name:  "log-format",
+					Usage: "Set the format of the logs: text or json",
+					Value: "text",
+				},
+				cli.StringSliceFlag{
 					Name:  "network",
-					Usage: "Network used to automatically connect Prometheus and exporters",
+					Usage: "Network used to automatically connect Prometheus and exporters, not joined when empty (can be repeated)",
+				},
+				cli.BoolFlag{
+					Name:  "create-network",
+					Usage: "Create the networks that don't exist at start up, instead of failing",
+				},
+				cli.StringFlag{
+					Name:  "exporters-config",
+					Usage: "Path of a JSON or YAML file describing custom exporters, taking precedence over predefined ones",
+				},
+				cli.StringSliceFlag{
+					Name:  "disable-exporter",
+					Usage: "Type of predefined exporter never run, e.g. redis (can be repeated)",
+				},
+				cli.BoolFlag{
+					Name:  "swarm",
+					Usage: "Run exporters as Swarm services instead of plain containers",
+				},
+				cli.StringFlag{
+					Name:   "rules-version",
+					Usage:  "Version of the exporter rules (e.g. git SHA) stamped on created exporters",
+					EnvVar: "AUTOEXPORTER_RULES_VERSION",
 				},
 				cli.BoolFlag{
 					Name:  "force-recreate",
 					Usage: "Cleanup all exporters created by prom-autoexporter and recreate them at start up",
 				},
+				cli.BoolFlag{
+					Name:  "once",
+					Usage: "Clean up orphaned exporters and start missing ones once, then exit with a non-zero status if anything failed",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Log actions that would change Docker state instead of executing them",
+				},
+				cli.StringFlag{
+					Name:  "metrics-addr",
+					Usage: "Address on which internal metrics are exposed (e.g. :9099), disabled when empty",
+				},
+				cli.StringFlag{
+					Name:  "admin-addr",
+					Usage: "Address on which the admin API is exposed (e.g. 127.0.0.1:9097), disabled when empty",
+				},
+				cli.StringFlag{
+					Name:   "admin-token",
+					Usage:  "Bearer token required by the admin API, mandatory unless it listens on a loopback address",
+					EnvVar: "AUTOEXPORTER_ADMIN_TOKEN",
+				},
+				cli.StringFlag{
+					Name:  "lifecycle-webhook",
+					Usage: "URL to which exporter start and stop events are posted as JSON, disabled when empty",
+				},
+				cli.StringFlag{
+					Name:  "file-sd",
+					Usage: "Path of a file_sd_config file listing the targets of running exporters, disabled when empty",
+				},
+				cli.StringSliceFlag{
+					Name:  "file-sd-label",
+					Usage: "Add this label of exporters to their file_sd target, a trailing * matches a prefix (can be repeated)",
+				},
+				cli.DurationFlag{
+					Name:  "lifecycle-webhook-timeout",
+					Usage: "Maximum time spent posting a lifecycle event",
+					Value: time.Duration(10 * time.Second),
+				},
+				cli.StringFlag{
+					Name:  "default-scrape-port",
+					Usage: "Port scraped when an exporter doesn't define one, ignored when empty",
+				},
+				cli.StringFlag{
+					Name:  "registry-config",
+					Usage: "Path of a docker config file holding credentials for private registries (e.g. ~/.docker/config.json)",
+				},
+				cli.StringSliceFlag{
+					Name:  "image-rewrite",
+					Usage: "Rewrite exporter images starting with a prefix, e.g. docker.io/=registry.internal/ (can be repeated)",
+				},
+				cli.BoolFlag{
+					Name:  "init",
+					Usage: "Run an init process inside all exporter containers to reap zombie processes",
+				},
+				cli.StringFlag{
+					Name:  "unhealthy-action",
+					Usage: "What to do with exporters of unhealthy containers: pause, or annotate their file_sd targets with a health label (disabled when empty)",
+				},
+				cli.BoolFlag{
+					Name:  "podman-compat",
+					Usage: "Adjust to Podman Docker-compatible API (automatically enabled when Podman is detected)",
+				},
+				cli.StringSliceFlag{
+					Name:  "include-label",
+					Usage: "Only export containers having this label (label or label=value, can be repeated)",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-label",
+					Usage: "Never export containers having this label (label or label=value, can be repeated)",
+				},
+				cli.StringSliceFlag{
+					Name:  "include-name",
+					Usage: "Only export containers whose name matches this glob pattern (can be repeated)",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-name",
+					Usage: "Never export containers whose name matches this glob pattern (can be repeated)",
+				},
+				cli.StringSliceFlag{
+					Name:  "allow-image",
+					Usage: "Only export containers running this image, e.g. redis or redis:5 (can be repeated)",
+				},
+				cli.StringSliceFlag{
+					Name:  "allow-bind-source",
+					Usage: "Host path under which autoexporter.bind.* labels can mount sources into exporters (can be repeated)",
+				},
+				cli.StringSliceFlag{
+					Name:  "allow-env-file-source",
+					Usage: "Host path under which autoexporter.env-file.* labels can mount files into exporters (can be repeated)",
+				},
+				cli.StringSliceFlag{
+					Name:  "propagate-label",
+					Usage: "Copy this label of exported containers onto their exporters, a trailing * matches a prefix (can be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "name-collision",
+					Usage: "What to do when an unmanaged container has the name of an exporter: skip or suffix",
+					Value: "skip",
+				},
+				cli.StringFlag{
+					Name:  "disconnect-failure",
+					Usage: "What to do when a scrape target can't be disconnected during cleanup: abort or best-effort",
+					Value: "best-effort",
+				},
+				cli.StringFlag{
+					Name:  "stop-order",
+					Usage: "When exporters of a stack are stopped: exporters-first or exporters-last (along with their own container when empty)",
+				},
+				cli.BoolFlag{
+					Name:  "cleanup-on-exit",
+					Usage: "Forcefully remove all exporters when receiving SIGTERM or SIGINT",
+				},
+				cli.BoolFlag{
+					Name:  "handle-oom",
+					Usage: "Watch oom events to count OOM kills and forcefully clean up the associated exporters",
+				},
+				cli.StringSliceFlag{
+					Name:  "event",
+					Usage: "Container event handled: start, die, oom, health_status or rename (can be repeated, start, die and rename when empty). Without start, exporters only start once containers are healthy",
+				},
+				cli.DurationFlag{
+					Name:  "reconcile-interval",
+					Usage: "Interval between two periodic reconciliations of missing exporters, disabled when 0",
+				},
+				cli.DurationFlag{
+					Name:  "reconcile-jitter",
+					Usage: "Maximum random deviation of each periodic reconciliation from its interval",
+				},
+				cli.DurationFlag{
+					Name:  "wait-healthy-timeout",
+					Usage: "Maximum time spent waiting for exported containers labeled autoexporter.wait-healthy=true to be healthy",
+					Value: time.Duration(2 * time.Minute),
+				},
+				cli.DurationFlag{
+					Name:  "liveness-interval",
+					Usage: "Interval between two checks that exporters still serve their metrics, disabled when 0",
+				},
+				cli.DurationFlag{
+					Name:  "liveness-timeout",
+					Usage: "Time after which an exporter not serving its metrics is restarted",
+					Value: time.Duration(5 * time.Second),
+				},
+				cli.IntFlag{
+					Name:  "quarantine-threshold",
+					Usage: "Number of restarts within the quarantine window after which an exporter isn't recreated anymore, disabled when 0",
+				},
+				cli.DurationFlag{
+					Name:  "quarantine-window",
+					Usage: "Period over which exporter restarts are counted",
+					Value: time.Duration(10 * time.Minute),
+				},
+				cli.UintFlag{
+					Name:  "retry-attempts",
+					Usage: "Number of times a Docker event is handled before giving up",
+					Value: 3,
+				},
+				cli.DurationFlag{
+					Name:  "retry-interval",
+					Usage: "Initial delay between two attempts, doubled after each failure",
+					Value: time.Duration(5 * time.Second),
+				},
+				cli.DurationFlag{
+					Name:  "retry-max-interval",
+					Usage: "Maximum delay between two attempts",
+					Value: time.Duration(1 * time.Minute),
+				},
+				cli.DurationFlag{
+					Name:  "docker-timeout",
+					Usage: "Maximum duration of Docker API calls, unbounded when 0",
+					Value: time.Duration(30 * time.Second),
+				},
+				cli.DurationFlag{
+					Name:  "pull-timeout",
+					Usage: "Maximum duration of exporter image pulls, unbounded when 0",
+					Value: time.Duration(10 * time.Minute),
+				},
 			},
 			Action: AutoExport,
 		},
@@ -36,12 +239,33 @@ func BuildCommands() []cli.Command {
 					Usage: "Set the level of the logger",
 				},
 				cli.StringFlag{
+					Name:  "log-format",
+					Usage: "Set the format of the logs: text or json",
+					Value: "text",
+				},
+				cli.StringSliceFlag{
 					Name:  "network",
-					Usage: "Network used to interconnect exported containers and Prometheus",
+					Usage: "Network used to interconnect exported containers and Prometheus (can be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "exporters-config",
+					Usage: "Path of a JSON or YAML file describing custom exporters, taking precedence over predefined ones",
+				},
+				cli.StringSliceFlag{
+					Name:  "disable-exporter",
+					Usage: "Type of predefined exporter never run, e.g. redis (can be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "default-scrape-port",
+					Usage: "Port scraped when an exporter doesn't define one, ignored when empty",
 				},
 				cli.StringFlag{
 					Name:  "filepath",
-					Usage: "Path of the generated SD file",
+					Usage: "Path of the generated SD file, disabled when empty",
+				},
+				cli.StringFlag{
+					Name:  "http-sd-addr",
+					Usage: "Address on which targets are served for Prometheus http_sd on /sd (e.g. :9098), disabled when empty",
 				},
 				cli.DurationFlag{
 					Name:  "interval",
@@ -59,8 +283,94 @@ func BuildCommands() []cli.Command {
 					Name:  "level",
 					Usage: "Set the level of the logger",
 				},
+				cli.StringFlag{
+					Name:  "log-format",
+					Usage: "Set the format of the logs: text or json",
+					Value: "text",
+				},
+				cli.StringSliceFlag{
+					Name:  "selector",
+					Usage: "Only clean up exporters having this label (label or label=value, can be repeated)",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Log actions that would change Docker state instead of executing them",
+				},
 			},
 			Action: Cleanup,
 		},
+		{
+			Name:        "describe",
+			Usage:       "describe CONTAINER",
+			Description: "print the exporters that would be run for a container, without starting them",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "level",
+					Usage: "Set the level of the logger",
+				},
+				cli.StringFlag{
+					Name:  "log-format",
+					Usage: "Set the format of the logs: text or json",
+					Value: "text",
+				},
+				cli.StringFlag{
+					Name:  "exporters-config",
+					Usage: "Path of a JSON or YAML file describing custom exporters, taking precedence over predefined ones",
+				},
+				cli.StringSliceFlag{
+					Name:  "disable-exporter",
+					Usage: "Type of predefined exporter never run, e.g. redis (can be repeated)",
+				},
+			},
+			Action: Describe,
+		},
+		{
+			Name:        "diagnose",
+			Description: "check that exporters can be run, and list managed and missing exporters",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "level",
+					Usage: "Set the level of the logger",
+				},
+				cli.StringFlag{
+					Name:  "log-format",
+					Usage: "Set the format of the logs: text or json",
+					Value: "text",
+				},
+				cli.StringSliceFlag{
+					Name:  "network",
+					Usage: "Network used to automatically connect Prometheus and exporters (can be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "exporters-config",
+					Usage: "Path of a JSON or YAML file describing custom exporters, taking precedence over predefined ones",
+				},
+				cli.StringSliceFlag{
+					Name:  "disable-exporter",
+					Usage: "Type of predefined exporter never run, e.g. redis (can be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "registry-config",
+					Usage: "Path of a docker config file holding credentials for private registries (e.g. ~/.docker/config.json)",
+				},
+			},
+			Action: Diagnose,
+		},
+	}
+}
+
+// newFinder returns the finder for predefined exporters not disabled,
+// preceded by the one for custom exporters when a config file is provided
+func newFinder(configPath string, disabled []string) (models.ExporterFinder, error) {
+	predefined := models.NewPredefinedExporterFinder(disabled...)
+	if configPath == "" {
+		return predefined, nil
+	}
+
+	custom, err := models.LoadConfigFinder(configPath)
+	if err != nil {
+		return nil, err
 	}
+
+	return models.NewChainFinder(custom, predefined), nil
 }
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/NiR-/prom-autoexporter/models"
+)
+
+func TestNewFinderDisablesPredefinedExporters(t *testing.T) {
+	redis := models.NewTaskToExport("redis-id", "/redis", "redis:5", nil)
+	worker := models.NewTaskToExport("worker-id", "/worker", "mycompany/worker:1.0", nil)
+
+	finder, err := newFinder("../models/testdata/exporters.json", []string{"redis"})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	if exporters, _ := finder.FindMatchingExporters(redis); len(exporters) != 0 {
+		t.Errorf("expected the disabled exporter not to match, got %v", exporters)
+	}
+	// Custom exporters are still found
+	if exporters, _ := finder.FindMatchingExporters(worker); len(exporters) != 1 {
+		t.Errorf("expected the worker exporter to match, got %v", exporters)
+	}
+}
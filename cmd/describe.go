@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/NiR-/prom-autoexporter/backend"
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func Describe(c *cli.Context) {
+	ctx := log.WithDefaultLogger(context.Background())
+	if err := log.ConfigureLogger(c.String("level"), c.String("log-format")); err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	if c.NArg() != 1 {
+		logrus.Fatal("Exactly one container name or ID has to be provided.")
+	}
+
+	cli, err := backend.NewClient()
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	defer cli.Close()
+
+	finder, err := newFinder(c.String("exporters-config"), c.StringSlice("disable-exporter"))
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	b := backend.NewDockerBackend(cli, backend.WithFinder(finder))
+
+	exporters, err := b.DescribeExporter(ctx, c.Args().First())
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(exporters); err != nil {
+		logrus.Fatalf("%+v", errors.WithStack(err))
+	}
+}
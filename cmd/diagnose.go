@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/NiR-/prom-autoexporter/backend"
+	"github.com/NiR-/prom-autoexporter/log"
+	"github.com/sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func Diagnose(c *cli.Context) {
+	ctx := log.WithDefaultLogger(context.Background())
+	if err := log.ConfigureLogger(c.String("level"), c.String("log-format")); err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	cli, err := backend.NewClient()
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	defer cli.Close()
+
+	finder, err := newFinder(c.String("exporters-config"), c.StringSlice("disable-exporter"))
+	if err != nil {
+		logrus.Fatalf("%+v", err)
+	}
+
+	opts := []backend.Option{backend.WithFinder(finder)}
+	if registryConfig := c.String("registry-config"); registryConfig != "" {
+		auths, err := backend.LoadRegistryAuths(registryConfig)
+		if err != nil {
+			logrus.Fatalf("%+v", err)
+		}
+		opts = append(opts, backend.WithRegistryAuths(auths))
+	}
+
+	b := backend.NewDockerBackend(cli, opts...)
+	diagnosis := b.Diagnose(ctx, c.StringSlice("network"))
+
+	for _, check := range diagnosis.Checks {
+		status := "OK"
+		if !check.OK {
+			status = "FAIL"
+		}
+		fmt.Printf("[%-4s] %s: %s\n", status, check.Name, check.Detail)
+	}
+	for _, name := range diagnosis.Managed {
+		fmt.Printf("managed: %s\n", name)
+	}
+	for _, name := range diagnosis.Missing {
+		fmt.Printf("missing: %s\n", name)
+	}
+
+	if !diagnosis.Healthy() {
+		os.Exit(1)
+	}
+}
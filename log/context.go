@@ -37,24 +37,30 @@ func GetLogger(ctx context.Context) *logrus.Entry {
 }
 
 func ConfigureDefaultLogger(level string) error {
-	switch level {
-	case "debug":
-		logrus.SetLevel(logrus.DebugLevel)
-	case "":
-		fallthrough
-	case "info":
-		logrus.SetLevel(logrus.InfoLevel)
-	case "warn":
-		logrus.SetLevel(logrus.WarnLevel)
-	case "error":
-		logrus.SetLevel(logrus.ErrorLevel)
-	case "fatal":
-		logrus.SetLevel(logrus.FatalLevel)
-	case "panic":
-		logrus.SetLevel(logrus.PanicLevel)
+	return ConfigureLogger(level, "")
+}
+
+// ConfigureLogger sets the level and the output format (text or json) of
+// the default logger. Text is used when format is empty.
+func ConfigureLogger(level, format string) error {
+	switch format {
+	case "", "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
 	default:
+		return errors.WithStack(errors.New(fmt.Sprintf("Invalid log format %q. Should be one of: text or json.", format)))
+	}
+
+	if level == "" {
+		level = "info"
+	}
+
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
 		return errors.WithStack(errors.New(fmt.Sprintf("Invalid log level %q. Should be one of: debug, info, warn, error, fatal or panic.", level)))
 	}
+	logrus.SetLevel(lvl)
 
 	return nil
 }
@@ -0,0 +1,93 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConfigureLoggerJSON(t *testing.T) {
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+	defer ConfigureDefaultLogger("")
+
+	if err := ConfigureLogger("debug", "json"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	ctx := WithLogger(context.Background(), GetLogger(context.Background()).WithField("exported.name", "/redis"))
+	GetLogger(ctx).Debug("Exporter started.")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a JSON log entry, got %q: %v", out.String(), err)
+	}
+
+	expected := map[string]string{
+		"level":         "debug",
+		"msg":           "Exporter started.",
+		"exported.name": "/redis",
+	}
+	for field, value := range expected {
+		if entry[field] != value {
+			t.Errorf("expected field %q to be %q, got %v", field, value, entry[field])
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("expected the entry to have a time field")
+	}
+}
+
+func TestConfigureLoggerRejectsInvalidFormat(t *testing.T) {
+	defer ConfigureDefaultLogger("")
+
+	if err := ConfigureLogger("info", "xml"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestConfigureDefaultLoggerLevel(t *testing.T) {
+	defer ConfigureDefaultLogger("")
+
+	testcases := map[string]struct {
+		level     string
+		expected  logrus.Level
+		expectErr bool
+	}{
+		"defaults to info": {level: "", expected: logrus.InfoLevel},
+		"debug":            {level: "debug", expected: logrus.DebugLevel},
+		"warn":             {level: "warn", expected: logrus.WarnLevel},
+		"warning alias":    {level: "warning", expected: logrus.WarnLevel},
+		"case insensitive": {level: "ERROR", expected: logrus.ErrorLevel},
+		"typo":             {level: "degub", expectErr: true},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			logrus.SetLevel(logrus.PanicLevel)
+
+			err := ConfigureDefaultLogger(tc.level)
+			if tc.expectErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				if logrus.GetLevel() != logrus.PanicLevel {
+					t.Errorf("expected the level to be left untouched, got %s", logrus.GetLevel())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if got := logrus.GetLevel(); got != tc.expected {
+				t.Errorf("expected level %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package metrics
+
+// This package implements the small subset of the Prometheus text exposition
+// format needed to expose prom-autoexporter internal metrics.
+// @see https://prometheus.io/docs/instrumenting/exposition_formats/
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+type registry struct {
+	mutex      sync.RWMutex
+	collectors map[string]collector
+}
+
+var (
+	defaultRegistry = &registry{
+		collectors: make(map[string]collector, 0),
+	}
+)
+
+func (r *registry) register(c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.collectors[c.name()]; ok {
+		panic(fmt.Sprintf("metric %q already registered", c.name()))
+	}
+
+	r.collectors[c.name()] = c
+}
+
+func (r *registry) write(w io.Writer) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.collectors[name].write(w)
+	}
+}
+
+// Handler returns an http.Handler serving all the registered metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		defaultRegistry.write(w)
+	})
+}
+
+type Gauge struct {
+	mutex sync.RWMutex
+	n     string
+	help  string
+	value float64
+}
+
+// NewGauge creates a new gauge and registers it into the default registry
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{n: name, help: help}
+	defaultRegistry.register(g)
+
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.value = v
+}
+
+func (g *Gauge) Value() float64 {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return g.value
+}
+
+func (g *Gauge) name() string {
+	return g.n
+}
+
+func (g *Gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.n, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.n)
+	fmt.Fprintf(w, "%s %v\n", g.n, g.Value())
+}
+
+type Counter struct {
+	mutex sync.RWMutex
+	n     string
+	help  string
+	value float64
+}
+
+// NewCounter creates a new counter and registers it into the default registry
+func NewCounter(name, help string) *Counter {
+	c := &Counter{n: name, help: help}
+	defaultRegistry.register(c)
+
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increases the counter by v, which has to be positive
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.value += v
+}
+
+func (c *Counter) Value() float64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.value
+}
+
+func (c *Counter) name() string {
+	return c.n
+}
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", c.n, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.n)
+	fmt.Fprintf(w, "%s %v\n", c.n, c.Value())
+}
+
+// DefaultBuckets are the upper bounds, in seconds, used by histograms created
+// without explicit buckets. They range from 1 minute to 1 week.
+var DefaultBuckets = []float64{60, 300, 900, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600}
+
+type Histogram struct {
+	mutex   sync.RWMutex
+	n       string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram creates a new histogram and registers it into the default
+// registry. Buckets have to be sorted in increasing order, DefaultBuckets
+// are used when none are provided.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	h := &Histogram{
+		n:       name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	defaultRegistry.register(h)
+
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Count returns the number of observations made so far
+func (h *Histogram) Count() uint64 {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.count
+}
+
+func (h *Histogram) name() string {
+	return h.n
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.n, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.n)
+	for i, upperBound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.n, upperBound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.n, h.count)
+	fmt.Fprintf(w, "%s_sum %v\n", h.n, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.n, h.count)
+}
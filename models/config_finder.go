@@ -0,0 +1,218 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// exportersConfig is the format of the file describing custom exporters,
+// written either in JSON or in YAML when its extension is .yml or .yaml, e.g.:
+//
+//	{
+//	  "exporters": {
+//	    "myapp": {
+//	      "match": {"image": "^mycompany/myapp:", "labels": {"app": "myapp"}},
+//	      "image": "mycompany/myapp-exporter:1.0.0",
+//	      "cmd": ["--target=localhost:8080"],
+//	      "env": ["APP_NAME={{ .Name }}"],
+//	      "port": "9100",
+//	      "user": "1000"
+//	    }
+//	  }
+//	}
+type exportersConfig struct {
+	Exporters map[string]exporterConfig `json:"exporters" yaml:"exporters"`
+}
+
+type exporterConfig struct {
+	Match         matchConfig `json:"match" yaml:"match"`
+	Image         string      `json:"image" yaml:"image"`
+	Entrypoint    []string    `json:"entrypoint" yaml:"entrypoint"`
+	Cmd           []string    `json:"cmd" yaml:"cmd"`
+	Env           []string    `json:"env" yaml:"env"`
+	Port          string      `json:"port" yaml:"port"`
+	User          string      `json:"user" yaml:"user"`
+	ScrapeTimeout string      `json:"scrape_timeout" yaml:"scrape_timeout"`
+	Init          bool        `json:"init" yaml:"init"`
+	ShareUTS      bool        `json:"share_uts" yaml:"share_uts"`
+	// Templates of the containers whose namespaces are shared with the
+	// exporter, and through which the exporter is scraped
+	NamespaceTarget string `json:"namespace_target" yaml:"namespace_target"`
+	ScrapeTarget    string `json:"scrape_target" yaml:"scrape_target"`
+	// Either shared-netns (the default) or network
+	NetworkMode string `json:"network_mode" yaml:"network_mode"`
+	// Either Always or IfNotPresent, derived from the image tag when empty
+	PullPolicy string `json:"pull_policy" yaml:"pull_policy"`
+	// Labels the exported container must have for the exporter to run
+	RequiredLabels []string `json:"required_labels" yaml:"required_labels"`
+	// Binds mounted into the exporter, e.g. /etc/snmp:/etc/snmp:ro
+	Binds []string `json:"binds" yaml:"binds"`
+	// Env vars the exporter reads from the file their _FILE variant points
+	// to, e.g. DATA_SOURCE_NAME when it supports DATA_SOURCE_NAME_FILE
+	FileEnv []string `json:"file_env" yaml:"file_env"`
+	// Template of the address of a central exporter the exported container
+	// is registered to, instead of running an exporter container
+	CentralAddress string `json:"central_address" yaml:"central_address"`
+}
+
+// All the rules provided have to match. A definition without any rule never
+// matches, but can still be selected through the exporter label.
+type matchConfig struct {
+	// Regexp matched against the container name
+	Name string `json:"name" yaml:"name"`
+	// Regexp matched against the container image
+	Image string `json:"image" yaml:"image"`
+	// Case-insensitively contained in the repository of the container image,
+	// or equal to its last path component when exact_repository is true
+	Repository      string `json:"repository" yaml:"repository"`
+	ExactRepository bool   `json:"exact_repository" yaml:"exact_repository"`
+	// Labels the container should have, an empty value matching any value
+	Labels map[string]string `json:"labels" yaml:"labels"`
+}
+
+// LoadConfigFinder reads the JSON or YAML file at the given path and returns
+// an ExporterFinder for the exporters it describes
+func LoadConfigFinder(path string) (ExporterFinder, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var config exportersConfig
+	if err := decodeConfig(path, content, &config); err != nil {
+		return nil, errors.Wrapf(err, "invalid exporters config file %q", path)
+	}
+
+	definitions := make(map[string]exporterDefinition, len(config.Exporters))
+	for exporterType, c := range config.Exporters {
+		definition, err := c.toDefinition()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid exporter %q in %q", exporterType, path)
+		}
+
+		definitions[exporterType] = definition
+	}
+
+	return newDefinitionFinder(definitions), nil
+}
+
+// decodeConfig decodes the given content as YAML when path has a .yml or
+// .yaml extension, as JSON otherwise. Unknown fields are rejected.
+func decodeConfig(path string, content []byte, config *exportersConfig) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return yaml.UnmarshalStrict(content, config)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(config)
+}
+
+func (c exporterConfig) toDefinition() (exporterDefinition, error) {
+	if c.Image == "" {
+		return exporterDefinition{}, errors.New("image is required")
+	}
+	if c.Port == "" {
+		return exporterDefinition{}, errors.New("port is required")
+	}
+	switch c.PullPolicy {
+	case "", PullPolicyAlways, PullPolicyIfNotPresent:
+	default:
+		return exporterDefinition{}, errors.Errorf("invalid pull policy %q", c.PullPolicy)
+	}
+	switch c.NetworkMode {
+	case "", NetworkModeSharedNetns, NetworkModeNetwork:
+	default:
+		return exporterDefinition{}, errors.Errorf("invalid network mode %q", c.NetworkMode)
+	}
+
+	matcher, err := newConfigMatcher(c.Match)
+	if err != nil {
+		return exporterDefinition{}, err
+	}
+
+	return exporterDefinition{
+		matcher:         matcher,
+		image:           c.Image,
+		entrypoint:      c.Entrypoint,
+		cmd:             c.Cmd,
+		envVars:         c.Env,
+		exporterPort:    c.Port,
+		scrapeTimeout:   c.ScrapeTimeout,
+		user:            c.User,
+		init:            c.Init,
+		shareUTS:        c.ShareUTS,
+		namespaceTarget: c.NamespaceTarget,
+		scrapeTarget:    c.ScrapeTarget,
+		networkMode:     c.NetworkMode,
+		pullPolicy:      c.PullPolicy,
+		requiredLabels:  c.RequiredLabels,
+		binds:           c.Binds,
+		fileEnvVars:     c.FileEnv,
+		centralAddress:  c.CentralAddress,
+	}, nil
+}
+
+type configMatcher struct {
+	name       *regexp.Regexp
+	image      *regexp.Regexp
+	repository *imageMatcher
+	labels     map[string]string
+}
+
+func newConfigMatcher(c matchConfig) (configMatcher, error) {
+	m := configMatcher{labels: c.Labels}
+
+	var err error
+	if c.Name != "" {
+		if m.name, err = regexp.Compile(c.Name); err != nil {
+			return configMatcher{}, errors.Wrap(err, "invalid name matcher")
+		}
+	}
+	if c.Image != "" {
+		if m.image, err = regexp.Compile(c.Image); err != nil {
+			return configMatcher{}, errors.Wrap(err, "invalid image matcher")
+		}
+	}
+	if c.Repository != "" {
+		repository := newImageMatcher(c.Repository)
+		if c.ExactRepository {
+			repository = newExactImageMatcher(c.Repository)
+		}
+		m.repository = &repository
+	}
+
+	return m, nil
+}
+
+func (m configMatcher) match(exported TaskToExport) bool {
+	if m.name == nil && m.image == nil && m.repository == nil && len(m.labels) == 0 {
+		return false
+	}
+
+	if m.name != nil && !m.name.MatchString(exported.Name) {
+		return false
+	}
+
+	if m.image != nil && !m.image.MatchString(exported.Image) {
+		return false
+	}
+
+	if m.repository != nil && !m.repository.match(exported) {
+		return false
+	}
+
+	if len(m.labels) > 0 && !newLabelMatcher(m.labels).match(exported) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,418 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoadConfigFinder(t *testing.T) {
+	finder, err := LoadConfigFinder("testdata/exporters.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	exported := exportedTask("/myapp", "mycompany/myapp:3.1", map[string]string{"app": "myapp", "env": "prod"})
+	exporters, errs := finder.FindMatchingExporters(exported)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(exporters) != 1 {
+		t.Fatalf("expected only myapp exporter to match, got %v", exporters)
+	}
+
+	exporter, ok := exporters["myapp"]
+	if !ok {
+		t.Fatalf("expected myapp exporter to match, got %v", exporters)
+	}
+	if exporter.Image != "mycompany/myapp-exporter:1.0.0" {
+		t.Errorf("unexpected image %q", exporter.Image)
+	}
+	if expected := []string{"--target=localhost:8080", "--name=/myapp"}; !reflect.DeepEqual(exporter.Cmd, expected) {
+		t.Errorf("expected cmd %v, got %v", expected, exporter.Cmd)
+	}
+	if expected := []string{"APP_ENV=prod"}; !reflect.DeepEqual(exporter.EnvVars, expected) {
+		t.Errorf("expected env %v, got %v", expected, exporter.EnvVars)
+	}
+	if exporter.Port != "9100" || exporter.User != "nobody" || exporter.ScrapeTimeout != "20s" {
+		t.Errorf("unexpected port %q, user %q or scrape timeout %q", exporter.Port, exporter.User, exporter.ScrapeTimeout)
+	}
+}
+
+func TestLoadYAMLConfigFinder(t *testing.T) {
+	jsonFinder, err := LoadConfigFinder("testdata/exporters.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	yamlFinder, err := LoadConfigFinder("testdata/exporters.yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	exported := exportedTask("/myapp", "mycompany/myapp:3.1", map[string]string{"app": "myapp", "env": "prod"})
+	expected, _ := jsonFinder.FindMatchingExporters(exported)
+	exporters, errs := yamlFinder.FindMatchingExporters(exported)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !reflect.DeepEqual(exporters, expected) {
+		t.Errorf("expected the YAML config to describe the same exporters as the JSON one: %+v, got %+v", expected, exporters)
+	}
+
+	f, err := ioutil.TempFile("", "exporters-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("exporters:\n  myapp:\n    image: myapp-exporter\n    port: \"9100\"\n    ports: \"9100\"\n")
+	f.Close()
+
+	if _, err := LoadConfigFinder(f.Name()); err == nil {
+		t.Error("expected unknown fields to be rejected")
+	}
+}
+
+func TestConfigFinderMatchRules(t *testing.T) {
+	finder, err := LoadConfigFinder("testdata/exporters.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	testcases := map[string]struct {
+		name     string
+		image    string
+		labels   map[string]string
+		expected []string
+	}{
+		"all rules have to match": {
+			name:     "/myapp",
+			image:    "mycompany/myapp:3.1",
+			labels:   map[string]string{"app": "other"},
+			expected: []string{},
+		},
+		"image regexp": {
+			name:     "/myapp",
+			image:    "othercompany/myapp:3.1",
+			labels:   map[string]string{"app": "myapp"},
+			expected: []string{},
+		},
+		"name regexp": {
+			name:     "/stack_worker.1",
+			image:    "mycompany/worker:1.0",
+			expected: []string{"worker"},
+		},
+		"definitions without rules never match": {
+			name:     "/manual",
+			image:    "mycompany/manual:1.0",
+			expected: []string{},
+		},
+	}
+
+	for tcname, tc := range testcases {
+		t.Run(tcname, func(t *testing.T) {
+			exporters, _ := finder.FindMatchingExporters(exportedTask(tc.name, tc.image, tc.labels))
+
+			found := []string{}
+			for exporterType := range exporters {
+				found = append(found, exporterType)
+			}
+			if !reflect.DeepEqual(found, tc.expected) {
+				t.Errorf("expected %v to match, got %v", tc.expected, found)
+			}
+		})
+	}
+
+	// Definitions without rules can still be selected explicitly
+	if _, err := finder.GetExporter("manual", exportedTask("/manual", "mycompany/manual:1.0", nil)); err != nil {
+		t.Errorf("unexpected error: %+v", err)
+	}
+}
+
+func TestChainFinderPrecedence(t *testing.T) {
+	custom, err := LoadConfigFinder("testdata/exporters.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	override := newDefinitionFinder(map[string]exporterDefinition{
+		"worker": {
+			matcher:      newRegexpMatcher("worker"),
+			image:        "override/worker-exporter",
+			exporterPort: "9201",
+		},
+	})
+	finder := NewChainFinder(override, custom, NewPredefinedExporterFinder())
+
+	exporters, _ := finder.FindMatchingExporters(exportedTask("/worker", "mycompany/worker:1.0", nil))
+	if exporters["worker"].Image != "override/worker-exporter" {
+		t.Errorf("expected the first finder to take precedence, got %q", exporters["worker"].Image)
+	}
+
+	exporter, err := finder.GetExporter("redis", exportedTask("/cache", "redis:5", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if exporter.Image != "oliver006/redis_exporter:v0.25.0" {
+		t.Errorf("expected predefined exporters to be composable, got %q", exporter.Image)
+	}
+
+	if _, err := finder.GetExporter("unknown", exportedTask("/cache", "redis:5", nil)); !IsErrPredefinedExporterNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestLoadConfigFinderRejectsInvalidConfig(t *testing.T) {
+	testcases := map[string]string{
+		"unknown field":        `{"exporters": {"myapp": {"image": "myapp-exporter", "port": "9100", "ports": "9100"}}}`,
+		"missing image":        `{"exporters": {"myapp": {"port": "9100"}}}`,
+		"missing port":         `{"exporters": {"myapp": {"image": "myapp-exporter"}}}`,
+		"invalid regexp":       `{"exporters": {"myapp": {"image": "myapp-exporter", "port": "9100", "match": {"name": "("}}}}`,
+		"invalid network mode": `{"exporters": {"myapp": {"image": "myapp-exporter", "port": "9100", "network_mode": "host"}}}`,
+	}
+
+	for tcname, content := range testcases {
+		t.Run(tcname, func(t *testing.T) {
+			path := writeTempConfig(t, content)
+			defer os.Remove(path)
+
+			if _, err := LoadConfigFinder(path); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func writeTempConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "exporters-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestConfigFinderFileEnvVars(t *testing.T) {
+	path := writeTempConfig(t, `{"exporters": {"myapp": {
+		"image": "myapp-exporter",
+		"port": "9100",
+		"file_env": ["DATA_SOURCE_NAME"]
+	}}}`)
+	defer os.Remove(path)
+
+	finder, err := LoadConfigFinder(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	exporter, err := finder.GetExporter("myapp", NewTaskToExport("app-id", "/app", "app:1", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if expected := []string{"DATA_SOURCE_NAME"}; !reflect.DeepEqual(exporter.FileEnvVars, expected) {
+		t.Errorf("expected file env vars %v, got %v", expected, exporter.FileEnvVars)
+	}
+}
+
+func TestConfigFinderEntrypointLabelsAreScopedByType(t *testing.T) {
+	path := writeTempConfig(t, `{"exporters": {
+		"myapp": {"match": {"name": "^/app$"}, "image": "myapp-exporter", "port": "9100"},
+		"envoy": {"match": {"name": "^/app$"}, "image": "envoy-exporter", "port": "9901"}
+	}}`)
+	defer os.Remove(path)
+
+	finder, err := LoadConfigFinder(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	exported := NewTaskToExport("app-id", "/app", "app:1", map[string]string{
+		"autoexporter.envoy.entrypoint": `["/wrapper.sh"]`,
+	})
+	exporters, errs := finder.FindMatchingExporters(exported)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(exporters) != 2 {
+		t.Fatalf("expected 2 exporters, got %d", len(exporters))
+	}
+	if entrypoint := exporters["envoy"].Entrypoint; !reflect.DeepEqual(entrypoint, []string{"/wrapper.sh"}) {
+		t.Errorf("expected envoy exporter entrypoint [/wrapper.sh], got %v", entrypoint)
+	}
+	if entrypoint := exporters["myapp"].Entrypoint; entrypoint != nil {
+		t.Errorf("expected myapp exporter to keep its image entrypoint, got %v", entrypoint)
+	}
+}
+
+func TestConfigFinderNamespaceAndScrapeTargets(t *testing.T) {
+	path := writeTempConfig(t, `{"exporters": {"envoy": {
+		"match": {"name": "^/app$"},
+		"image": "envoy-exporter",
+		"port": "9901",
+		"namespace_target": "{{ .Name }}-proxy",
+		"scrape_target": "{{ .Name }}-gateway"
+	}}}`)
+	defer os.Remove(path)
+
+	finder, err := LoadConfigFinder(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	exporter, err := finder.GetExporter("envoy", NewTaskToExport("app-id", "/app", "app:1", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if got := exporter.NamespaceTargetID(); got != "/app-proxy" {
+		t.Errorf("expected namespace target %q, got %q", "/app-proxy", got)
+	}
+	if got := exporter.ScrapeTargetName(); got != "/app-gateway" {
+		t.Errorf("expected scrape target %q, got %q", "/app-gateway", got)
+	}
+
+	// Both default to the exported task
+	exporter.NamespaceTarget, exporter.ScrapeTarget = "", ""
+	if got := exporter.NamespaceTargetID(); got != "app-id" {
+		t.Errorf("expected namespace target to default to the exported ID, got %q", got)
+	}
+	if got := exporter.ScrapeTargetName(); got != "/app" {
+		t.Errorf("expected scrape target to default to the exported name, got %q", got)
+	}
+}
+
+func TestConfigFinderRequiredLabels(t *testing.T) {
+	path := writeTempConfig(t, `{"exporters": {"mysql": {
+		"match": {"name": "^/db$"},
+		"image": "mysqld-exporter",
+		"port": "9104",
+		"required_labels": ["mysql.dsn", "mysql.user"]
+	}}}`)
+	defer os.Remove(path)
+
+	finder, err := LoadConfigFinder(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	exported := NewTaskToExport("db-id", "/db", "mysql:8", map[string]string{"mysql.dsn": "tcp(db:3306)/"})
+	exporters, errs := finder.FindMatchingExporters(exported)
+	if len(exporters) != 0 {
+		t.Errorf("expected no exporter, got %+v", exporters)
+	}
+	if len(errs) != 1 || !IsErrMissingRequiredLabels(errs[0]) {
+		t.Fatalf("expected a missing required labels error, got %v", errs)
+	}
+	if expected := `exporter "mysql" can't run for "/db", required labels are missing: mysql.user`; errs[0].Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, errs[0].Error())
+	}
+
+	exported.Labels["mysql.user"] = "exporter"
+	exporters, errs = finder.FindMatchingExporters(exported)
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if _, ok := exporters["mysql"]; !ok {
+		t.Error("expected the exporter to be built once required labels are present")
+	}
+}
+
+func TestConfigFinderNetworkMode(t *testing.T) {
+	path := writeTempConfig(t, `{"exporters": {"mysql": {
+		"match": {"name": "^/db$"},
+		"image": "mysqld-exporter",
+		"port": "9104",
+		"network_mode": "network",
+		"scrape_target": "{{ .Name }}-gateway"
+	}}}`)
+	defer os.Remove(path)
+
+	finder, err := LoadConfigFinder(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	exporter, err := finder.GetExporter("mysql", NewTaskToExport("db-id", "/db", "mysql:8", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if !exporter.HasOwnNetns() {
+		t.Fatalf("expected the exporter to run in its own network namespace")
+	}
+	// The exporter is scraped directly, the scrape target is ignored
+	if got := exporter.ScrapeTargetName(); got != exporter.Name {
+		t.Errorf("expected the exporter to be its own scrape target, got %q", got)
+	}
+
+	shared := exporter
+	shared.NetworkMode = NetworkModeSharedNetns
+	if shared.HasOwnNetns() || shared.SpecHash() == exporter.SpecHash() {
+		t.Errorf("expected the network mode to be part of the exporter spec")
+	}
+}
+
+func TestConfigFinderRepositoryRules(t *testing.T) {
+	path := writeTempConfig(t, `{"exporters": {
+		"redis": {"match": {"repository": "Redis"}, "image": "redis-exporter", "port": "9121"},
+		"sentinel": {"match": {"repository": "redis-sentinel", "exact_repository": true}, "image": "sentinel-exporter", "port": "9355"}
+	}}`)
+	defer os.Remove(path)
+
+	finder, err := LoadConfigFinder(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	testcases := map[string][]string{
+		"docker.io/library/redis:7":          {"redis"},
+		"bitnami/redis-sentinel:5":           {"redis", "sentinel"},
+		"mycompany/redis-sentinel-proxy:1.0": {"redis"},
+		"memcached:1.5":                      {},
+	}
+
+	for image, expected := range testcases {
+		image, expected := image, expected
+		t.Run(image, func(t *testing.T) {
+			exporters, _ := finder.FindMatchingExporters(exportedTask("/app", image, nil))
+
+			found := []string{}
+			for exporterType := range exporters {
+				found = append(found, exporterType)
+			}
+			sort.Strings(found)
+			if !reflect.DeepEqual(found, expected) {
+				t.Errorf("expected %v to match, got %v", expected, found)
+			}
+		})
+	}
+}
+
+func TestConfigFinderBinds(t *testing.T) {
+	path := writeTempConfig(t, `{"exporters": {"snmp": {
+		"match": {"name": "^/router$"},
+		"image": "prom/snmp-exporter",
+		"port": "9116",
+		"binds": ["/etc/snmp/{{ .Labels.site }}.yml:/etc/snmp_exporter/snmp.yml:ro"]
+	}}}`)
+	defer os.Remove(path)
+
+	finder, err := LoadConfigFinder(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	exporter, err := finder.GetExporter("snmp", exportedTask("/router", "router:1", map[string]string{"site": "paris"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if expected := []string{"/etc/snmp/paris.yml:/etc/snmp_exporter/snmp.yml:ro"}; !reflect.DeepEqual(exporter.Binds, expected) {
+		t.Errorf("expected binds %v, got %v", expected, exporter.Binds)
+	}
+}
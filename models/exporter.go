@@ -1,7 +1,29 @@
 package models
 
 import (
-	"github.com/docker/docker/api/types"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The exporter image is pulled each time the exporter is started
+	PullPolicyAlways = "Always"
+	// The exporter image is pulled only when missing locally
+	PullPolicyIfNotPresent = "IfNotPresent"
+)
+
+const (
+	// The exporter joins the network namespace of its namespace target and
+	// is scraped through its scrape target
+	NetworkModeSharedNetns = "shared-netns"
+	// The exporter runs in its own network namespace on the Prometheus
+	// networks, reaches the exported container by name and is scraped
+	// directly
+	NetworkModeNetwork = "network"
 )
 
 type Exporter struct {
@@ -10,18 +32,208 @@ type Exporter struct {
 	Image          string
 	Cmd            []string
 	EnvVars        []string
-	PromNetwork    string
-	Exported       types.ContainerJSON
+	PromNetworks   []string
+	Exported       TaskToExport
+	// Entrypoint overrides the one of the image when not empty
+	Entrypoint []string
+	// Port on which the exporter exposes its metrics
+	Port string
+	// User running the exporter process, the default one is used when empty
+	User string
+	// Init runs an init process inside the exporter container, to reap zombies
+	Init bool
+	// ShareUTS makes the exporter share the UTS namespace (hostname) of the
+	// exported container
+	ShareUTS bool
+	// NamespaceTarget is the container whose namespaces are shared with the
+	// exporter. Defaults to the exported container when empty.
+	NamespaceTarget string
+	// ScrapeTarget is the container through which Prometheus scrapes the
+	// exporter. Defaults to the exported container when empty.
+	ScrapeTarget string
+	// NetworkMode is either NetworkModeSharedNetns (when empty) or
+	// NetworkModeNetwork. Namespace and scrape targets are ignored in the
+	// latter mode.
+	NetworkMode string
+	// ScrapeTimeout overrides the global scrape timeout of Prometheus for this
+	// exporter (e.g. "30s"). Empty means the global one is used.
+	ScrapeTimeout string
+	// ScrapeInterval overrides the global scrape interval the same way
+	ScrapeInterval string
+	// ImagePullPolicy is either PullPolicyAlways or PullPolicyIfNotPresent
+	ImagePullPolicy string
+	// ScrapeAuth is translated into cmd flags and env vars at create time
+	ScrapeAuth ScrapeAuth
+	// Files written into the exporter container before it starts, indexed by
+	// absolute path (e.g. config files)
+	Files map[string]string
+	// CentralAddress is the address (host:port) of an exporter run outside of
+	// prom-autoexporter. When set, no exporter container is run and the
+	// exported task is only registered as a target of the central exporter.
+	CentralAddress string
+	// Binds mounted into the exporter container, following Docker format
+	// (e.g. /etc/blackbox:/etc/blackbox:ro)
+	Binds []string
+	// FileEnvVars are the env vars the exporter reads from the file their
+	// _FILE variant points to. Only those can be set from files or secrets.
+	FileEnvVars []string
+	// MetricsPath overrides the path scraped by Prometheus, and ScrapeParams
+	// are added to its query (e.g. for blackbox probes)
+	MetricsPath  string
+	ScrapeParams map[string]string
+	// Status is the state of the exporter container (e.g. running), and
+	// LastError the last error that happened while starting it. They're only
+	// set on exporters listed from the backend.
+	Status    string
+	LastError string
 }
 
-func NewExporter(name, predefinedType, image string, cmd, envVars []string, exported types.ContainerJSON) Exporter {
+func NewExporter(name, predefinedType, image string, cmd, envVars []string, exported TaskToExport) Exporter {
 	return Exporter{
-		Name:           name,
-		PredefinedType: predefinedType,
-		Image:          image,
-		Cmd:            cmd,
-		EnvVars:        envVars,
-		PromNetwork:    "",
-		Exported:       exported,
+		Name:            name,
+		PredefinedType:  predefinedType,
+		Image:           image,
+		Cmd:             cmd,
+		EnvVars:         envVars,
+		Exported:        exported,
+		ImagePullPolicy: defaultPullPolicy(image),
+	}
+}
+
+type errInvalidExporter struct {
+	exporterType string
+	reason       string
+}
+
+func (e errInvalidExporter) Error() string {
+	return fmt.Sprintf("invalid exporter %q: %s", e.exporterType, e.reason)
+}
+
+func IsErrInvalidExporter(e error) bool {
+	_, ok := e.(errInvalidExporter)
+	return ok
+}
+
+// Validate checks that the exporter can be run, such that misconfigurations
+// are reported before any container is created
+func (e Exporter) Validate() error {
+	if e.Name == "" {
+		return errInvalidExporter{e.PredefinedType, "name is required"}
+	}
+	if e.Port == "" {
+		return errInvalidExporter{e.PredefinedType, "port is required"}
+	}
+
+	return e.validateSpec()
+}
+
+// validateSpec checks the properties set by finders. The name is set later,
+// and the port might be defaulted, so they're not required at this point.
+func (e Exporter) validateSpec() error {
+	if e.Image == "" {
+		return errInvalidExporter{e.PredefinedType, "image is required"}
 	}
+	if e.Port != "" {
+		if port, err := strconv.Atoi(e.Port); err != nil || port < 1 || port > 65535 {
+			return errInvalidExporter{e.PredefinedType, fmt.Sprintf("port %q is not a valid port number", e.Port)}
+		}
+	}
+
+	return nil
+}
+
+// defaultPullPolicy returns PullPolicyIfNotPresent for images pinned to a tag
+// or a digest, and PullPolicyAlways for untagged and latest images
+func defaultPullPolicy(image string) string {
+	if strings.Contains(image, "@") {
+		return PullPolicyIfNotPresent
+	}
+
+	// The registry part may contain a port, so only the last path
+	// component is checked
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 && name[i+1:] != "latest" {
+		return PullPolicyIfNotPresent
+	}
+
+	return PullPolicyAlways
+}
+
+// SpecHash returns a hash of the exporter properties applied to its container,
+// such that two exporters with the same hash run the same way
+func (e Exporter) SpecHash() string {
+	spec, _ := json.Marshal(struct {
+		Image           string
+		Entrypoint      []string
+		Cmd             []string
+		EnvVars         []string
+		Port            string
+		User            string
+		Init            bool
+		ShareUTS        bool
+		NamespaceTarget string
+		ScrapeTarget    string
+		NetworkMode     string
+		ScrapeTimeout   string
+		ScrapeInterval  string
+		ScrapeAuth      ScrapeAuth
+		Files           map[string]string
+		Binds           []string
+		MetricsPath     string
+		ScrapeParams    map[string]string
+	}{e.Image, e.Entrypoint, e.Cmd, e.EnvVars, e.Port, e.User, e.Init, e.ShareUTS, e.NamespaceTarget, e.ScrapeTarget, e.NetworkMode, e.ScrapeTimeout, e.ScrapeInterval, e.ScrapeAuth, e.Files, e.Binds, e.MetricsPath, e.ScrapeParams})
+
+	return shortHash(spec)
+}
+
+// SourceHash returns a hash of the exported task properties the exporter
+// config is rendered from, such that the exporter can be recreated when they
+// change
+func (e Exporter) SourceHash() string {
+	source, _ := json.Marshal(struct {
+		Name   string
+		Image  string
+		Labels map[string]string
+	}{e.Exported.Name, e.Exported.Image, e.Exported.Labels})
+
+	return shortHash(source)
+}
+
+func shortHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// NamespaceTargetID returns the ID (or name) of the container whose
+// namespaces are joined by the exporter
+func (e Exporter) NamespaceTargetID() string {
+	if e.NamespaceTarget != "" {
+		return e.NamespaceTarget
+	}
+
+	return e.Exported.ID
+}
+
+// IsCentral checks if the exporter is run outside of prom-autoexporter, such
+// that only its target is registered in service discovery
+func (e Exporter) IsCentral() bool {
+	return e.CentralAddress != ""
+}
+
+// HasOwnNetns checks if the exporter runs in its own network namespace
+func (e Exporter) HasOwnNetns() bool {
+	return e.NetworkMode == NetworkModeNetwork
+}
+
+// ScrapeTargetName returns the name of the container through which
+// Prometheus scrapes the exporter
+func (e Exporter) ScrapeTargetName() string {
+	if e.HasOwnNetns() {
+		return e.Name
+	}
+	if e.ScrapeTarget != "" {
+		return e.ScrapeTarget
+	}
+
+	return e.Exported.Name
 }
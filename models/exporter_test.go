@@ -0,0 +1,212 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSourceHash(t *testing.T) {
+	exporter := NewExporter("", "mysql", "mysqld_exporter", nil, nil, exportedTask("/db", "mysql:8", map[string]string{"autoexporter.dsn": "root@db:3306"}))
+	hash := exporter.SourceHash()
+
+	testcases := map[string]struct {
+		exported TaskToExport
+		changed  bool
+	}{
+		"same source": {
+			exported: exportedTask("/db", "mysql:8", map[string]string{"autoexporter.dsn": "root@db:3306"}),
+			changed:  false,
+		},
+		"source label changed": {
+			exported: exportedTask("/db", "mysql:8", map[string]string{"autoexporter.dsn": "root@db:3307"}),
+			changed:  true,
+		},
+		"image changed": {
+			exported: exportedTask("/db", "mysql:8.1", map[string]string{"autoexporter.dsn": "root@db:3306"}),
+			changed:  true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			other := exporter
+			other.Exported = tc.exported
+
+			if changed := other.SourceHash() != hash; changed != tc.changed {
+				t.Errorf("expected source hash change to be %v, got %v", tc.changed, changed)
+			}
+			if other.SpecHash() != exporter.SpecHash() {
+				t.Errorf("expected spec hash not to depend on the exported task")
+			}
+		})
+	}
+}
+
+func TestSpecHashCoversScrapeSettings(t *testing.T) {
+	exporter := NewExporter("", "blackbox", "prom/blackbox-exporter", nil, nil, TaskToExport{})
+	exporter.MetricsPath = "/probe"
+	exporter.ScrapeParams = map[string]string{"module": "tcp_connect"}
+	hash := exporter.SpecHash()
+
+	testcases := map[string]func(e *Exporter){
+		"metrics path changed": func(e *Exporter) {
+			e.MetricsPath = "/metrics"
+		},
+		"scrape param changed": func(e *Exporter) {
+			e.ScrapeParams = map[string]string{"module": "http_2xx"}
+		},
+	}
+
+	for tcname, change := range testcases {
+		change := change
+		t.Run(tcname, func(t *testing.T) {
+			other := exporter
+			change(&other)
+
+			if other.SpecHash() == hash {
+				t.Errorf("expected spec hash to change")
+			}
+		})
+	}
+}
+
+func TestDefaultPullPolicy(t *testing.T) {
+	testcases := map[string]struct {
+		image    string
+		expected string
+	}{
+		"tagged image":            {image: "oliver006/redis_exporter:v1.0.0", expected: PullPolicyIfNotPresent},
+		"image pinned by digest":  {image: "redis_exporter@sha256:abcdef", expected: PullPolicyIfNotPresent},
+		"latest image":            {image: "oliver006/redis_exporter:latest", expected: PullPolicyAlways},
+		"untagged image":          {image: "oliver006/redis_exporter", expected: PullPolicyAlways},
+		"registry with port only": {image: "registry:5000/redis_exporter", expected: PullPolicyAlways},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exporter := NewExporter("", "redis", tc.image, nil, nil, TaskToExport{})
+			if exporter.ImagePullPolicy != tc.expected {
+				t.Errorf("expected pull policy %q, got %q", tc.expected, exporter.ImagePullPolicy)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testcases := map[string]struct {
+		name    string
+		image   string
+		port    string
+		invalid bool
+	}{
+		"valid exporter": {
+			name:  "/exporter.redis.redis",
+			image: "oliver006/redis_exporter:v0.25.0",
+			port:  "9121",
+		},
+		"missing name": {
+			image:   "oliver006/redis_exporter:v0.25.0",
+			port:    "9121",
+			invalid: true,
+		},
+		"missing image": {
+			name:    "/exporter.redis.redis",
+			port:    "9121",
+			invalid: true,
+		},
+		"missing port": {
+			name:    "/exporter.redis.redis",
+			image:   "oliver006/redis_exporter:v0.25.0",
+			invalid: true,
+		},
+		"non-numeric port": {
+			name:    "/exporter.redis.redis",
+			image:   "oliver006/redis_exporter:v0.25.0",
+			port:    "redis",
+			invalid: true,
+		},
+		"out of range port": {
+			name:    "/exporter.redis.redis",
+			image:   "oliver006/redis_exporter:v0.25.0",
+			port:    "65536",
+			invalid: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exporter := NewExporter(tc.name, "redis", tc.image, nil, nil, exportedTask("/redis", "redis:5", nil))
+			exporter.Port = tc.port
+
+			err := exporter.Validate()
+			if tc.invalid && !IsErrInvalidExporter(err) {
+				t.Errorf("expected an invalid exporter error, got %v", err)
+			} else if !tc.invalid && err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		})
+	}
+}
+
+func TestFinderRejectsInvalidExporters(t *testing.T) {
+	finder := newDefinitionFinder(map[string]exporterDefinition{
+		"myapp": {image: "myapp-exporter", exporterPort: "http"},
+	})
+
+	_, err := finder.GetExporter("myapp", exportedTask("/myapp", "myapp:1.0", nil))
+	if !IsErrInvalidExporter(err) {
+		t.Errorf("expected an invalid exporter error, got %v", err)
+	}
+}
+
+func TestEntrypointFromLabels(t *testing.T) {
+	testcases := map[string]struct {
+		labels      map[string]string
+		tpls        []string
+		expected    []string
+		expectedErr bool
+	}{
+		"image entrypoint": {},
+		"definition entrypoint": {
+			labels:   map[string]string{"env": "prod"},
+			tpls:     []string{"/wrapper.sh", "--env={{ .Labels.env }}"},
+			expected: []string{"/wrapper.sh", "--env=prod"},
+		},
+		"label overriding the definition": {
+			labels:   map[string]string{"autoexporter.redis.entrypoint": `["/bin/sh", "-c"]`},
+			tpls:     []string{"/wrapper.sh"},
+			expected: []string{"/bin/sh", "-c"},
+		},
+		"label of another exporter type": {
+			labels:   map[string]string{"autoexporter.nginx.entrypoint": `["/bin/sh", "-c"]`},
+			tpls:     []string{"/wrapper.sh"},
+			expected: []string{"/wrapper.sh"},
+		},
+		"invalid label": {
+			labels:      map[string]string{"autoexporter.redis.entrypoint": "/bin/sh -c"},
+			expectedErr: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			entrypoint, err := entrypointFromLabels(exportedTask("/app", "app:1", tc.labels), "redis", tc.tpls)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(entrypoint, tc.expected) {
+				t.Errorf("expected entrypoint %v, got %v", tc.expected, entrypoint)
+			}
+		})
+	}
+}
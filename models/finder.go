@@ -0,0 +1,223 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Label of the exported task overriding the entrypoint of its exporters of
+// the given type (e.g. autoexporter.redis.entrypoint)
+const labelEntrypointFmt = "autoexporter.%s.entrypoint"
+
+// ExporterFinder resolves which exporters should be run for a given exported
+// container
+type ExporterFinder interface {
+	// FindMatchingExporters returns the exporters matching the given
+	// container, indexed by exporter type. Errors are returned for exporters
+	// matching the container but that can't be built.
+	FindMatchingExporters(exported TaskToExport) (map[string]Exporter, []error)
+	// GetExporter builds the exporter of the given type for the given
+	// container, regardless of its matchers. It returns an error detectable
+	// with IsErrPredefinedExporterNotFound when the type is unknown.
+	GetExporter(exporterType string, exported TaskToExport) (Exporter, error)
+}
+
+type definitionFinder struct {
+	definitions map[string]exporterDefinition
+}
+
+func newDefinitionFinder(definitions map[string]exporterDefinition) definitionFinder {
+	return definitionFinder{definitions}
+}
+
+func (f definitionFinder) FindMatchingExporters(exported TaskToExport) (map[string]Exporter, []error) {
+	exporters := map[string]Exporter{}
+	errs := []error{}
+
+	for exporterType, definition := range f.definitions {
+		if !definition.matcher.match(exported) {
+			continue
+		}
+
+		exporter, err := definition.build(exporterType, exported)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		exporters[exporterType] = exporter
+	}
+
+	return exporters, errs
+}
+
+func (f definitionFinder) GetExporter(exporterType string, exported TaskToExport) (Exporter, error) {
+	definition, ok := f.definitions[exporterType]
+	if !ok {
+		return Exporter{}, newErrPredefinedExporterNotFound(exporterType)
+	}
+
+	return definition.build(exporterType, exported)
+}
+
+func (d exporterDefinition) build(exporterType string, exported TaskToExport) (Exporter, error) {
+	missing := []string{}
+	for _, label := range d.requiredLabels {
+		if _, ok := exported.Labels[label]; !ok {
+			missing = append(missing, label)
+		}
+	}
+	if len(missing) > 0 {
+		return Exporter{}, errMissingRequiredLabels{exporterType, exported.Name, missing}
+	}
+
+	entrypoint, err := entrypointFromLabels(exported, exporterType, d.entrypoint)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	cmd, err := renderSliceOfTpls(d.cmd, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	envVars, err := renderSliceOfTpls(d.envVars, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	namespaceTarget, err := RenderTpl(d.namespaceTarget, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	scrapeTarget, err := RenderTpl(d.scrapeTarget, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	files, err := renderMapOfTpls(d.files, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	binds, err := renderSliceOfTpls(d.binds, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	centralAddress, err := RenderTpl(d.centralAddress, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	metricsPath, err := RenderTpl(d.metricsPath, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	scrapeParams, err := renderMapOfTpls(d.scrapeParams, exported)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	scrapeInterval, scrapeTimeout, err := scrapeHintsFromLabels(exported, "", d.scrapeTimeout)
+	if err != nil {
+		return Exporter{}, err
+	}
+
+	exporter := NewExporter("", exporterType, d.image, cmd, envVars, exported)
+	exporter.Entrypoint = entrypoint
+	exporter.Port = d.exporterPort
+	exporter.ScrapeTimeout = scrapeTimeout
+	exporter.ScrapeInterval = scrapeInterval
+	exporter.User = d.user
+	exporter.Init = d.init
+	exporter.ShareUTS = d.shareUTS
+	exporter.NamespaceTarget = namespaceTarget
+	exporter.ScrapeTarget = scrapeTarget
+	exporter.NetworkMode = d.networkMode
+	exporter.ScrapeAuth = scrapeAuthFromLabels(exported.Labels, d.scrapeAuth)
+	exporter.Files = files
+	exporter.CentralAddress = centralAddress
+	if len(binds) > 0 {
+		exporter.Binds = binds
+	}
+	exporter.FileEnvVars = d.fileEnvVars
+	exporter.MetricsPath = metricsPath
+	exporter.ScrapeParams = scrapeParams
+	if d.pullPolicy != "" {
+		exporter.ImagePullPolicy = d.pullPolicy
+	}
+
+	if err := exporter.validateSpec(); err != nil {
+		return Exporter{}, err
+	}
+
+	return exporter, nil
+}
+
+// entrypointFromLabels returns the entrypoint given by the exported task
+// label of the exporter type, as a JSON array (e.g. ["/wrapper.sh", "--"]),
+// or the rendered entrypoint templates of the definition otherwise
+func entrypointFromLabels(exported TaskToExport, exporterType string, tpls []string) ([]string, error) {
+	label := fmt.Sprintf(labelEntrypointFmt, exporterType)
+	value, ok := exported.Labels[label]
+	if !ok {
+		if len(tpls) == 0 {
+			return nil, nil
+		}
+
+		return renderSliceOfTpls(tpls, exported)
+	}
+
+	var entrypoint []string
+	if err := json.Unmarshal([]byte(value), &entrypoint); err != nil {
+		return nil, errors.Wrapf(err, "invalid label %s on %q, should be a JSON array", label, exported.Name)
+	}
+
+	return entrypoint, nil
+}
+
+type chainFinder struct {
+	finders []ExporterFinder
+}
+
+// NewChainFinder composes multiple finders. When several finders provide an
+// exporter of the same type, the first one takes precedence.
+func NewChainFinder(finders ...ExporterFinder) ExporterFinder {
+	return chainFinder{finders}
+}
+
+func (f chainFinder) FindMatchingExporters(exported TaskToExport) (map[string]Exporter, []error) {
+	exporters := map[string]Exporter{}
+	errs := []error{}
+
+	for _, finder := range f.finders {
+		found, findErrs := finder.FindMatchingExporters(exported)
+		errs = append(errs, findErrs...)
+
+		for exporterType, exporter := range found {
+			if _, ok := exporters[exporterType]; !ok {
+				exporters[exporterType] = exporter
+			}
+		}
+	}
+
+	return exporters, errs
+}
+
+func (f chainFinder) GetExporter(exporterType string, exported TaskToExport) (Exporter, error) {
+	for _, finder := range f.finders {
+		exporter, err := finder.GetExporter(exporterType, exported)
+		if IsErrPredefinedExporterNotFound(err) {
+			continue
+		}
+
+		return exporter, err
+	}
+
+	return Exporter{}, newErrPredefinedExporterNotFound(exporterType)
+}
@@ -1,26 +1,60 @@
 package models
 
 import (
-	"fmt"
-	"regexp"
 	"bufio"
 	"bytes"
-	"html/template"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
 
-	"github.com/docker/docker/api/types"
 	"github.com/pkg/errors"
 )
 
-type predefinedExporter struct {
+type exporterDefinition struct {
 	matcher      exporterMatcher
 	image        string
+	entrypoint   []string
 	cmd          []string
 	envVars      []string
 	exporterPort string
+	// Empty scrapeTimeout means Prometheus global timeout applies
+	scrapeTimeout string
+	// Empty user means the default exporter user is used
+	user string
+	// Whether an init process should run inside the exporter container
+	init bool
+	// Whether the exporter needs the hostname of the exported container
+	shareUTS bool
+	// Templates of the containers whose namespaces are shared with the
+	// exporter and through which it is scraped, both default to the exported one
+	namespaceTarget string
+	scrapeTarget    string
+	// Either NetworkModeSharedNetns (when empty) or NetworkModeNetwork
+	networkMode string
+	// Overrides the pull policy derived from the image when not empty
+	pullPolicy string
+	// Labels the exported task must have for the exporter to be built
+	requiredLabels []string
+	// Overridden by the scrape auth labels of the exported task
+	scrapeAuth ScrapeAuth
+	// Templates of the files written into the exporter, indexed by path
+	files map[string]string
+	// Templates of the binds mounted into the exporter
+	binds []string
+	// Env vars the exporter reads from the file their _FILE variant points to
+	fileEnvVars []string
+	// Template of the address of a central exporter, no container is run
+	// when it renders to a non-empty address
+	centralAddress string
+	// Templates of the path and the query params scraped by Prometheus
+	metricsPath  string
+	scrapeParams map[string]string
 }
 
 type exporterMatcher interface {
-	match(containerName string) bool
+	match(exported TaskToExport) bool
 }
 
 type regexpMatcher struct {
@@ -33,8 +67,27 @@ func newRegexpMatcher(exp string) regexpMatcher {
 	}
 }
 
-func (m regexpMatcher) match(containerName string) bool {
-	return m.regexp.FindStringIndex(containerName) != nil
+func (m regexpMatcher) match(exported TaskToExport) bool {
+	return m.regexp.FindStringIndex(exported.Name) != nil
+}
+
+// anyMatcher matches when at least one of its matchers does
+type anyMatcher struct {
+	matchers []exporterMatcher
+}
+
+func newAnyMatcher(matchers ...exporterMatcher) anyMatcher {
+	return anyMatcher{matchers}
+}
+
+func (m anyMatcher) match(exported TaskToExport) bool {
+	for _, matcher := range m.matchers {
+		if matcher.match(exported) {
+			return true
+		}
+	}
+
+	return false
 }
 
 type boolMatcher struct {
@@ -45,18 +98,83 @@ func newBoolMatcher(val bool) boolMatcher {
 	return boolMatcher{val}
 }
 
-func (m boolMatcher) match(containerName string) bool {
-	return m.value
+// imageMatcher matches against the repository of the exported container
+// image, regardless of its registry, tag or digest, and case-insensitively.
+// The repository contains the given name unless the matcher is exact, in
+// which case its last path component has to be the name (e.g. redis for
+// docker.io/library/redis:7 and bitnami/redis:latest).
+type imageMatcher struct {
+	name  string
+	exact bool
+}
+
+func newImageMatcher(name string) imageMatcher {
+	return imageMatcher{strings.ToLower(name), false}
+}
+
+func newExactImageMatcher(name string) imageMatcher {
+	return imageMatcher{strings.ToLower(name), true}
 }
 
-func FindMatchingExporter(name string) string {
-	for exporterName, predefinedExporter := range predefinedExporters {
-		if predefinedExporter.matcher.match(name) {
-			return exporterName
+func (m imageMatcher) match(exported TaskToExport) bool {
+	repository := imageRepository(exported.Image)
+	if !m.exact {
+		return strings.Contains(repository, m.name)
+	}
+
+	return repository[strings.LastIndex(repository, "/")+1:] == m.name
+}
+
+// imageRepository returns the lowercased repository of the given image
+// reference, without registry, tag or digest (e.g. bitnami/redis for
+// docker.io/bitnami/redis:latest)
+func imageRepository(image string) string {
+	image = strings.ToLower(image)
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	// The first path component is a registry when it looks like a hostname
+	if i := strings.Index(image, "/"); i >= 0 {
+		if host := image[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			image = image[i+1:]
+		}
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	return image
+}
+
+// labelMatcher matches when the exported container has all the given labels.
+// An empty value matches any value.
+type labelMatcher struct {
+	labels map[string]string
+}
+
+func newLabelMatcher(labels map[string]string) labelMatcher {
+	return labelMatcher{labels}
+}
+
+func (m labelMatcher) match(exported TaskToExport) bool {
+	if len(m.labels) == 0 {
+		return false
+	}
+
+	for label, expected := range m.labels {
+		value, ok := exported.Labels[label]
+		if !ok || (expected != "" && value != expected) {
+			return false
 		}
 	}
 
-	return ""
+	return true
+}
+
+func (m boolMatcher) match(exported TaskToExport) bool {
+	return m.value
 }
 
 type errPredefinedExporterNotFound struct {
@@ -76,23 +194,34 @@ func IsErrPredefinedExporterNotFound(e error) bool {
 	return ok
 }
 
-func FromPredefinedExporter(name, predefinedExporter string, exported types.ContainerJSON) (Exporter, error) {
-	p, ok := predefinedExporters[predefinedExporter]
-	if !ok {
-		return Exporter{}, newErrPredefinedExporterNotFound(predefinedExporter)
-	}
+type errMissingRequiredLabels struct {
+	exporterType string
+	exportedName string
+	labels       []string
+}
 
-	cmd, err := renderSliceOfTpls(p.cmd, exported)
-	if err != nil {
-		return Exporter{}, err
-	}
+func (e errMissingRequiredLabels) Error() string {
+	return fmt.Sprintf("exporter %q can't run for %q, required labels are missing: %s", e.exporterType, e.exportedName, strings.Join(e.labels, ", "))
+}
 
-	envVars, err := renderSliceOfTpls(p.envVars, exported)
-	if err != nil {
-		return Exporter{}, err
+func IsErrMissingRequiredLabels(e error) bool {
+	_, ok := e.(errMissingRequiredLabels)
+	return ok
+}
+
+// NewPredefinedExporterFinder returns an ExporterFinder for the exporters
+// shipped with prom-autoexporter, except the disabled types which are neither
+// matched nor selectable through the exporter label
+func NewPredefinedExporterFinder(disabled ...string) ExporterFinder {
+	definitions := make(map[string]exporterDefinition, len(predefinedExporters))
+	for exporterType, definition := range predefinedExporters {
+		definitions[exporterType] = definition
+	}
+	for _, exporterType := range disabled {
+		delete(definitions, exporterType)
 	}
 
-	return NewExporter(name, predefinedExporter, p.image, cmd, envVars, exported), nil
+	return newDefinitionFinder(definitions)
 }
 
 // This function will render multiple templates with the same set of values each time
@@ -102,7 +231,7 @@ func renderSliceOfTpls(tpls []string, values interface{}) ([]string, error) {
 	res := []string{}
 
 	for _, fragment := range tpls {
-		val, err := renderTpl(fragment, values)
+		val, err := RenderTpl(fragment, values)
 		if err != nil {
 			return []string{}, err
 		}
@@ -113,8 +242,41 @@ func renderSliceOfTpls(tpls []string, values interface{}) ([]string, error) {
 	return res, nil
 }
 
-func renderTpl(tplStr string, values interface{}) (string, error) {
-	tpl, err := template.New("").Parse(tplStr)
+// renderMapOfTpls renders the values of the given map of templates, it
+// returns nil for an empty map
+func renderMapOfTpls(tpls map[string]string, values interface{}) (map[string]string, error) {
+	if len(tpls) == 0 {
+		return nil, nil
+	}
+
+	res := make(map[string]string, len(tpls))
+	for key, tpl := range tpls {
+		val, err := RenderTpl(tpl, values)
+		if err != nil {
+			return nil, err
+		}
+
+		res[key] = val
+	}
+
+	return res, nil
+}
+
+// Functions available in exporter templates, in addition to builtin ones
+var tplFuncs = template.FuncMap{
+	"trimPrefix": strings.TrimPrefix,
+	"userinfo":   userinfo,
+}
+
+// userinfo returns the escaped user and password part of an URL
+func userinfo(user, password string) string {
+	return url.UserPassword(user, password).String()
+}
+
+// RenderTpl renders the given template with the given values, using the
+// functions available in exporter templates
+func RenderTpl(tplStr string, values interface{}) (string, error) {
+	tpl, err := template.New("").Funcs(tplFuncs).Parse(tplStr)
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
@@ -132,74 +294,136 @@ func renderTpl(tplStr string, values interface{}) (string, error) {
 	return val, nil
 }
 
-func PredefinedExporterExist(predefinedExporter string) bool {
-	_, ok := predefinedExporters[predefinedExporter]
-	return ok
-}
-
-func GetExporterPort(predefinedExporter string) (string, error) {
-	if _, ok := predefinedExporters[predefinedExporter]; !ok {
-		return "", newErrPredefinedExporterNotFound(predefinedExporter)
-	}
-
-	return predefinedExporters[predefinedExporter].exporterPort, nil
-}
-
 var (
-	predefinedExporters = map[string]predefinedExporter{
-		"redis": predefinedExporter{
-			matcher: newRegexpMatcher("redis"),
+	predefinedExporters = map[string]exporterDefinition{
+		"redis": exporterDefinition{
+			matcher: newAnyMatcher(newRegexpMatcher("redis"), newImageMatcher("redis"), newLabelMatcher(map[string]string{"app": "redis"})),
 			image:   "oliver006/redis_exporter:v0.25.0",
 			cmd: []string{
 				"-redis.addr=redis://localhost:6379",
-				"-redis.alias={{ index .Config.Labels \"com.docker.swarm.service.name\" }}",
-				"-namespace={{ index .Config.Labels \"com.docker.swarm.service.name\" }}",
+				"-redis.alias={{ index .Labels \"com.docker.swarm.service.name\" }}",
+				"-namespace={{ index .Labels \"com.docker.swarm.service.name\" }}",
 			},
-			envVars: []string{},
+			envVars:      []string{},
 			exporterPort: "9121",
 		},
-		"php": predefinedExporter{
-			matcher: newRegexpMatcher("php"),
+		"php": exporterDefinition{
+			matcher: newAnyMatcher(newRegexpMatcher("php"), newImageMatcher("php")),
 			image:   "bakins/php-fpm-exporter:v0.5.0",
 			cmd: []string{
 				"--addr", ":8080",
 				"--fastcgi", "tcp://localhost:9000/_fpm_status",
 			},
-			envVars: []string{},
+			envVars:      []string{},
 			exporterPort: "8080",
 		},
-		"elasticsearch": predefinedExporter{
-			matcher: newRegexpMatcher("elasticsearch"),
+		"elasticsearch": exporterDefinition{
+			matcher: newAnyMatcher(newRegexpMatcher("elasticsearch"), newImageMatcher("elasticsearch")),
 			image:   "justwatch/elasticsearch_exporter:1.0.4rc1",
 			cmd: []string{
 				"-es.uri=http://localhost:9200",
 				"-es.all=false",
 			},
-			envVars: []string{},
+			envVars:      []string{},
 			exporterPort: "9108",
 		},
-		"fluentd": predefinedExporter{
-			matcher: newRegexpMatcher("fluentd?"),
+		"fluentd": exporterDefinition{
+			matcher: newAnyMatcher(newRegexpMatcher("fluentd?"), newImageMatcher("fluent")),
 			image:   "bitnami/fluentd-exporter:0.2.0",
-			cmd:     []string{
+			cmd: []string{
 				"-scrape_uri", "http://localhost:24220/api/plugins.json",
 			},
-			envVars: []string{},
+			envVars:      []string{},
 			exporterPort: "9309",
 		},
-		"nginx": predefinedExporter{
-			matcher: newRegexpMatcher("nginx"),
+		"nginx": exporterDefinition{
+			matcher: newAnyMatcher(newRegexpMatcher("nginx"), newImageMatcher("nginx")),
 			image:   "nginx/nginx-prometheus-exporter:0.2.0",
-			cmd:     []string{
-				"-nginx.scrape-uri", "http://localhost/_status",
+			cmd: []string{
+				// The stub_status path depends on nginx config, so it can be overridden
+				"-nginx.scrape-uri", "{{ or (index .Labels \"autoexporter.nginx.scrape-uri\") \"http://localhost/_status\" }}",
 			},
-			envVars: []string{},
+			envVars:      []string{},
 			exporterPort: "9113",
 		},
-		/* "blackbox": predefinedExporter{
+		"mysql": exporterDefinition{
+			matcher: newAnyMatcher(newImageMatcher("mysql"), newImageMatcher("mariadb")),
+			image:   "prom/mysqld-exporter:v0.11.0",
+			cmd:     []string{},
+			// Unlike postgres DSNs, mysql ones are not URLs: the driver
+			// doesn't unescape credentials, which are thus not escaped
+			envVars: []string{
+				"DATA_SOURCE_NAME=" +
+					"{{ or (index .Labels \"autoexporter.mysql.user\") \"exporter\" }}" +
+					":{{ index .Labels \"autoexporter.mysql.password\" }}" +
+					"@(localhost:3306)/",
+			},
+			exporterPort: "9104",
+		},
+		"postgres": exporterDefinition{
+			matcher: newImageMatcher("postgres"),
+			image:   "wrouesnel/postgres_exporter:v0.4.7",
+			cmd:     []string{},
+			envVars: []string{
+				"DATA_SOURCE_NAME=postgresql://" +
+					"{{ userinfo (or (index .Labels \"autoexporter.postgres.user\") \"postgres\") (index .Labels \"autoexporter.postgres.password\") }}" +
+					"@localhost:5432/postgres" +
+					"?sslmode={{ or (index .Labels \"autoexporter.postgres.sslmode\") \"disable\" | urlquery }}" +
+					"&application_name={{ trimPrefix .Name \"/\" | urlquery }}",
+			},
+			exporterPort: "9187",
+		},
+		// The snmp exporter scrapes network gear through SNMP. It runs for
+		// containers labeled with autoexporter.snmp.target, which is the
+		// address of the device, and walks the module given by
+		// autoexporter.snmp.module. As it's usually deployed centrally, the
+		// device is only registered as a target of the snmp exporter at the
+		// address given by autoexporter.snmp.exporter (e.g. snmp:9116) when
+		// this label is set.
+		"snmp": exporterDefinition{
+			matcher: newLabelMatcher(map[string]string{"autoexporter.snmp.target": ""}),
+			image:   "prom/snmp-exporter:v0.15.0",
+			cmd: []string{
+				"--config.file={{ or (index .Labels \"autoexporter.snmp.config\") \"/etc/snmp_exporter/snmp.yml\" }}",
+			},
+			envVars:        []string{},
+			exporterPort:   "9116",
+			requiredLabels: []string{"autoexporter.snmp.target"},
+			metricsPath:    "/snmp",
+			scrapeParams: map[string]string{
+				"target": "{{ index .Labels \"autoexporter.snmp.target\" }}",
+				"module": "{{ or (index .Labels \"autoexporter.snmp.module\") \"if_mib\" }}",
+			},
+			centralAddress: "{{ index .Labels \"autoexporter.snmp.exporter\" }}",
+		},
+		// The blackbox exporter probes services without native metrics. It's
+		// only selected through the exporter label, and probes the port given
+		// by autoexporter.blackbox.port with the module given by
+		// autoexporter.blackbox.module (http_2xx or tcp_connect).
+		"blackbox": exporterDefinition{
 			matcher: newBoolMatcher(false),
 			image:   "prom/blackbox-exporter:v0.13.0",
-			cmd:     []string{},
-		}, */
+			cmd: []string{
+				"--config.file=/etc/blackbox_exporter/autoexporter.yml",
+			},
+			envVars:      []string{},
+			exporterPort: "9115",
+			files: map[string]string{
+				"/etc/blackbox_exporter/autoexporter.yml": "modules:\n" +
+					"  http_2xx:\n" +
+					"    prober: http\n" +
+					"    timeout: {{ or (index .Labels \"autoexporter.blackbox.timeout\") \"5s\" }}\n" +
+					"  tcp_connect:\n" +
+					"    prober: tcp\n" +
+					"    timeout: {{ or (index .Labels \"autoexporter.blackbox.timeout\") \"5s\" }}\n",
+			},
+			metricsPath: "/probe",
+			scrapeParams: map[string]string{
+				"module": "{{ or (index .Labels \"autoexporter.blackbox.module\") \"http_2xx\" }}",
+				"target": "{{ if eq (or (index .Labels \"autoexporter.blackbox.module\") \"http_2xx\") \"http_2xx\" }}http://{{ end }}" +
+					"localhost:{{ or (index .Labels \"autoexporter.blackbox.port\") \"80\" }}" +
+					"{{ index .Labels \"autoexporter.blackbox.path\" }}",
+			},
+		},
 	}
 )
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ScrapeAuthNone   = "none"
+	ScrapeAuthBasic  = "basic"
+	ScrapeAuthBearer = "bearer"
+	ScrapeAuthTLS    = "tls"
+
+	// Labels of the exported container overriding the scrape auth of its
+	// exporters, e.g. autoexporter.scrape-auth.type=basic
+	labelScrapeAuthType     = "autoexporter.scrape-auth.type"
+	labelScrapeAuthUsername = "autoexporter.scrape-auth.username"
+	labelScrapeAuthPassword = "autoexporter.scrape-auth.password"
+	labelScrapeAuthToken    = "autoexporter.scrape-auth.token"
+	labelScrapeAuthCAFile   = "autoexporter.scrape-auth.ca-file"
+	labelScrapeAuthCertFile = "autoexporter.scrape-auth.cert-file"
+	labelScrapeAuthKeyFile  = "autoexporter.scrape-auth.key-file"
+)
+
+// ScrapeAuth describes how an exporter authenticates against its target.
+// Type is one of the ScrapeAuth* constants, an empty type meaning none.
+type ScrapeAuth struct {
+	Type     string
+	Username string
+	Password string
+	Token    string
+	// Paths of the CA, client certificate and key, as seen by the exporter
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// scrapeAuthTranslator returns the cmd flags and the env vars configuring the
+// given auth on an exporter
+type scrapeAuthTranslator func(auth ScrapeAuth) (cmd []string, env []string, err error)
+
+// Exporters not listed here don't support scrape auth
+var scrapeAuthTranslators = map[string]scrapeAuthTranslator{
+	"redis": func(auth ScrapeAuth) ([]string, []string, error) {
+		switch auth.Type {
+		case ScrapeAuthBasic:
+			return []string{"-redis.password=" + auth.Password}, nil, nil
+		}
+
+		return nil, nil, newErrUnsupportedScrapeAuth("redis", auth.Type)
+	},
+	"elasticsearch": func(auth ScrapeAuth) ([]string, []string, error) {
+		switch auth.Type {
+		case ScrapeAuthBasic:
+			uri := url.URL{Scheme: "http", User: url.UserPassword(auth.Username, auth.Password), Host: "localhost:9200"}
+			return []string{"-es.uri=" + uri.String()}, nil, nil
+		case ScrapeAuthTLS:
+			return []string{
+				"-es.uri=https://localhost:9200",
+				"-es.ca=" + auth.CAFile,
+				"-es.client-cert=" + auth.CertFile,
+				"-es.client-private-key=" + auth.KeyFile,
+			}, nil, nil
+		}
+
+		return nil, nil, newErrUnsupportedScrapeAuth("elasticsearch", auth.Type)
+	},
+	"nginx": func(auth ScrapeAuth) ([]string, []string, error) {
+		switch auth.Type {
+		case ScrapeAuthTLS:
+			return []string{"-nginx.ssl-verify=true"}, []string{"SSL_CERT_FILE=" + auth.CAFile}, nil
+		}
+
+		return nil, nil, newErrUnsupportedScrapeAuth("nginx", auth.Type)
+	},
+}
+
+type errUnsupportedScrapeAuth struct {
+	exporterType string
+	authType     string
+}
+
+func newErrUnsupportedScrapeAuth(exporterType, authType string) error {
+	return errors.WithStack(errUnsupportedScrapeAuth{exporterType, authType})
+}
+
+func (e errUnsupportedScrapeAuth) Error() string {
+	return fmt.Sprintf("exporter %q doesn't support %q scrape auth", e.exporterType, e.authType)
+}
+
+// scrapeAuthFromLabels returns the scrape auth described by the labels of the
+// exported task, or def when it has no such labels
+func scrapeAuthFromLabels(labels map[string]string, def ScrapeAuth) ScrapeAuth {
+	authType, ok := labels[labelScrapeAuthType]
+	if !ok {
+		return def
+	}
+
+	return ScrapeAuth{
+		Type:     authType,
+		Username: labels[labelScrapeAuthUsername],
+		Password: labels[labelScrapeAuthPassword],
+		Token:    labels[labelScrapeAuthToken],
+		CAFile:   labels[labelScrapeAuthCAFile],
+		CertFile: labels[labelScrapeAuthCertFile],
+		KeyFile:  labels[labelScrapeAuthKeyFile],
+	}
+}
+
+// ScrapeAuthArgs returns the cmd flags and env vars to add to the exporter
+// for its scrape auth, and an error when its type doesn't support it
+func (e Exporter) ScrapeAuthArgs() ([]string, []string, error) {
+	if e.ScrapeAuth.Type == "" || e.ScrapeAuth.Type == ScrapeAuthNone {
+		return nil, nil, nil
+	}
+
+	translate, ok := scrapeAuthTranslators[e.PredefinedType]
+	if !ok {
+		return nil, nil, newErrUnsupportedScrapeAuth(e.PredefinedType, e.ScrapeAuth.Type)
+	}
+
+	return translate(e.ScrapeAuth)
+}
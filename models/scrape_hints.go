@@ -0,0 +1,54 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// Labels of the exported container overriding the scrape interval and
+	// timeout of its exporters, e.g. autoexporter.scrape-interval=30s
+	labelScrapeInterval = "autoexporter.scrape-interval"
+	labelScrapeTimeout  = "autoexporter.scrape-timeout"
+)
+
+// Durations as accepted by Prometheus, e.g. 30s or 1m30s
+var promDurationRegexp = regexp.MustCompile(`^([0-9]+(y|w|d|h|ms|m|s))+$`)
+
+type errInvalidScrapeHint struct {
+	exportedName string
+	label        string
+	value        string
+}
+
+func (e errInvalidScrapeHint) Error() string {
+	return fmt.Sprintf("invalid label %s=%q on %q, should be a duration like 30s or 1m30s", e.label, e.value, e.exportedName)
+}
+
+func IsErrInvalidScrapeHint(e error) bool {
+	_, ok := e.(errInvalidScrapeHint)
+	return ok
+}
+
+// scrapeHintsFromLabels returns the scrape interval and timeout given by the
+// labels of the exported task, defaulting to the given ones
+func scrapeHintsFromLabels(exported TaskToExport, interval, timeout string) (string, string, error) {
+	hints := map[string]*string{
+		labelScrapeInterval: &interval,
+		labelScrapeTimeout:  &timeout,
+	}
+
+	for label, hint := range hints {
+		value, ok := exported.Labels[label]
+		if !ok {
+			continue
+		}
+		if !promDurationRegexp.MatchString(value) {
+			return "", "", errInvalidScrapeHint{exported.Name, label, value}
+		}
+
+		*hint = value
+	}
+
+	return interval, timeout, nil
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestScrapeHintsFromLabels(t *testing.T) {
+	testcases := map[string]struct {
+		labels           map[string]string
+		expectedInterval string
+		expectedTimeout  string
+		expectedErr      bool
+	}{
+		"no hints": {
+			expectedTimeout: "10s",
+		},
+		"both hints": {
+			labels: map[string]string{
+				labelScrapeInterval: "1m30s",
+				labelScrapeTimeout:  "500ms",
+			},
+			expectedInterval: "1m30s",
+			expectedTimeout:  "500ms",
+		},
+		"interval only": {
+			labels:           map[string]string{labelScrapeInterval: "2h"},
+			expectedInterval: "2h",
+			expectedTimeout:  "10s",
+		},
+		"go duration with a decimal": {
+			labels:      map[string]string{labelScrapeInterval: "1.5s"},
+			expectedErr: true,
+		},
+		"missing unit": {
+			labels:      map[string]string{labelScrapeTimeout: "30"},
+			expectedErr: true,
+		},
+		"empty value": {
+			labels:      map[string]string{labelScrapeTimeout: ""},
+			expectedErr: true,
+		},
+	}
+
+	for tcname, tc := range testcases {
+		tc := tc
+		t.Run(tcname, func(t *testing.T) {
+			exported := exportedTask("/redis", "redis:5", tc.labels)
+			interval, timeout, err := scrapeHintsFromLabels(exported, "", "10s")
+			if tc.expectedErr {
+				if !IsErrInvalidScrapeHint(err) {
+					t.Fatalf("expected an invalid scrape hint error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if interval != tc.expectedInterval {
+				t.Errorf("expected interval %q, got %q", tc.expectedInterval, interval)
+			}
+			if timeout != tc.expectedTimeout {
+				t.Errorf("expected timeout %q, got %q", tc.expectedTimeout, timeout)
+			}
+		})
+	}
+}
+
+func TestExportersCarryScrapeHints(t *testing.T) {
+	finder := NewPredefinedExporterFinder()
+
+	exporter, err := finder.GetExporter("redis", exportedTask("/redis", "redis:5", map[string]string{
+		labelScrapeInterval: "15s",
+		labelScrapeTimeout:  "5s",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if exporter.ScrapeInterval != "15s" || exporter.ScrapeTimeout != "5s" {
+		t.Errorf("expected the scrape hints to be set, got interval %q and timeout %q", exporter.ScrapeInterval, exporter.ScrapeTimeout)
+	}
+
+	if _, err := finder.GetExporter("redis", exportedTask("/redis", "redis:5", map[string]string{
+		labelScrapeInterval: "often",
+	})); !IsErrInvalidScrapeHint(err) {
+		t.Errorf("expected an invalid scrape hint error, got %v", err)
+	}
+}
@@ -2,6 +2,12 @@ package models
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
 )
 
 // The StaticConfig holds a set of targets with their associated labels
@@ -19,13 +25,20 @@ func (c *StaticConfig) AddTarget(target string, labels map[string]string) {
 	c.Targets[target] = labels
 }
 
+// ToJSON returns the targets sorted by address, such that the content only
+// changes when the targets do
 func (c *StaticConfig) ToJSON() ([]byte, error) {
-	config := make([]map[string]interface{}, 0)
+	targets := make([]string, 0, len(c.Targets))
+	for target := range c.Targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
 
-	for target, labels := range c.Targets {
+	config := make([]map[string]interface{}, 0)
+	for _, target := range targets {
 		config = append(config, map[string]interface{}{
 			"targets": []string{target},
-			"labels": labels,
+			"labels":  c.Targets[target],
 		})
 	}
 
@@ -36,3 +49,33 @@ func (c *StaticConfig) ToJSON() ([]byte, error) {
 
 	return content, nil
 }
+
+// WriteFile atomically writes the static config to the given path: the
+// content is written to a temporary file in the same directory, renamed then
+// over the destination such that readers never see a partial file
+func (c *StaticConfig) WriteFile(path string) error {
+	content, err := c.ToJSON()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(f.Name(), path))
+}
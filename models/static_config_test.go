@@ -0,0 +1,24 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestStaticConfigToJSONSortsTargets(t *testing.T) {
+	config := NewStaticConfig()
+	config.AddTarget("redis:9121", map[string]string{"job": "autoexporter-redis"})
+	config.AddTarget("nginx:9113", map[string]string{"job": "autoexporter-nginx"})
+	config.AddTarget("mysql:9104", map[string]string{"job": "autoexporter-mysql"})
+
+	content, err := config.ToJSON()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	expected := `[{"labels":{"job":"autoexporter-mysql"},"targets":["mysql:9104"]},` +
+		`{"labels":{"job":"autoexporter-nginx"},"targets":["nginx:9113"]},` +
+		`{"labels":{"job":"autoexporter-redis"},"targets":["redis:9121"]}]`
+	if string(content) != expected {
+		t.Errorf("expected %s, got %s", expected, content)
+	}
+}
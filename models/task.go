@@ -0,0 +1,26 @@
+package models
+
+// TaskToExport describes a container, or a swarm task, which might need
+// exporters. Matchers and exporter templates are evaluated against it.
+type TaskToExport struct {
+	ID     string
+	Name   string
+	Image  string
+	Labels map[string]string
+	// State of the container (e.g. running) or of the swarm task, empty when
+	// unknown
+	State string
+}
+
+func NewTaskToExport(id, name, image string, labels map[string]string) TaskToExport {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	return TaskToExport{
+		ID:     id,
+		Name:   name,
+		Image:  image,
+		Labels: labels,
+	}
+}